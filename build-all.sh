@@ -28,7 +28,7 @@ build_standard_builder() {
 
 fhs() {
     BUILDER_NAME="root-filesystem"
-    build "$BUILDER_NAME" --output-directory-path "/tmp/output/$BUILDER_NAME"
+    build "$BUILDER_NAME" --output-directory-path "/tmp/output/$BUILDER_NAME" --static-device-nodes
     package "$BUILDER_NAME"
     install "$BUILDER_NAME"
 }
@@ -60,7 +60,7 @@ standard_builder zstd
 standard_builder libressl
 standard_builder busybox --config-file-path ./assets/busybox/.config
 standard_builder linux-kernel --config-file-path ./assets/linux-kernel/.config
-chroot "$ROOTFS_PATH" echo "chroot test"
+go run . test boot --kernel-directory-path "/tmp/output/linux-kernel" --root-fs-directory-path "$ROOTFS_PATH"
 
 # GRUB/bootloader packages
 standard_builder bzip2
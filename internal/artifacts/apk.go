@@ -0,0 +1,321 @@
+package artifacts
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gravitational/trace"
+	"github.com/solidDoWant/distrobuilder/internal/utils"
+)
+
+const apkChecksumPAXRecordName = "APK-TOOLS.checksum.SHA1"
+
+// Produces Alpine (apk-tools v2) compatible packages. A package is the concatenation of three
+// gzip streams: a signature of the control stream, the control stream containing package
+// metadata, and the data stream containing the packaged files.
+type APK struct {
+	OutputPath       string
+	SourcePath       string
+	ShouldResetOwner bool // True to change owner/group to root/root for packaging
+	Metadata         *PackageMetadata
+	SigningKeyPath   string // Path to a PEM encoded RSA private key
+	SigningKeyName   string // File name of the public key that will be used to verify the package, i.e. "builder-5f2a.rsa.pub"
+}
+
+func (a *APK) Package(ctx context.Context) (string, error) {
+	err := a.validate()
+	if err != nil {
+		return "", trace.Wrap(err, "failed to validate APK packager options")
+	}
+
+	if a.OutputPath == "" {
+		a.OutputPath = path.Join(os.TempDir(), fmt.Sprintf("%s-%s.apk", a.Metadata.Name, a.Metadata.Version))
+	}
+
+	_, err = utils.EnsureDirectoryExists(path.Dir(a.OutputPath))
+	if err != nil {
+		return "", trace.Wrap(err, "failed to ensure package output directory exists")
+	}
+
+	privateKey, err := LoadRSAPrivateKey(a.SigningKeyPath)
+	if err != nil {
+		return "", trace.Wrap(err, "failed to load signing key")
+	}
+
+	// The data stream must be built first as its hash is included in the control stream
+	dataFile, err := os.CreateTemp("", "apk-data-*.tar.gz")
+	if err != nil {
+		return "", trace.Wrap(err, "failed to create temporary file for package data")
+	}
+	defer utils.ErrDefer(func() error { return os.Remove(dataFile.Name()) }, &err)
+	defer utils.Close(dataFile, &err)
+
+	dataHash, installedSize, err := a.writeDataSegment(dataFile)
+	if err != nil {
+		return "", trace.Wrap(err, "failed to write package data")
+	}
+
+	controlSegment, err := writeGzipTarSegment([]*archiveFile{
+		{
+			Name:     ".PKGINFO",
+			Contents: []byte(a.getPkgInfo(dataHash, installedSize)),
+		},
+	}, true, a.Metadata.GetBuildDate())
+	if err != nil {
+		return "", trace.Wrap(err, "failed to create package control data")
+	}
+
+	signatureSegment, err := getAPKSignatureSegment(privateKey, a.SigningKeyName, controlSegment, a.Metadata.GetBuildDate())
+	if err != nil {
+		return "", trace.Wrap(err, "failed to sign package control data")
+	}
+
+	outputFile, err := os.OpenFile(a.OutputPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	defer utils.Close(outputFile, &err)
+	if err != nil {
+		return "", trace.Wrap(err, "failed to create APK file %q", a.OutputPath)
+	}
+
+	for _, segment := range [][]byte{signatureSegment, controlSegment} {
+		_, err = outputFile.Write(segment)
+		if err != nil {
+			return "", trace.Wrap(err, "failed to write package segment to %q", a.OutputPath)
+		}
+	}
+
+	_, err = dataFile.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", trace.Wrap(err, "failed to seek to the start of the package data")
+	}
+
+	_, err = io.Copy(outputFile, dataFile)
+	if err != nil {
+		return "", trace.Wrap(err, "failed to copy package data to %q", a.OutputPath)
+	}
+
+	slog.Info("Packaging complete!", "output_file", a.OutputPath)
+	return a.OutputPath, nil
+}
+
+func (a *APK) validate() error {
+	if a.Metadata == nil {
+		return trace.Errorf("package metadata is required")
+	}
+
+	err := a.Metadata.Validate()
+	if err != nil {
+		return trace.Wrap(err, "invalid package metadata")
+	}
+
+	if a.SigningKeyPath == "" {
+		return trace.Errorf("a signing key is required")
+	}
+
+	if a.SigningKeyName == "" {
+		// Follow the abuild convention of naming the public key after the private key
+		a.SigningKeyName = path.Base(a.SigningKeyPath) + ".pub"
+	}
+
+	return nil
+}
+
+// Write the gzip compressed data tar stream, returning the SHA256 hash of the compressed stream,
+// and the total size of all packaged files
+func (a *APK) writeDataSegment(dataFile io.Writer) (string, int64, error) {
+	hasher := sha256.New()
+	gzipWriter := gzip.NewWriter(io.MultiWriter(dataFile, hasher))
+	tarWriter := tar.NewWriter(gzipWriter)
+
+	sourceTree := &SourceTree{
+		Path:             a.SourcePath,
+		ShouldResetOwner: a.ShouldResetOwner,
+	}
+
+	var installedSize int64
+	err := sourceTree.Walk(func(objectPath string, filesystemObjectInfo os.FileInfo, header *tar.Header) error {
+		slog.Debug("adding file to package", "file_path", objectPath)
+
+		checksum, err := getAPKChecksum(objectPath, header)
+		if err != nil {
+			return trace.Wrap(err, "failed to calculate checksum for %q", objectPath)
+		}
+
+		if checksum != "" {
+			header.Format = tar.FormatPAX
+			header.PAXRecords = map[string]string{
+				apkChecksumPAXRecordName: checksum,
+			}
+		}
+
+		err = tarWriter.WriteHeader(header)
+		if err != nil {
+			return trace.Wrap(err, "failed to write tar header for %q", objectPath)
+		}
+
+		err = copyFileToArchive(objectPath, filesystemObjectInfo, tarWriter)
+		if err != nil {
+			return trace.Wrap(err, "failed to copy %q to package", objectPath)
+		}
+
+		if filesystemObjectInfo.Mode().IsRegular() {
+			installedSize += filesystemObjectInfo.Size()
+		}
+
+		return nil
+	})
+	if err != nil {
+		return "", 0, trace.Wrap(err, "failed to add all files to the package")
+	}
+
+	// Unlike the other segments, the data segment includes the end-of-archive trailer
+	err = tarWriter.Close()
+	if err != nil {
+		return "", 0, trace.Wrap(err, "failed to close data tar stream")
+	}
+
+	err = gzipWriter.Close()
+	if err != nil {
+		return "", 0, trace.Wrap(err, "failed to close data gzip stream")
+	}
+
+	return hex.EncodeToString(hasher.Sum(nil)), installedSize, nil
+}
+
+// apk-tools records the SHA1 hash of file contents, or link targets for symlinks
+func getAPKChecksum(objectPath string, header *tar.Header) (string, error) {
+	switch header.Typeflag {
+	case tar.TypeSymlink:
+		checksum := sha1.Sum([]byte(header.Linkname))
+		return hex.EncodeToString(checksum[:]), nil
+	case tar.TypeReg:
+		fileHandle, err := os.Open(objectPath)
+		defer utils.Close(fileHandle, &err)
+		if err != nil {
+			return "", trace.Wrap(err, "failed to open %q", objectPath)
+		}
+
+		hasher := sha1.New()
+		_, err = io.Copy(hasher, fileHandle)
+		if err != nil {
+			return "", trace.Wrap(err, "failed to read %q", objectPath)
+		}
+
+		return hex.EncodeToString(hasher.Sum(nil)), nil
+	}
+
+	return "", nil
+}
+
+func (a *APK) getPkgInfo(dataHash string, installedSize int64) string {
+	lines := []string{
+		"# Generated by distrobuilder",
+		fmt.Sprintf("pkgname = %s", a.Metadata.Name),
+		fmt.Sprintf("pkgver = %s", a.Metadata.Version),
+		fmt.Sprintf("pkgdesc = %s", a.Metadata.Description),
+		fmt.Sprintf("url = %s", a.Metadata.URL),
+		fmt.Sprintf("builddate = %d", a.Metadata.GetBuildDate().Unix()),
+		fmt.Sprintf("packager = %s", a.Metadata.Maintainer),
+		fmt.Sprintf("size = %d", installedSize),
+		fmt.Sprintf("arch = %s", a.Metadata.Architecture),
+		fmt.Sprintf("origin = %s", a.Metadata.Name),
+		fmt.Sprintf("license = %s", a.Metadata.License),
+	}
+
+	for _, dependency := range a.Metadata.Depends {
+		lines = append(lines, fmt.Sprintf("depend = %s", dependency))
+	}
+
+	lines = append(lines, fmt.Sprintf("datahash = %s", dataHash))
+
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func (a *APK) SetOutputFilePath(outputFilePath string) {
+	a.OutputPath = outputFilePath
+}
+
+// Produce the gzip stream containing a signature of the provided (control or index) stream
+func getAPKSignatureSegment(privateKey *rsa.PrivateKey, signingKeyName string, signedSegment []byte, modTime time.Time) ([]byte, error) {
+	signature, err := signDigest(privateKey, crypto.SHA1, signedSegment)
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to sign segment")
+	}
+
+	signatureSegment, err := writeGzipTarSegment([]*archiveFile{
+		{
+			Name:     fmt.Sprintf(".SIGN.RSA.%s", signingKeyName),
+			Contents: signature,
+		},
+	}, true, modTime)
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to create signature segment")
+	}
+
+	return signatureSegment, nil
+}
+
+// An in-memory file to be written to an archive
+type archiveFile struct {
+	Name     string
+	Contents []byte
+}
+
+// Write the files to a gzip compressed tar stream. If shouldCut is true then the end-of-archive
+// trailer is omitted so that the stream can be concatenated with other streams, as expected by
+// apk-tools.
+func writeGzipTarSegment(files []*archiveFile, shouldCut bool, modTime time.Time) ([]byte, error) {
+	buffer := &bytes.Buffer{}
+	gzipWriter := gzip.NewWriter(buffer)
+	tarWriter := tar.NewWriter(gzipWriter)
+
+	for _, file := range files {
+		err := tarWriter.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     file.Name,
+			Size:     int64(len(file.Contents)),
+			Mode:     0644,
+			Uname:    "root",
+			Gname:    "root",
+			ModTime:  modTime,
+		})
+		if err != nil {
+			return nil, trace.Wrap(err, "failed to write tar header for %q", file.Name)
+		}
+
+		_, err = tarWriter.Write(file.Contents)
+		if err != nil {
+			return nil, trace.Wrap(err, "failed to write contents of %q", file.Name)
+		}
+	}
+
+	var err error
+	if shouldCut {
+		err = tarWriter.Flush()
+	} else {
+		err = tarWriter.Close()
+	}
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to finish tar stream")
+	}
+
+	err = gzipWriter.Close()
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to close gzip stream")
+	}
+
+	return buffer.Bytes(), nil
+}
@@ -0,0 +1,286 @@
+package artifacts
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gravitational/trace"
+)
+
+const APKIndexFileName = "APKINDEX.tar.gz"
+
+// Mapping of .PKGINFO keys to APKINDEX field names
+var apkIndexFieldNames = []struct {
+	PkgInfoKey string
+	FieldName  string
+}{
+	{"pkgname", "P"},
+	{"pkgver", "V"},
+	{"arch", "A"},
+	{"size", "I"},
+	{"pkgdesc", "T"},
+	{"url", "U"},
+	{"license", "L"},
+	{"origin", "o"},
+	{"packager", "m"},
+	{"builddate", "t"},
+	{"commit", "c"},
+}
+
+// Generates a signed APKINDEX.tar.gz for a directory of APK packages, so that the directory
+// can be used as an apk-tools repository
+type APKIndex struct {
+	PackageDirectoryPath string
+	OutputPath           string // Defaults to APKINDEX.tar.gz in the package directory
+	Description          string // Repository description, shown by `apk update`
+	SigningKeyPath       string // Path to a PEM encoded RSA private key
+	SigningKeyName       string // File name of the public key that will be used to verify the index, i.e. "builder-5f2a.rsa.pub"
+}
+
+func (ai *APKIndex) Generate(ctx context.Context) (string, error) {
+	err := ai.validate()
+	if err != nil {
+		return "", trace.Wrap(err, "failed to validate APK index options")
+	}
+
+	privateKey, err := LoadRSAPrivateKey(ai.SigningKeyPath)
+	if err != nil {
+		return "", trace.Wrap(err, "failed to load signing key")
+	}
+
+	packageFilePaths, err := filepath.Glob(path.Join(ai.PackageDirectoryPath, "*.apk"))
+	if err != nil {
+		return "", trace.Wrap(err, "failed to find packages in %q", ai.PackageDirectoryPath)
+	}
+	slices.Sort(packageFilePaths)
+
+	if len(packageFilePaths) == 0 {
+		slog.Warn("no packages found, generating an empty index", "package_directory", ai.PackageDirectoryPath)
+	}
+
+	indexEntries := make([]string, 0, len(packageFilePaths))
+	for _, packageFilePath := range packageFilePaths {
+		slog.Debug("adding package to index", "package_file", packageFilePath)
+		indexEntry, err := getAPKIndexEntry(packageFilePath)
+		if err != nil {
+			return "", trace.Wrap(err, "failed to build index entry for %q", packageFilePath)
+		}
+
+		indexEntries = append(indexEntries, indexEntry)
+	}
+
+	modTime := time.Now()
+	indexSegment, err := writeGzipTarSegment([]*archiveFile{
+		{
+			Name:     "DESCRIPTION",
+			Contents: []byte(ai.Description),
+		},
+		{
+			Name:     "APKINDEX",
+			Contents: []byte(strings.Join(indexEntries, "")),
+		},
+	}, true, modTime)
+	if err != nil {
+		return "", trace.Wrap(err, "failed to create index archive")
+	}
+
+	signatureSegment, err := getAPKSignatureSegment(privateKey, ai.SigningKeyName, indexSegment, modTime)
+	if err != nil {
+		return "", trace.Wrap(err, "failed to sign index")
+	}
+
+	err = os.WriteFile(ai.OutputPath, append(signatureSegment, indexSegment...), 0644)
+	if err != nil {
+		return "", trace.Wrap(err, "failed to write index to %q", ai.OutputPath)
+	}
+
+	slog.Info("Index generation complete!", "output_file", ai.OutputPath, "package_count", len(indexEntries))
+	return ai.OutputPath, nil
+}
+
+func (ai *APKIndex) validate() error {
+	if ai.PackageDirectoryPath == "" {
+		return trace.Errorf("a package directory is required")
+	}
+
+	if ai.SigningKeyPath == "" {
+		return trace.Errorf("a signing key is required")
+	}
+
+	if ai.SigningKeyName == "" {
+		ai.SigningKeyName = path.Base(ai.SigningKeyPath) + ".pub"
+	}
+
+	if ai.OutputPath == "" {
+		ai.OutputPath = path.Join(ai.PackageDirectoryPath, APKIndexFileName)
+	}
+
+	return nil
+}
+
+// Build the APKINDEX record for a single package, including the trailing blank line
+func getAPKIndexEntry(packageFilePath string) (string, error) {
+	packageContents, err := os.ReadFile(packageFilePath)
+	if err != nil {
+		return "", trace.Wrap(err, "failed to read package")
+	}
+
+	segments, err := splitGzipStreams(packageContents)
+	if err != nil {
+		return "", trace.Wrap(err, "failed to split package into gzip streams")
+	}
+
+	controlSegment, pkgInfo, err := findAPKControlSegment(segments)
+	if err != nil {
+		return "", trace.Wrap(err, "failed to find package control data")
+	}
+
+	// The control segment hash identifies the package, as it includes the hash of the data segment
+	controlHash := sha1.Sum(controlSegment)
+
+	builder := &strings.Builder{}
+	fmt.Fprintf(builder, "C:Q1%s\n", base64.StdEncoding.EncodeToString(controlHash[:]))
+	for _, field := range apkIndexFieldNames {
+		values := pkgInfo[field.PkgInfoKey]
+		if len(values) == 0 || values[0] == "" {
+			continue
+		}
+
+		fmt.Fprintf(builder, "%s:%s\n", field.FieldName, values[0])
+
+		// The package file size immediately follows the architecture, matching apk-tools output
+		if field.FieldName == "A" {
+			fmt.Fprintf(builder, "S:%d\n", len(packageContents))
+		}
+	}
+
+	if dependencies := pkgInfo["depend"]; len(dependencies) > 0 {
+		fmt.Fprintf(builder, "D:%s\n", strings.Join(dependencies, " "))
+	}
+
+	if provides := pkgInfo["provides"]; len(provides) > 0 {
+		fmt.Fprintf(builder, "p:%s\n", strings.Join(provides, " "))
+	}
+
+	builder.WriteString("\n")
+	return builder.String(), nil
+}
+
+// Split concatenated gzip streams into the raw (compressed) bytes of each stream
+func splitGzipStreams(data []byte) ([][]byte, error) {
+	var segments [][]byte
+	dataReader := bytes.NewReader(data)
+	for dataReader.Len() > 0 {
+		startOffset := len(data) - dataReader.Len()
+
+		// The bufio reader is required for gzip.Reader to not read past the end of the stream
+		bufferedReader := bufio.NewReader(dataReader)
+		gzipReader, err := gzip.NewReader(bufferedReader)
+		if err != nil {
+			return nil, trace.Wrap(err, "failed to read gzip stream at offset %d", startOffset)
+		}
+		gzipReader.Multistream(false)
+
+		_, err = io.Copy(io.Discard, gzipReader)
+		if err != nil {
+			return nil, trace.Wrap(err, "failed to decompress gzip stream at offset %d", startOffset)
+		}
+
+		// Return any bytes read by the buffer, but not consumed by the gzip reader
+		endOffset := len(data) - dataReader.Len() - bufferedReader.Buffered()
+		_, err = dataReader.Seek(int64(endOffset), io.SeekStart)
+		if err != nil {
+			return nil, trace.Wrap(err, "failed to seek to the end of gzip stream at offset %d", startOffset)
+		}
+
+		segments = append(segments, data[startOffset:endOffset])
+	}
+
+	return segments, nil
+}
+
+// Find the gzip stream containing the .PKGINFO file, returning the raw stream and the parsed file
+func findAPKControlSegment(segments [][]byte) ([]byte, map[string][]string, error) {
+	for _, segment := range segments {
+		pkgInfoContents, err := readFileFromGzipTarSegment(segment, ".PKGINFO")
+		if err != nil {
+			return nil, nil, trace.Wrap(err, "failed to read package segment")
+		}
+
+		if pkgInfoContents != nil {
+			return segment, parsePkgInfo(pkgInfoContents), nil
+		}
+	}
+
+	return nil, nil, trace.Errorf("package does not contain a .PKGINFO file")
+}
+
+// Read a single file from a (possibly cut) gzip compressed tar stream. Returns nil if the file
+// does not exist.
+func readFileFromGzipTarSegment(segment []byte, fileName string) ([]byte, error) {
+	gzipReader, err := gzip.NewReader(bytes.NewReader(segment))
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to create gzip reader")
+	}
+
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, nil
+		}
+
+		if err != nil {
+			return nil, trace.Wrap(err, "failed to read next tar header")
+		}
+
+		if header.Name != fileName {
+			// Data segments may be large, and are never the segment being searched for
+			if !strings.HasPrefix(header.Name, ".") {
+				return nil, nil
+			}
+
+			continue
+		}
+
+		fileContents, err := io.ReadAll(tarReader)
+		if err != nil {
+			return nil, trace.Wrap(err, "failed to read %q", fileName)
+		}
+
+		return fileContents, nil
+	}
+}
+
+// Parse the "key = value" lines of a .PKGINFO file. Keys may be repeated.
+func parsePkgInfo(contents []byte) map[string][]string {
+	values := make(map[string][]string)
+	for _, line := range strings.Split(string(contents), "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value, found := strings.Cut(line, " = ")
+		if !found {
+			continue
+		}
+
+		values[key] = append(values[key], value)
+	}
+
+	return values
+}
@@ -0,0 +1,115 @@
+package artifacts
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gravitational/trace"
+)
+
+// Common (System V/GNU) ar archive format, as used by Debian packages
+const (
+	arGlobalHeader     = "!<arch>\n"
+	arMemberHeaderSize = 60
+	arMemberTrailer    = "`\n"
+)
+
+type arWriter struct {
+	writer          io.Writer
+	isHeaderWritten bool
+}
+
+func newArWriter(writer io.Writer) *arWriter {
+	return &arWriter{
+		writer: writer,
+	}
+}
+
+// Write a single member to the archive. Exactly size bytes are read from contents.
+func (aw *arWriter) WriteMember(name string, size int64, modTime time.Time, contents io.Reader) error {
+	if len(name) > 16 {
+		return trace.Errorf("ar member name %q is longer than 16 characters", name)
+	}
+
+	if !aw.isHeaderWritten {
+		_, err := io.WriteString(aw.writer, arGlobalHeader)
+		if err != nil {
+			return trace.Wrap(err, "failed to write ar global header")
+		}
+		aw.isHeaderWritten = true
+	}
+
+	header := fmt.Sprintf("%-16s%-12d%-6d%-6d%-8o%-10d%s", name, modTime.Unix(), 0, 0, 0100644, size, arMemberTrailer)
+	_, err := io.WriteString(aw.writer, header)
+	if err != nil {
+		return trace.Wrap(err, "failed to write ar member header for %q", name)
+	}
+
+	copiedByteCount, err := io.CopyN(aw.writer, contents, size)
+	if err != nil {
+		return trace.Wrap(err, "failed to write ar member contents for %q (wrote %d of %d bytes)", name, copiedByteCount, size)
+	}
+
+	// Members are aligned to an even byte boundary
+	if size%2 != 0 {
+		_, err = io.WriteString(aw.writer, "\n")
+		if err != nil {
+			return trace.Wrap(err, "failed to write ar member padding for %q", name)
+		}
+	}
+
+	return nil
+}
+
+// Call the handler for every member in the archive. The handler must not retain the reader.
+func readArMembers(reader io.Reader, memberHandler func(name string, size int64, contents io.Reader) error) error {
+	bufferedReader := bufio.NewReader(reader)
+
+	globalHeader := make([]byte, len(arGlobalHeader))
+	_, err := io.ReadFull(bufferedReader, globalHeader)
+	if err != nil {
+		return trace.Wrap(err, "failed to read ar global header")
+	}
+
+	if string(globalHeader) != arGlobalHeader {
+		return trace.Errorf("file is not an ar archive")
+	}
+
+	memberHeader := make([]byte, arMemberHeaderSize)
+	for {
+		_, err := io.ReadFull(bufferedReader, memberHeader)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return trace.Wrap(err, "failed to read ar member header")
+		}
+
+		if string(memberHeader[58:60]) != arMemberTrailer {
+			return trace.Errorf("invalid ar member header %q", string(memberHeader))
+		}
+
+		// GNU ar terminates names with a slash
+		name := strings.TrimSuffix(strings.TrimSpace(string(memberHeader[0:16])), "/")
+		size, err := strconv.ParseInt(strings.TrimSpace(string(memberHeader[48:58])), 10, 64)
+		if err != nil {
+			return trace.Wrap(err, "failed to parse size of ar member %q", name)
+		}
+
+		contentsReader := &io.LimitedReader{R: bufferedReader, N: size}
+		err = memberHandler(name, size, contentsReader)
+		if err != nil {
+			return trace.Wrap(err, "failed to handle ar member %q", name)
+		}
+
+		// Skip any contents not read by the handler, along with the alignment padding
+		_, err = io.Copy(io.Discard, io.LimitReader(bufferedReader, contentsReader.N+size%2))
+		if err != nil {
+			return trace.Wrap(err, "failed to skip to the end of ar member %q", name)
+		}
+	}
+}
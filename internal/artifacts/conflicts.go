@@ -0,0 +1,102 @@
+package artifacts
+
+import (
+	"fmt"
+	"log/slog"
+	"path"
+
+	"github.com/gravitational/trace"
+)
+
+// A filesystem object that would be overwritten by installing a package
+type FileConflict struct {
+	Path             string
+	PackageName      string // Package being installed
+	OwnerPackageName string // Previously installed package that owns the path
+	Entry            *ManifestEntry
+	OwnerEntry       *ManifestEntry
+}
+
+func (fc *FileConflict) String() string {
+	return fmt.Sprintf("%s: %s (%s) would overwrite %s (%s)", fc.Path, fc.PackageName, describeManifestEntry(fc.Entry), fc.OwnerPackageName, describeManifestEntry(fc.OwnerEntry))
+}
+
+func describeManifestEntry(entry *ManifestEntry) string {
+	switch entry.Type {
+	case ManifestEntryTypeFile:
+		return fmt.Sprintf("file, sha256 %s", entry.SHA256)
+	case ManifestEntryTypeSymlink:
+		return fmt.Sprintf("symlink to %q", entry.LinkTarget)
+	case ManifestEntryTypeCharacterDevice:
+		return fmt.Sprintf("character device %d:%d", entry.DevMajor, entry.DevMinor)
+	case ManifestEntryTypeBlockDevice:
+		return fmt.Sprintf("block device %d:%d", entry.DevMajor, entry.DevMinor)
+	}
+
+	return entry.Type
+}
+
+type FileConflicts []*FileConflict
+
+// Splits the conflicts into those that match one of the provided glob patterns, and those that do not
+func (fc FileConflicts) Partition(allowedOverwritePatterns []string) (FileConflicts, FileConflicts, error) {
+	var allowed, blocking FileConflicts
+	for _, conflict := range fc {
+		isAllowed, err := isPathAllowedToOverwrite(conflict.Path, allowedOverwritePatterns)
+		if err != nil {
+			return nil, nil, trace.Wrap(err, "failed to check if %q is allowed to be overwritten", conflict.Path)
+		}
+
+		if isAllowed {
+			allowed = append(allowed, conflict)
+			continue
+		}
+
+		blocking = append(blocking, conflict)
+	}
+
+	return allowed, blocking, nil
+}
+
+func isPathAllowedToOverwrite(conflictPath string, allowedOverwritePatterns []string) (bool, error) {
+	for _, pattern := range allowedOverwritePatterns {
+		isMatch, err := path.Match(normalizeManifestPath(pattern), conflictPath)
+		if err != nil {
+			return false, trace.Wrap(err, "invalid overwrite pattern %q", pattern)
+		}
+
+		if isMatch {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// Print the conflict report, returning an error if there are conflicts that have not been
+// explicitly allowed
+func (fc FileConflicts) Check(allowedOverwritePatterns []string) error {
+	if len(fc) == 0 {
+		return nil
+	}
+
+	allowed, blocking, err := fc.Partition(allowedOverwritePatterns)
+	if err != nil {
+		return trace.Wrap(err, "failed to sort conflicts by allowed overwrite patterns")
+	}
+
+	for _, conflict := range allowed {
+		slog.Warn("Overwriting file owned by another package", "conflict", conflict.String())
+	}
+
+	if len(blocking) == 0 {
+		return nil
+	}
+
+	slog.Error(fmt.Sprintf("Found %d file conflicts with installed packages", len(blocking)))
+	for _, conflict := range blocking {
+		slog.Error("File conflict", "conflict", conflict.String())
+	}
+
+	return trace.Errorf("package would overwrite %d files owned by other packages, set allowed overwrites to install anyway", len(blocking))
+}
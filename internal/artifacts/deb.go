@@ -0,0 +1,447 @@
+package artifacts
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/gravitational/trace"
+	"github.com/solidDoWant/distrobuilder/internal/runners"
+	"github.com/solidDoWant/distrobuilder/internal/utils"
+)
+
+const (
+	debianBinaryMemberName  = "debian-binary"
+	debianBinaryContents    = "2.0\n"
+	debControlMemberPrefix  = "control.tar"
+	debDataMemberNamePrefix = "data.tar"
+)
+
+// Commands used to decompress package members, keyed by member name extension
+var debMemberDecompressionCommands = map[string]string{
+	".xz":  "xz",
+	".zst": "zstd",
+}
+
+// Mapping of GNU machine names to Debian architecture names
+var debianArchitectures = map[string]string{
+	"x86_64":  "amd64",
+	"aarch64": "arm64",
+	"i386":    "i386",
+	"i686":    "i386",
+	"armv7l":  "armhf",
+	"riscv64": "riscv64",
+}
+
+// Produces and installs Debian binary packages. A package is an ar archive containing the
+// package format version, a control tarball with package metadata, and a data tarball with
+// the packaged files.
+type Deb struct {
+	OutputPath       string
+	SourcePath       string
+	ShouldResetOwner bool // True to change owner/group to root/root for packaging, and to set owner/group to the current user/primary group for installing
+	Metadata         *PackageMetadata
+}
+
+func (d *Deb) Package(ctx context.Context) (string, error) {
+	if d.Metadata == nil {
+		return "", trace.Errorf("package metadata is required")
+	}
+
+	err := d.Metadata.Validate()
+	if err != nil {
+		return "", trace.Wrap(err, "invalid package metadata")
+	}
+
+	if d.OutputPath == "" {
+		d.OutputPath = path.Join(os.TempDir(), fmt.Sprintf("%s_%s_%s.deb", d.Metadata.Name, d.Metadata.Version, GetDebianArchitecture(d.Metadata.Architecture)))
+	}
+
+	_, err = utils.EnsureDirectoryExists(path.Dir(d.OutputPath))
+	if err != nil {
+		return "", trace.Wrap(err, "failed to ensure package output directory exists")
+	}
+
+	dataFile, err := os.CreateTemp("", "deb-data-*.tar.gz")
+	if err != nil {
+		return "", trace.Wrap(err, "failed to create temporary file for package data")
+	}
+	defer utils.ErrDefer(func() error { return os.Remove(dataFile.Name()) }, &err)
+	defer utils.Close(dataFile, &err)
+
+	md5sums, installedSize, err := d.writeDataTarball(dataFile)
+	if err != nil {
+		return "", trace.Wrap(err, "failed to write package data")
+	}
+
+	buildDate := d.Metadata.GetBuildDate()
+	controlTarball, err := writeGzipTarSegment([]*archiveFile{
+		{
+			Name:     "./control",
+			Contents: []byte(d.getControlFile(installedSize)),
+		},
+		{
+			Name:     "./md5sums",
+			Contents: []byte(md5sums),
+		},
+	}, false, buildDate)
+	if err != nil {
+		return "", trace.Wrap(err, "failed to create package control tarball")
+	}
+
+	dataFileInfo, err := dataFile.Stat()
+	if err != nil {
+		return "", trace.Wrap(err, "failed to get size of package data")
+	}
+
+	_, err = dataFile.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", trace.Wrap(err, "failed to seek to the start of the package data")
+	}
+
+	outputFile, err := os.OpenFile(d.OutputPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	defer utils.Close(outputFile, &err)
+	if err != nil {
+		return "", trace.Wrap(err, "failed to create deb file %q", d.OutputPath)
+	}
+
+	archiveWriter := newArWriter(outputFile)
+	err = archiveWriter.WriteMember(debianBinaryMemberName, int64(len(debianBinaryContents)), buildDate, strings.NewReader(debianBinaryContents))
+	if err != nil {
+		return "", trace.Wrap(err, "failed to write package format version")
+	}
+
+	err = archiveWriter.WriteMember(debControlMemberPrefix+".gz", int64(len(controlTarball)), buildDate, bytes.NewReader(controlTarball))
+	if err != nil {
+		return "", trace.Wrap(err, "failed to write package control tarball")
+	}
+
+	err = archiveWriter.WriteMember(debDataMemberNamePrefix+".gz", dataFileInfo.Size(), buildDate, dataFile)
+	if err != nil {
+		return "", trace.Wrap(err, "failed to write package data tarball")
+	}
+
+	slog.Info("Packaging complete!", "output_file", d.OutputPath)
+	return d.OutputPath, nil
+}
+
+// Write the gzip compressed data tarball, returning the contents of the md5sums control file and
+// the installed size in KiB
+func (d *Deb) writeDataTarball(dataFile io.Writer) (string, int64, error) {
+	gzipWriter := gzip.NewWriter(dataFile)
+	tarWriter := tar.NewWriter(gzipWriter)
+
+	sourceTree := &SourceTree{
+		Path:             d.SourcePath,
+		ShouldResetOwner: d.ShouldResetOwner,
+	}
+
+	md5sums := &strings.Builder{}
+	var installedSize int64
+	err := sourceTree.Walk(func(objectPath string, filesystemObjectInfo os.FileInfo, header *tar.Header) error {
+		slog.Debug("adding file to package", "file_path", objectPath)
+
+		relativePath := header.Name
+		// dpkg-deb produces paths relative to the install root with a "./" prefix
+		header.Name = "./" + relativePath
+
+		err := tarWriter.WriteHeader(header)
+		if err != nil {
+			return trace.Wrap(err, "failed to write tar header for %q", objectPath)
+		}
+
+		if !filesystemObjectInfo.Mode().IsRegular() {
+			// dpkg counts one block per non-regular file
+			installedSize += 1
+			return nil
+		}
+
+		hasher := md5.New()
+		err = copyFileToArchive(objectPath, filesystemObjectInfo, io.MultiWriter(tarWriter, hasher))
+		if err != nil {
+			return trace.Wrap(err, "failed to copy %q to package", objectPath)
+		}
+
+		fmt.Fprintf(md5sums, "%s  %s\n", hex.EncodeToString(hasher.Sum(nil)), relativePath)
+		installedSize += (filesystemObjectInfo.Size() + 1023) / 1024
+		return nil
+	})
+	if err != nil {
+		return "", 0, trace.Wrap(err, "failed to add all files to the package")
+	}
+
+	err = tarWriter.Close()
+	if err != nil {
+		return "", 0, trace.Wrap(err, "failed to close data tar stream")
+	}
+
+	err = gzipWriter.Close()
+	if err != nil {
+		return "", 0, trace.Wrap(err, "failed to close data gzip stream")
+	}
+
+	return md5sums.String(), installedSize, nil
+}
+
+func (d *Deb) getControlFile(installedSize int64) string {
+	description := d.Metadata.Description
+	if description == "" {
+		description = d.Metadata.Name
+	}
+
+	lines := []string{
+		fmt.Sprintf("Package: %s", d.Metadata.Name),
+		fmt.Sprintf("Version: %s", d.Metadata.Version),
+		fmt.Sprintf("Architecture: %s", GetDebianArchitecture(d.Metadata.Architecture)),
+	}
+
+	if d.Metadata.Maintainer != "" {
+		lines = append(lines, fmt.Sprintf("Maintainer: %s", d.Metadata.Maintainer))
+	}
+
+	lines = append(lines, fmt.Sprintf("Installed-Size: %d", installedSize))
+
+	if len(d.Metadata.Depends) > 0 {
+		lines = append(lines, fmt.Sprintf("Depends: %s", strings.Join(d.Metadata.Depends, ", ")))
+	}
+
+	if d.Metadata.URL != "" {
+		lines = append(lines, fmt.Sprintf("Homepage: %s", d.Metadata.URL))
+	}
+
+	lines = append(lines, fmt.Sprintf("Description: %s", description))
+
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func (d *Deb) SetOutputFilePath(outputFilePath string) {
+	d.OutputPath = outputFilePath
+}
+
+// Install the data tarball from the package. Installed files are tracked and checked for
+// conflicts in the same way as tarballs, under the package name from the control file.
+func (d *Deb) Install(ctx context.Context, options *InstallOptions) error {
+	if options.SourcePath == "" {
+		return trace.Errorf("no source path was provided")
+	}
+
+	dataFile, err := os.CreateTemp("", "deb-data-*.tar")
+	if err != nil {
+		return trace.Wrap(err, "failed to create temporary file for package data")
+	}
+	defer utils.ErrDefer(func() error { return os.Remove(dataFile.Name()) }, &err)
+	defer utils.Close(dataFile, &err)
+
+	packageName, err := d.extractDataTarball(options.SourcePath, dataFile)
+	if err != nil {
+		return trace.Wrap(err, "failed to read deb %q", options.SourcePath)
+	}
+
+	tarballOptions := *options
+	tarballOptions.SourcePath = dataFile.Name()
+	if tarballOptions.PackageName == "" {
+		tarballOptions.PackageName = packageName
+	}
+
+	tarball := &Tarball{
+		ShouldResetOwner: d.ShouldResetOwner,
+	}
+	err = tarball.Install(ctx, &tarballOptions)
+	if err != nil {
+		return trace.Wrap(err, "failed to install package data from %q", options.SourcePath)
+	}
+
+	return nil
+}
+
+// Copy the data tarball out of the package, returning the package name from the control file
+func (d *Deb) extractDataTarball(debPath string, dataFile io.Writer) (string, error) {
+	fileHandle, err := os.Open(debPath)
+	defer utils.Close(fileHandle, &err)
+	if err != nil {
+		return "", trace.Wrap(err, "failed to open %q for reading", debPath)
+	}
+
+	var packageName string
+	var isDataFound bool
+	err = readArMembers(fileHandle, func(name string, size int64, contents io.Reader) error {
+		memberPrefix := strings.TrimSuffix(name, path.Ext(name))
+		if memberPrefix != debControlMemberPrefix && memberPrefix != debDataMemberNamePrefix {
+			return nil
+		}
+
+		// gzip streams are detected and decompressed when the tarballs are read
+		extension := path.Ext(name)
+		if extension != ".tar" && extension != ".gz" {
+			if _, ok := debMemberDecompressionCommands[extension]; !ok {
+				return trace.Errorf("unsupported compression %q of member %q", extension, name)
+			}
+
+			decompressedContents := &bytes.Buffer{}
+			err := decompressDebMember(contents, extension, decompressedContents)
+			if err != nil {
+				return trace.Wrap(err, "failed to decompress member %q", name)
+			}
+
+			contents = decompressedContents
+		}
+
+		if memberPrefix == debControlMemberPrefix {
+			controlFile, err := readDebControlFile(contents)
+			if err != nil {
+				return trace.Wrap(err, "failed to read control file")
+			}
+
+			packageName = getDebControlField(controlFile, "Package")
+			return nil
+		}
+
+		_, err := io.Copy(dataFile, contents)
+		if err != nil {
+			return trace.Wrap(err, "failed to copy package data")
+		}
+
+		isDataFound = true
+		return nil
+	})
+	if err != nil {
+		return "", trace.Wrap(err, "failed to read ar archive members")
+	}
+
+	if !isDataFound {
+		return "", trace.Errorf("package does not contain a data tarball")
+	}
+
+	if packageName == "" {
+		packageName = strings.TrimSuffix(path.Base(debPath), ".deb")
+	}
+
+	return packageName, nil
+}
+
+// Decompress a package member with an external command. The member is decompressed to a file, as
+// command output is streamed to the console.
+func decompressDebMember(contents io.Reader, extension string, output io.Writer) (err error) {
+	command := debMemberDecompressionCommands[extension]
+	err = runners.CheckRequiredCommandsExist([]string{command})
+	if err != nil {
+		return trace.Wrap(err, "%s is required to decompress %q members", command, extension)
+	}
+
+	directoryPath, err := os.MkdirTemp("", "deb-member-*")
+	if err != nil {
+		return trace.Wrap(err, "failed to create temporary directory")
+	}
+	defer utils.ErrDefer(func() error { return os.RemoveAll(directoryPath) }, &err)
+
+	decompressedFilePath := path.Join(directoryPath, "member")
+	compressedFilePath := decompressedFilePath + extension
+	err = writeDebMemberFile(compressedFilePath, contents)
+	if err != nil {
+		return trace.Wrap(err, "failed to write compressed member")
+	}
+
+	_, err = runners.Run(&runners.CommandRunner{
+		Command:   command,
+		Arguments: []string{"-d", "-q", compressedFilePath},
+	})
+	if err != nil {
+		return trace.Wrap(err, "failed to decompress %q with %s", compressedFilePath, command)
+	}
+
+	decompressedFile, err := os.Open(decompressedFilePath)
+	if err != nil {
+		return trace.Wrap(err, "failed to open decompressed member %q", decompressedFilePath)
+	}
+	defer utils.Close(decompressedFile, &err)
+
+	_, err = io.Copy(output, decompressedFile)
+	if err != nil {
+		return trace.Wrap(err, "failed to read decompressed member %q", decompressedFilePath)
+	}
+
+	return nil
+}
+
+func writeDebMemberFile(filePath string, contents io.Reader) (err error) {
+	fileHandle, err := os.Create(filePath)
+	if err != nil {
+		return trace.Wrap(err, "failed to create %q", filePath)
+	}
+	defer utils.Close(fileHandle, &err)
+
+	_, err = io.Copy(fileHandle, contents)
+	if err != nil {
+		return trace.Wrap(err, "failed to write %q", filePath)
+	}
+
+	return nil
+}
+
+func readDebControlFile(controlTarball io.Reader) (string, error) {
+	bufferedReader := bufio.NewReader(controlTarball)
+	var archiveReader io.Reader = bufferedReader
+	if isGzipStream(bufferedReader) {
+		gzipReader, err := gzip.NewReader(bufferedReader)
+		if err != nil {
+			return "", trace.Wrap(err, "failed to create gzip reader")
+		}
+
+		archiveReader = gzipReader
+	}
+
+	tarReader := tar.NewReader(archiveReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return "", trace.Errorf("control tarball does not contain a control file")
+		}
+
+		if err != nil {
+			return "", trace.Wrap(err, "failed to read next tar header")
+		}
+
+		if path.Clean(header.Name) != "control" {
+			continue
+		}
+
+		fileContents, err := io.ReadAll(tarReader)
+		if err != nil {
+			return "", trace.Wrap(err, "failed to read control file")
+		}
+
+		return string(fileContents), nil
+	}
+}
+
+// Get the value of a single-line field from a control file
+func getDebControlField(controlFile, fieldName string) string {
+	for _, line := range strings.Split(controlFile, "\n") {
+		key, value, found := strings.Cut(line, ":")
+		if found && key == fieldName {
+			return strings.TrimSpace(value)
+		}
+	}
+
+	return ""
+}
+
+// Convert a GNU machine name (as used by triplets) to the equivalent Debian architecture name.
+// Unknown values are assumed to already be Debian architecture names.
+func GetDebianArchitecture(machine string) string {
+	if debianArchitecture, ok := debianArchitectures[machine]; ok {
+		return debianArchitecture
+	}
+
+	return machine
+}
@@ -0,0 +1,351 @@
+package artifacts
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"slices"
+
+	"github.com/google/uuid"
+	"github.com/gravitational/trace"
+	"github.com/solidDoWant/distrobuilder/internal/runners"
+	"github.com/solidDoWant/distrobuilder/internal/utils"
+)
+
+const (
+	FilesystemImageTypeSquashfs = "squashfs"
+	FilesystemImageTypeErofs    = "erofs"
+
+	FilesystemImageCompressionZstd = "zstd"
+	FilesystemImageCompressionLz4  = "lz4"
+	FilesystemImageCompressionXz   = "xz"
+	FilesystemImageCompressionNone = "none"
+)
+
+var (
+	FilesystemImageTypes        = []string{FilesystemImageTypeSquashfs, FilesystemImageTypeErofs}
+	FilesystemImageCompressions = []string{FilesystemImageCompressionZstd, FilesystemImageCompressionLz4, FilesystemImageCompressionXz, FilesystemImageCompressionNone}
+)
+
+// Produces a read-only SquashFS or EROFS image of a root filesystem. Ownership of files is taken
+// from the package database in the root filesystem (as recorded when the packages were installed),
+// rather than from the files themselves, so the image is correct even when packages were installed
+// without root privileges. Files that are not owned by any package are owned by root.
+type FilesystemImage struct {
+	OutputPath     string
+	SourcePath     string
+	FilesystemType string
+	Compression    string
+	ShouldVerify   bool // True to extract the produced image and compare it to the source tree
+}
+
+func (fi *FilesystemImage) Package(ctx context.Context) (string, error) {
+	err := fi.validate()
+	if err != nil {
+		return "", trace.Wrap(err, "failed to validate filesystem image options")
+	}
+
+	err = runners.CheckRequiredCommandsExist(fi.getRequiredCommands())
+	if err != nil {
+		return "", trace.Wrap(err, "failed to find required commands for building the %s image", fi.FilesystemType)
+	}
+
+	_, err = utils.EnsureDirectoryExists(path.Dir(fi.OutputPath))
+	if err != nil {
+		return "", trace.Wrap(err, "failed to ensure image output directory exists")
+	}
+
+	// Both mksquashfs and mkfs.erofs can build images from a tarball, which allows for setting
+	// ownership without modifying the source tree
+	tarballFile, err := os.CreateTemp("", "filesystem-image-*.tar")
+	if err != nil {
+		return "", trace.Wrap(err, "failed to create temporary tarball")
+	}
+	defer utils.ErrDefer(func() error { return os.Remove(tarballFile.Name()) }, &err)
+	defer utils.Close(tarballFile, &err)
+
+	expectedManifest, err := fi.writeTarball(tarballFile)
+	if err != nil {
+		return "", trace.Wrap(err, "failed to create tarball of %q", fi.SourcePath)
+	}
+
+	_, err = tarballFile.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", trace.Wrap(err, "failed to seek to the start of the tarball")
+	}
+
+	err = fi.buildImage(tarballFile)
+	if err != nil {
+		return "", trace.Wrap(err, "failed to build %s image", fi.FilesystemType)
+	}
+
+	if fi.ShouldVerify {
+		err = fi.verifyImage(expectedManifest)
+		if err != nil {
+			return "", trace.Wrap(err, "failed to verify %s image %q", fi.FilesystemType, fi.OutputPath)
+		}
+	}
+
+	slog.Info("Packaging complete!", "output_file", fi.OutputPath)
+	return fi.OutputPath, nil
+}
+
+func (fi *FilesystemImage) validate() error {
+	if fi.SourcePath == "" {
+		return trace.Errorf("a source path is required")
+	}
+
+	if fi.FilesystemType == "" {
+		fi.FilesystemType = FilesystemImageTypeSquashfs
+	}
+
+	if !slices.Contains(FilesystemImageTypes, fi.FilesystemType) {
+		return trace.Errorf("unsupported filesystem type %q, must be one of %v", fi.FilesystemType, FilesystemImageTypes)
+	}
+
+	if fi.Compression == "" {
+		fi.Compression = FilesystemImageCompressionZstd
+	}
+
+	if !slices.Contains(FilesystemImageCompressions, fi.Compression) {
+		return trace.Errorf("unsupported compression %q, must be one of %v", fi.Compression, FilesystemImageCompressions)
+	}
+
+	if fi.OutputPath == "" {
+		fi.OutputPath = path.Join(os.TempDir(), fmt.Sprintf("rootfs-%s.%s", uuid.New(), fi.FilesystemType))
+	}
+
+	return nil
+}
+
+func (fi *FilesystemImage) getRequiredCommands() []string {
+	switch fi.FilesystemType {
+	case FilesystemImageTypeSquashfs:
+		if fi.ShouldVerify {
+			return []string{"mksquashfs", "unsquashfs"}
+		}
+		return []string{"mksquashfs"}
+	case FilesystemImageTypeErofs:
+		if fi.ShouldVerify {
+			return []string{"mkfs.erofs", "fsck.erofs"}
+		}
+		return []string{"mkfs.erofs"}
+	}
+
+	return nil
+}
+
+// Write the source tree to the tarball with ownership from the package database, returning a
+// manifest of the written entries
+func (fi *FilesystemImage) writeTarball(tarballFile io.Writer) (*PackageManifest, error) {
+	database := NewPackageDatabase(fi.SourcePath)
+	err := database.Load()
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to load package database from %q", fi.SourcePath)
+	}
+
+	tarWriter := tar.NewWriter(tarballFile)
+	manifest := NewPackageManifest(path.Base(fi.OutputPath))
+	sourceTree := &SourceTree{
+		Path:             fi.SourcePath,
+		ShouldResetOwner: true,
+	}
+
+	ownedEntries := database.GetEntriesByPath()
+	unownedCount := 0
+	err = sourceTree.Walk(func(objectPath string, filesystemObjectInfo os.FileInfo, header *tar.Header) error {
+		entryPath := normalizeManifestPath(header.Name)
+		if entry, ok := ownedEntries[entryPath]; ok {
+			header.Uid = entry.UID
+			header.Gid = entry.GID
+			header.Uname = ""
+			header.Gname = ""
+		} else {
+			unownedCount++
+		}
+
+		err := tarWriter.WriteHeader(header)
+		if err != nil {
+			return trace.Wrap(err, "failed to write tar header for %q", objectPath)
+		}
+
+		err = copyFileToArchive(objectPath, filesystemObjectInfo, tarWriter)
+		if err != nil {
+			return trace.Wrap(err, "failed to copy %q to tarball", objectPath)
+		}
+
+		err = fi.addToManifest(manifest, objectPath, filesystemObjectInfo, header)
+		if err != nil {
+			return trace.Wrap(err, "failed to record %q", objectPath)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to add all files to the tarball")
+	}
+
+	err = tarWriter.Close()
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to close tarball")
+	}
+
+	if unownedCount > 0 {
+		slog.Info("Filesystem objects not owned by any package will be owned by root", "count", unownedCount)
+	}
+
+	return manifest, nil
+}
+
+func (fi *FilesystemImage) addToManifest(manifest *PackageManifest, objectPath string, filesystemObjectInfo os.FileInfo, header *tar.Header) error {
+	if !filesystemObjectInfo.Mode().IsRegular() {
+		return manifest.AddTarEntry(header, nil)
+	}
+
+	fileHandle, err := os.Open(objectPath)
+	defer utils.Close(fileHandle, &err)
+	if err != nil {
+		return trace.Wrap(err, "failed to open %q", objectPath)
+	}
+
+	return manifest.AddTarEntry(header, fileHandle)
+}
+
+func (fi *FilesystemImage) buildImage(tarballFile *os.File) error {
+	var err error
+	switch fi.FilesystemType {
+	case FilesystemImageTypeSquashfs:
+		_, err = runners.Run(&runners.CommandRunner{
+			Command:     "mksquashfs",
+			Arguments:   append([]string{"-", fi.OutputPath, "-tar", "-noappend", "-quiet"}, fi.getSquashfsCompressionArguments()...),
+			StdinReader: tarballFile,
+		})
+	case FilesystemImageTypeErofs:
+		_, err = runners.Run(&runners.CommandRunner{
+			Command:   "mkfs.erofs",
+			Arguments: append(fi.getErofsCompressionArguments(), "--tar=f", fi.OutputPath, tarballFile.Name()),
+		})
+	}
+	if err != nil {
+		return trace.Wrap(err, "failed to create %s image", fi.FilesystemType)
+	}
+
+	return nil
+}
+
+func (fi *FilesystemImage) getSquashfsCompressionArguments() []string {
+	if fi.Compression == FilesystemImageCompressionNone {
+		return []string{"-noI", "-noD", "-noF", "-noX"}
+	}
+
+	return []string{"-comp", fi.Compression}
+}
+
+func (fi *FilesystemImage) getErofsCompressionArguments() []string {
+	switch fi.Compression {
+	case FilesystemImageCompressionLz4:
+		return []string{"-zlz4hc"}
+	case FilesystemImageCompressionXz:
+		return []string{"-zlzma"}
+	case FilesystemImageCompressionZstd:
+		return []string{"-zzstd"}
+	}
+
+	return nil
+}
+
+// Extract the image, and compare every filesystem object to the expected manifest
+func (fi *FilesystemImage) verifyImage(expectedManifest *PackageManifest) error {
+	slog.Info("Verifying image contents", "image_path", fi.OutputPath)
+
+	extractionDirectoryPath, err := os.MkdirTemp("", "filesystem-image-verify-*")
+	if err != nil {
+		return trace.Wrap(err, "failed to create temporary extraction directory")
+	}
+	defer utils.ErrDefer(func() error { return os.RemoveAll(extractionDirectoryPath) }, &err)
+
+	// Both tools require that the destination directory does not exist
+	extractedRootPath := path.Join(extractionDirectoryPath, "root")
+	switch fi.FilesystemType {
+	case FilesystemImageTypeSquashfs:
+		_, err = runners.Run(&runners.CommandRunner{
+			Command:   "unsquashfs",
+			Arguments: []string{"-quiet", "-no-progress", "-d", extractedRootPath, fi.OutputPath},
+		})
+	case FilesystemImageTypeErofs:
+		_, err = runners.Run(&runners.CommandRunner{
+			Command:   "fsck.erofs",
+			Arguments: []string{"--extract=" + extractedRootPath, "--preserve", fi.OutputPath},
+		})
+	}
+	if err != nil {
+		return trace.Wrap(err, "failed to extract image")
+	}
+
+	actualManifest := NewPackageManifest(expectedManifest.Name)
+	sourceTree := &SourceTree{
+		Path: extractedRootPath,
+	}
+	err = sourceTree.Walk(func(objectPath string, filesystemObjectInfo os.FileInfo, header *tar.Header) error {
+		return fi.addToManifest(actualManifest, objectPath, filesystemObjectInfo, header)
+	})
+	if err != nil {
+		return trace.Wrap(err, "failed to read extracted image contents")
+	}
+
+	differences := compareManifests(expectedManifest, actualManifest, os.Geteuid() == 0)
+	if len(differences) == 0 {
+		slog.Info("Image contents match the source tree", "entry_count", len(expectedManifest.Entries))
+		return nil
+	}
+
+	for _, difference := range differences {
+		slog.Error("Image content mismatch", "difference", difference)
+	}
+
+	return trace.Errorf("found %d differences between the image and the source tree", len(differences))
+}
+
+// Returns a description of every difference between the two manifests. Ownership is only compared
+// if requested, as extraction without root privileges cannot preserve it.
+func compareManifests(expected, actual *PackageManifest, shouldCompareOwnership bool) []string {
+	expectedEntries := expected.GetEntriesByPath()
+	actualEntries := actual.GetEntriesByPath()
+
+	var differences []string
+	for _, expectedEntry := range expected.Entries {
+		actualEntry, ok := actualEntries[expectedEntry.Path]
+		if !ok {
+			differences = append(differences, fmt.Sprintf("%s: missing from image", expectedEntry.Path))
+			continue
+		}
+
+		if !expectedEntry.HasSameContent(actualEntry) {
+			differences = append(differences, fmt.Sprintf("%s: expected %s, found %s", expectedEntry.Path, describeManifestEntry(expectedEntry), describeManifestEntry(actualEntry)))
+		}
+
+		if expectedEntry.Mode != actualEntry.Mode && expectedEntry.Type != ManifestEntryTypeSymlink {
+			differences = append(differences, fmt.Sprintf("%s: expected mode %o, found %o", expectedEntry.Path, expectedEntry.Mode, actualEntry.Mode))
+		}
+
+		if shouldCompareOwnership && (expectedEntry.UID != actualEntry.UID || expectedEntry.GID != actualEntry.GID) {
+			differences = append(differences, fmt.Sprintf("%s: expected owner %d:%d, found %d:%d", expectedEntry.Path, expectedEntry.UID, expectedEntry.GID, actualEntry.UID, actualEntry.GID))
+		}
+	}
+
+	for _, actualEntry := range actual.Entries {
+		if _, ok := expectedEntries[actualEntry.Path]; !ok {
+			differences = append(differences, fmt.Sprintf("%s: unexpected entry in image", actualEntry.Path))
+		}
+	}
+
+	return differences
+}
+
+func (fi *FilesystemImage) SetOutputFilePath(outputFilePath string) {
+	fi.OutputPath = outputFilePath
+}
@@ -3,8 +3,10 @@ package artifacts
 import "context"
 
 type InstallOptions struct {
-	InstallPath string
-	SourcePath  string
+	InstallPath       string
+	SourcePath        string
+	PackageName       string   // Name to record the installed files under. Derived from the source path if not set.
+	AllowedOverwrites []string // Glob patterns of paths that may be overwritten even if owned by another package
 }
 
 type Install interface {
@@ -0,0 +1,168 @@
+package artifacts
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/gravitational/trace"
+	"github.com/solidDoWant/distrobuilder/internal/runners"
+	"github.com/solidDoWant/distrobuilder/internal/utils"
+	"golang.org/x/exp/maps"
+)
+
+// Directory containing a subdirectory of modules for each installed kernel release
+var kernelModulesDirectoryPath = path.Join("/", "usr", "lib", "modules")
+
+// Index files written by depmod, relative to the modules directory of a release
+var kernelModuleIndexFiles = []string{
+	"modules.alias",
+	"modules.alias.bin",
+	"modules.builtin.alias.bin",
+	"modules.builtin.bin",
+	"modules.dep",
+	"modules.dep.bin",
+	"modules.devname",
+	"modules.softdep",
+	"modules.symbols",
+	"modules.symbols.bin",
+	"modules.weakdep",
+}
+
+// Name of the generated manifest that owns the module index of a kernel release
+func getKernelModuleIndexManifestName(release string) string {
+	return fmt.Sprintf("kernel-module-index-%s", release)
+}
+
+// Get the kernel releases that the package installs modules for, whose module index must be
+// regenerated. This is the case when the package does not ship an index, typically a package of
+// out-of-tree modules, or when the index was previously regenerated, as a shipped index (i.e. from
+// the kernel package) would not include modules from other packages.
+func getKernelReleasesToIndex(manifest *PackageManifest, database *PackageDatabase) []string {
+	releases := map[string]struct{}{}
+	indexedReleases := map[string]struct{}{}
+	for _, entry := range manifest.Entries {
+		if entry.Type != ManifestEntryTypeFile {
+			continue
+		}
+
+		relativePath, ok := strings.CutPrefix(entry.Path, kernelModulesDirectoryPath+"/")
+		if !ok {
+			continue
+		}
+
+		release, releaseRelativePath, ok := strings.Cut(relativePath, "/")
+		if !ok {
+			continue
+		}
+
+		if releaseRelativePath == "modules.dep" {
+			indexedReleases[release] = struct{}{}
+			continue
+		}
+
+		if strings.Contains(path.Base(releaseRelativePath), ".ko") {
+			releases[release] = struct{}{}
+		}
+	}
+
+	for indexedRelease := range indexedReleases {
+		if _, ok := database.Manifests[getKernelModuleIndexManifestName(indexedRelease)]; !ok {
+			delete(releases, indexedRelease)
+		}
+	}
+
+	sortedReleases := maps.Keys(releases)
+	slices.Sort(sortedReleases)
+	return sortedReleases
+}
+
+// Regenerate the module index of each kernel release in the install path with depmod, so that
+// newly installed modules can be loaded by name. Ownership of the index is transferred to a
+// generated manifest for the release, so that the recorded hashes match the regenerated files.
+func updateKernelModuleIndexes(database *PackageDatabase, releases []string) (err error) {
+	err = runners.CheckRequiredCommandsExist([]string{"depmod"})
+	if err != nil {
+		return trace.Wrap(err, "depmod is required to install kernel modules")
+	}
+
+	installPath, err := filepath.Abs(database.InstallPath)
+	if err != nil {
+		return trace.Wrap(err, "failed to get absolute path of %q", database.InstallPath)
+	}
+
+	// /lib in the install path is typically an absolute link to /usr/lib, which depmod would
+	// resolve on the host. Link each release into a staging directory instead. Newer versions of
+	// kmod may be configured to look under /usr/lib/modules rather than /lib/modules.
+	stagingDirectoryPath, err := os.MkdirTemp("", "depmod-*")
+	if err != nil {
+		return trace.Wrap(err, "failed to create depmod staging directory")
+	}
+	defer utils.ErrDefer(func() error { return os.RemoveAll(stagingDirectoryPath) }, &err)
+
+	for _, stagedModulesDirectoryPath := range []string{path.Join(stagingDirectoryPath, "lib", "modules"), path.Join(stagingDirectoryPath, "usr", "lib", "modules")} {
+		_, err = utils.EnsureDirectoryExists(stagedModulesDirectoryPath)
+		if err != nil {
+			return trace.Wrap(err, "failed to create directory %q", stagedModulesDirectoryPath)
+		}
+
+		for _, release := range releases {
+			err = os.Symlink(path.Join(installPath, kernelModulesDirectoryPath, release), path.Join(stagedModulesDirectoryPath, release))
+			if err != nil {
+				return trace.Wrap(err, "failed to link modules for kernel release %q", release)
+			}
+		}
+	}
+
+	for _, release := range releases {
+		slog.Info("Updating kernel module index", "kernel_release", release)
+		_, err = runners.Run(&runners.CommandRunner{
+			Command:   "depmod",
+			Arguments: []string{"-b", stagingDirectoryPath, release},
+		})
+		if err != nil {
+			return trace.Wrap(err, "failed to run depmod for kernel release %q", release)
+		}
+
+		err = recordKernelModuleIndex(database, release)
+		if err != nil {
+			return trace.Wrap(err, "failed to record the module index for kernel release %q", release)
+		}
+	}
+
+	return nil
+}
+
+func recordKernelModuleIndex(database *PackageDatabase, release string) error {
+	manifest := NewPackageManifest(getKernelModuleIndexManifestName(release))
+	manifest.IsGenerated = true
+
+	for _, indexFile := range kernelModuleIndexFiles {
+		indexFilePath := path.Join(kernelModulesDirectoryPath, release, indexFile)
+		exists, err := utils.DoesFilesystemPathExist(path.Join(database.InstallPath, indexFilePath))
+		if err != nil {
+			return trace.Wrap(err, "failed to check if %q exists", indexFilePath)
+		}
+
+		// The files that are written vary between depmod versions
+		if !exists {
+			continue
+		}
+
+		err = manifest.AddInstalledFileEntry(database.InstallPath, indexFilePath)
+		if err != nil {
+			return trace.Wrap(err, "failed to add %q to the manifest", indexFilePath)
+		}
+	}
+
+	err := database.Record(manifest)
+	if err != nil {
+		return trace.Wrap(err, "failed to record manifest %q", manifest.Name)
+	}
+
+	return nil
+}
@@ -0,0 +1,646 @@
+package artifacts
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gravitational/trace"
+	"github.com/solidDoWant/distrobuilder/internal/utils"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	OCIImageFormatLayout        = "oci"
+	OCIImageFormatDockerArchive = "docker-archive"
+
+	ociIndexMediaType    = "application/vnd.oci.image.index.v1+json"
+	ociManifestMediaType = "application/vnd.oci.image.manifest.v1+json"
+	ociConfigMediaType   = "application/vnd.oci.image.config.v1+json"
+	ociLayerMediaType    = "application/vnd.oci.image.layer.v1.tar+gzip"
+
+	ociRefNameAnnotation       = "org.opencontainers.image.ref.name"
+	containerdNameAnnotation   = "io.containerd.image.name"
+	ociWhiteoutPrefix          = ".wh."
+	ociOpaqueWhiteoutName      = ociWhiteoutPrefix + ociWhiteoutPrefix + ".opq"
+	overlayOpaqueXattrName     = "trusted.overlay.opaque"
+	overlayUserOpaqueXattrName = "user.overlay.opaque"
+	paxXattrPrefix             = "SCHILY.xattr."
+)
+
+var OCIImageFormats = []string{OCIImageFormatLayout, OCIImageFormatDockerArchive}
+
+// Mapping of GNU machine names to OCI (GOARCH) architecture names and variants
+var ociArchitectures = map[string]struct {
+	Architecture string
+	Variant      string
+}{
+	"x86_64":  {"amd64", ""},
+	"aarch64": {"arm64", "v8"},
+	"i386":    {"386", ""},
+	"i686":    {"386", ""},
+	"armv7l":  {"arm", "v7"},
+	"riscv64": {"riscv64", ""},
+}
+
+// Runtime configuration for containers created from the image
+type OCIImageConfig struct {
+	User       string   `json:"User,omitempty"`
+	Env        []string `json:"Env,omitempty"`
+	Entrypoint []string `json:"Entrypoint,omitempty"`
+	Cmd        []string `json:"Cmd,omitempty"`
+	WorkingDir string   `json:"WorkingDir,omitempty"`
+}
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type ociIndex struct {
+	SchemaVersion int              `json:"schemaVersion"`
+	MediaType     string           `json:"mediaType"`
+	Manifests     []*ociDescriptor `json:"manifests"`
+}
+
+type ociManifest struct {
+	SchemaVersion int              `json:"schemaVersion"`
+	MediaType     string           `json:"mediaType"`
+	Config        *ociDescriptor   `json:"config"`
+	Layers        []*ociDescriptor `json:"layers"`
+}
+
+type ociHistory struct {
+	Created   time.Time `json:"created"`
+	CreatedBy string    `json:"created_by"`
+	Comment   string    `json:"comment,omitempty"`
+}
+
+type ociRootFS struct {
+	Type    string   `json:"type"`
+	DiffIDs []string `json:"diff_ids"`
+}
+
+type ociImage struct {
+	Created      time.Time       `json:"created"`
+	Architecture string          `json:"architecture"`
+	Variant      string          `json:"variant,omitempty"`
+	OS           string          `json:"os"`
+	Config       *OCIImageConfig `json:"config"`
+	RootFS       *ociRootFS      `json:"rootfs"`
+	History      []*ociHistory   `json:"history"`
+}
+
+// Entry in the manifest.json file used by `docker load`
+type dockerArchiveManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// A single image layer, written to the blob store
+type ociLayer struct {
+	Descriptor *ociDescriptor
+	DiffID     string // Digest of the uncompressed layer
+	Source     string
+}
+
+// Produces container images loadable by podman/docker without a registry. The image is built from
+// either a root filesystem directory (as a single layer), or a list of component tarballs (each as
+// its own layer, applied in order). Overlay filesystem whiteouts are converted to OCI whiteouts.
+type OCIImage struct {
+	OutputPath        string // Directory for OCI image layouts, file for docker archives
+	SourcePath        string // Root filesystem directory
+	LayerTarballPaths []string
+	Format            string
+	ShouldResetOwner  bool   // True to change owner/group to root/root for packaging
+	Architecture      string // GNU machine name, i.e. "x86_64"
+	Tag               string // Image reference, i.e. "distrobuilder:latest"
+	Config            OCIImageConfig
+}
+
+func (oi *OCIImage) Package(ctx context.Context) (string, error) {
+	err := oi.validate()
+	if err != nil {
+		return "", trace.Wrap(err, "failed to validate OCI image options")
+	}
+
+	layoutPath := oi.OutputPath
+	if oi.Format == OCIImageFormatDockerArchive {
+		// Docker archives are tarballs containing an OCI image layout, plus a docker-specific manifest
+		layoutPath, err = os.MkdirTemp("", "oci-layout-*")
+		if err != nil {
+			return "", trace.Wrap(err, "failed to create temporary directory for image layout")
+		}
+		defer utils.ErrDefer(func() error { return os.RemoveAll(layoutPath) }, &err)
+	}
+
+	blobDirectoryPath := path.Join(layoutPath, "blobs", "sha256")
+	_, err = utils.EnsureDirectoryExists(blobDirectoryPath)
+	if err != nil {
+		return "", trace.Wrap(err, "failed to create blob directory %q", blobDirectoryPath)
+	}
+
+	layers, err := oi.writeLayers(blobDirectoryPath)
+	if err != nil {
+		return "", trace.Wrap(err, "failed to write image layers")
+	}
+
+	manifestDescriptor, configDescriptor, err := oi.writeManifest(blobDirectoryPath, layers)
+	if err != nil {
+		return "", trace.Wrap(err, "failed to write image manifest")
+	}
+
+	err = oi.writeLayoutMetadata(layoutPath, manifestDescriptor)
+	if err != nil {
+		return "", trace.Wrap(err, "failed to write image layout metadata")
+	}
+
+	if oi.Format == OCIImageFormatDockerArchive {
+		err = oi.writeDockerArchive(layoutPath, configDescriptor, layers)
+		if err != nil {
+			return "", trace.Wrap(err, "failed to write docker archive")
+		}
+	}
+
+	slog.Info("Packaging complete!", "output_path", oi.OutputPath, "format", oi.Format, "layer_count", len(layers))
+	return oi.OutputPath, nil
+}
+
+func (oi *OCIImage) validate() error {
+	if oi.SourcePath == "" && len(oi.LayerTarballPaths) == 0 {
+		return trace.Errorf("either a root filesystem directory or at least one layer tarball is required")
+	}
+
+	if oi.SourcePath != "" && len(oi.LayerTarballPaths) > 0 {
+		return trace.Errorf("a root filesystem directory and layer tarballs cannot both be provided")
+	}
+
+	if oi.Format == "" {
+		oi.Format = OCIImageFormatLayout
+	}
+
+	switch oi.Format {
+	case OCIImageFormatLayout:
+		if oi.OutputPath == "" {
+			oi.OutputPath = path.Join(os.TempDir(), fmt.Sprintf("image-%s", uuid.New()))
+		}
+	case OCIImageFormatDockerArchive:
+		if oi.OutputPath == "" {
+			oi.OutputPath = path.Join(os.TempDir(), fmt.Sprintf("image-%s.tar", uuid.New()))
+		}
+	default:
+		return trace.Errorf("unsupported image format %q, must be one of %v", oi.Format, OCIImageFormats)
+	}
+
+	if oi.Architecture == "" {
+		oi.Architecture = utils.GetTripletMachineValue()
+	}
+
+	if _, ok := ociArchitectures[oi.Architecture]; !ok {
+		return trace.Errorf("unsupported architecture %q", oi.Architecture)
+	}
+
+	if oi.Tag == "" {
+		oi.Tag = "distrobuilder:latest"
+	}
+
+	return nil
+}
+
+func (oi *OCIImage) writeLayers(blobDirectoryPath string) ([]*ociLayer, error) {
+	if oi.SourcePath != "" {
+		layer, err := oi.writeLayer(blobDirectoryPath, oi.SourcePath, oi.addRootFilesystemToLayer)
+		if err != nil {
+			return nil, trace.Wrap(err, "failed to create layer from root filesystem %q", oi.SourcePath)
+		}
+
+		return []*ociLayer{layer}, nil
+	}
+
+	layers := make([]*ociLayer, 0, len(oi.LayerTarballPaths))
+	for _, layerTarballPath := range oi.LayerTarballPaths {
+		layer, err := oi.writeLayer(blobDirectoryPath, layerTarballPath, oi.addTarballToLayer)
+		if err != nil {
+			return nil, trace.Wrap(err, "failed to create layer from tarball %q", layerTarballPath)
+		}
+
+		layers = append(layers, layer)
+	}
+
+	return layers, nil
+}
+
+// Write a gzip compressed layer to the blob store. The layer contents are produced by the
+// provided function.
+func (oi *OCIImage) writeLayer(blobDirectoryPath, source string, addContents func(string, *tar.Writer) error) (*ociLayer, error) {
+	slog.Info("Creating image layer", "source", source)
+
+	layerFile, err := os.CreateTemp(blobDirectoryPath, "layer-*")
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to create temporary layer file")
+	}
+	defer utils.Close(layerFile, &err)
+
+	digestHasher := sha256.New()
+	gzipWriter := gzip.NewWriter(io.MultiWriter(layerFile, digestHasher))
+	diffIDHasher := sha256.New()
+	tarWriter := tar.NewWriter(io.MultiWriter(gzipWriter, diffIDHasher))
+
+	err = addContents(source, tarWriter)
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to add contents to layer")
+	}
+
+	err = tarWriter.Close()
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to close layer tar stream")
+	}
+
+	err = gzipWriter.Close()
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to close layer gzip stream")
+	}
+
+	layerFileInfo, err := layerFile.Stat()
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to get layer size")
+	}
+
+	descriptor := &ociDescriptor{
+		MediaType: ociLayerMediaType,
+		Digest:    getSHA256Digest(digestHasher),
+		Size:      layerFileInfo.Size(),
+	}
+
+	// Temporary files are only readable by the owner
+	err = layerFile.Chmod(0644)
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to set layer file permissions")
+	}
+
+	blobPath := getBlobPath(blobDirectoryPath, descriptor.Digest)
+	err = os.Rename(layerFile.Name(), blobPath)
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to move layer to %q", blobPath)
+	}
+
+	return &ociLayer{
+		Descriptor: descriptor,
+		DiffID:     getSHA256Digest(diffIDHasher),
+		Source:     source,
+	}, nil
+}
+
+func (oi *OCIImage) addRootFilesystemToLayer(rootFilesystemPath string, tarWriter *tar.Writer) error {
+	sourceTree := &SourceTree{
+		Path:             rootFilesystemPath,
+		ShouldResetOwner: oi.ShouldResetOwner,
+	}
+
+	err := sourceTree.Walk(func(objectPath string, filesystemObjectInfo os.FileInfo, header *tar.Header) error {
+		slog.Debug("adding file to layer", "file_path", objectPath)
+
+		if isOverlayWhiteout(header) {
+			return writeOCIWhiteout(tarWriter, header)
+		}
+
+		err := tarWriter.WriteHeader(header)
+		if err != nil {
+			return trace.Wrap(err, "failed to write tar header for %q", objectPath)
+		}
+
+		err = copyFileToArchive(objectPath, filesystemObjectInfo, tarWriter)
+		if err != nil {
+			return trace.Wrap(err, "failed to copy %q to layer", objectPath)
+		}
+
+		if filesystemObjectInfo.IsDir() {
+			isOpaque, err := isOverlayOpaqueDirectory(objectPath)
+			if err != nil {
+				return trace.Wrap(err, "failed to check if %q is an opaque directory", objectPath)
+			}
+
+			if isOpaque {
+				return writeOCIOpaqueWhiteout(tarWriter, header)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return trace.Wrap(err, "failed to add root filesystem to layer")
+	}
+
+	return nil
+}
+
+func (oi *OCIImage) addTarballToLayer(tarballPath string, tarWriter *tar.Writer) error {
+	err := readTarball(tarballPath, func(header *tar.Header, tarReader *tar.Reader) error {
+		if oi.ShouldResetOwner {
+			header.Uid = 0
+			header.Gid = 0
+			header.Uname = "root"
+			header.Gname = "root"
+		}
+
+		if isOverlayWhiteout(header) {
+			return writeOCIWhiteout(tarWriter, header)
+		}
+
+		isOpaque := false
+		for _, xattrName := range []string{overlayOpaqueXattrName, overlayUserOpaqueXattrName} {
+			if header.PAXRecords[paxXattrPrefix+xattrName] == "y" {
+				isOpaque = true
+				delete(header.PAXRecords, paxXattrPrefix+xattrName)
+			}
+		}
+
+		err := tarWriter.WriteHeader(header)
+		if err != nil {
+			return trace.Wrap(err, "failed to write tar header for %q", header.Name)
+		}
+
+		_, err = io.Copy(tarWriter, tarReader)
+		if err != nil {
+			return trace.Wrap(err, "failed to copy %q to layer", header.Name)
+		}
+
+		if isOpaque && header.Typeflag == tar.TypeDir {
+			return writeOCIOpaqueWhiteout(tarWriter, header)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return trace.Wrap(err, "failed to add tarball to layer")
+	}
+
+	return nil
+}
+
+// Overlay filesystems represent deleted files with a 0:0 character device
+func isOverlayWhiteout(header *tar.Header) bool {
+	return header.Typeflag == tar.TypeChar && header.Devmajor == 0 && header.Devminor == 0
+}
+
+func isOverlayOpaqueDirectory(directoryPath string) (bool, error) {
+	for _, xattrName := range []string{overlayOpaqueXattrName, overlayUserOpaqueXattrName} {
+		value := make([]byte, 1)
+		valueSize, err := unix.Lgetxattr(directoryPath, xattrName, value)
+		if err != nil {
+			if errors.Is(err, unix.ENODATA) || errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.ERANGE) {
+				continue
+			}
+
+			// Reading trusted xattrs requires CAP_SYS_ADMIN
+			if errors.Is(err, unix.EPERM) {
+				continue
+			}
+
+			return false, trace.Wrap(err, "failed to read xattr %q of %q", xattrName, directoryPath)
+		}
+
+		if valueSize == 1 && value[0] == 'y' {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// Replace a deleted file with an empty ".wh.<name>" file in the same directory
+func writeOCIWhiteout(tarWriter *tar.Writer, header *tar.Header) error {
+	directoryPath, fileName := path.Split(strings.TrimSuffix(header.Name, "/"))
+	whiteoutName := directoryPath + ociWhiteoutPrefix + fileName
+	slog.Debug("converting overlay whiteout", "path", header.Name, "whiteout", whiteoutName)
+
+	err := tarWriter.WriteHeader(getOCIWhiteoutHeader(header, whiteoutName))
+	if err != nil {
+		return trace.Wrap(err, "failed to write whiteout for %q", header.Name)
+	}
+
+	return nil
+}
+
+// Mark a directory as opaque, hiding all contents of the directory from lower layers
+func writeOCIOpaqueWhiteout(tarWriter *tar.Writer, directoryHeader *tar.Header) error {
+	whiteoutName := path.Join(directoryHeader.Name, ociOpaqueWhiteoutName)
+	slog.Debug("converting overlay opaque directory", "path", directoryHeader.Name, "whiteout", whiteoutName)
+
+	err := tarWriter.WriteHeader(getOCIWhiteoutHeader(directoryHeader, whiteoutName))
+	if err != nil {
+		return trace.Wrap(err, "failed to write opaque whiteout for %q", directoryHeader.Name)
+	}
+
+	return nil
+}
+
+func getOCIWhiteoutHeader(header *tar.Header, whiteoutName string) *tar.Header {
+	return &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     whiteoutName,
+		Mode:     0,
+		Uid:      header.Uid,
+		Gid:      header.Gid,
+		Uname:    header.Uname,
+		Gname:    header.Gname,
+		ModTime:  header.ModTime,
+	}
+}
+
+// Write the image config and manifest blobs, returning their descriptors
+func (oi *OCIImage) writeManifest(blobDirectoryPath string, layers []*ociLayer) (*ociDescriptor, *ociDescriptor, error) {
+	architecture := ociArchitectures[oi.Architecture]
+	created := time.Now().UTC()
+
+	image := &ociImage{
+		Created:      created,
+		Architecture: architecture.Architecture,
+		Variant:      architecture.Variant,
+		OS:           "linux",
+		Config:       &oi.Config,
+		RootFS: &ociRootFS{
+			Type:    "layers",
+			DiffIDs: make([]string, 0, len(layers)),
+		},
+		History: make([]*ociHistory, 0, len(layers)),
+	}
+
+	layerDescriptors := make([]*ociDescriptor, 0, len(layers))
+	for _, layer := range layers {
+		image.RootFS.DiffIDs = append(image.RootFS.DiffIDs, layer.DiffID)
+		image.History = append(image.History, &ociHistory{
+			Created:   created,
+			CreatedBy: "distrobuilder",
+			Comment:   path.Base(layer.Source),
+		})
+		layerDescriptors = append(layerDescriptors, layer.Descriptor)
+	}
+
+	configDescriptor, err := writeJSONBlob(blobDirectoryPath, ociConfigMediaType, image)
+	if err != nil {
+		return nil, nil, trace.Wrap(err, "failed to write image config")
+	}
+
+	manifestDescriptor, err := writeJSONBlob(blobDirectoryPath, ociManifestMediaType, &ociManifest{
+		SchemaVersion: 2,
+		MediaType:     ociManifestMediaType,
+		Config:        configDescriptor,
+		Layers:        layerDescriptors,
+	})
+	if err != nil {
+		return nil, nil, trace.Wrap(err, "failed to write image manifest")
+	}
+
+	return manifestDescriptor, configDescriptor, nil
+}
+
+func (oi *OCIImage) writeLayoutMetadata(layoutPath string, manifestDescriptor *ociDescriptor) error {
+	err := writeJSONFile(path.Join(layoutPath, "oci-layout"), map[string]string{"imageLayoutVersion": "1.0.0"})
+	if err != nil {
+		return trace.Wrap(err, "failed to write image layout version")
+	}
+
+	manifestDescriptor.Annotations = map[string]string{
+		ociRefNameAnnotation:     oi.getTagVersion(),
+		containerdNameAnnotation: oi.Tag,
+	}
+
+	err = writeJSONFile(path.Join(layoutPath, "index.json"), &ociIndex{
+		SchemaVersion: 2,
+		MediaType:     ociIndexMediaType,
+		Manifests:     []*ociDescriptor{manifestDescriptor},
+	})
+	if err != nil {
+		return trace.Wrap(err, "failed to write image index")
+	}
+
+	return nil
+}
+
+// Get the version portion of the tag (i.e. "latest" for "distrobuilder:latest"), as expected by
+// the OCI ref name annotation
+func (oi *OCIImage) getTagVersion() string {
+	lastComponent := path.Base(oi.Tag)
+	if _, version, found := strings.Cut(lastComponent, ":"); found {
+		return version
+	}
+
+	return "latest"
+}
+
+func (oi *OCIImage) writeDockerArchive(layoutPath string, configDescriptor *ociDescriptor, layers []*ociLayer) error {
+	dockerManifest := &dockerArchiveManifest{
+		Config:   getBlobPath(path.Join("blobs", "sha256"), configDescriptor.Digest),
+		RepoTags: []string{oi.Tag},
+		Layers:   make([]string, 0, len(layers)),
+	}
+
+	for _, layer := range layers {
+		dockerManifest.Layers = append(dockerManifest.Layers, getBlobPath(path.Join("blobs", "sha256"), layer.Descriptor.Digest))
+	}
+
+	err := writeJSONFile(path.Join(layoutPath, "manifest.json"), []*dockerArchiveManifest{dockerManifest})
+	if err != nil {
+		return trace.Wrap(err, "failed to write docker manifest")
+	}
+
+	_, err = utils.EnsureDirectoryExists(path.Dir(oi.OutputPath))
+	if err != nil {
+		return trace.Wrap(err, "failed to ensure image output directory exists")
+	}
+
+	archiveFile, err := os.OpenFile(oi.OutputPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	defer utils.Close(archiveFile, &err)
+	if err != nil {
+		return trace.Wrap(err, "failed to create docker archive %q", oi.OutputPath)
+	}
+
+	tarWriter := tar.NewWriter(archiveFile)
+	defer utils.Close(tarWriter, &err)
+
+	sourceTree := &SourceTree{
+		Path:             layoutPath,
+		ShouldResetOwner: true,
+	}
+
+	err = sourceTree.Walk(func(objectPath string, filesystemObjectInfo os.FileInfo, header *tar.Header) error {
+		err := tarWriter.WriteHeader(header)
+		if err != nil {
+			return trace.Wrap(err, "failed to write tar header for %q", objectPath)
+		}
+
+		return copyFileToArchive(objectPath, filesystemObjectInfo, tarWriter)
+	})
+	if err != nil {
+		return trace.Wrap(err, "failed to add image layout to docker archive")
+	}
+
+	return nil
+}
+
+func (oi *OCIImage) SetOutputFilePath(outputFilePath string) {
+	oi.OutputPath = outputFilePath
+}
+
+func writeJSONBlob(blobDirectoryPath, mediaType string, value interface{}) (*ociDescriptor, error) {
+	contents, err := json.Marshal(value)
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to serialize %q", mediaType)
+	}
+
+	hasher := sha256.New()
+	hasher.Write(contents)
+	descriptor := &ociDescriptor{
+		MediaType: mediaType,
+		Digest:    getSHA256Digest(hasher),
+		Size:      int64(len(contents)),
+	}
+
+	blobPath := getBlobPath(blobDirectoryPath, descriptor.Digest)
+	err = os.WriteFile(blobPath, contents, 0644)
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to write blob %q", blobPath)
+	}
+
+	return descriptor, nil
+}
+
+func writeJSONFile(filePath string, value interface{}) error {
+	contents, err := json.Marshal(value)
+	if err != nil {
+		return trace.Wrap(err, "failed to serialize %q", filePath)
+	}
+
+	err = os.WriteFile(filePath, contents, 0644)
+	if err != nil {
+		return trace.Wrap(err, "failed to write %q", filePath)
+	}
+
+	return nil
+}
+
+func getSHA256Digest(hasher hash.Hash) string {
+	return "sha256:" + hex.EncodeToString(hasher.Sum(nil))
+}
+
+func getBlobPath(blobDirectoryPath, digest string) string {
+	return filepath.Join(blobDirectoryPath, strings.TrimPrefix(digest, "sha256:"))
+}
@@ -0,0 +1,405 @@
+package artifacts
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/gravitational/trace"
+	"golang.org/x/exp/maps"
+	"golang.org/x/sys/unix"
+)
+
+// Path, relative to the install root, where records of installed packages are stored
+var PackageDatabaseRelativePath = path.Join("var", "lib", "distrobuilder", "packages")
+
+const (
+	ManifestEntryTypeFile            = "file"
+	ManifestEntryTypeSymlink         = "symlink"
+	ManifestEntryTypeDirectory       = "directory"
+	ManifestEntryTypeCharacterDevice = "character-device"
+	ManifestEntryTypeBlockDevice     = "block-device"
+	ManifestEntryTypeFifo            = "fifo"
+)
+
+// Record of a single filesystem object installed by a package
+type ManifestEntry struct {
+	Path       string      `json:"path"` // Absolute path, relative to the install root
+	Type       string      `json:"type"`
+	Mode       fs.FileMode `json:"mode"`
+	UID        int         `json:"uid"`
+	GID        int         `json:"gid"`
+	Size       int64       `json:"size,omitempty"`
+	SHA256     string      `json:"sha256,omitempty"` // Only set for regular files
+	LinkTarget string      `json:"link_target,omitempty"`
+	DevMajor   int64       `json:"dev_major,omitempty"`
+	DevMinor   int64       `json:"dev_minor,omitempty"`
+}
+
+func (me *ManifestEntry) IsDirectory() bool {
+	return me.Type == ManifestEntryTypeDirectory
+}
+
+// Returns true if the two entries would produce the same filesystem object when installed.
+// Ownership and permissions are not considered.
+func (me *ManifestEntry) HasSameContent(other *ManifestEntry) bool {
+	if me.Type != other.Type {
+		return false
+	}
+
+	switch me.Type {
+	case ManifestEntryTypeFile:
+		return me.SHA256 == other.SHA256
+	case ManifestEntryTypeSymlink:
+		return me.LinkTarget == other.LinkTarget
+	case ManifestEntryTypeCharacterDevice, ManifestEntryTypeBlockDevice:
+		return me.DevMajor == other.DevMajor && me.DevMinor == other.DevMinor
+	}
+
+	return true
+}
+
+// List of all filesystem objects installed by a package
+type PackageManifest struct {
+	Name    string           `json:"name"`
+	Entries []*ManifestEntry `json:"entries"`
+	// Generated manifests own files that are regenerated by the installer, such as the kernel
+	// module index, rather than installed from a package. Packages may replace these files.
+	IsGenerated bool `json:"generated,omitempty"`
+}
+
+func NewPackageManifest(name string) *PackageManifest {
+	return &PackageManifest{
+		Name: name,
+	}
+}
+
+func (pm *PackageManifest) AddTarEntry(header *tar.Header, contents io.Reader) error {
+	entry := &ManifestEntry{
+		Path:       normalizeManifestPath(header.Name),
+		Mode:       header.FileInfo().Mode().Perm(),
+		UID:        header.Uid,
+		GID:        header.Gid,
+		LinkTarget: header.Linkname,
+	}
+
+	switch header.Typeflag {
+	case tar.TypeReg:
+		entry.Type = ManifestEntryTypeFile
+		entry.Size = header.Size
+
+		hasher := sha256.New()
+		_, err := io.Copy(hasher, contents)
+		if err != nil {
+			return trace.Wrap(err, "failed to hash contents of %q", header.Name)
+		}
+		entry.SHA256 = hex.EncodeToString(hasher.Sum(nil))
+	case tar.TypeLink:
+		// Hard links are recorded as a copy of the file that they link to, which must be an
+		// earlier entry in the tarball
+		targetEntry := pm.GetEntry(normalizeManifestPath(header.Linkname))
+		if targetEntry == nil || targetEntry.Type != ManifestEntryTypeFile {
+			return trace.Errorf("hard link %q target %q is not a previously added file", header.Name, header.Linkname)
+		}
+
+		entry.Type = ManifestEntryTypeFile
+		entry.Size = targetEntry.Size
+		entry.SHA256 = targetEntry.SHA256
+		entry.Mode = targetEntry.Mode
+		entry.UID = targetEntry.UID
+		entry.GID = targetEntry.GID
+		entry.LinkTarget = ""
+	case tar.TypeSymlink:
+		entry.Type = ManifestEntryTypeSymlink
+	case tar.TypeDir:
+		entry.Type = ManifestEntryTypeDirectory
+	case tar.TypeChar:
+		entry.Type = ManifestEntryTypeCharacterDevice
+		entry.DevMajor = header.Devmajor
+		entry.DevMinor = header.Devminor
+	case tar.TypeBlock:
+		entry.Type = ManifestEntryTypeBlockDevice
+		entry.DevMajor = header.Devmajor
+		entry.DevMinor = header.Devminor
+	case tar.TypeFifo:
+		entry.Type = ManifestEntryTypeFifo
+	default:
+		return trace.Errorf("unsupported tar entry type %q for %q", header.Typeflag, header.Name)
+	}
+
+	pm.Entries = append(pm.Entries, entry)
+	return nil
+}
+
+// Add an entry for a regular file that has already been installed
+func (pm *PackageManifest) AddInstalledFileEntry(installPath, entryPath string) error {
+	filePath := path.Join(installPath, entryPath)
+	stat := &unix.Stat_t{}
+	err := unix.Lstat(filePath, stat)
+	if err != nil {
+		return trace.Wrap(err, "failed to get file info for %q", filePath)
+	}
+
+	if stat.Mode&unix.S_IFMT != unix.S_IFREG {
+		return trace.Errorf("%q is not a regular file", filePath)
+	}
+
+	fileContents, err := os.ReadFile(filePath)
+	if err != nil {
+		return trace.Wrap(err, "failed to read %q", filePath)
+	}
+
+	entry := &ManifestEntry{
+		Path: normalizeManifestPath(entryPath),
+		Type: ManifestEntryTypeFile,
+		Mode: fs.FileMode(stat.Mode).Perm(),
+		UID:  int(stat.Uid),
+		GID:  int(stat.Gid),
+		Size: stat.Size,
+	}
+
+	fileHash := sha256.Sum256(fileContents)
+	entry.SHA256 = hex.EncodeToString(fileHash[:])
+
+	pm.Entries = append(pm.Entries, entry)
+	return nil
+}
+
+func (pm *PackageManifest) GetEntry(entryPath string) *ManifestEntry {
+	for _, entry := range pm.Entries {
+		if entry.Path == entryPath {
+			return entry
+		}
+	}
+
+	return nil
+}
+
+func (pm *PackageManifest) GetEntriesByPath() map[string]*ManifestEntry {
+	entries := make(map[string]*ManifestEntry, len(pm.Entries))
+	for _, entry := range pm.Entries {
+		entries[entry.Path] = entry
+	}
+
+	return entries
+}
+
+// Removes all entries with the provided paths. Returns true if any entries were removed.
+func (pm *PackageManifest) RemoveEntries(entryPaths []string) bool {
+	originalCount := len(pm.Entries)
+	pm.Entries = slices.DeleteFunc(pm.Entries, func(entry *ManifestEntry) bool {
+		return slices.Contains(entryPaths, entry.Path)
+	})
+
+	return len(pm.Entries) != originalCount
+}
+
+func normalizeManifestPath(entryPath string) string {
+	return path.Clean("/" + entryPath)
+}
+
+// Collection of manifests for all packages installed under an install root
+type PackageDatabase struct {
+	InstallPath string
+	Manifests   map[string]*PackageManifest // Keyed by package name
+}
+
+func NewPackageDatabase(installPath string) *PackageDatabase {
+	return &PackageDatabase{
+		InstallPath: installPath,
+		Manifests:   make(map[string]*PackageManifest),
+	}
+}
+
+func (pd *PackageDatabase) GetDatabaseDirectoryPath() string {
+	return path.Join(pd.InstallPath, PackageDatabaseRelativePath)
+}
+
+func (pd *PackageDatabase) getManifestFilePath(packageName string) string {
+	return path.Join(pd.GetDatabaseDirectoryPath(), packageName+".json")
+}
+
+// Read all package manifests from the install root. A missing database is treated as empty.
+func (pd *PackageDatabase) Load() error {
+	databaseDirectoryPath := pd.GetDatabaseDirectoryPath()
+	manifestFiles, err := os.ReadDir(databaseDirectoryPath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+
+		return trace.Wrap(err, "failed to read package database directory %q", databaseDirectoryPath)
+	}
+
+	for _, manifestFile := range manifestFiles {
+		if manifestFile.IsDir() || filepath.Ext(manifestFile.Name()) != ".json" {
+			continue
+		}
+
+		manifestFilePath := path.Join(databaseDirectoryPath, manifestFile.Name())
+		fileContents, err := os.ReadFile(manifestFilePath)
+		if err != nil {
+			return trace.Wrap(err, "failed to read package manifest %q", manifestFilePath)
+		}
+
+		manifest := &PackageManifest{}
+		err = json.Unmarshal(fileContents, manifest)
+		if err != nil {
+			return trace.Wrap(err, "failed to parse package manifest %q", manifestFilePath)
+		}
+
+		pd.Manifests[manifest.Name] = manifest
+	}
+
+	return nil
+}
+
+// Returns the names of all packages, other than the provided package, that own the given path
+func (pd *PackageDatabase) GetOwners(entryPath, excludedPackageName string) []string {
+	var owners []string
+	for packageName, manifest := range pd.Manifests {
+		if packageName == excludedPackageName {
+			continue
+		}
+
+		if manifest.GetEntry(entryPath) != nil {
+			owners = append(owners, packageName)
+		}
+	}
+
+	slices.Sort(owners)
+	return owners
+}
+
+// Map every recorded path to its manifest entry. Ownership of files is transferred on install so
+// they only have a single entry, but directories may be recorded by multiple packages, in which
+// case an arbitrary entry is used.
+func (pd *PackageDatabase) GetEntriesByPath() map[string]*ManifestEntry {
+	// Directories may be recorded by multiple packages. Manifests are visited in name order, and
+	// the first record of each directory is used, so that the result does not depend on map order.
+	manifestNames := maps.Keys(pd.Manifests)
+	slices.Sort(manifestNames)
+
+	entries := make(map[string]*ManifestEntry)
+	for _, manifestName := range manifestNames {
+		for _, entry := range pd.Manifests[manifestName].Entries {
+			if _, ok := entries[entry.Path]; ok && entry.IsDirectory() {
+				continue
+			}
+
+			entries[entry.Path] = entry
+		}
+	}
+
+	return entries
+}
+
+// Find all entries in the provided manifest that would replace a filesystem object owned
+// by another installed package with different content.
+func (pd *PackageDatabase) FindConflicts(manifest *PackageManifest) FileConflicts {
+	var conflicts FileConflicts
+	for _, entry := range manifest.Entries {
+		for _, owner := range pd.GetOwners(entry.Path, manifest.Name) {
+			existingEntry := pd.Manifests[owner].GetEntry(entry.Path)
+
+			// Directories are shared between packages
+			if entry.IsDirectory() && existingEntry.IsDirectory() {
+				continue
+			}
+
+			if pd.Manifests[owner].IsGenerated {
+				continue
+			}
+
+			if entry.HasSameContent(existingEntry) {
+				continue
+			}
+
+			conflicts = append(conflicts, &FileConflict{
+				Path:             entry.Path,
+				PackageName:      manifest.Name,
+				OwnerPackageName: owner,
+				Entry:            entry,
+				OwnerEntry:       existingEntry,
+			})
+		}
+	}
+
+	return conflicts
+}
+
+// Store the manifest in the database, transferring ownership of any non-directory paths
+// from previously installed packages.
+func (pd *PackageDatabase) Record(manifest *PackageManifest) error {
+	transferredPaths := make([]string, 0, len(manifest.Entries))
+	for _, entry := range manifest.Entries {
+		if !entry.IsDirectory() {
+			transferredPaths = append(transferredPaths, entry.Path)
+		}
+	}
+
+	for packageName, otherManifest := range pd.Manifests {
+		if packageName == manifest.Name {
+			continue
+		}
+
+		if !otherManifest.RemoveEntries(transferredPaths) {
+			continue
+		}
+
+		err := pd.writeManifest(otherManifest)
+		if err != nil {
+			return trace.Wrap(err, "failed to update manifest for package %q", packageName)
+		}
+	}
+
+	pd.Manifests[manifest.Name] = manifest
+	err := pd.writeManifest(manifest)
+	if err != nil {
+		return trace.Wrap(err, "failed to write manifest for package %q", manifest.Name)
+	}
+
+	return nil
+}
+
+func (pd *PackageDatabase) writeManifest(manifest *PackageManifest) error {
+	// Don't use utils.EnsureDirectoryExists here as it will set the owner to the current user,
+	// and the database will be included in the target filesystem
+	databaseDirectoryPath := pd.GetDatabaseDirectoryPath()
+	err := os.MkdirAll(databaseDirectoryPath, 0755)
+	if err != nil {
+		return trace.Wrap(err, "failed to create package database directory %q", databaseDirectoryPath)
+	}
+
+	fileContents, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return trace.Wrap(err, "failed to serialize manifest for package %q", manifest.Name)
+	}
+
+	manifestFilePath := pd.getManifestFilePath(manifest.Name)
+	err = os.WriteFile(manifestFilePath, fileContents, 0644)
+	if err != nil {
+		return trace.Wrap(err, "failed to write package manifest to %q", manifestFilePath)
+	}
+
+	return nil
+}
+
+// Get a package name from the package file name, i.e. /tmp/package/musl-libc.tar.gz -> musl-libc
+func GetPackageNameFromFilePath(packageFilePath string) string {
+	packageName := path.Base(packageFilePath)
+	for _, extension := range []string{".gz", ".tgz", ".tar"} {
+		packageName = strings.TrimSuffix(packageName, extension)
+	}
+
+	return packageName
+}
@@ -0,0 +1,45 @@
+package artifacts
+
+import (
+	"time"
+
+	"github.com/gravitational/trace"
+)
+
+// Descriptive information about a package, used by package formats that carry
+// metadata alongside the packaged files
+type PackageMetadata struct {
+	Name         string
+	Version      string
+	Architecture string // Architecture name as used by the package format, i.e. "x86_64" for APK or "amd64" for deb
+	Description  string
+	URL          string
+	License      string
+	Maintainer   string
+	Depends      []string
+	BuildDate    time.Time
+}
+
+func (pm *PackageMetadata) Validate() error {
+	if pm.Name == "" {
+		return trace.Errorf("package name is required")
+	}
+
+	if pm.Version == "" {
+		return trace.Errorf("package version is required")
+	}
+
+	if pm.Architecture == "" {
+		return trace.Errorf("package architecture is required")
+	}
+
+	return nil
+}
+
+func (pm *PackageMetadata) GetBuildDate() time.Time {
+	if pm.BuildDate.IsZero() {
+		return time.Now()
+	}
+
+	return pm.BuildDate
+}
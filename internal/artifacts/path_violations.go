@@ -0,0 +1,74 @@
+package artifacts
+
+import (
+	"archive/tar"
+	"fmt"
+	"log/slog"
+	"path"
+
+	"github.com/gravitational/trace"
+	"github.com/solidDoWant/distrobuilder/internal/utils"
+)
+
+// An archive entry that would be written, or point, outside of the install path
+type PathViolation struct {
+	Name   string
+	Reason string
+}
+
+func (pv *PathViolation) String() string {
+	return fmt.Sprintf("%q: %s", pv.Name, pv.Reason)
+}
+
+type PathViolations []*PathViolation
+
+func FindPathViolations(header *tar.Header) PathViolations {
+	var violations PathViolations
+	addViolation := func(reason string, args ...any) {
+		violations = append(violations, &PathViolation{
+			Name:   header.Name,
+			Reason: fmt.Sprintf(reason, args...),
+		})
+	}
+
+	if header.Name == "" {
+		addViolation("entry name is empty")
+		return violations
+	}
+
+	if path.IsAbs(header.Name) {
+		addViolation("entry name is an absolute path")
+	} else if utils.IsEscapingPath(header.Name) {
+		addViolation("entry name resolves outside of the install path")
+	}
+
+	// Absolute symlink targets are resolved relative to the install path when the filesystem is in use,
+	// but relative targets that climb above the install path are always a packaging error
+	if header.Typeflag == tar.TypeSymlink && !path.IsAbs(header.Linkname) {
+		linkTarget := path.Join(path.Dir(header.Name), header.Linkname)
+		if utils.IsEscapingPath(linkTarget) {
+			addViolation("symlink target %q resolves outside of the install path", header.Linkname)
+		}
+	}
+
+	// Hard link targets are always relative to the root of the tarball
+	if header.Typeflag == tar.TypeLink && (path.IsAbs(header.Linkname) || utils.IsEscapingPath(header.Linkname)) {
+		addViolation("hard link target %q resolves outside of the install path", header.Linkname)
+	}
+
+	return violations
+}
+
+// Print the violation report, returning an error if there are any violations
+func (pv PathViolations) Check() error {
+	if len(pv) == 0 {
+		return nil
+	}
+
+	slog.Error(fmt.Sprintf("Found %d entries that resolve outside of the install path", len(pv)))
+	for _, violation := range pv {
+		slog.Error("Path violation", "violation", violation.String())
+	}
+
+	return trace.Errorf("found %d path violations", len(pv))
+}
@@ -0,0 +1,63 @@
+package artifacts
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+
+	"github.com/gravitational/trace"
+)
+
+// Read a PEM encoded RSA private key, in either PKCS #1 or PKCS #8 format
+func LoadRSAPrivateKey(keyFilePath string) (*rsa.PrivateKey, error) {
+	fileContents, err := os.ReadFile(keyFilePath)
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to read private key file %q", keyFilePath)
+	}
+
+	for {
+		var block *pem.Block
+		block, fileContents = pem.Decode(fileContents)
+		if block == nil {
+			return nil, trace.Errorf("failed to find a private key in %q", keyFilePath)
+		}
+
+		switch block.Type {
+		case "RSA PRIVATE KEY":
+			privateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, trace.Wrap(err, "failed to parse PKCS #1 private key from %q", keyFilePath)
+			}
+
+			return privateKey, nil
+		case "PRIVATE KEY":
+			parsedKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, trace.Wrap(err, "failed to parse PKCS #8 private key from %q", keyFilePath)
+			}
+
+			privateKey, ok := parsedKey.(*rsa.PrivateKey)
+			if !ok {
+				return nil, trace.Errorf("private key in %q is of type %T, not an RSA key", keyFilePath, parsedKey)
+			}
+
+			return privateKey, nil
+		}
+	}
+}
+
+// Sign the digest of some data with PKCS #1 v1.5 padding
+func signDigest(privateKey *rsa.PrivateKey, hash crypto.Hash, data []byte) ([]byte, error) {
+	hasher := hash.New()
+	hasher.Write(data)
+
+	signature, err := rsa.SignPKCS1v15(rand.Reader, privateKey, hash, hasher.Sum(nil))
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to sign data")
+	}
+
+	return signature, nil
+}
@@ -0,0 +1,106 @@
+package artifacts
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gravitational/trace"
+	"github.com/solidDoWant/distrobuilder/internal/utils"
+)
+
+// A directory of files (typically build output) to be packaged
+type SourceTree struct {
+	Path             string
+	ShouldResetOwner bool // True to change owner/group to root/root in produced headers
+}
+
+// Walk over every filesystem object in the tree, excluding the root, producing a tar header
+// for each with a name relative to the root
+func (st *SourceTree) Walk(handler func(objectPath string, filesystemObjectInfo os.FileInfo, header *tar.Header) error) error {
+	err := filepath.Walk(st.Path, func(objectPath string, filesystemObjectInfo os.FileInfo, err error) error {
+		if err != nil {
+			return trace.Wrap(err, "failed to walk dir %q", objectPath)
+		}
+
+		// Skip the root path
+		if objectPath == st.Path {
+			return nil
+		}
+
+		filesystemObjectHeader, err := st.getTarHeaderForFSObject(objectPath, filesystemObjectInfo)
+		if err != nil {
+			return trace.Wrap(err, "failed to create tar header for %q", objectPath)
+		}
+
+		return handler(objectPath, filesystemObjectInfo, filesystemObjectHeader)
+	})
+	if err != nil {
+		return trace.Wrap(err, "failed to walk over source tree %q", st.Path)
+	}
+
+	return nil
+}
+
+func (st *SourceTree) getTarHeaderForFSObject(objectPath string, filesystemObjectInfo os.FileInfo) (*tar.Header, error) {
+	linkTarget, err := getTarHeaderLinkTarget(objectPath, filesystemObjectInfo)
+	if err != nil {
+		return nil, trace.Wrap(err, "failure to get link target for %q", objectPath)
+	}
+
+	filesystemObjectHeader, err := tar.FileInfoHeader(filesystemObjectInfo, linkTarget)
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to create tar header for %q", objectPath)
+	}
+
+	relativePath := strings.TrimPrefix(objectPath, st.Path)
+	relativePath = strings.TrimPrefix(relativePath, "/")
+
+	filesystemObjectHeader.Name = relativePath
+
+	if st.ShouldResetOwner {
+		filesystemObjectHeader.Uid = 0
+		filesystemObjectHeader.Gid = 0
+		filesystemObjectHeader.Uname = "root"
+		filesystemObjectHeader.Gname = "root"
+	}
+
+	return filesystemObjectHeader, nil
+}
+
+func getTarHeaderLinkTarget(path string, filesystemObjectInfo os.FileInfo) (string, error) {
+	// If not a symlink, return an empty string
+	if filesystemObjectInfo.Mode()&os.ModeSymlink == 0 {
+		return "", nil
+	}
+
+	// Get the target listed for the symbolic link, but do not resolve the target
+	linkTarget, err := os.Readlink(path)
+	if err != nil {
+		return "", trace.Wrap(err, "failed to read link %q", path)
+	}
+
+	return linkTarget, nil
+}
+
+func copyFileToArchive(path string, filesystemObjectInfo os.FileInfo, archiveWriter io.Writer) error {
+	// Only regular files have content that needs to be copied
+	if !filesystemObjectInfo.Mode().IsRegular() {
+		return nil
+	}
+
+	fileHandle, err := os.Open(path)
+	defer utils.Close(fileHandle, &err)
+	if err != nil {
+		return trace.Wrap(err, "failed to open %q", path)
+	}
+
+	_, err = io.Copy(archiveWriter, fileHandle)
+	if err != nil {
+		return trace.Wrap(err, "failed to copy file %q to archive", path)
+	}
+
+	return nil
+}
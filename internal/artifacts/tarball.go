@@ -2,6 +2,7 @@ package artifacts
 
 import (
 	"archive/tar"
+	"bufio"
 	"compress/gzip"
 	"context"
 	"errors"
@@ -10,11 +11,8 @@ import (
 	"io/fs"
 	"log/slog"
 	"path"
-	"strings"
-	"syscall"
 
 	"os"
-	"path/filepath"
 
 	"github.com/google/uuid"
 	"github.com/gravitational/trace"
@@ -39,11 +37,45 @@ func (t Tarball) Install(ctx context.Context, options *InstallOptions) error {
 		return trace.Wrap(err, "failed to ensure that install path %q exists", options.InstallPath)
 	}
 
+	manifest, pathViolations, err := t.buildManifest(options.SourcePath, options.PackageName)
+	if err != nil {
+		return trace.Wrap(err, "failed to build manifest for tarball %q", options.SourcePath)
+	}
+
+	err = pathViolations.Check()
+	if err != nil {
+		return trace.Wrap(err, "tarball %q contains entries that would be written outside of %q", options.SourcePath, options.InstallPath)
+	}
+
+	database := NewPackageDatabase(options.InstallPath)
+	err = database.Load()
+	if err != nil {
+		return trace.Wrap(err, "failed to load installed package database from %q", options.InstallPath)
+	}
+
+	err = database.FindConflicts(manifest).Check(options.AllowedOverwrites)
+	if err != nil {
+		return trace.Wrap(err, "package %q conflicts with installed packages", manifest.Name)
+	}
+
 	err = t.extractFilesFromTarball(options.SourcePath, options.InstallPath)
 	if err != nil {
 		return trace.Wrap(err, "failed to extract files from tarball %q to destination base path %q", options.SourcePath, options.InstallPath)
 	}
 
+	err = database.Record(manifest)
+	if err != nil {
+		return trace.Wrap(err, "failed to record installed files for package %q", manifest.Name)
+	}
+
+	kernelReleasesToIndex := getKernelReleasesToIndex(manifest, database)
+	if len(kernelReleasesToIndex) > 0 {
+		err = updateKernelModuleIndexes(database, kernelReleasesToIndex)
+		if err != nil {
+			return trace.Wrap(err, "failed to update kernel module indexes for package %q", manifest.Name)
+		}
+	}
+
 	return nil
 }
 
@@ -69,32 +101,61 @@ func (t *Tarball) validateInstallOptions(options *InstallOptions) error {
 		options.InstallPath = "/"
 	}
 
+	if options.PackageName == "" {
+		options.PackageName = GetPackageNameFromFilePath(options.SourcePath)
+	}
+
 	return nil
 }
 
-func (t *Tarball) extractFilesFromTarball(tarballPath, destinationBasePath string) error {
+// Read the entire tarball, recording every entry along with file content hashes, and any
+// entries that would escape the install path
+func (t *Tarball) buildManifest(tarballPath, packageName string) (*PackageManifest, PathViolations, error) {
+	manifest := NewPackageManifest(packageName)
+	var pathViolations PathViolations
+	err := readTarball(tarballPath, func(header *tar.Header, tarReader *tar.Reader) error {
+		entryViolations := FindPathViolations(header)
+		if len(entryViolations) > 0 {
+			pathViolations = append(pathViolations, entryViolations...)
+			return nil
+		}
+
+		err := manifest.AddTarEntry(header, tarReader)
+		if err != nil {
+			return trace.Wrap(err, "failed to add %q to manifest", header.Name)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, nil, trace.Wrap(err, "failed to read entries from %q", tarballPath)
+	}
+
+	return manifest, pathViolations, nil
+}
+
+func readTarball(tarballPath string, entryHandler func(*tar.Header, *tar.Reader) error) error {
 	fileHandle, err := os.Open(tarballPath)
 	defer utils.Close(fileHandle, &err)
 	if err != nil {
 		return trace.Wrap(err, "failed to open source path %q for reading", tarballPath)
 	}
 
-	gzipReader, err := gzip.NewReader(fileHandle)
-	defer utils.Close(gzipReader, &err)
-	if err != nil {
-		return trace.Wrap(err, "failed to create a new gzip reader for %q", tarballPath)
-	}
+	// Tarballs produced by other tools (i.e. data.tar from a deb) may not be compressed
+	bufferedReader := bufio.NewReader(fileHandle)
+	var archiveReader io.Reader = bufferedReader
+	if isGzipStream(bufferedReader) {
+		var gzipReader *gzip.Reader
+		gzipReader, err = gzip.NewReader(bufferedReader)
+		defer utils.Close(gzipReader, &err)
+		if err != nil {
+			return trace.Wrap(err, "failed to create a new gzip reader for %q", tarballPath)
+		}
 
-	tarReader := tar.NewReader(gzipReader)
-	err = t.extractFilesFromArchive(tarReader, destinationBasePath)
-	if err != nil {
-		return trace.Wrap(err, "failed to extract archive to %q", destinationBasePath)
+		archiveReader = gzipReader
 	}
 
-	return nil
-}
-
-func (t *Tarball) extractFilesFromArchive(tarReader *tar.Reader, destinationBasePath string) error {
+	tarReader := tar.NewReader(archiveReader)
 	for {
 		header, err := tarReader.Next()
 		if err != nil {
@@ -107,38 +168,84 @@ func (t *Tarball) extractFilesFromArchive(tarReader *tar.Reader, destinationBase
 		}
 
 		if header == nil {
-			return trace.Errorf("encountered empty tar header while extracting source file")
+			return trace.Errorf("encountered empty tar header while reading source file")
 		}
 
-		err = t.extractFilesystemObject(header, tarReader, destinationBasePath)
+		err = entryHandler(header, tarReader)
+		if err != nil {
+			return trace.Wrap(err, "failed to handle tar entry %q", header.Name)
+		}
+	}
+}
+
+func isGzipStream(reader *bufio.Reader) bool {
+	magicBytes, err := reader.Peek(2)
+	if err != nil {
+		return false
+	}
+
+	return magicBytes[0] == 0x1f && magicBytes[1] == 0x8b
+}
+
+func (t *Tarball) extractFilesFromTarball(tarballPath, destinationBasePath string) error {
+	root, err := utils.OpenRootedDirectory(destinationBasePath)
+	defer utils.Close(root, &err)
+	if err != nil {
+		return trace.Wrap(err, "failed to open destination base path %q", destinationBasePath)
+	}
+
+	err = readTarball(tarballPath, func(header *tar.Header, tarReader *tar.Reader) error {
+		err := t.extractFilesystemObject(header, tarReader, root)
 		if err != nil {
 			return trace.Wrap(err, "failed to extract filesystem object to %q", destinationBasePath)
 		}
+
+		return nil
+	})
+	if err != nil {
+		return trace.Wrap(err, "failed to extract archive to %q", destinationBasePath)
 	}
+
+	return nil
 }
 
-func (t *Tarball) extractFilesystemObject(header *tar.Header, tarReader *tar.Reader, destinationBasePath string) error {
+// All writes are confined to the root directory. Entry names are expected to have been checked
+// for path violations prior to extraction, but any that slip through will still be resolved
+// within the root.
+func (t *Tarball) extractFilesystemObject(header *tar.Header, tarReader *tar.Reader, root *utils.RootedDirectory) error {
 	switch header.Typeflag {
 	case tar.TypeReg:
-		err := t.extractFile(header, tarReader, destinationBasePath)
+		err := t.extractFile(header, tarReader, root)
 		if err != nil {
 			return trace.Wrap(err, "failed to extract file %q", header.Name)
 		}
 
 	case tar.TypeSymlink:
-		err := t.extractSymlink(header, destinationBasePath)
+		err := t.extractSymlink(header, root)
 		if err != nil {
 			return trace.Wrap(err, "failed to extract symlink %q", header.Name)
 		}
 
-	case tar.TypeChar:
-		err := t.extractCharacterFile(header, destinationBasePath)
+	case tar.TypeLink:
+		err := t.extractHardLink(header, root)
+		if err != nil {
+			return trace.Wrap(err, "failed to extract hard link %q", header.Name)
+		}
+
+	case tar.TypeChar, tar.TypeBlock:
+		err := t.extractDeviceFile(header, root)
 		if err != nil {
-			return trace.Wrap(err, "failed to extract character file %q", header.Name)
+			return trace.Wrap(err, "failed to extract device file %q", header.Name)
+		}
+
+	case tar.TypeFifo:
+		err := t.extractFifo(header, root)
+		if err != nil {
+			return trace.Wrap(err, "failed to extract FIFO %q", header.Name)
 		}
 
 	case tar.TypeDir:
-		err := t.extractDirectory(header, destinationBasePath)
+		err := t.extractDirectory(header, root)
 		if err != nil {
 			return trace.Wrap(err, "failed to extract directory %q", header.Name)
 		}
@@ -150,134 +257,139 @@ func (t *Tarball) extractFilesystemObject(header *tar.Header, tarReader *tar.Rea
 	return nil
 }
 
-func (t *Tarball) extractFile(header *tar.Header, tarReader *tar.Reader, destinationBasePath string) error {
-	outputFilePath := path.Join(destinationBasePath, header.Name)
+func (t *Tarball) extractFile(header *tar.Header, tarReader *tar.Reader, root *utils.RootedDirectory) error {
 	fileInfo := header.FileInfo()
 	fileMode := fileInfo.Mode()
 
-	outputFileHandle, err := os.OpenFile(outputFilePath, os.O_CREATE|os.O_WRONLY, fileMode)
+	// Remove any existing file first so that a pre-existing symlink is replaced rather than followed,
+	// and so that the new contents are not written on top of old contents
+	err := root.RemoveNonDirectory(header.Name)
+	if err != nil {
+		return trace.Wrap(err, "failed to remove pre-existing file at %q", header.Name)
+	}
+
+	outputFileHandle, err := root.OpenFile(header.Name, os.O_CREATE|os.O_EXCL|os.O_WRONLY|unix.O_NOFOLLOW, fileMode)
 	defer utils.Close(outputFileHandle, &err)
 	if err != nil {
-		return trace.Wrap(err, "failed to open %q for writing", outputFilePath)
+		return trace.Wrap(err, "failed to open %q for writing", header.Name)
 	}
 
 	copyByteCount, err := io.Copy(outputFileHandle, tarReader)
 	if err != nil {
-		return trace.Wrap(err, "an error occured while extracting %q to %q", header.Name, outputFilePath)
+		return trace.Wrap(err, "an error occured while extracting %q", header.Name)
 	}
 
 	fileSize := fileInfo.Size()
 	if copyByteCount != fileSize {
-		return trace.Errorf("failed to extract %q to %q, expected %d bytes, wrote %d", header.Name, outputFilePath, fileSize, copyByteCount)
+		return trace.Errorf("failed to extract %q, expected %d bytes, wrote %d", header.Name, fileSize, copyByteCount)
 	}
 
-	err = t.updateOwnerAndPerms(header, outputFilePath)
+	err = t.updateOwnerAndPerms(header, root)
 	if err != nil {
-		return trace.Wrap(err, "failed to update ownership and permissions of %q", outputFilePath)
+		return trace.Wrap(err, "failed to update ownership and permissions of %q", header.Name)
 	}
 
 	return nil
 }
 
-func (t *Tarball) extractSymlink(header *tar.Header, destinationBasePath string) error {
-	outputFilePath := path.Join(destinationBasePath, header.Name)
-
-	err := os.Symlink(header.Linkname, outputFilePath)
-	if err == nil {
-		return nil
-	}
-
-	if !isSymlinkExistError(err) {
-		return trace.Wrap(err, "failed to create symlink %q to %q", outputFilePath, header.Linkname)
-	}
-
-	// Attempt to remove the file and recreate
-	// This is not attmepted on every file to reduce the number of stat syscalls
-	err = os.Remove(outputFilePath)
+func (t *Tarball) extractSymlink(header *tar.Header, root *utils.RootedDirectory) error {
+	// Attempt to remove the file and recreate, as symlinks cannot be updated in place
+	err := root.RemoveNonDirectory(header.Name)
 	if err != nil {
-		return trace.Wrap(err, "failed to remove pre-existing symlink at %q", outputFilePath)
+		return trace.Wrap(err, "failed to remove pre-existing file at %q", header.Name)
 	}
 
-	err = os.Symlink(header.Linkname, outputFilePath)
+	err = root.Symlink(header.Linkname, header.Name)
 	if err != nil {
-		return trace.Wrap(err, "failed to create symlink %q to %q after removing pre-existing file at %q[1]", outputFilePath, header.Linkname)
+		return trace.Wrap(err, "failed to create symlink %q to %q", header.Name, header.Linkname)
 	}
 
 	return nil
 }
 
-func (t *Tarball) extractCharacterFile(header *tar.Header, destinationBasePath string) error {
-	outputFilePath := path.Join(destinationBasePath, header.Name)
-
-	doesExist, err := utils.DoesFilesystemPathExist(outputFilePath)
+// The link target is an earlier entry in the tarball, so its ownership and permissions have
+// already been set
+func (t *Tarball) extractHardLink(header *tar.Header, root *utils.RootedDirectory) error {
+	err := root.RemoveNonDirectory(header.Name)
 	if err != nil {
-		return trace.Wrap(err, "failed to check if character file exists at %q", outputFilePath)
+		return trace.Wrap(err, "failed to remove pre-existing file at %q", header.Name)
 	}
 
-	if doesExist {
-		err = os.Remove(outputFilePath)
-		if err != nil {
-			return trace.Wrap(err, "failed to remove character file at %q", outputFilePath)
-		}
+	err = root.Link(header.Linkname, header.Name)
+	if err != nil {
+		return trace.Wrap(err, "failed to create hard link %q to %q", header.Name, header.Linkname)
 	}
 
+	return nil
+}
+
+func (t *Tarball) extractDeviceFile(header *tar.Header, root *utils.RootedDirectory) error {
 	// These reductions in var sizes are not great, but there's nothing I can do about them
-	devNumber := unix.Mkdev(uint32(header.Devmajor), uint32(header.Devminor))
-	err = syscall.Mknod(outputFilePath, uint32(syscall.S_IFCHR|header.FileInfo().Mode()&fs.ModePerm), int(devNumber))
+	err := root.CreateDeviceNode(&utils.DeviceNode{
+		Path:          header.Name,
+		IsBlockDevice: header.Typeflag == tar.TypeBlock,
+		Permissions:   header.FileInfo().Mode() & fs.ModePerm,
+		Major:         uint32(header.Devmajor),
+		Minor:         uint32(header.Devminor),
+	})
 	if err != nil {
-		return trace.Wrap(err, "failed to create device node at %q for device number %d:%d", outputFilePath, header.Devmajor, header.Devminor)
+		return trace.Wrap(err, "failed to create device node at %q for device number %d:%d", header.Name, header.Devmajor, header.Devminor)
 	}
 
-	err = t.updateOwnerAndPerms(header, outputFilePath)
+	err = t.updateOwnerAndPerms(header, root)
 	if err != nil {
-		return trace.Wrap(err, "failed to update ownership and permissions of %q", outputFilePath)
+		return trace.Wrap(err, "failed to update ownership and permissions of %q", header.Name)
 	}
 
 	return nil
 }
 
-func (t *Tarball) extractDirectory(header *tar.Header, destinationBasePath string) error {
-	outputFilePath := path.Join(destinationBasePath, header.Name)
-	fileMode := header.FileInfo().Mode()
+func (t *Tarball) extractFifo(header *tar.Header, root *utils.RootedDirectory) error {
+	err := root.RemoveNonDirectory(header.Name)
+	if err != nil {
+		return trace.Wrap(err, "failed to remove pre-existing file at %q", header.Name)
+	}
 
-	err := os.MkdirAll(outputFilePath, fileMode)
+	err = root.Mknod(header.Name, unix.S_IFIFO|utils.GetSyscallMode(header.FileInfo().Mode()&fs.ModePerm), 0, 0)
 	if err != nil {
-		return trace.Wrap(err, "failed to create %q", outputFilePath)
+		return trace.Wrap(err, "failed to create FIFO at %q", header.Name)
 	}
 
-	err = t.updateOwnerAndPerms(header, outputFilePath)
+	err = t.updateOwnerAndPerms(header, root)
 	if err != nil {
-		return trace.Wrap(err, "failed to update ownership and permissions of %q", outputFilePath)
+		return trace.Wrap(err, "failed to update ownership and permissions of %q", header.Name)
 	}
 
 	return nil
 }
 
-func isSymlinkExistError(err error) bool {
-	linkErr, ok := err.(*os.LinkError)
-	if !ok {
-		return false
+func (t *Tarball) extractDirectory(header *tar.Header, root *utils.RootedDirectory) error {
+	fileMode := header.FileInfo().Mode()
+
+	err := root.MkdirAll(header.Name, fileMode)
+	if err != nil {
+		return trace.Wrap(err, "failed to create %q", header.Name)
 	}
 
-	syscallErrNumber, ok := linkErr.Err.(syscall.Errno)
-	if !ok {
-		return false
+	err = t.updateOwnerAndPerms(header, root)
+	if err != nil {
+		return trace.Wrap(err, "failed to update ownership and permissions of %q", header.Name)
 	}
 
-	return errors.Is(syscallErrNumber, syscall.EEXIST)
+	return nil
 }
 
-func (t *Tarball) updateOwnerAndPerms(header *tar.Header, outputFilePath string) error {
+func (t *Tarball) updateOwnerAndPerms(header *tar.Header, root *utils.RootedDirectory) error {
 	fileMode := header.FileInfo().Mode()
-	err := os.Chmod(outputFilePath, fileMode)
+	err := root.Chmod(header.Name, fileMode)
 	if err != nil {
-		return trace.Wrap(err, "failed to update file permissions on %q to %o", outputFilePath, fileMode)
+		return trace.Wrap(err, "failed to update file permissions on %q to %o", header.Name, fileMode)
 	}
 
 	if !t.ShouldResetOwner {
-		err = os.Chown(outputFilePath, header.Uid, header.Gid)
+		err = root.Lchown(header.Name, header.Uid, header.Gid)
 		if err != nil {
-			return trace.Wrap(err, "failed to set ownership of %q to %d:%d", outputFilePath, header.Uid, header.Gid)
+			return trace.Wrap(err, "failed to set ownership of %q to %d:%d", header.Name, header.Uid, header.Gid)
 		}
 	}
 
@@ -316,29 +428,24 @@ func (t *Tarball) Package(ctx context.Context) (string, error) {
 }
 
 func (t *Tarball) addFilesToArchive(archiveWriter *tar.Writer) error {
-	err := filepath.Walk(t.SourcePath, func(path string, filesystemObjectInfo os.FileInfo, err error) error {
-		if err != nil {
-			return trace.Wrap(err, "failed to walk dir %q", path)
-		}
-
-		// Skip the root path
-		if path == t.SourcePath {
-			return nil
-		}
+	sourceTree := &SourceTree{
+		Path:             t.SourcePath,
+		ShouldResetOwner: t.ShouldResetOwner,
+	}
 
-		slog.Debug("adding file to archive", "file_path", path)
-		filesystemObjectHeader, err := t.getTarHeaderForFSObject(path, filesystemObjectInfo)
+	err := sourceTree.Walk(func(objectPath string, filesystemObjectInfo os.FileInfo, filesystemObjectHeader *tar.Header) error {
+		slog.Debug("adding file to archive", "file_path", objectPath)
 
 		// Write the header to the archive
-		err = archiveWriter.WriteHeader(filesystemObjectHeader)
+		err := archiveWriter.WriteHeader(filesystemObjectHeader)
 		if err != nil {
-			return trace.Wrap(err, "failed to write tar header for %q", path)
+			return trace.Wrap(err, "failed to write tar header for %q", objectPath)
 		}
 
 		// Copy the file cotnent to the archive
-		err = t.copyFileToArchive(path, filesystemObjectInfo, archiveWriter)
+		err = copyFileToArchive(objectPath, filesystemObjectInfo, archiveWriter)
 		if err != nil {
-			return trace.Wrap(err, "failed to copy %q to archive", path)
+			return trace.Wrap(err, "failed to copy %q to archive", objectPath)
 		}
 
 		return nil
@@ -351,75 +458,6 @@ func (t *Tarball) addFilesToArchive(archiveWriter *tar.Writer) error {
 	return nil
 }
 
-func (t *Tarball) copyFileToArchive(path string, filesystemObjectInfo os.FileInfo, archiveWriter *tar.Writer) error {
-	// Regular files don't need to be copied
-	if !filesystemObjectInfo.Mode().IsRegular() {
-		return nil
-	}
-
-	fileHandle, err := os.Open(path)
-	defer func() {
-		if fileHandle != nil {
-			closeErr := fileHandle.Close()
-			if closeErr == nil || err != nil {
-				return
-			}
-			err = trace.Wrap(err, "failed to close file handle")
-		}
-	}()
-	if err != nil {
-		return trace.Wrap(err, "failed to open %q", path)
-	}
-
-	_, err = io.Copy(archiveWriter, fileHandle)
-	if err != nil {
-		return trace.Wrap(err, "failed to copy file %q to archive", path)
-	}
-
-	return nil
-}
-
-func (t *Tarball) getTarHeaderForFSObject(objectPath string, filesystemObjectInfo os.FileInfo) (*tar.Header, error) {
-	linkTarget, err := t.getTarHeaderLinkTarget(objectPath, filesystemObjectInfo)
-	if err != nil {
-		return nil, trace.Wrap(err, "failure to get link target for %q", objectPath)
-	}
-
-	filesystemObjectHeader, err := tar.FileInfoHeader(filesystemObjectInfo, linkTarget)
-	if err != nil {
-		return nil, trace.Wrap(err, "failed to create tar header for %q", t.SourcePath)
-	}
-
-	relativePath := strings.TrimPrefix(objectPath, t.SourcePath)
-	relativePath = strings.TrimPrefix(relativePath, "/")
-
-	filesystemObjectHeader.Name = relativePath
-
-	if t.ShouldResetOwner {
-		filesystemObjectHeader.Uid = 0
-		filesystemObjectHeader.Gid = 0
-		filesystemObjectHeader.Uname = "root"
-		filesystemObjectHeader.Gname = "root"
-	}
-
-	return filesystemObjectHeader, nil
-}
-
-func (t *Tarball) getTarHeaderLinkTarget(path string, filesystemObjectInfo os.FileInfo) (string, error) {
-	// If not a symlink, return an empty string
-	if filesystemObjectInfo.Mode()&os.ModeSymlink == 0 {
-		return "", nil
-	}
-
-	// Get the target listed for the symbolic link, but do not resolve the target
-	linkTarget, err := os.Readlink(path)
-	if err != nil {
-		return "", trace.Wrap(err, "failed to read link %q", path)
-	}
-
-	return linkTarget, nil
-}
-
 func (t *Tarball) SetOutputFilePath(outputFilePath string) {
 	t.OutputPath = outputFilePath
 }
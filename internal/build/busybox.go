@@ -1,20 +1,98 @@
 package build
 
 import (
+	"context"
 	"fmt"
+	"log/slog"
+	"os"
 	"path"
+	"path/filepath"
+	"slices"
+	"strings"
 
 	"github.com/gravitational/trace"
+	"github.com/otiai10/copy"
 	"github.com/solidDoWant/distrobuilder/internal/runners"
 	"github.com/solidDoWant/distrobuilder/internal/runners/args"
 	"github.com/solidDoWant/distrobuilder/internal/source"
 	git_source "github.com/solidDoWant/distrobuilder/internal/source/git"
 	"github.com/solidDoWant/distrobuilder/internal/utils"
+	"golang.org/x/exp/maps"
 )
 
+// Initial mount and service startup, ran by init once at boot
+const busyBoxRCSScript = `#!/bin/sh
+# Generated from the configured BusyBox applets
+
+is_mounted() {
+	grep -q " $1 " /proc/mounts 2>/dev/null
+}
+
+# These may have already been moved from the initramfs
+is_mounted /proc || mount -t proc proc /proc
+is_mounted /sys || mount -t sysfs sysfs /sys
+is_mounted /dev || mount -t devtmpfs devtmpfs /dev
+is_mounted /run || mount -t tmpfs -o mode=0755,nosuid,nodev tmpfs /run
+
+# /tmp, /var/lock and /dev/shm are links into /run
+mkdir -p -m 1777 /run/lock /run/shm /run/tmp
+mkdir -p /dev/pts
+is_mounted /dev/pts || mount -t devpts devpts /dev/pts
+
+[ -f /etc/fstab ] && mount -a
+[ -f /etc/hostname ] && hostname -F /etc/hostname
+%s
+for script in /etc/init.d/S??*; do
+	[ -x "$script" ] && "$script" start
+done
+`
+
+// Hotplug device node handling, appended to rcS when mdev is available
+const busyBoxRCSMdevCommands = `
+echo /sbin/mdev > /proc/sys/kernel/hotplug
+mdev -s
+`
+
+// Installed to /etc/profile.d rather than /etc/profile so that other packages can add their own settings
+const busyBoxProfile = `# Generated from the configured BusyBox applets
+if [ "$(id -u)" -eq 0 ]; then
+	PS1='\h:\w# '
+else
+	PS1='\h:\w$ '
+fi
+export PS1
+`
+
+// Device node permissions, in the format <device regex> <uid>:<gid> <permissions> [command]
+const busyBoxMdevConfig = `# Generated from the configured BusyBox applets
+null        0:0 666
+zero        0:0 666
+full        0:0 666
+random      0:0 444
+urandom     0:0 444
+console     0:0 600
+kmsg        0:0 640
+mem         0:0 640
+ptmx        0:0 666
+tty         0:0 666
+tty[0-9]*   0:0 620
+ttyS[0-9]*  0:0 660
+loop[0-9]*  0:0 660
+sd[a-z].*   0:0 660
+vd[a-z].*   0:0 660
+nvme.*      0:0 660
+mmcblk.*    0:0 660
+`
+
+// Load drivers for new devices, appended to the mdev config when modprobe is available
+const busyBoxMdevModprobeRule = `$MODALIAS=.* 0:0 660 @modprobe -q "$MODALIAS"
+`
+
 type BusyBox struct {
 	StandardBuilder
 	KconfigBuilder
+
+	applets map[string]string // Applet name to installed link path, relative to the output directory
 }
 
 func NewBusyBox() *BusyBox {
@@ -22,8 +100,10 @@ func NewBusyBox() *BusyBox {
 		StandardBuilder: StandardBuilder{
 			Name: "busybox",
 			BinariesToCheck: []string{
-				path.Join("bin", "busybox"),
+				path.Join("usr", "bin", "busybox"),
 			},
+			// CONFIG_PIE is disabled in the default config
+			AllowNonPIEExecutables: true,
 		},
 	}
 
@@ -60,6 +140,26 @@ func (bb *BusyBox) DoConfiguration(buildDirectoryPath string) error {
 		return trace.Wrap(err, "failed to copy and update the kconfig")
 	}
 
+	err = bb.ResolveKconfig(buildDirectoryPath, func() error {
+		makeOptions, err := bb.getMakeOptions()
+		if err != nil {
+			return trace.Wrap(err, "failed to build make options")
+		}
+
+		// BusyBox's kconfig predates olddefconfig, so accept the default for every new symbol instead
+		_, err = runners.Run(&runners.Make{
+			GenericRunner: bb.getGenericRunner(buildDirectoryPath),
+			Path:          ".",
+			Targets:       []string{"oldconfig"},
+			Options:       makeOptions,
+			StdinReader:   newlineReader{},
+		})
+		return trace.Wrap(err, "failed to run oldconfig")
+	})
+	if err != nil {
+		return trace.Wrap(err, "failed to resolve the merged kconfig")
+	}
+
 	return nil
 }
 
@@ -69,9 +169,185 @@ func (bb *BusyBox) DoBuild(buildDirectoryPath string) error {
 		return trace.Wrap(err, "failed to build make options")
 	}
 
-	err = bb.MakeBuild(buildDirectoryPath, makeOptions, "all", "install")
+	// The install target is not used as it installs to /bin and /sbin, which are links to /usr
+	// in the root filesystem
+	err = bb.MakeBuild(buildDirectoryPath, makeOptions, "all", "busybox.links")
+	if err != nil {
+		return trace.Wrap(err, "failed to build %s", bb.Name)
+	}
+
+	err = bb.installApplets(buildDirectoryPath)
+	if err != nil {
+		return trace.Wrap(err, "failed to install %s applets", bb.Name)
+	}
+
+	err = bb.installInitConfiguration()
+	if err != nil {
+		return trace.Wrap(err, "failed to install init configuration")
+	}
+
+	return nil
+}
+
+// Install the binary, along with a link for each configured applet. The applet list is also
+// written to the output so that other tools can tell what is provided by BusyBox.
+func (bb *BusyBox) installApplets(buildDirectoryPath string) error {
+	binaryPath := path.Join("usr", "bin", "busybox")
+	err := copy.Copy(path.Join(buildDirectoryPath, "busybox"), path.Join(bb.OutputDirectoryPath, binaryPath), copy.Options{PermissionControl: copy.PerservePermission})
+	if err != nil {
+		return trace.Wrap(err, "failed to install the %s binary", bb.Name)
+	}
+
+	appletsFilePath := path.Join(buildDirectoryPath, "busybox.links")
+	appletsFileContents, err := os.ReadFile(appletsFilePath)
+	if err != nil {
+		return trace.Wrap(err, "failed to read applet list %q", appletsFilePath)
+	}
+
+	bb.applets = map[string]string{}
+	for _, appletPath := range strings.Fields(string(appletsFileContents)) {
+		linkPath := getMergedUsrPath(appletPath)
+		if linkPath == binaryPath {
+			continue
+		}
+
+		linkDirectoryPath := path.Join(bb.OutputDirectoryPath, path.Dir(linkPath))
+		err := os.MkdirAll(linkDirectoryPath, 0755)
+		if err != nil {
+			return trace.Wrap(err, "failed to create applet directory %q", linkDirectoryPath)
+		}
+
+		linkTarget, err := filepath.Rel(path.Dir(linkPath), binaryPath)
+		if err != nil {
+			return trace.Wrap(err, "failed to get path of %q relative to %q", binaryPath, linkPath)
+		}
+
+		err = os.Symlink(linkTarget, path.Join(bb.OutputDirectoryPath, linkPath))
+		if err != nil {
+			return trace.Wrap(err, "failed to create applet link %q", linkPath)
+		}
+
+		bb.applets[path.Base(linkPath)] = linkPath
+	}
+
+	linkPaths := maps.Values(bb.applets)
+	slices.Sort(linkPaths)
+	appletListFilePath := path.Join("usr", "share", "busybox", "applets")
+	err = bb.WriteOutputFile(appletListFilePath, strings.Join(linkPaths, "\n")+"\n", 0644)
+	if err != nil {
+		return trace.Wrap(err, "failed to write applet list")
+	}
+
+	slog.Info("Installed BusyBox applets", "applet_count", len(bb.applets), "applet_list_path", appletListFilePath)
+	return nil
+}
+
+// Get the output path of a file when /bin, /sbin, and /lib are links to their /usr counterparts
+func getMergedUsrPath(filePath string) string {
+	filePath = strings.TrimPrefix(path.Clean(filePath), "/")
+	for _, mergedDirectory := range []string{"bin", "sbin", "lib"} {
+		if strings.HasPrefix(filePath, mergedDirectory+"/") {
+			return path.Join("usr", filePath)
+		}
+	}
+
+	return filePath
+}
+
+// Generate the files needed to boot into a usable system with BusyBox init, limited to what
+// the configured applets support
+func (bb *BusyBox) installInitConfiguration() error {
+	if bb.hasApplets("sh") {
+		err := bb.WriteOutputFile(path.Join("etc", "profile.d", "busybox.sh"), busyBoxProfile, 0644)
+		if err != nil {
+			return trace.Wrap(err, "failed to write profile")
+		}
+	}
+
+	if bb.hasApplets("mdev") {
+		mdevConfig := busyBoxMdevConfig
+		if bb.hasApplets("modprobe") {
+			mdevConfig += busyBoxMdevModprobeRule
+		}
+
+		err := bb.WriteOutputFile(path.Join("etc", "mdev.conf"), mdevConfig, 0644)
+		if err != nil {
+			return trace.Wrap(err, "failed to write mdev config")
+		}
+	}
+
+	if !bb.hasApplets("init", "sh", "mount", "mkdir", "grep") {
+		slog.Warn("Not generating init configuration as the applets required by it are not configured")
+		return nil
+	}
+
+	rcsMdevCommands := ""
+	if bb.hasApplets("mdev") {
+		rcsMdevCommands = busyBoxRCSMdevCommands
+	}
+
+	err := bb.WriteOutputFile(path.Join("etc", "init.d", "rcS"), fmt.Sprintf(busyBoxRCSScript, rcsMdevCommands), 0755)
+	if err != nil {
+		return trace.Wrap(err, "failed to write rcS")
+	}
+
+	err = bb.WriteOutputFile(path.Join("etc", "inittab"), bb.getInittab(), 0644)
+	if err != nil {
+		return trace.Wrap(err, "failed to write inittab")
+	}
+
+	return nil
+}
+
+func (bb *BusyBox) getInittab() string {
+	inittab := &strings.Builder{}
+	inittab.WriteString("# Generated from the configured BusyBox applets\n")
+	inittab.WriteString("::sysinit:/etc/init.d/rcS\n")
+
+	// Require a login when it is supported, otherwise prompt for a root shell
+	if bb.hasApplets("getty", "login") {
+		fmt.Fprintf(inittab, "::respawn:/%s -L 0 console vt100\n", bb.applets["getty"])
+	} else {
+		inittab.WriteString("::askfirst:-/bin/sh\n")
+	}
+
+	if bb.hasApplets("reboot") {
+		fmt.Fprintf(inittab, "::ctrlaltdel:/%s\n", bb.applets["reboot"])
+	}
+
+	if bb.hasApplets("swapoff") {
+		fmt.Fprintf(inittab, "::shutdown:/%s -a\n", bb.applets["swapoff"])
+	}
+
+	if bb.hasApplets("umount") {
+		fmt.Fprintf(inittab, "::shutdown:/%s -a -r\n", bb.applets["umount"])
+	}
+
+	fmt.Fprintf(inittab, "::restart:/%s\n", bb.applets["init"])
+	return inittab.String()
+}
+
+func (bb *BusyBox) hasApplets(appletNames ...string) bool {
+	for _, appletName := range appletNames {
+		if _, ok := bb.applets[appletName]; !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (bb *BusyBox) VerifyBuild(ctx context.Context) error {
+	err := bb.StandardBuilder.VerifyBuild(ctx)
 	if err != nil {
-		return trace.Wrap(err, "failed to build and install %s", bb.Name)
+		return trace.Wrap(err)
+	}
+
+	for appletName, linkPath := range bb.applets {
+		_, err := os.Stat(path.Join(bb.OutputDirectoryPath, linkPath))
+		if err != nil {
+			return trace.Wrap(err, "link for applet %q at %q does not resolve to the BusyBox binary", appletName, linkPath)
+		}
 	}
 
 	return nil
@@ -0,0 +1,130 @@
+package build
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/gravitational/trace"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	cpioNewcMagic   = "070701"
+	cpioTrailerName = "TRAILER!!!"
+)
+
+// Writes archives in the "newc" (SVR4 without CRC) cpio format, which is the only format
+// that the Linux kernel accepts for an initramfs.
+type cpioWriter struct {
+	writer       io.Writer
+	nextInode    uint32
+	bytesWritten int64
+}
+
+type cpioEntry struct {
+	Name      string // Path relative to the archive root, without a leading "/"
+	Mode      uint32 // File type and permission bits, i.e. unix.S_IFREG | 0755
+	UID       uint32
+	GID       uint32
+	MTime     int64
+	Size      int64
+	RDevMajor uint32 // Only used by device nodes
+	RDevMinor uint32 // Only used by device nodes
+}
+
+func newCPIOWriter(writer io.Writer) *cpioWriter {
+	return &cpioWriter{
+		writer: writer,
+		// Inode 0 is avoided as some tools treat it as a special value
+		nextInode: 1,
+	}
+}
+
+// Write an entry to the archive. The contents reader must provide exactly entry.Size bytes,
+// and may be nil for entries without contents.
+func (cw *cpioWriter) WriteEntry(entry *cpioEntry, contents io.Reader) error {
+	nlink := uint32(1)
+	if entry.Mode&unix.S_IFMT == unix.S_IFDIR {
+		nlink = 2
+	}
+
+	err := cw.writeHeader(entry, cw.nextInode, nlink)
+	if err != nil {
+		return trace.Wrap(err, "failed to write header for %q", entry.Name)
+	}
+	cw.nextInode++
+
+	if entry.Size > 0 {
+		if contents == nil {
+			return trace.Errorf("no contents were provided for %q", entry.Name)
+		}
+
+		copiedBytes, err := io.CopyN(cw.writer, contents, entry.Size)
+		cw.bytesWritten += copiedBytes
+		if err != nil {
+			return trace.Wrap(err, "failed to write contents of %q", entry.Name)
+		}
+	}
+
+	err = cw.pad()
+	if err != nil {
+		return trace.Wrap(err, "failed to pad contents of %q", entry.Name)
+	}
+
+	return nil
+}
+
+// Write the trailer entry that marks the end of the archive
+func (cw *cpioWriter) Close() error {
+	err := cw.writeHeader(&cpioEntry{Name: cpioTrailerName}, 0, 1)
+	if err != nil {
+		return trace.Wrap(err, "failed to write archive trailer")
+	}
+
+	return nil
+}
+
+func (cw *cpioWriter) writeHeader(entry *cpioEntry, inode, nlink uint32) error {
+	// The name size includes the null terminator
+	header := fmt.Sprintf("%s%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%s\x00",
+		cpioNewcMagic,
+		inode,
+		entry.Mode,
+		entry.UID,
+		entry.GID,
+		nlink,
+		uint32(entry.MTime),
+		uint32(entry.Size),
+		0, // Device major
+		0, // Device minor
+		entry.RDevMajor,
+		entry.RDevMinor,
+		len(entry.Name)+1,
+		0, // Checksum, unused by the newc format
+		entry.Name,
+	)
+
+	writtenBytes, err := io.WriteString(cw.writer, header)
+	cw.bytesWritten += int64(writtenBytes)
+	if err != nil {
+		return trace.Wrap(err, "failed to write header")
+	}
+
+	// The header and name are padded to a multiple of four bytes
+	return trace.Wrap(cw.pad())
+}
+
+func (cw *cpioWriter) pad() error {
+	paddingSize := (4 - cw.bytesWritten%4) % 4
+	if paddingSize == 0 {
+		return nil
+	}
+
+	writtenBytes, err := cw.writer.Write(make([]byte, paddingSize))
+	cw.bytesWritten += int64(writtenBytes)
+	if err != nil {
+		return trace.Wrap(err, "failed to write padding")
+	}
+
+	return nil
+}
@@ -22,11 +22,11 @@ func NewDejaVuFonts() *DejaVuFonts {
 	instance := &DejaVuFonts{
 		StandardBuilder: StandardBuilder{
 			Name: "DejaVuFonts",
-			// BinariesToCheck: []string{
-			// path.Join("usr", "bin", "DejaVuFonts"),
-			// path.Join("usr", "bin", "unDejaVuFonts"),
-			// path.Join("usr", "lib", "libDejaVuFonts.so"),
-			// },
+			BinariesToCheck: []string{
+				path.Join("usr", "share", "fonts", "DejaVuSans.ttf"),
+				path.Join("usr", "share", "fonts", "DejaVuSansMono.ttf"),
+				path.Join("usr", "share", "fonts", "DejaVuSerif.ttf"),
+			},
 		},
 	}
 
@@ -0,0 +1,358 @@
+package build
+
+import (
+	"bytes"
+	"debug/elf"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/gravitational/trace"
+	"github.com/solidDoWant/distrobuilder/internal/utils"
+	"golang.org/x/exp/maps"
+	"golang.org/x/sys/unix"
+)
+
+// Loaded dynamic ELF file, either from the build output or the root filesystem
+type dynamicElfFile struct {
+	Path             string // Absolute path within the root filesystem
+	IsExecutable     bool   // True if the file has an interpreter, false for shared libraries
+	NeededLibraries  []string
+	SearchPaths      []string // Paths that the loader searches for needed libraries, in order
+	RawSearchPaths   []string // DT_RPATH and DT_RUNPATH entries, as they appear in the file
+	DefinedSymbols   map[string]struct{}
+	UndefinedSymbols []string // Strong references only, as weak references may be unresolved at runtime
+}
+
+// Checks that the dynamic dependencies of ELF files in a build output will resolve when installed
+// to the root filesystem
+type elfDependencyChecker struct {
+	outputRoot         *utils.RootedDirectory
+	rootFSRoot         *utils.RootedDirectory // nil if there is no root filesystem
+	forbiddenPathRoots []string               // Absolute host paths that search paths must not point into
+	loadedFiles        map[string]*dynamicElfFile
+}
+
+// Verify the dynamic dependencies of every ELF file in the output directory
+func (sb *StandardBuilder) VerifyElfDependencies() (err error) {
+	outputRoot, err := utils.OpenRootedDirectory(sb.OutputDirectoryPath)
+	if err != nil {
+		return trace.Wrap(err, "failed to open output directory %q", sb.OutputDirectoryPath)
+	}
+	defer utils.Close(outputRoot, &err)
+
+	checker := &elfDependencyChecker{
+		outputRoot:  outputRoot,
+		loadedFiles: map[string]*dynamicElfFile{},
+	}
+
+	// Build and output directories are created in the temp directory by default
+	for _, forbiddenPathRoot := range []string{os.TempDir(), sb.OutputDirectoryPath, sb.SourceDirectoryPath, sb.ToolchainPath, sb.RootFSDirectoryPath} {
+		if forbiddenPathRoot != "" && forbiddenPathRoot != "/" {
+			checker.forbiddenPathRoots = append(checker.forbiddenPathRoots, filepath.Clean(forbiddenPathRoot))
+		}
+	}
+
+	if sb.RootFSDirectoryPath != "" {
+		checker.rootFSRoot, err = utils.OpenRootedDirectory(sb.RootFSDirectoryPath)
+		if err != nil {
+			return trace.Wrap(err, "failed to open root filesystem directory %q", sb.RootFSDirectoryPath)
+		}
+		defer utils.Close(checker.rootFSRoot, &err)
+	}
+
+	err = checker.CheckDirectory(sb.OutputDirectoryPath)
+	if err != nil {
+		return trace.Wrap(err, "ELF dependency check failed for %s", sb.Name)
+	}
+
+	return nil
+}
+
+func (edc *elfDependencyChecker) CheckDirectory(directoryPath string) error {
+	var errs []error
+	err := filepath.WalkDir(directoryPath, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return trace.Wrap(err, "failed to walk %q", filePath)
+		}
+
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+
+		relativeFilePath, err := filepath.Rel(directoryPath, filePath)
+		if err != nil {
+			return trace.Wrap(err, "failed to get path of %q relative to %q", filePath, directoryPath)
+		}
+
+		file, err := edc.loadFile(edc.outputRoot, "/"+relativeFilePath)
+		if err != nil {
+			return trace.Wrap(err, "failed to load %q", relativeFilePath)
+		}
+
+		if file == nil {
+			return nil
+		}
+
+		errs = append(errs, edc.checkFile(file)...)
+		return nil
+	})
+	if err != nil {
+		return trace.Wrap(err, "failed to check ELF files in %q", directoryPath)
+	}
+
+	if len(errs) > 0 {
+		return trace.NewAggregate(errs...)
+	}
+
+	return nil
+}
+
+func (edc *elfDependencyChecker) checkFile(file *dynamicElfFile) []error {
+	var errs []error
+	for _, searchPath := range file.RawSearchPaths {
+		if reason := edc.getSearchPathViolation(searchPath); reason != "" {
+			errs = append(errs, trace.Errorf("%q has library search path %q, which %s", file.Path, searchPath, reason))
+		}
+	}
+
+	// Breadth first, matching the order that the loader searches for symbols
+	dependencies, unresolvedLibraries, err := edc.resolveDependencies(file)
+	if err != nil {
+		return append(errs, trace.Wrap(err, "failed to resolve dependencies of %q", file.Path))
+	}
+
+	for _, unresolvedLibrary := range unresolvedLibraries {
+		errs = append(errs, trace.Errorf("%q needs %q, which was not found in the build output or root filesystem", file.Path, unresolvedLibrary))
+	}
+
+	// Symbols cannot be reliably checked when libraries are missing
+	if len(unresolvedLibraries) > 0 {
+		return errs
+	}
+
+	var unresolvedSymbols []string
+	for _, symbolName := range file.UndefinedSymbols {
+		if !slices.ContainsFunc(dependencies, func(dependency *dynamicElfFile) bool {
+			_, ok := dependency.DefinedSymbols[symbolName]
+			return ok
+		}) {
+			unresolvedSymbols = append(unresolvedSymbols, symbolName)
+		}
+	}
+
+	if len(unresolvedSymbols) == 0 {
+		return errs
+	}
+
+	// Shared libraries may reference symbols from the executable that loads them, i.e. plugins
+	if !file.IsExecutable {
+		slog.Warn("Shared library has symbols that are not defined by its dependencies", "path", file.Path, "symbols", unresolvedSymbols)
+		return errs
+	}
+
+	return append(errs, trace.Errorf("%q has unresolved symbols %v", file.Path, unresolvedSymbols))
+}
+
+// Get the reason that a search path will not work when installed, or an empty string if it will
+func (edc *elfDependencyChecker) getSearchPathViolation(searchPath string) string {
+	if strings.HasPrefix(searchPath, "$ORIGIN") || strings.HasPrefix(searchPath, "${ORIGIN}") {
+		return ""
+	}
+
+	if !path.IsAbs(searchPath) {
+		return "is relative to the working directory"
+	}
+
+	cleanedSearchPath := path.Clean(searchPath)
+	for _, forbiddenPathRoot := range edc.forbiddenPathRoots {
+		if cleanedSearchPath == forbiddenPathRoot || strings.HasPrefix(cleanedSearchPath, forbiddenPathRoot+"/") {
+			return fmt.Sprintf("points into the build host path %q", forbiddenPathRoot)
+		}
+	}
+
+	return ""
+}
+
+// Find every library loaded along with the file, returning the names of any that could not be found
+func (edc *elfDependencyChecker) resolveDependencies(file *dynamicElfFile) ([]*dynamicElfFile, []string, error) {
+	var dependencies []*dynamicElfFile
+	var unresolvedLibraries []string
+	loadedPaths := map[string]struct{}{file.Path: {}}
+	queue := []*dynamicElfFile{file}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+
+		for _, libraryName := range current.NeededLibraries {
+			library, err := edc.findLibrary(current, libraryName)
+			if err != nil {
+				return nil, nil, trace.Wrap(err, "failed to find library %q needed by %q", libraryName, current.Path)
+			}
+
+			if library == nil {
+				if !slices.Contains(unresolvedLibraries, libraryName) {
+					unresolvedLibraries = append(unresolvedLibraries, libraryName)
+				}
+				continue
+			}
+
+			if _, ok := loadedPaths[library.Path]; ok {
+				continue
+			}
+			loadedPaths[library.Path] = struct{}{}
+
+			dependencies = append(dependencies, library)
+			queue = append(queue, library)
+		}
+	}
+
+	return dependencies, unresolvedLibraries, nil
+}
+
+// Search for the library in the file's search paths, then the standard paths. The build output is
+// searched first, as it will replace files in the root filesystem when installed.
+func (edc *elfDependencyChecker) findLibrary(neededBy *dynamicElfFile, libraryName string) (*dynamicElfFile, error) {
+	candidatePaths := []string{libraryName}
+	if !strings.Contains(libraryName, "/") {
+		candidatePaths = nil
+		for _, searchPath := range neededBy.SearchPaths {
+			candidatePaths = append(candidatePaths, path.Join(searchPath, libraryName))
+		}
+	}
+
+	for _, root := range []*utils.RootedDirectory{edc.outputRoot, edc.rootFSRoot} {
+		if root == nil {
+			continue
+		}
+
+		for _, candidatePath := range candidatePaths {
+			library, err := edc.loadFile(root, candidatePath)
+			if err != nil {
+				return nil, trace.Wrap(err, "failed to load %q", candidatePath)
+			}
+
+			if library != nil {
+				return library, nil
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+// Read the dynamic linking information from the file. Nil is returned if the file does not exist,
+// is not an ELF file, or is not dynamically linked.
+func (edc *elfDependencyChecker) loadFile(root *utils.RootedDirectory, filePath string) (*dynamicElfFile, error) {
+	cacheKey := root.Path + ":" + filePath
+	if file, ok := edc.loadedFiles[cacheKey]; ok {
+		return file, nil
+	}
+
+	file, err := readDynamicElfFile(root, filePath)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	edc.loadedFiles[cacheKey] = file
+	return file, nil
+}
+
+func readDynamicElfFile(root *utils.RootedDirectory, filePath string) (file *dynamicElfFile, err error) {
+	// Symlinks are followed within the root, as libraries are typically installed as a chain of links
+	fileHandle, err := root.OpenFile(filePath, os.O_RDONLY, 0)
+	if err != nil {
+		// A path component may be a file, rather than a directory
+		if errors.Is(err, unix.ENOENT) || errors.Is(err, unix.ENOTDIR) {
+			return nil, nil
+		}
+
+		return nil, trace.Wrap(err, "failed to open %q", filePath)
+	}
+	defer utils.Close(fileHandle, &err)
+
+	fileInfo, err := fileHandle.Stat()
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to stat %q", filePath)
+	}
+
+	if !fileInfo.Mode().IsRegular() {
+		return nil, nil
+	}
+
+	magic := make([]byte, len(elf.ELFMAG))
+	_, err = fileHandle.ReadAt(magic, 0)
+	if err != nil || !bytes.Equal(magic, []byte(elf.ELFMAG)) {
+		return nil, nil
+	}
+
+	elfFile, err := elf.NewFile(fileHandle)
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to parse ELF file %q", filePath)
+	}
+
+	// Objects and kernel modules are not loaded by the dynamic loader
+	if (elfFile.Type != elf.ET_EXEC && elfFile.Type != elf.ET_DYN) || elfFile.Section(".dynamic") == nil {
+		return nil, nil
+	}
+
+	file = &dynamicElfFile{
+		Path:           path.Clean("/" + filePath),
+		IsExecutable:   slices.ContainsFunc(elfFile.Progs, func(program *elf.Prog) bool { return program.Type == elf.PT_INTERP }),
+		DefinedSymbols: map[string]struct{}{},
+	}
+
+	file.NeededLibraries, err = elfFile.ImportedLibraries()
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to read needed libraries of %q", filePath)
+	}
+
+	for _, tag := range []elf.DynTag{elf.DT_RUNPATH, elf.DT_RPATH} {
+		values, err := elfFile.DynString(tag)
+		if err != nil {
+			return nil, trace.Wrap(err, "failed to read %s of %q", tag, filePath)
+		}
+
+		for _, value := range values {
+			file.RawSearchPaths = append(file.RawSearchPaths, strings.Split(value, ":")...)
+		}
+	}
+
+	file.SearchPaths, err = getLibrarySearchPaths(elfFile, file.Path[1:])
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to get library search paths of %q", filePath)
+	}
+
+	symbols, err := elfFile.DynamicSymbols()
+	if err != nil && !errors.Is(err, elf.ErrNoSymbols) {
+		return nil, trace.Wrap(err, "failed to read dynamic symbols of %q", filePath)
+	}
+
+	undefinedSymbols := map[string]struct{}{}
+	for _, symbol := range symbols {
+		binding := elf.ST_BIND(symbol.Info)
+		if symbol.Name == "" || binding == elf.STB_LOCAL {
+			continue
+		}
+
+		if symbol.Section != elf.SHN_UNDEF {
+			file.DefinedSymbols[symbol.Name] = struct{}{}
+			continue
+		}
+
+		if binding != elf.STB_WEAK {
+			undefinedSymbols[symbol.Name] = struct{}{}
+		}
+	}
+
+	file.UndefinedSymbols = maps.Keys(undefinedSymbols)
+	slices.Sort(file.UndefinedSymbols)
+
+	return file, nil
+}
@@ -1,8 +1,12 @@
 package build
 
 import (
+	"io/fs"
+	"os"
 	"path"
 
+	"github.com/gravitational/trace"
+
 	"github.com/solidDoWant/distrobuilder/internal/runners"
 	"github.com/solidDoWant/distrobuilder/internal/runners/args"
 )
@@ -51,3 +55,26 @@ func (fob *FilesystemOutputBuilder) GetMesonOptions() *runners.MesonOptions {
 func (fob *FilesystemOutputBuilder) getInstallPath(installSubdirectory string) string {
 	return path.Join(fob.OutputDirectoryPath, installSubdirectory)
 }
+
+// Write a file to the output directory, creating parent directories as needed. The parent
+// directories are world readable as they are typically installed to the root filesystem.
+func (fob *FilesystemOutputBuilder) WriteOutputFile(relativeFilePath, fileContents string, permissions fs.FileMode) error {
+	filePath := path.Join(fob.OutputDirectoryPath, relativeFilePath)
+	err := os.MkdirAll(path.Dir(filePath), 0755)
+	if err != nil {
+		return trace.Wrap(err, "failed to create directory for %q", filePath)
+	}
+
+	err = os.WriteFile(filePath, []byte(fileContents), permissions)
+	if err != nil {
+		return trace.Wrap(err, "failed to write %q", filePath)
+	}
+
+	// Ignore the umask
+	err = os.Chmod(filePath, permissions)
+	if err != nil {
+		return trace.Wrap(err, "failed to set permissions of %q to %o", filePath, permissions)
+	}
+
+	return nil
+}
@@ -0,0 +1,809 @@
+package build
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"debug/elf"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/gravitational/trace"
+	"github.com/otiai10/copy"
+	"github.com/solidDoWant/distrobuilder/internal/runners"
+	"github.com/solidDoWant/distrobuilder/internal/utils"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	InitramfsCompressionZstd = "zstd"
+	InitramfsCompressionXz   = "xz"
+	InitramfsCompressionNone = "none"
+
+	// Maximum number of symlinks that will be followed when resolving a single path, matching
+	// the Linux kernel limit
+	maxSymlinkFollows = 40
+)
+
+var InitramfsCompressions = []string{InitramfsCompressionZstd, InitramfsCompressionXz, InitramfsCompressionNone}
+
+// Module index files that are copied alongside the modules so that modprobe can resolve
+// dependencies and aliases at boot
+var kernelModuleIndexFiles = []string{
+	"modules.alias",
+	"modules.alias.bin",
+	"modules.builtin",
+	"modules.builtin.bin",
+	"modules.builtin.modinfo",
+	"modules.dep",
+	"modules.dep.bin",
+	"modules.devname",
+	"modules.order",
+	"modules.softdep",
+	"modules.symbols",
+	"modules.symbols.bin",
+}
+
+// Directories searched for shared libraries when a binary does not specify a runpath
+var defaultLibrarySearchPaths = []string{
+	"lib",
+	"usr/lib",
+	"usr/local/lib",
+}
+
+// Script used as the initramfs /init. Kernel modules listed in /etc/modules are loaded, then the
+// filesystem specified by the "root=" kernel command line parameter is mounted and switched to.
+const initramfsInitScript = `#!/bin/busybox sh
+/bin/busybox mkdir -p /bin /sbin /usr/bin /usr/sbin
+/bin/busybox --install -s
+
+mount -t proc -o nosuid,nodev,noexec proc /proc
+mount -t sysfs -o nosuid,nodev,noexec sysfs /sys
+mount -t devtmpfs -o nosuid,mode=0755 devtmpfs /dev
+mount -t tmpfs -o nosuid,nodev,mode=0755 tmpfs /run
+
+rescue_shell() {
+	echo "$1. Dropping to a shell."
+	exec sh
+}
+
+# Print the device of the GPT partition with the given unique GUID. This is not stored in the
+# filesystem, so findfs cannot be used. Targets are assumed to be little endian.
+find_partuuid() {
+	partuuid="$(echo "$1" | tr 'A-F' 'a-f')"
+	for partition in /sys/class/block/*; do
+		[ -f "${partition}/partition" ] || continue
+		number="$(cat "${partition}/partition")"
+		disk="$(basename "$(dirname "$(readlink -f "${partition}")")")"
+		block_size="$(cat "/sys/block/${disk}/queue/logical_block_size" 2>/dev/null)" || continue
+
+		# The GPT header is in the second logical block
+		signature="$(dd if="/dev/${disk}" bs=1 skip="${block_size}" count=8 2>/dev/null)"
+		[ "${signature}" = "EFI PART" ] || continue
+		entries_lba="$(od -A n -t u4 -j "$((block_size + 72))" -N 4 "/dev/${disk}" | tr -d ' ')"
+		entry_size="$(od -A n -t u4 -j "$((block_size + 84))" -N 4 "/dev/${disk}" | tr -d ' ')"
+
+		# The unique partition GUID starts 16 bytes into the partition entry, and its first three
+		# fields are little endian
+		offset="$((entries_lba * block_size + (number - 1) * entry_size + 16))"
+		set -- $(od -A n -t x1 -j "${offset}" -N 16 "/dev/${disk}")
+		[ "$#" -eq 16 ] || continue
+		guid="$4$3$2$1-$6$5-$8$7-$9${10}-${11}${12}${13}${14}${15}${16}"
+
+		if [ "${guid}" = "${partuuid}" ]; then
+			echo "/dev/$(basename "${partition}")"
+			return
+		fi
+	done
+}
+
+if [ -f /etc/modules ]; then
+	while read -r module; do
+		[ -n "${module}" ] && modprobe "${module}"
+	done < /etc/modules
+fi
+
+root=""
+rootfstype=""
+rootflags="ro"
+init="/sbin/init"
+for parameter in $(cat /proc/cmdline); do
+	case "${parameter}" in
+		root=*) root="${parameter#root=}" ;;
+		rootfstype=*) rootfstype="${parameter#rootfstype=}" ;;
+		rootflags=*) rootflags="${parameter#rootflags=}" ;;
+		rw) rootflags="rw" ;;
+		init=*) init="${parameter#init=}" ;;
+		rdshell) rescue_shell "Shell requested on the kernel command line" ;;
+	esac
+done
+
+[ -n "${root}" ] || rescue_shell "No root filesystem was specified"
+
+# Wait for the root device to appear, as storage drivers may probe asynchronously
+device=""
+for attempt in $(seq 1 30); do
+	mdev -s
+	case "${root}" in
+		/dev/*) [ -b "${root}" ] && device="${root}" ;;
+		PARTUUID=*) device="$(find_partuuid "${root#PARTUUID=}")" ;;
+		*) device="$(findfs "${root}" 2>/dev/null)" ;;
+	esac
+	[ -n "${device}" ] && break
+	sleep 1
+done
+
+[ -n "${device}" ] || rescue_shell "Root device ${root} was not found"
+
+if [ -n "${rootfstype}" ]; then
+	mount -t "${rootfstype}" -o "${rootflags}" "${device}" /sysroot || rescue_shell "Failed to mount ${device}"
+else
+	mount -o "${rootflags}" "${device}" /sysroot || rescue_shell "Failed to mount ${device}"
+fi
+
+for filesystem in /proc /sys /dev /run; do
+	mount -o move "${filesystem}" "/sysroot${filesystem}"
+done
+
+exec switch_root /sysroot "${init}"
+`
+
+// Builds a compressed initramfs image from files in the root filesystem. Shared library
+// dependencies of included ELF files, and dependencies of included kernel modules, are
+// pulled in automatically.
+type Initramfs struct {
+	FilesystemOutputBuilder
+	RootFSBuilder
+
+	KernelVersion string   // If unset, this is detected from the modules installed in the root filesystem
+	Files         []string // Paths relative to the root filesystem
+	Modules       []string // Kernel module names, i.e. "virtio_blk"
+	Compression   string
+	// Also write the uncompressed archive, for embedding in the kernel image. The kernel build
+	// only accepts uncompressed cpio archives, and compresses them itself.
+	ShouldWriteEmbeddableArchive bool
+}
+
+// An item to place in the initramfs. Exactly one of SourcePath or Contents should be set for
+// regular files.
+type initramfsEntry struct {
+	cpioEntry
+	SourcePath string
+	Contents   []byte
+}
+
+func (i *Initramfs) CheckHostRequirements() error {
+	compressionCommand := i.getCompressionCommand()
+	if compressionCommand == "" {
+		return nil
+	}
+
+	err := runners.CheckRequiredCommandsExist([]string{compressionCommand})
+	if err != nil {
+		return trace.Wrap(err, "failed to verify that all required commands exist")
+	}
+
+	return nil
+}
+
+func (i *Initramfs) getCompressionCommand() string {
+	switch i.Compression {
+	case InitramfsCompressionZstd, InitramfsCompressionXz:
+		return i.Compression
+	default:
+		return ""
+	}
+}
+
+func (i *Initramfs) Build(ctx context.Context) (err error) {
+	if !slices.Contains(InitramfsCompressions, i.Compression) {
+		return trace.Errorf("unsupported compression %q, must be one of %v", i.Compression, InitramfsCompressions)
+	}
+
+	outputDirectory, err := setupOutputDirectory(i.OutputDirectoryPath)
+	if err != nil {
+		return trace.Wrap(err, "failed to setup output directory")
+	}
+	i.OutputDirectoryPath = outputDirectory.Path
+
+	if i.KernelVersion == "" {
+		i.KernelVersion, err = getInstalledKernelRelease(i.RootFSDirectoryPath)
+		if err != nil {
+			return trace.Wrap(err, "failed to detect the kernel version")
+		}
+	}
+
+	slog.Info("Collecting initramfs contents", "kernel_version", i.KernelVersion)
+	entries, err := i.collectEntries()
+	if err != nil {
+		return trace.Wrap(err, "failed to collect initramfs contents")
+	}
+
+	bootDirectoryPath := path.Join(i.OutputDirectoryPath, "boot")
+	_, err = utils.EnsureDirectoryExists(bootDirectoryPath)
+	if err != nil {
+		return trace.Wrap(err, "failed to ensure that the output boot directory exists")
+	}
+
+	// The archive is written next to the output so that it can be renamed into place
+	archiveFile, err := os.CreateTemp(bootDirectoryPath, ".initramfs-*.cpio")
+	if err != nil {
+		return trace.Wrap(err, "failed to create temporary initramfs archive file")
+	}
+	defer utils.ErrDefer(func() error { return removeIfExists(archiveFile.Name()) }, &err)
+	defer utils.Close(archiveFile, &err)
+
+	err = writeInitramfsArchive(archiveFile, entries)
+	if err != nil {
+		return trace.Wrap(err, "failed to write initramfs archive")
+	}
+
+	if i.ShouldWriteEmbeddableArchive {
+		embeddableArchiveFilePath := i.GetEmbeddableArchiveFilePath()
+		err = copy.Copy(archiveFile.Name(), embeddableArchiveFilePath, copy.Options{PermissionControl: copy.AddPermission(0644)})
+		if err != nil {
+			return trace.Wrap(err, "failed to write embeddable initramfs archive to %q", embeddableArchiveFilePath)
+		}
+	}
+
+	outputFilePath := i.GetOutputFilePath()
+	slog.Info("Compressing initramfs", "compression", i.Compression, "output_file", outputFilePath)
+	err = i.compress(archiveFile.Name(), outputFilePath)
+	if err != nil {
+		return trace.Wrap(err, "failed to compress initramfs archive")
+	}
+
+	// Temporary files are created as owner-readable only
+	err = os.Chmod(outputFilePath, 0644)
+	if err != nil {
+		return trace.Wrap(err, "failed to set permissions on %q", outputFilePath)
+	}
+
+	return nil
+}
+
+// Path of the built image. The name matches what is expected by the image builders.
+func (i *Initramfs) GetOutputFilePath() string {
+	return path.Join(i.OutputDirectoryPath, "boot", fmt.Sprintf("initramfs-%s.img", i.KernelVersion))
+}
+
+// Path of the uncompressed archive, for embedding in the kernel image via CONFIG_INITRAMFS_SOURCE.
+// Kbuild requires the ".cpio" suffix to use a file as an archive rather than a file list.
+func (i *Initramfs) GetEmbeddableArchiveFilePath() string {
+	return path.Join(i.OutputDirectoryPath, "boot", fmt.Sprintf("initramfs-%s.cpio", i.KernelVersion))
+}
+
+func (i *Initramfs) VerifyBuild(ctx context.Context) error {
+	outputFilePaths := []string{i.GetOutputFilePath()}
+	if i.ShouldWriteEmbeddableArchive {
+		outputFilePaths = append(outputFilePaths, i.GetEmbeddableArchiveFilePath())
+	}
+
+	for _, outputFilePath := range outputFilePaths {
+		outputFileInfo, err := os.Stat(outputFilePath)
+		if err != nil {
+			return trace.Wrap(err, "failed to stat initramfs image %q", outputFilePath)
+		}
+
+		if outputFileInfo.Size() == 0 {
+			return trace.Errorf("initramfs image %q is empty", outputFilePath)
+		}
+	}
+
+	return nil
+}
+
+// Get the release of the only kernel installed in the root filesystem
+func getInstalledKernelRelease(rootFSDirectoryPath string) (string, error) {
+	modulesDirectoryPath := path.Join(rootFSDirectoryPath, "usr", "lib", "modules")
+	directoryEntries, err := os.ReadDir(modulesDirectoryPath)
+	if err != nil {
+		return "", trace.Wrap(err, "failed to read kernel modules directory %q", modulesDirectoryPath)
+	}
+
+	kernelVersions := make([]string, 0, len(directoryEntries))
+	for _, directoryEntry := range directoryEntries {
+		if directoryEntry.IsDir() {
+			kernelVersions = append(kernelVersions, directoryEntry.Name())
+		}
+	}
+
+	if len(kernelVersions) != 1 {
+		return "", trace.Errorf("expected exactly one kernel version in %q, found %v", modulesDirectoryPath, kernelVersions)
+	}
+
+	return kernelVersions[0], nil
+}
+
+func (i *Initramfs) collectEntries() (entries map[string]*initramfsEntry, err error) {
+	rootDirectory, err := utils.OpenRootedDirectory(i.RootFSDirectoryPath)
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to open root filesystem %q", i.RootFSDirectoryPath)
+	}
+	defer utils.Close(rootDirectory, &err)
+
+	collector := &initramfsCollector{
+		RootFSDirectoryPath: i.RootFSDirectoryPath,
+		RootDirectory:       rootDirectory,
+		Entries:             map[string]*initramfsEntry{},
+	}
+
+	// Directories needed by /init
+	for _, directoryPath := range []string{"dev", "proc", "sys", "run", "tmp", "sysroot", "etc"} {
+		collector.AddGenerated(&initramfsEntry{
+			cpioEntry: cpioEntry{
+				Name: directoryPath,
+				Mode: unix.S_IFDIR | 0755,
+			},
+		})
+	}
+
+	// The kernel opens the console before running /init, which happens before devtmpfs is mounted
+	collector.AddGenerated(&initramfsEntry{
+		cpioEntry: cpioEntry{
+			Name:      "dev/console",
+			Mode:      unix.S_IFCHR | 0600,
+			RDevMajor: 5,
+			RDevMinor: 1,
+		},
+	})
+
+	collector.AddGenerated(&initramfsEntry{
+		cpioEntry: cpioEntry{
+			Name: "init",
+			Mode: unix.S_IFREG | 0755,
+		},
+		Contents: []byte(initramfsInitScript),
+	})
+
+	err = collector.AddPath("bin/busybox")
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to add busybox, which is required by /init")
+	}
+
+	for _, filePath := range i.Files {
+		err := collector.AddPath(filePath)
+		if err != nil {
+			return nil, trace.Wrap(err, "failed to add %q", filePath)
+		}
+	}
+
+	if len(i.Modules) > 0 {
+		err := i.addModules(collector)
+		if err != nil {
+			return nil, trace.Wrap(err, "failed to add kernel modules")
+		}
+	}
+
+	return collector.Entries, nil
+}
+
+func (i *Initramfs) addModules(collector *initramfsCollector) error {
+	modulesDirectoryPath := path.Join("usr", "lib", "modules", i.KernelVersion)
+	moduleDependencies, err := readModulesDep(path.Join(i.RootFSDirectoryPath, modulesDirectoryPath, "modules.dep"))
+	if err != nil {
+		return trace.Wrap(err, "failed to read module dependencies")
+	}
+
+	modulePathsByName := make(map[string]string, len(moduleDependencies))
+	for modulePath := range moduleDependencies {
+		modulePathsByName[getModuleName(modulePath)] = modulePath
+	}
+
+	// Resolve the full set of modules, including transitive dependencies
+	includedModulePaths := map[string]struct{}{}
+	pendingModulePaths := make([]string, 0, len(i.Modules))
+	for _, moduleName := range i.Modules {
+		modulePath, ok := modulePathsByName[normalizeModuleName(moduleName)]
+		if !ok {
+			return trace.Errorf("kernel module %q was not found in modules.dep for kernel %q", moduleName, i.KernelVersion)
+		}
+
+		pendingModulePaths = append(pendingModulePaths, modulePath)
+	}
+
+	for len(pendingModulePaths) > 0 {
+		modulePath := pendingModulePaths[len(pendingModulePaths)-1]
+		pendingModulePaths = pendingModulePaths[:len(pendingModulePaths)-1]
+
+		if _, ok := includedModulePaths[modulePath]; ok {
+			continue
+		}
+		includedModulePaths[modulePath] = struct{}{}
+
+		pendingModulePaths = append(pendingModulePaths, moduleDependencies[modulePath]...)
+	}
+
+	for modulePath := range includedModulePaths {
+		err := collector.AddPath(path.Join(modulesDirectoryPath, modulePath))
+		if err != nil {
+			return trace.Wrap(err, "failed to add kernel module %q", modulePath)
+		}
+	}
+
+	for _, indexFileName := range kernelModuleIndexFiles {
+		indexFilePath := path.Join(modulesDirectoryPath, indexFileName)
+		doesExist, err := utils.DoesFilesystemPathExist(path.Join(i.RootFSDirectoryPath, indexFilePath))
+		if err != nil {
+			return trace.Wrap(err, "failed to check if module index file %q exists", indexFilePath)
+		}
+
+		if !doesExist {
+			continue
+		}
+
+		err = collector.AddPath(indexFilePath)
+		if err != nil {
+			return trace.Wrap(err, "failed to add module index file %q", indexFilePath)
+		}
+	}
+
+	collector.AddGenerated(&initramfsEntry{
+		cpioEntry: cpioEntry{
+			Name: "etc/modules",
+			Mode: unix.S_IFREG | 0644,
+		},
+		Contents: []byte(strings.Join(i.Modules, "\n") + "\n"),
+	})
+
+	return nil
+}
+
+// Parse a modules.dep file into a map of module paths to the paths of their dependencies.
+// Paths are relative to the kernel modules directory.
+func readModulesDep(modulesDepPath string) (map[string][]string, error) {
+	fileContents, err := os.ReadFile(modulesDepPath)
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to read %q", modulesDepPath)
+	}
+
+	moduleDependencies := map[string][]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(fileContents))
+	for scanner.Scan() {
+		modulePath, dependencies, found := strings.Cut(scanner.Text(), ":")
+		if !found {
+			continue
+		}
+
+		moduleDependencies[strings.TrimSpace(modulePath)] = strings.Fields(dependencies)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, trace.Wrap(err, "failed to parse %q", modulesDepPath)
+	}
+
+	return moduleDependencies, nil
+}
+
+// Get the module name from a module file path, i.e. "kernel/drivers/block/virtio_blk.ko.zst" -> "virtio_blk"
+func getModuleName(modulePath string) string {
+	moduleName := path.Base(modulePath)
+	for _, compressionExtension := range []string{".gz", ".xz", ".zst"} {
+		moduleName = strings.TrimSuffix(moduleName, compressionExtension)
+	}
+
+	return normalizeModuleName(strings.TrimSuffix(moduleName, ".ko"))
+}
+
+// Dashes and underscores are interchangeable in module names
+func normalizeModuleName(moduleName string) string {
+	return strings.ReplaceAll(moduleName, "-", "_")
+}
+
+func (i *Initramfs) compress(archiveFilePath, outputFilePath string) error {
+	switch i.Compression {
+	case InitramfsCompressionZstd:
+		_, err := runners.Run(&runners.CommandRunner{
+			Command:   "zstd",
+			Arguments: []string{"-q", "-19", "-f", archiveFilePath, "-o", outputFilePath},
+		})
+		if err != nil {
+			return trace.Wrap(err, "failed to compress %q with zstd", archiveFilePath)
+		}
+	case InitramfsCompressionXz:
+		// The kernel decompressor only supports CRC32 checks, and a limited dictionary size
+		_, err := runners.Run(&runners.CommandRunner{
+			Command:   "xz",
+			Arguments: []string{"-q", "-f", "--check=crc32", "--lzma2=dict=1MiB", archiveFilePath},
+		})
+		if err != nil {
+			return trace.Wrap(err, "failed to compress %q with xz", archiveFilePath)
+		}
+
+		err = os.Rename(archiveFilePath+".xz", outputFilePath)
+		if err != nil {
+			return trace.Wrap(err, "failed to move compressed archive to %q", outputFilePath)
+		}
+	default:
+		err := os.Rename(archiveFilePath, outputFilePath)
+		if err != nil {
+			return trace.Wrap(err, "failed to move archive to %q", outputFilePath)
+		}
+	}
+
+	return nil
+}
+
+func removeIfExists(filePath string) error {
+	err := os.Remove(filePath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return trace.Wrap(err, "failed to remove %q", filePath)
+	}
+
+	return nil
+}
+
+// Write the entries to a cpio archive. Entries are sorted by path so that parent directories
+// are created before their contents, and so that the output is reproducible.
+func writeInitramfsArchive(archiveFile io.Writer, entries map[string]*initramfsEntry) error {
+	entryPaths := make([]string, 0, len(entries))
+	for entryPath := range entries {
+		entryPaths = append(entryPaths, entryPath)
+	}
+	slices.Sort(entryPaths)
+
+	bufferedWriter := bufio.NewWriter(archiveFile)
+	archiveWriter := newCPIOWriter(bufferedWriter)
+	for _, entryPath := range entryPaths {
+		err := writeInitramfsEntry(archiveWriter, entries[entryPath])
+		if err != nil {
+			return trace.Wrap(err, "failed to add %q to the archive", entryPath)
+		}
+	}
+
+	err := archiveWriter.Close()
+	if err != nil {
+		return trace.Wrap(err, "failed to close archive")
+	}
+
+	err = bufferedWriter.Flush()
+	if err != nil {
+		return trace.Wrap(err, "failed to flush archive to disk")
+	}
+
+	return nil
+}
+
+func writeInitramfsEntry(archiveWriter *cpioWriter, entry *initramfsEntry) (err error) {
+	if entry.Mode&unix.S_IFMT != unix.S_IFREG || entry.SourcePath == "" {
+		entry.Size = int64(len(entry.Contents))
+		return trace.Wrap(archiveWriter.WriteEntry(&entry.cpioEntry, bytes.NewReader(entry.Contents)))
+	}
+
+	sourceFile, err := os.Open(entry.SourcePath)
+	if err != nil {
+		return trace.Wrap(err, "failed to open %q", entry.SourcePath)
+	}
+	defer utils.Close(sourceFile, &err)
+
+	sourceFileInfo, err := sourceFile.Stat()
+	if err != nil {
+		return trace.Wrap(err, "failed to stat %q", entry.SourcePath)
+	}
+	entry.Size = sourceFileInfo.Size()
+
+	return trace.Wrap(archiveWriter.WriteEntry(&entry.cpioEntry, sourceFile))
+}
+
+// Gathers files from the root filesystem, along with everything they need to work: parent
+// directories, symlink targets, and shared libraries.
+type initramfsCollector struct {
+	RootFSDirectoryPath string
+	RootDirectory       *utils.RootedDirectory
+	Entries             map[string]*initramfsEntry
+}
+
+// Add an entry that does not exist in the root filesystem, replacing any existing entry
+func (ic *initramfsCollector) AddGenerated(entry *initramfsEntry) {
+	ic.Entries[entry.Name] = entry
+}
+
+// Add a path from the root filesystem. Symlinks in any part of the path are included and
+// resolved within the root filesystem.
+func (ic *initramfsCollector) AddPath(rootFSPath string) error {
+	return trace.Wrap(ic.addPath(rootFSPath, 0))
+}
+
+func (ic *initramfsCollector) addPath(rootFSPath string, symlinkFollowCount int) error {
+	cleanedPath := strings.TrimPrefix(path.Clean("/"+rootFSPath), "/")
+	if cleanedPath == "" {
+		return nil
+	}
+
+	if _, ok := ic.Entries[cleanedPath]; ok {
+		return nil
+	}
+
+	// Resolve each path component in turn so that symlinked parent directories are
+	// resolved within the root filesystem, instead of the host filesystem
+	pathComponents := strings.Split(cleanedPath, "/")
+	for componentIndex := range pathComponents {
+		currentPath := path.Join(pathComponents[:componentIndex+1]...)
+		if entry, ok := ic.Entries[currentPath]; ok && entry.Mode&unix.S_IFMT == unix.S_IFDIR {
+			continue
+		}
+
+		hostPath := path.Join(ic.RootFSDirectoryPath, currentPath)
+		fileInfo, err := os.Lstat(hostPath)
+		if err != nil {
+			return trace.Wrap(err, "failed to stat %q", hostPath)
+		}
+
+		isLastComponent := componentIndex == len(pathComponents)-1
+		switch {
+		case fileInfo.Mode()&fs.ModeSymlink != 0:
+			if symlinkFollowCount >= maxSymlinkFollows {
+				return trace.Errorf("too many levels of symbolic links while resolving %q", rootFSPath)
+			}
+
+			linkTarget, err := os.Readlink(hostPath)
+			if err != nil {
+				return trace.Wrap(err, "failed to read symlink %q", hostPath)
+			}
+
+			ic.Entries[currentPath] = &initramfsEntry{
+				cpioEntry: cpioEntry{
+					Name: currentPath,
+					Mode: unix.S_IFLNK | 0777,
+				},
+				Contents: []byte(linkTarget),
+			}
+
+			resolvedPath := linkTarget
+			if !path.IsAbs(linkTarget) {
+				resolvedPath = path.Join(path.Dir(currentPath), linkTarget)
+			}
+			resolvedPath = path.Join(append([]string{resolvedPath}, pathComponents[componentIndex+1:]...)...)
+
+			return trace.Wrap(ic.addPath(resolvedPath, symlinkFollowCount+1))
+		case fileInfo.IsDir():
+			ic.Entries[currentPath] = &initramfsEntry{
+				cpioEntry: cpioEntry{
+					Name: currentPath,
+					Mode: unix.S_IFDIR | uint32(fileInfo.Mode().Perm()),
+				},
+			}
+		case !isLastComponent:
+			return trace.Errorf("%q is not a directory", hostPath)
+		case fileInfo.Mode().IsRegular():
+			ic.Entries[currentPath] = &initramfsEntry{
+				cpioEntry: cpioEntry{
+					Name: currentPath,
+					Mode: unix.S_IFREG | uint32(fileInfo.Mode().Perm()),
+				},
+				SourcePath: hostPath,
+			}
+
+			err := ic.addSharedLibraries(currentPath)
+			if err != nil {
+				return trace.Wrap(err, "failed to add shared libraries needed by %q", currentPath)
+			}
+		default:
+			return trace.Errorf("%q has unsupported file type %s", hostPath, fileInfo.Mode().Type())
+		}
+	}
+
+	return nil
+}
+
+// If the file is a dynamically linked ELF file, add its interpreter and needed libraries
+func (ic *initramfsCollector) addSharedLibraries(rootFSPath string) error {
+	hostPath := path.Join(ic.RootFSDirectoryPath, rootFSPath)
+	elfFile, err := elf.Open(hostPath)
+	if err != nil {
+		var formatErr *elf.FormatError
+		if errors.As(err, &formatErr) {
+			// Not an ELF file
+			return nil
+		}
+
+		return trace.Wrap(err, "failed to open %q", hostPath)
+	}
+	defer elfFile.Close()
+
+	for _, program := range elfFile.Progs {
+		if program.Type != elf.PT_INTERP {
+			continue
+		}
+
+		interpreterPath, err := io.ReadAll(program.Open())
+		if err != nil {
+			return trace.Wrap(err, "failed to read interpreter path")
+		}
+
+		err = ic.AddPath(strings.TrimRight(string(interpreterPath), "\x00"))
+		if err != nil {
+			return trace.Wrap(err, "failed to add interpreter")
+		}
+	}
+
+	neededLibraries, err := elfFile.ImportedLibraries()
+	if err != nil {
+		return trace.Wrap(err, "failed to read needed libraries")
+	}
+
+	if len(neededLibraries) == 0 {
+		return nil
+	}
+
+	searchPaths, err := getLibrarySearchPaths(elfFile, rootFSPath)
+	if err != nil {
+		return trace.Wrap(err, "failed to get library search paths")
+	}
+
+	for _, neededLibrary := range neededLibraries {
+		libraryPath, err := ic.findLibrary(neededLibrary, searchPaths)
+		if err != nil {
+			return trace.Wrap(err, "failed to find needed library %q", neededLibrary)
+		}
+
+		err = ic.AddPath(libraryPath)
+		if err != nil {
+			return trace.Wrap(err, "failed to add needed library %q", neededLibrary)
+		}
+	}
+
+	return nil
+}
+
+// Get the root filesystem-relative paths that the dynamic loader would search for libraries
+func getLibrarySearchPaths(elfFile *elf.File, rootFSPath string) ([]string, error) {
+	searchPaths := make([]string, 0, len(defaultLibrarySearchPaths))
+	for _, tag := range []elf.DynTag{elf.DT_RUNPATH, elf.DT_RPATH} {
+		values, err := elfFile.DynString(tag)
+		if err != nil {
+			return nil, trace.Wrap(err, "failed to read %s", tag)
+		}
+
+		for _, value := range values {
+			for _, searchPath := range strings.Split(value, ":") {
+				searchPath = strings.ReplaceAll(searchPath, "${ORIGIN}", "$ORIGIN")
+				searchPath = strings.ReplaceAll(searchPath, "$ORIGIN", "/"+path.Dir(rootFSPath))
+				searchPaths = append(searchPaths, searchPath)
+			}
+		}
+	}
+
+	return append(searchPaths, defaultLibrarySearchPaths...), nil
+}
+
+func (ic *initramfsCollector) findLibrary(libraryName string, searchPaths []string) (string, error) {
+	if strings.Contains(libraryName, "/") {
+		return libraryName, nil
+	}
+
+	for _, searchPath := range searchPaths {
+		libraryPath := path.Join(searchPath, libraryName)
+		doesExist, err := ic.doesPathExist(libraryPath)
+		if err != nil {
+			return "", trace.Wrap(err, "failed to check if %q exists", libraryPath)
+		}
+
+		if doesExist {
+			return libraryPath, nil
+		}
+	}
+
+	return "", trace.Errorf("library %q was not found in any of %v", libraryName, searchPaths)
+}
+
+// Check if a path exists in the root filesystem, resolving symlinks within the root filesystem
+func (ic *initramfsCollector) doesPathExist(rootFSPath string) (bool, error) {
+	file, err := ic.RootDirectory.OpenFile(rootFSPath, unix.O_PATH, 0)
+	if err != nil {
+		if errors.Is(err, unix.ENOENT) || errors.Is(err, unix.ENOTDIR) {
+			return false, nil
+		}
+
+		return false, trace.Wrap(err, "failed to open %q", rootFSPath)
+	}
+
+	return true, trace.Wrap(file.Close())
+}
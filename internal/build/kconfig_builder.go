@@ -2,23 +2,26 @@ package build
 
 import (
 	"fmt"
+	"log/slog"
 	"os"
 	"path"
 	"strings"
 
 	"github.com/gravitational/trace"
 	"github.com/solidDoWant/distrobuilder/internal/runners/args"
-	"github.com/solidDoWant/distrobuilder/internal/utils"
 )
 
 // TODO consider making this more generic, "ConfigBuilder" or similar
 type IKconfigBuilder interface {
 	SetConfigFilePath(string)
 	GetConfigFilePath() string
+	SetConfigFragmentPaths([]string)
+	GetConfigFragmentPaths() []string
 }
 
 type KconfigBuilder struct {
-	ConfigFilePath string
+	ConfigFilePath      string   // Base config, typically a defconfig or full .config
+	ConfigFragmentPaths []string // Fragments merged on top of the base config, in order
 }
 
 func (kb *KconfigBuilder) SetConfigFilePath(configFilePath string) {
@@ -29,54 +32,229 @@ func (kb *KconfigBuilder) GetConfigFilePath() string {
 	return kb.ConfigFilePath
 }
 
+func (kb *KconfigBuilder) SetConfigFragmentPaths(configFragmentPaths []string) {
+	kb.ConfigFragmentPaths = configFragmentPaths
+}
+
+func (kb *KconfigBuilder) GetConfigFragmentPaths() []string {
+	return kb.ConfigFragmentPaths
+}
+
+// Write the base config to the build directory, merged with each config fragment in order.
+// Later values override earlier ones, matching the behavior of the kernel's merge_config.sh.
+// Replacement variables are set as string values, overriding both the base config and fragments.
 func (kb *KconfigBuilder) CopyKconfig(buildDirectoryPath string, replacementVars map[string]args.IValue) error {
-	lineChannel, errChannel := utils.StreamLines(kb.ConfigFilePath)
+	config, err := readKconfig(kb.ConfigFilePath)
+	if err != nil {
+		return trace.Wrap(err, "failed to read base config")
+	}
+
+	for _, fragmentPath := range kb.ConfigFragmentPaths {
+		fragment, err := readKconfig(fragmentPath)
+		if err != nil {
+			return trace.Wrap(err, "failed to read config fragment")
+		}
+
+		config.Merge(fragment)
+	}
+
+	for varName, varValue := range replacementVars {
+		config.Set(varName, fmt.Sprintf("%q", varValue.GetValue()))
+	}
 
-	// This could possibly be made slightly safer/more clear if there is an issue
-	// by waiting for the first line to become availble before opening the destination
-	// file for writing. The tradeoff is that opening the destination file would not
-	// occur until after the first line is read, making this code slower.
 	destinationFilePath := path.Join(buildDirectoryPath, ".config")
-	destinationFile, err := os.OpenFile(destinationFilePath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
-	defer utils.Close(destinationFile, &err)
+	err = config.Write(destinationFilePath)
+	if err != nil {
+		return trace.Wrap(err, "failed to write merged config to %q", destinationFilePath)
+	}
+
+	return nil
+}
+
+// Resolve symbol dependencies and fill in defaults after merging config fragments. The resolve
+// function should run the builder's equivalent of `make olddefconfig`. Every value set by a
+// fragment must survive dependency resolution, otherwise an error is returned listing each
+// value that was dropped or changed.
+func (kb *KconfigBuilder) ResolveKconfig(buildDirectoryPath string, resolve func() error) error {
+	if len(kb.ConfigFragmentPaths) == 0 {
+		return nil
+	}
+
+	err := resolve()
 	if err != nil {
-		return trace.Wrap(err, "failed to open destination file %q for writing", destinationFilePath)
+		return trace.Wrap(err, "failed to resolve config dependencies")
 	}
 
-	// Write the replacement variables along with comment headers for the prefix and source file
+	requestedConfig := newKconfig("requested values")
+	for _, fragmentPath := range kb.ConfigFragmentPaths {
+		fragment, err := readKconfig(fragmentPath)
+		if err != nil {
+			return trace.Wrap(err, "failed to read config fragment")
+		}
+
+		requestedConfig.Merge(fragment)
+	}
 
-	// Write the variables from the source file, less replacement variables
-	err = kb.filterCopyFile(lineChannel, errChannel, destinationFile, replacementVars)
+	configFilePath := path.Join(buildDirectoryPath, ".config")
+	resolvedConfig, err := readKconfig(configFilePath)
 	if err != nil {
-		return trace.Wrap(err, "failed to copy config file at %q to %q", kb.ConfigFilePath, destinationFilePath)
+		return trace.Wrap(err, "failed to read resolved config")
+	}
+
+	mismatches := make([]string, 0)
+	for _, symbol := range requestedConfig.GetSymbols() {
+		requestedValue, _ := requestedConfig.Get(symbol)
+		resolvedValue, ok := resolvedConfig.Get(symbol)
+		if !ok {
+			// Symbols with unmet dependencies are omitted entirely, which is equivalent to disabled
+			resolvedValue = kconfigDisabledValue
+		}
+
+		if requestedValue == resolvedValue {
+			continue
+		}
+
+		mismatches = append(mismatches, fmt.Sprintf("%s: requested %s, resolved to %s", symbol, requestedValue, resolvedValue))
+	}
+
+	if len(mismatches) > 0 {
+		return trace.Errorf("%d requested config values did not survive dependency resolution, check the dependencies of each symbol:\n%s", len(mismatches), strings.Join(mismatches, "\n"))
 	}
 
 	return nil
 }
 
-func (kb *KconfigBuilder) filterCopyFile(lineChannel <-chan string, errChannel <-chan error, destinationFile *os.File, replacementVars map[string]args.IValue) error {
-	for {
-		select {
-		case err := <-errChannel:
-			return trace.Wrap(err, "failed to read kconfig file at %q", kb.ConfigFilePath)
-		case line, more := <-lineChannel:
-			// Check if the line starts with a variable that is being replaced
-			trimmedLine := strings.TrimSpace(line)
-			for varName, varValue := range replacementVars {
-				if strings.HasPrefix(trimmedLine, fmt.Sprintf("%s=", varName)) {
-					line = fmt.Sprintf("%s=%q", varName, varValue.GetValue())
-					break
-				}
-			}
-
-			_, err := destinationFile.WriteString(fmt.Sprintf("%s\n", line))
-			if err != nil {
-				return trace.Wrap(err, "failed to write line %q to destination file", line)
-			}
-
-			if !more {
-				return nil
-			}
+// Endless stream of newlines, equivalent to `yes ""`. This accepts the default answer for
+// every interactive kconfig prompt.
+type newlineReader struct{}
+
+func (newlineReader) Read(buffer []byte) (int, error) {
+	for i := range buffer {
+		buffer[i] = '\n'
+	}
+
+	return len(buffer), nil
+}
+
+// Value used for "# CONFIG_X is not set" lines
+const kconfigDisabledValue = "n"
+
+// Kconfig file contents (.config or a fragment), preserving line order and comments
+type kconfig struct {
+	Name        string // Used for logging
+	lines       []string
+	symbolLines map[string]int // Index of the line that sets each symbol
+	symbolOrder []string
+}
+
+func newKconfig(name string) *kconfig {
+	return &kconfig{
+		Name:        name,
+		symbolLines: map[string]int{},
+	}
+}
+
+func readKconfig(filePath string) (*kconfig, error) {
+	fileContents, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to read kconfig file at %q", filePath)
+	}
+
+	config := newKconfig(filePath)
+	for _, line := range strings.Split(string(fileContents), "\n") {
+		symbol, value, isSymbol := parseKconfigLine(line)
+		if !isSymbol {
+			config.lines = append(config.lines, line)
+			continue
 		}
+
+		config.Set(symbol, value)
+	}
+
+	// Drop the trailing empty line produced by the final newline
+	for len(config.lines) > 0 && config.lines[len(config.lines)-1] == "" {
+		config.lines = config.lines[:len(config.lines)-1]
 	}
+
+	return config, nil
+}
+
+// Parse a line of a kconfig file. Both "CONFIG_X=value" and "# CONFIG_X is not set" lines are
+// considered to set a symbol.
+func parseKconfigLine(line string) (string, string, bool) {
+	trimmedLine := strings.TrimSpace(line)
+
+	if disabledSymbol, ok := strings.CutPrefix(trimmedLine, "# "); ok {
+		disabledSymbol, ok = strings.CutSuffix(disabledSymbol, " is not set")
+		if ok && strings.HasPrefix(disabledSymbol, "CONFIG_") && !strings.Contains(disabledSymbol, " ") {
+			return disabledSymbol, kconfigDisabledValue, true
+		}
+
+		return "", "", false
+	}
+
+	symbol, value, found := strings.Cut(trimmedLine, "=")
+	if !found || !strings.HasPrefix(symbol, "CONFIG_") {
+		return "", "", false
+	}
+
+	return symbol, value, true
+}
+
+func formatKconfigLine(symbol, value string) string {
+	if value == kconfigDisabledValue {
+		return fmt.Sprintf("# %s is not set", symbol)
+	}
+
+	return fmt.Sprintf("%s=%s", symbol, value)
+}
+
+func (k *kconfig) Get(symbol string) (string, bool) {
+	lineIndex, ok := k.symbolLines[symbol]
+	if !ok {
+		return "", false
+	}
+
+	_, value, _ := parseKconfigLine(k.lines[lineIndex])
+	return value, true
+}
+
+// Set the raw value of a symbol. String values must include quotes.
+func (k *kconfig) Set(symbol, value string) {
+	line := formatKconfigLine(symbol, value)
+	if lineIndex, ok := k.symbolLines[symbol]; ok {
+		k.lines[lineIndex] = line
+		return
+	}
+
+	k.symbolLines[symbol] = len(k.lines)
+	k.symbolOrder = append(k.symbolOrder, symbol)
+	k.lines = append(k.lines, line)
+}
+
+// Get all symbols set by the file, in the order that they were first set
+func (k *kconfig) GetSymbols() []string {
+	return k.symbolOrder
+}
+
+// Apply all values set by the fragment
+func (k *kconfig) Merge(fragment *kconfig) {
+	for _, symbol := range fragment.GetSymbols() {
+		fragmentValue, _ := fragment.Get(symbol)
+		currentValue, ok := k.Get(symbol)
+		if ok && currentValue != fragmentValue {
+			slog.Info("Overriding config value", "symbol", symbol, "previous_value", currentValue, "new_value", fragmentValue, "fragment", fragment.Name)
+		}
+
+		k.Set(symbol, fragmentValue)
+	}
+}
+
+func (k *kconfig) Write(filePath string) error {
+	err := os.WriteFile(filePath, []byte(strings.Join(k.lines, "\n")+"\n"), 0644)
+	if err != nil {
+		return trace.Wrap(err, "failed to write kconfig file %q", filePath)
+	}
+
+	return nil
 }
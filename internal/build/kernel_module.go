@@ -0,0 +1,395 @@
+package build
+
+import (
+	"bytes"
+	"context"
+	"debug/elf"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/gravitational/trace"
+	"github.com/otiai10/copy"
+	"github.com/solidDoWant/distrobuilder/internal/runners"
+	"github.com/solidDoWant/distrobuilder/internal/runners/args"
+	"github.com/solidDoWant/distrobuilder/internal/source"
+	"github.com/solidDoWant/distrobuilder/internal/utils"
+)
+
+const (
+	DefaultKernelModuleRef string = "HEAD"
+
+	// Directory under /usr/lib/modules/<release> that external modules are installed to. This
+	// takes precedence over in-tree modules with the same name.
+	kernelModuleInstallDirectory = "updates"
+)
+
+// Builds an out-of-tree kernel module against the kernel installed in the root filesystem
+type KernelModule struct {
+	StandardBuilder
+
+	ModuleName             string // Name of the module source, used for the source download path
+	RepoURL                string
+	KernelRelease          string // Optional, defaults to the only kernel installed in the root filesystem
+	SourceSubdirectoryPath string // Optional path to the Kbuild file directory, relative to the repo root
+
+	kernelSourceDirectoryPath string
+}
+
+func NewKernelModule() *KernelModule {
+	instance := &KernelModule{
+		StandardBuilder: StandardBuilder{
+			Name: "kernel-module",
+		},
+	}
+
+	instance.IStandardBuilder = instance
+	return instance
+}
+
+func (km *KernelModule) GetGitRepo(repoDirectoryPath string, ref string) *source.GitRepo {
+	if ref == "" {
+		ref = DefaultKernelModuleRef
+	}
+
+	return source.NewGitRepo(km.ModuleName, km.RepoURL, ref)
+}
+
+func (km *KernelModule) CheckHostRequirements() error {
+	err := km.StandardBuilder.CheckHostRequirements()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	err = runners.CheckRequiredCommandsExist([]string{"depmod"})
+	if err != nil {
+		return trace.Wrap(err, "failed to verify that all required commands exist")
+	}
+
+	return nil
+}
+
+func (km *KernelModule) DoConfiguration(buildDirectoryPath string) error {
+	if km.KernelRelease == "" {
+		var err error
+		km.KernelRelease, err = getInstalledKernelRelease(km.RootFSDirectoryPath)
+		if err != nil {
+			return trace.Wrap(err, "failed to detect the installed kernel release")
+		}
+	}
+
+	kernelSourceDirectoryPath, err := km.getKernelSourceDirectoryPath()
+	if err != nil {
+		return trace.Wrap(err, "failed to find the kernel source for release %q", km.KernelRelease)
+	}
+	km.kernelSourceDirectoryPath = kernelSourceDirectoryPath
+
+	err = km.CopyToBuildDirectory(km.getModuleBuildDirectoryPath(buildDirectoryPath))
+	if err != nil {
+		return trace.Wrap(err, "failed to copy source directory %q to build directory %q", km.SourceDirectoryPath, buildDirectoryPath)
+	}
+
+	err = km.prepareKernel(buildDirectoryPath)
+	if err != nil {
+		return trace.Wrap(err, "failed to prepare the kernel tree for building external modules")
+	}
+
+	return nil
+}
+
+// Resolve the "build" link that the kernel installs in its modules directory. This is an
+// absolute path within the root filesystem.
+func (km *KernelModule) getKernelSourceDirectoryPath() (string, error) {
+	buildLinkPath := path.Join(km.getRootFSModulesDirectoryPath(), "build")
+	linkTarget, err := os.Readlink(buildLinkPath)
+	if err != nil {
+		return "", trace.Wrap(err, "failed to read kernel source link %q", buildLinkPath)
+	}
+
+	kernelSourceDirectoryPath := path.Join(path.Dir(buildLinkPath), linkTarget)
+	if path.IsAbs(linkTarget) {
+		kernelSourceDirectoryPath = path.Join(km.RootFSDirectoryPath, linkTarget)
+	}
+
+	exists, err := utils.DoesFilesystemPathExist(path.Join(kernelSourceDirectoryPath, "Makefile"))
+	if err != nil {
+		return "", trace.Wrap(err, "failed to check if kernel source exists at %q", kernelSourceDirectoryPath)
+	}
+
+	if !exists {
+		return "", trace.Errorf("kernel source directory %q does not contain a Makefile", kernelSourceDirectoryPath)
+	}
+
+	return kernelSourceDirectoryPath, nil
+}
+
+// The installed kernel source is pristine, so generate the headers and scripts needed for
+// building modules in a separate (O=) directory. This leaves the root filesystem untouched.
+func (km *KernelModule) prepareKernel(buildDirectoryPath string) error {
+	kernelBuildDirectoryPath := km.getKernelBuildDirectoryPath(buildDirectoryPath)
+	_, err := utils.EnsureDirectoryExists(kernelBuildDirectoryPath)
+	if err != nil {
+		return trace.Wrap(err, "failed to create kernel build directory %q", kernelBuildDirectoryPath)
+	}
+
+	for sourceFilePath, destinationFileName := range map[string]string{
+		path.Join(km.RootFSDirectoryPath, "boot", "config-"+km.KernelRelease): ".config",
+		path.Join(km.kernelSourceDirectoryPath, "Module.symvers"):             "Module.symvers",
+	} {
+		err = copy.Copy(sourceFilePath, path.Join(kernelBuildDirectoryPath, destinationFileName))
+		if err != nil {
+			return trace.Wrap(err, "failed to copy %q to the kernel build directory", sourceFilePath)
+		}
+	}
+
+	makeOptions, err := km.getMakeOptions(&runners.MakeOptions{
+		Variables: map[string]args.IValue{
+			"O": args.StringValue(kernelBuildDirectoryPath),
+		},
+	})
+	if err != nil {
+		return trace.Wrap(err, "failed to build make options")
+	}
+
+	err = km.MakeBuild(km.kernelSourceDirectoryPath, makeOptions, "olddefconfig", "modules_prepare")
+	if err != nil {
+		return trace.Wrap(err, "failed to prepare kernel tree %q", km.kernelSourceDirectoryPath)
+	}
+
+	return nil
+}
+
+func (km *KernelModule) DoBuild(buildDirectoryPath string) error {
+	makeOptions, err := km.getMakeOptions(&runners.MakeOptions{
+		Variables: map[string]args.IValue{
+			"M":               args.StringValue(km.getModuleSourceDirectoryPath(buildDirectoryPath)),
+			"INSTALL_MOD_DIR": args.StringValue(kernelModuleInstallDirectory),
+			// The module index is owned by the kernel package, and is regenerated when the modules are installed
+			"DEPMOD": args.StringValue("true"),
+		},
+	})
+	if err != nil {
+		return trace.Wrap(err, "failed to build make options")
+	}
+
+	err = km.MakeBuild(km.getKernelBuildDirectoryPath(buildDirectoryPath), makeOptions, "modules", "modules_install")
+	if err != nil {
+		return trace.Wrap(err, "failed to build %s", km.ModuleName)
+	}
+
+	err = km.checkModuleSymbols(buildDirectoryPath)
+	if err != nil {
+		return trace.Wrap(err, "failed to check module symbols")
+	}
+
+	return nil
+}
+
+func (km *KernelModule) getMakeOptions(additionalOptions ...*runners.MakeOptions) ([]*runners.MakeOptions, error) {
+	makeOptions, err := getKernelMakeOptions(&km.ToolchainRequiredBuilder, km.OutputDirectoryPath)
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to get kernel make options")
+	}
+
+	return append(makeOptions, additionalOptions...), nil
+}
+
+// Check for symbols used by the built modules that are not provided by the kernel or any module.
+// depmod indexes every module for the release, so the kernel's modules are staged alongside
+// the built modules. The resulting index is discarded, as the index in the root filesystem is
+// owned by the kernel package, and is regenerated when the built modules are installed.
+func (km *KernelModule) checkModuleSymbols(buildDirectoryPath string) error {
+	stagingDirectoryPath := path.Join(buildDirectoryPath, "depmod")
+	stagedModulesDirectoryPath := path.Join(stagingDirectoryPath, "lib", "modules", km.KernelRelease)
+	err := copy.Copy(km.getRootFSModulesDirectoryPath(), stagedModulesDirectoryPath, copy.Options{
+		// Skip the links to the kernel source, which are not valid outside of the root filesystem
+		OnSymlink: func(src string) copy.SymlinkAction { return copy.Skip },
+	})
+	if err != nil {
+		return trace.Wrap(err, "failed to stage the installed kernel modules")
+	}
+
+	err = copy.Copy(km.getOutputModulesDirectoryPath(), stagedModulesDirectoryPath)
+	if err != nil {
+		return trace.Wrap(err, "failed to stage the built kernel modules")
+	}
+
+	// Newer versions of kmod may be configured to look under /usr/lib/modules instead
+	stagedUsrLibDirectoryPath := path.Join(stagingDirectoryPath, "usr", "lib")
+	_, err = utils.EnsureDirectoryExists(stagedUsrLibDirectoryPath)
+	if err != nil {
+		return trace.Wrap(err, "failed to create directory %q", stagedUsrLibDirectoryPath)
+	}
+
+	err = os.Symlink(path.Join("..", "..", "lib", "modules"), path.Join(stagedUsrLibDirectoryPath, "modules"))
+	if err != nil {
+		return trace.Wrap(err, "failed to link the staged modules directory")
+	}
+
+	result, err := runners.Run(&runners.CommandRunner{
+		Command: "depmod",
+		Arguments: []string{
+			"-b", stagingDirectoryPath,
+			// Report symbols that are not provided by the kernel or any module
+			"-e", "-E", path.Join(km.kernelSourceDirectoryPath, "Module.symvers"),
+			km.KernelRelease,
+		},
+	})
+	if err != nil {
+		return trace.Wrap(err, "failed to run depmod for kernel release %q", km.KernelRelease)
+	}
+
+	// depmod only warns about unknown symbols, and still exits successfully
+	var unknownSymbolErrors []error
+	for _, line := range strings.Split(result.Stdout+"\n"+result.Stderr, "\n") {
+		if strings.Contains(line, "needs unknown symbol") {
+			unknownSymbolErrors = append(unknownSymbolErrors, trace.Errorf("%s", strings.TrimSpace(line)))
+		}
+	}
+
+	if len(unknownSymbolErrors) > 0 {
+		return trace.Wrap(trace.NewAggregate(unknownSymbolErrors...), "built modules use symbols that are not provided by the kernel or any module")
+	}
+
+	return nil
+}
+
+func (km *KernelModule) VerifyBuild(ctx context.Context) error {
+	expectedVermagic, err := km.getKernelVermagic()
+	if err != nil {
+		return trace.Wrap(err, "failed to get the vermagic of the installed kernel")
+	}
+
+	installDirectoryPath := path.Join(km.getOutputModulesDirectoryPath(), kernelModuleInstallDirectory)
+	moduleCount := 0
+	err = filepath.WalkDir(installDirectoryPath, func(fsPath string, fsEntry fs.DirEntry, err error) error {
+		if err != nil {
+			return trace.Wrap(err, "failed to walk dir %q", fsPath)
+		}
+
+		moduleExtension := getModuleExtension(fsPath)
+		if fsEntry.IsDir() || !strings.HasPrefix(moduleExtension, ".ko") {
+			return nil
+		}
+		moduleCount++
+
+		vermagic, err := readModuleVermagic(fsPath, moduleExtension)
+		if err != nil {
+			return trace.Wrap(err, "failed to read vermagic of module %q", fsPath)
+		}
+
+		if expectedVermagic == "" {
+			// Only the release could be determined, which is the first field of the vermagic
+			if !strings.HasPrefix(vermagic, km.KernelRelease+" ") {
+				return trace.Errorf("module %q vermagic %q does not match kernel release %q", fsPath, vermagic, km.KernelRelease)
+			}
+
+			return nil
+		}
+
+		if vermagic != expectedVermagic {
+			return trace.Errorf("module %q vermagic %q does not match kernel vermagic %q", fsPath, vermagic, expectedVermagic)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return trace.Wrap(err, "failed to verify modules in %q", installDirectoryPath)
+	}
+
+	if moduleCount == 0 {
+		return trace.Errorf("no modules were installed to %q", installDirectoryPath)
+	}
+
+	slog.Info("Verified kernel modules", "module_count", moduleCount, "vermagic", expectedVermagic)
+	return nil
+}
+
+// Get the vermagic from one of the kernel's own modules. If the kernel does not have any modules
+// installed, an empty string is returned.
+func (km *KernelModule) getKernelVermagic() (string, error) {
+	vermagic := ""
+	modulesDirectoryPath := km.getRootFSModulesDirectoryPath()
+	err := filepath.WalkDir(modulesDirectoryPath, func(fsPath string, fsEntry fs.DirEntry, err error) error {
+		if err != nil {
+			return trace.Wrap(err, "failed to walk dir %q", fsPath)
+		}
+
+		// Skip previously installed external modules
+		if fsEntry.IsDir() && fsEntry.Name() == kernelModuleInstallDirectory {
+			return fs.SkipDir
+		}
+
+		moduleExtension := getModuleExtension(fsPath)
+		if fsEntry.IsDir() || !strings.HasPrefix(moduleExtension, ".ko") {
+			return nil
+		}
+
+		vermagic, err = readModuleVermagic(fsPath, moduleExtension)
+		if err != nil {
+			return trace.Wrap(err, "failed to read vermagic of module %q", fsPath)
+		}
+
+		return fs.SkipAll
+	})
+	if err != nil {
+		return "", trace.Wrap(err, "failed to search for kernel modules in %q", modulesDirectoryPath)
+	}
+
+	return vermagic, nil
+}
+
+// Read the "vermagic" value from the module info section of a module
+func readModuleVermagic(modulePath, moduleExtension string) (string, error) {
+	moduleContents, err := readModule(modulePath, moduleExtension)
+	if err != nil {
+		return "", trace.Wrap(err, "failed to read module")
+	}
+
+	elfFile, err := elf.NewFile(bytes.NewReader(moduleContents))
+	if err != nil {
+		return "", trace.Wrap(err, "failed to parse module ELF")
+	}
+
+	modinfoSection := elfFile.Section(".modinfo")
+	if modinfoSection == nil {
+		return "", trace.Errorf("module does not have a .modinfo section")
+	}
+
+	modinfo, err := modinfoSection.Data()
+	if err != nil {
+		return "", trace.Wrap(err, "failed to read .modinfo section")
+	}
+
+	// The section is a series of null terminated "key=value" strings
+	for _, field := range bytes.Split(modinfo, []byte{0}) {
+		if vermagic, ok := bytes.CutPrefix(field, []byte("vermagic=")); ok {
+			return string(vermagic), nil
+		}
+	}
+
+	return "", trace.Errorf("module info does not contain a vermagic value")
+}
+
+func (km *KernelModule) getRootFSModulesDirectoryPath() string {
+	return path.Join(km.RootFSDirectoryPath, "usr", "lib", "modules", km.KernelRelease)
+}
+
+func (km *KernelModule) getOutputModulesDirectoryPath() string {
+	return path.Join(km.OutputDirectoryPath, "usr", "lib", "modules", km.KernelRelease)
+}
+
+func (km *KernelModule) getModuleBuildDirectoryPath(buildDirectoryPath string) string {
+	return path.Join(buildDirectoryPath, "module")
+}
+
+func (km *KernelModule) getModuleSourceDirectoryPath(buildDirectoryPath string) string {
+	return path.Join(km.getModuleBuildDirectoryPath(buildDirectoryPath), km.SourceSubdirectoryPath)
+}
+
+func (km *KernelModule) getKernelBuildDirectoryPath(buildDirectoryPath string) string {
+	return path.Join(buildDirectoryPath, "kernel")
+}
@@ -0,0 +1,247 @@
+package build
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/gravitational/trace"
+)
+
+// Kernel options that the distro depends on, regardless of the config that the kernel is
+// built with. Values use the same syntax as a kconfig fragment, with the addition of "|"
+// to allow multiple values.
+var defaultKernelRequirements = []string{
+	// /dev population, required by the initramfs and mdev
+	"CONFIG_DEVTMPFS=y",
+	// Read-only root images with writable overlays
+	"CONFIG_OVERLAY_FS=y|m",
+	"CONFIG_SQUASHFS=y|m",
+	// Namespaces, used by containers and sandboxing
+	"CONFIG_NAMESPACES=y",
+	"CONFIG_UTS_NS=y",
+	"CONFIG_IPC_NS=y",
+	"CONFIG_PID_NS=y",
+	"CONFIG_NET_NS=y",
+	"CONFIG_USER_NS=y",
+	// cgroups v2
+	"CONFIG_CGROUPS=y",
+	"CONFIG_MEMCG=y",
+	"CONFIG_CGROUP_PIDS=y",
+	// seccomp
+	"CONFIG_SECCOMP=y",
+	"CONFIG_SECCOMP_FILTER=y",
+}
+
+// Matches kconfig symbol references in a dependency expression
+var kconfigSymbolPattern = regexp.MustCompile(`\b[A-Z][A-Z0-9_]*\b`)
+
+// Maximum depth that dependency chains are followed when reporting unmet requirements
+const maxDependencyChainDepth = 8
+
+// Get the kernel requirements, with any requirements from the file overriding the defaults
+func getKernelRequirements(requirementsFilePath string) (*kconfig, error) {
+	requirements := newKconfig("default requirements")
+	for _, requirement := range defaultKernelRequirements {
+		symbol, value, _ := parseKconfigLine(requirement)
+		requirements.Set(symbol, value)
+	}
+
+	if requirementsFilePath == "" {
+		return requirements, nil
+	}
+
+	fileRequirements, err := readKconfig(requirementsFilePath)
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to read kernel requirements file")
+	}
+	requirements.Merge(fileRequirements)
+
+	return requirements, nil
+}
+
+// Check the resolved config against the requirements. Each unmet requirement is reported along
+// with the chain of dependencies that prevent it from being set, when the kernel source is
+// available.
+func checkKernelRequirements(config, requirements *kconfig, kernelSourceDirectoryPath string) error {
+	unmetSymbols := make([]string, 0)
+	for _, symbol := range requirements.GetSymbols() {
+		requiredValue, _ := requirements.Get(symbol)
+		if slices.Contains(strings.Split(requiredValue, "|"), getResolvedKconfigValue(config, symbol)) {
+			continue
+		}
+
+		unmetSymbols = append(unmetSymbols, symbol)
+	}
+
+	if len(unmetSymbols) == 0 {
+		return nil
+	}
+
+	var dependencies map[string][]string
+	if kernelSourceDirectoryPath != "" {
+		var err error
+		dependencies, err = readKconfigDependencies(kernelSourceDirectoryPath)
+		if err != nil {
+			return trace.Wrap(err, "failed to read kconfig dependencies from the kernel source")
+		}
+	}
+
+	report := &strings.Builder{}
+	for _, symbol := range unmetSymbols {
+		requiredValue, _ := requirements.Get(symbol)
+		fmt.Fprintf(report, "\n%s: required %s, found %s", symbol, requiredValue, getResolvedKconfigValue(config, symbol))
+		writeDependencyChain(report, config, dependencies, strings.TrimPrefix(symbol, "CONFIG_"), 1, map[string]struct{}{})
+	}
+
+	return trace.Errorf("%d required kernel options are not met:%s", len(unmetSymbols), report.String())
+}
+
+func getResolvedKconfigValue(config *kconfig, symbol string) string {
+	value, ok := config.Get(symbol)
+	if !ok {
+		return kconfigDisabledValue
+	}
+
+	return value
+}
+
+// Write the dependencies of the symbol (without the "CONFIG_" prefix), recursing into
+// dependencies that are not enabled
+func writeDependencyChain(report *strings.Builder, config *kconfig, dependencies map[string][]string, symbol string, depth int, visited map[string]struct{}) {
+	if depth > maxDependencyChainDepth {
+		return
+	}
+
+	if _, ok := visited[symbol]; ok {
+		return
+	}
+	visited[symbol] = struct{}{}
+
+	indent := strings.Repeat("  ", depth)
+	for _, expression := range dependencies[symbol] {
+		fmt.Fprintf(report, "\n%sdepends on %s", indent, expression)
+
+		dependencySymbols := kconfigSymbolPattern.FindAllString(expression, -1)
+		slices.Sort(dependencySymbols)
+		for _, dependencySymbol := range slices.Compact(dependencySymbols) {
+			dependencyValue := getResolvedKconfigValue(config, "CONFIG_"+dependencySymbol)
+			if dependencyValue != kconfigDisabledValue {
+				continue
+			}
+
+			fmt.Fprintf(report, "\n%s  CONFIG_%s is not set", indent, dependencySymbol)
+			writeDependencyChain(report, config, dependencies, dependencySymbol, depth+2, visited)
+		}
+	}
+}
+
+// Parse the "depends on" expressions for every symbol defined in the kernel source. Expressions
+// from enclosing "if" blocks are included. Expressions from enclosing menus are not.
+func readKconfigDependencies(kernelSourceDirectoryPath string) (map[string][]string, error) {
+	// The source directory is typically a symlink, which would not be walked
+	kernelSourceDirectoryPath, err := filepath.EvalSymlinks(kernelSourceDirectoryPath)
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to resolve kernel source directory path")
+	}
+
+	dependencies := map[string][]string{}
+	err = filepath.WalkDir(kernelSourceDirectoryPath, func(fsPath string, fsEntry fs.DirEntry, err error) error {
+		if err != nil {
+			return trace.Wrap(err, "failed to walk dir %q", fsPath)
+		}
+
+		if fsEntry.IsDir() || !strings.HasPrefix(fsEntry.Name(), "Kconfig") {
+			return nil
+		}
+
+		fileContents, err := os.ReadFile(fsPath)
+		if err != nil {
+			return trace.Wrap(err, "failed to read %q", fsPath)
+		}
+
+		parseKconfigDependencies(string(fileContents), dependencies)
+		return nil
+	})
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to read Kconfig files in %q", kernelSourceDirectoryPath)
+	}
+
+	return dependencies, nil
+}
+
+func parseKconfigDependencies(fileContents string, dependencies map[string][]string) {
+	currentSymbol := ""
+	ifExpressions := make([]string, 0)
+	isInHelpText := false
+	helpTextIndent := -1
+	for _, line := range strings.Split(fileContents, "\n") {
+		trimmedLine := strings.TrimSpace(line)
+
+		// Help text continues until a line that is indented less than the first line of the text
+		if isInHelpText {
+			if trimmedLine == "" {
+				continue
+			}
+
+			lineIndent := getKconfigIndent(line)
+			if helpTextIndent == -1 {
+				helpTextIndent = lineIndent
+			}
+
+			if lineIndent >= helpTextIndent {
+				continue
+			}
+
+			isInHelpText = false
+		}
+
+		keyword, arguments, _ := strings.Cut(trimmedLine, " ")
+		arguments = strings.TrimSpace(arguments)
+
+		switch keyword {
+		case "config", "menuconfig":
+			currentSymbol = arguments
+			dependencies[currentSymbol] = append(dependencies[currentSymbol], ifExpressions...)
+		case "depends":
+			expression, isDependsOn := strings.CutPrefix(arguments, "on ")
+			if currentSymbol != "" && isDependsOn {
+				dependencies[currentSymbol] = append(dependencies[currentSymbol], strings.TrimSpace(expression))
+			}
+		case "if":
+			ifExpressions = append(ifExpressions, arguments)
+			currentSymbol = ""
+		case "endif":
+			if len(ifExpressions) > 0 {
+				ifExpressions = ifExpressions[:len(ifExpressions)-1]
+			}
+			currentSymbol = ""
+		case "help", "---help---":
+			isInHelpText = true
+			helpTextIndent = -1
+		case "menu", "endmenu", "choice", "endchoice", "comment", "source", "mainmenu":
+			currentSymbol = ""
+		}
+	}
+}
+
+// Get the width of the leading whitespace of a line, with tabs expanded to eight columns
+func getKconfigIndent(line string) int {
+	indent := 0
+	for _, character := range line {
+		switch character {
+		case ' ':
+			indent++
+		case '\t':
+			indent = (indent/8 + 1) * 8
+		default:
+			return indent
+		}
+	}
+
+	return indent
+}
@@ -3,8 +3,6 @@ package build
 import (
 	"os"
 	"path"
-	"path/filepath"
-	"strings"
 
 	"github.com/gravitational/trace"
 	"github.com/solidDoWant/distrobuilder/internal/runners"
@@ -123,7 +121,7 @@ func (lssl *LibreSSL) patchBinaryEtcReferences() error {
 	for _, fileToPatch := range filesToPatch {
 		filePath := path.Join(lssl.OutputDirectoryPath, "usr", fileToPatch)
 
-		err := lssl.patchBinaryEtcReference(filePath, searchPrefix)
+		err := patchNullTerminatedPathPrefix(filePath, searchPrefix)
 		if err != nil {
 			return trace.Wrap(err, "failed to patch binary at %q", filePath)
 		}
@@ -132,71 +130,6 @@ func (lssl *LibreSSL) patchBinaryEtcReferences() error {
 	return nil
 }
 
-func (lssl *LibreSSL) patchBinaryEtcReference(filePath, searchPrefix string) error {
-	fileBytes, err := os.ReadFile(filePath)
-	if err != nil {
-		return trace.Wrap(err, "failed to read file %q into memory", filePath)
-	}
-
-	// TODO look in data sections only?
-
-	fileStrings := findNullTerminatedStrings(fileBytes, len(searchPrefix))
-	for fileString, positions := range fileStrings {
-		startOffset := strings.Index(fileString, searchPrefix)
-
-		// Skip the string if the search prefix is not found in it
-		if startOffset == -1 {
-			continue
-		}
-
-		// Remove the search prefix from the portion of the file string that contains it
-		correctPath, err := filepath.Rel(searchPrefix, fileString[startOffset:])
-		if err != nil {
-			return trace.Wrap(err, "failed to get path of %q relative to %q", fileString, searchPrefix)
-		}
-
-		// Make the path absolute, and add a null termination character
-		replacementValue := []byte("/" + correctPath + string(rune(0)))
-
-		// Copy the replacement value
-		for _, position := range positions {
-			utils.UpdateSubset(&fileBytes, startOffset+position, &replacementValue)
-		}
-	}
-
-	err = os.WriteFile(filePath, fileBytes, 0)
-	if err != nil {
-		return trace.Wrap(err, "failed to write patched binary to %q", filePath)
-	}
-
-	return nil
-}
-
-func findNullTerminatedStrings(bytes []byte, minLength int) map[string][]int {
-	results := make(map[string][]int)
-	minLength++ // Increase by 1 to account for the null termination character
-
-	previousNullTerminationCharacterPosition := 0
-	for i, b := range bytes {
-		// Find null termination characters
-		if rune(b) != rune(0) {
-			continue
-		}
-
-		// Found a string of approprate length
-		if i-previousNullTerminationCharacterPosition >= minLength {
-			// Skip the last null termination character, and the current one
-			startPosition := previousNullTerminationCharacterPosition + 1
-			foundString := string(bytes[startPosition:i])
-			results[foundString] = append(results[foundString], startPosition)
-		}
-
-		previousNullTerminationCharacterPosition = i
-	}
-
-	return results
-}
-
 func (lssl *LibreSSL) getCmakeBuildDirectory(buildDirectoryPath string) string {
 	return path.Join(buildDirectoryPath, "build")
 }
@@ -81,7 +81,7 @@ func (lh *LinuxHeaders) runLinuxMake(sourceDirectoryPath, buildDirectoryPath, bu
 		Options: []*runners.MakeOptions{
 			{
 				Variables: map[string]args.IValue{
-					"ARCH":             args.StringValue(lh.Triplet.Machine),
+					"ARCH":             args.StringValue(lh.Triplet.GetKernelArch()),
 					"INSTALL_HDR_PATH": args.StringValue(path.Join(lh.OutputDirectoryPath, "usr")),
 				},
 			},
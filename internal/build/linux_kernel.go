@@ -1,11 +1,18 @@
 package build
 
 import (
+	"compress/gzip"
+	"context"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"io"
 	"io/fs"
+	"log/slog"
 	"os"
 	"path"
 	"path/filepath"
+	"slices"
 	"strings"
 
 	"github.com/gravitational/trace"
@@ -20,17 +27,24 @@ import (
 type LinuxKernel struct {
 	StandardBuilder
 	KconfigBuilder
+
+	// Optional uncompressed initramfs cpio archive, or directory, to embed in the kernel image
+	InitramfsPath        string
+	InitramfsCompression string // Compression applied by the kernel build to the embedded initramfs
+	RequirementsPath     string // Optional kconfig fragment of options that must be set, in addition to the defaults
+	// Optional PEM file containing the module signing private key and certificate. If the file
+	// does not exist, a new key pair is generated and written to it so that it can be reused by
+	// later builds.
+	ModuleSigningKeyPath  string
+	ShouldCompressModules bool // Compress installed modules with zstd
+
+	kernelRelease string
 }
 
 func NewLinuxKernel() *LinuxKernel {
 	instance := &LinuxKernel{
 		StandardBuilder: StandardBuilder{
-			Name:            "linux-kernel",
-			BinariesToCheck: []string{
-				// path.Join("usr", "lib", "libz.so"),
-				// path.Join("usr", "bin", "minigzip"),
-				// path.Join("bin", "busybox"),
-			},
+			Name: "linux-kernel",
 		},
 	}
 
@@ -55,14 +69,196 @@ func (lk *LinuxKernel) DoConfiguration(buildDirectoryPath string) error {
 		return trace.Wrap(err, "failed to clean the %q", buildDirectoryPath)
 	}
 
+	fragmentPath, err := lk.writeConfigFragment(buildDirectoryPath)
+	if err != nil {
+		return trace.Wrap(err, "failed to create module and initramfs config")
+	}
+
+	if fragmentPath != "" {
+		lk.ConfigFragmentPaths = append(lk.ConfigFragmentPaths, fragmentPath)
+	}
+
 	err = lk.CopyKconfig(buildDirectoryPath, nil)
 	if err != nil {
 		return trace.Wrap(err, "failed to copy the kconfig to %q", buildDirectoryPath)
 	}
 
+	err = lk.ResolveKconfig(buildDirectoryPath, func() error {
+		makeOptions, err := lk.getMakeOptions()
+		if err != nil {
+			return trace.Wrap(err, "failed to build make options")
+		}
+
+		return trace.Wrap(lk.MakeBuild(buildDirectoryPath, makeOptions, "olddefconfig"))
+	})
+	if err != nil {
+		return trace.Wrap(err, "failed to resolve the merged kconfig")
+	}
+
 	return nil
 }
 
+// Write a config fragment that enables module signing and compression, and initramfs embedding,
+// as requested. Values are verified after dependency resolution, like user provided fragments.
+// An empty path is returned if nothing is requested.
+func (lk *LinuxKernel) writeConfigFragment(buildDirectoryPath string) (string, error) {
+	fragmentLines, err := lk.getInitramfsConfigLines()
+	if err != nil {
+		return "", trace.Wrap(err, "failed to get initramfs config")
+	}
+
+	if lk.ModuleSigningKeyPath != "" {
+		keyPath, err := lk.ensureModuleSigningKey()
+		if err != nil {
+			return "", trace.Wrap(err, "failed to get module signing key")
+		}
+
+		fragmentLines = append(fragmentLines,
+			"CONFIG_MODULES=y",
+			"CONFIG_MODULE_SIG=y",
+			"CONFIG_MODULE_SIG_ALL=y",
+			"CONFIG_MODULE_SIG_SHA512=y",
+			`CONFIG_MODULE_SIG_HASH="sha512"`,
+			fmt.Sprintf("CONFIG_MODULE_SIG_KEY=%q", keyPath),
+		)
+	}
+
+	if lk.ShouldCompressModules {
+		// Newer kernels (6.12+) gate the compression choice behind a separate option
+		hasCompressionOption, err := lk.doesKconfigSymbolExist("MODULE_COMPRESS", path.Join("kernel", "module", "Kconfig"))
+		if err != nil {
+			return "", trace.Wrap(err, "failed to check for module compression option")
+		}
+
+		if hasCompressionOption {
+			fragmentLines = append(fragmentLines, "CONFIG_MODULE_COMPRESS=y")
+		}
+
+		fragmentLines = append(fragmentLines, "CONFIG_MODULES=y", "CONFIG_MODULE_COMPRESS_ZSTD=y")
+	}
+
+	if len(fragmentLines) == 0 {
+		return "", nil
+	}
+
+	fragmentPath := path.Join(buildDirectoryPath, ".distrobuilder.config")
+	err = os.WriteFile(fragmentPath, []byte(strings.Join(fragmentLines, "\n")+"\n"), 0644)
+	if err != nil {
+		return "", trace.Wrap(err, "failed to write config fragment to %q", fragmentPath)
+	}
+
+	return fragmentPath, nil
+}
+
+// Get the config lines that embed the initramfs in the kernel image, if one was provided
+func (lk *LinuxKernel) getInitramfsConfigLines() ([]string, error) {
+	if lk.InitramfsPath == "" {
+		return nil, nil
+	}
+
+	// Relative paths would be resolved against the kernel source tree
+	initramfsPath, err := filepath.Abs(lk.InitramfsPath)
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to get absolute path of initramfs %q", lk.InitramfsPath)
+	}
+
+	fragmentLines := []string{
+		"CONFIG_BLK_DEV_INITRD=y",
+		fmt.Sprintf("CONFIG_INITRAMFS_SOURCE=%q", initramfsPath),
+	}
+
+	switch lk.InitramfsCompression {
+	case InitramfsCompressionZstd:
+		fragmentLines = append(fragmentLines, "CONFIG_RD_ZSTD=y", "CONFIG_INITRAMFS_COMPRESSION_ZSTD=y")
+	case InitramfsCompressionXz:
+		fragmentLines = append(fragmentLines, "CONFIG_RD_XZ=y", "CONFIG_INITRAMFS_COMPRESSION_XZ=y")
+	case InitramfsCompressionNone:
+		fragmentLines = append(fragmentLines, "CONFIG_INITRAMFS_COMPRESSION_NONE=y")
+	default:
+		return nil, trace.Errorf("unsupported initramfs compression %q, must be one of %v", lk.InitramfsCompression, InitramfsCompressions)
+	}
+
+	return fragmentLines, nil
+}
+
+// Check that the initramfs can be embedded. Kbuild uses a directory or a file with a ".cpio"
+// suffix as-is, and parses any other file as a gen_init_cpio file list.
+func (lk *LinuxKernel) validateInitramfsPath() (err error) {
+	if lk.InitramfsPath == "" {
+		return nil
+	}
+
+	var initramfsInfo fs.FileInfo
+	initramfsInfo, err = os.Stat(lk.InitramfsPath)
+	if err != nil {
+		return trace.Wrap(err, "failed to stat initramfs %q", lk.InitramfsPath)
+	}
+
+	if initramfsInfo.IsDir() {
+		return nil
+	}
+
+	if !strings.HasSuffix(lk.InitramfsPath, ".cpio") {
+		return trace.Errorf("initramfs %q must be a directory or an uncompressed archive with a .cpio suffix, build it with the initramfs embeddable archive flag", lk.InitramfsPath)
+	}
+
+	var initramfsFile *os.File
+	initramfsFile, err = os.Open(lk.InitramfsPath)
+	if err != nil {
+		return trace.Wrap(err, "failed to open initramfs %q", lk.InitramfsPath)
+	}
+	defer utils.Close(initramfsFile, &err)
+
+	magic := make([]byte, len(cpioNewcMagic))
+	_, err = io.ReadFull(initramfsFile, magic)
+	if err != nil || string(magic) != cpioNewcMagic {
+		return trace.Errorf("initramfs %q is not an uncompressed newc cpio archive", lk.InitramfsPath)
+	}
+
+	return nil
+}
+
+// Get the absolute path to the module signing key, generating it if it does not exist
+func (lk *LinuxKernel) ensureModuleSigningKey() (string, error) {
+	// Relative paths would be resolved against the kernel source tree
+	keyPath, err := filepath.Abs(lk.ModuleSigningKeyPath)
+	if err != nil {
+		return "", trace.Wrap(err, "failed to get absolute path of module signing key %q", lk.ModuleSigningKeyPath)
+	}
+
+	doesKeyExist, err := utils.DoesFilesystemPathExist(keyPath)
+	if err != nil {
+		return "", trace.Wrap(err, "failed to check if module signing key %q exists", keyPath)
+	}
+
+	if !doesKeyExist {
+		slog.Info("Generating module signing key", "key_path", keyPath)
+		err = generateModuleSigningKey(keyPath, "distrobuilder kernel module signing key")
+		if err != nil {
+			return "", trace.Wrap(err, "failed to generate module signing key")
+		}
+	}
+
+	return keyPath, nil
+}
+
+// Check if the source file defines the kconfig symbol
+func (lk *LinuxKernel) doesKconfigSymbolExist(symbol, kconfigFilePath string) (bool, error) {
+	dependencies := map[string][]string{}
+	fileContents, err := os.ReadFile(path.Join(lk.SourceDirectoryPath, kconfigFilePath))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		}
+
+		return false, trace.Wrap(err, "failed to read %q", kconfigFilePath)
+	}
+
+	parseKconfigDependencies(string(fileContents), dependencies)
+	_, ok := dependencies[symbol]
+	return ok, nil
+}
+
 func (lk *LinuxKernel) DoBuild(buildDirectoryPath string) error {
 	makeOptions, err := lk.getMakeOptions()
 	if err != nil {
@@ -74,12 +270,62 @@ func (lk *LinuxKernel) DoBuild(buildDirectoryPath string) error {
 		return trace.Wrap(err, "failed to ensure that the output boot directory exists")
 	}
 
-	err = lk.MakeBuild(buildDirectoryPath, makeOptions, "all", "install", "modules_install")
+	buildTargets := append([]string{"all"}, lk.getImageTargets()...)
+	if lk.hasDeviceTrees() {
+		buildTargets = append(buildTargets, "dtbs")
+	}
+
+	err = lk.MakeBuild(buildDirectoryPath, makeOptions, buildTargets...)
+	if err != nil {
+		return trace.Wrap(err, "failed to build %s", lk.Name)
+	}
+
+	lk.kernelRelease, err = lk.getKernelRelease(buildDirectoryPath, makeOptions)
+	if err != nil {
+		return trace.Wrap(err, "failed to get the kernel release")
+	}
+
+	err = lk.installImage(buildDirectoryPath, makeOptions)
+	if err != nil {
+		return trace.Wrap(err, "failed to install the kernel image")
+	}
+
+	err = lk.MakeBuild(buildDirectoryPath, makeOptions, "modules_install")
 	if err != nil {
-		return trace.Wrap(err, "failed to build and install %s", lk.Name)
+		return trace.Wrap(err, "failed to install %s modules", lk.Name)
+	}
+
+	// The config may not select any platforms that device trees are built for
+	builtDeviceTreeCount := 0
+	if lk.hasDeviceTrees() {
+		builtDeviceTreesDirectoryPath := path.Join(buildDirectoryPath, "arch", lk.Triplet.GetKernelArch(), "boot", "dts")
+		builtDeviceTreeCount, err = countDeviceTrees(builtDeviceTreesDirectoryPath)
+		if err != nil {
+			return trace.Wrap(err, "failed to count built device trees")
+		}
+
+		if builtDeviceTreeCount == 0 {
+			slog.Warn("No device trees were built, enable the platforms to build them for in the kernel config", "directory", builtDeviceTreesDirectoryPath)
+		}
 	}
 
-	err = lk.copySource(makeOptions)
+	if builtDeviceTreeCount > 0 {
+		err = lk.MakeBuild(buildDirectoryPath, append(makeOptions, &runners.MakeOptions{
+			Variables: map[string]args.IValue{
+				"INSTALL_DTBS_PATH": args.StringValue(lk.getDeviceTreeDirectoryPath()),
+			},
+		}), "dtbs_install")
+		if err != nil {
+			return trace.Wrap(err, "failed to install device trees")
+		}
+	}
+
+	err = lk.installConfig(buildDirectoryPath)
+	if err != nil {
+		return trace.Wrap(err, "failed to install the kernel config")
+	}
+
+	err = lk.copySource(buildDirectoryPath, makeOptions)
 	if err != nil {
 		return trace.Wrap(err, "failed to copy source to the build output directory")
 	}
@@ -87,7 +333,388 @@ func (lk *LinuxKernel) DoBuild(buildDirectoryPath string) error {
 	return nil
 }
 
+func (lk *LinuxKernel) getKernelRelease(buildDirectoryPath string, makeOptions []*runners.MakeOptions) (string, error) {
+	kernelReleaseOutput, err := runners.Run(&runners.Make{
+		GenericRunner: lk.getGenericRunner(buildDirectoryPath),
+		Path:          ".",
+		Targets:       []string{"-s", "kernelrelease"},
+		Options:       makeOptions,
+	})
+	if err != nil {
+		return "", trace.Wrap(err, "failed to run make kernelrelease")
+	}
+
+	return strings.TrimSpace(kernelReleaseOutput.Stdout), nil
+}
+
+// Architectures where boards are described by device trees built with the kernel
+func (lk *LinuxKernel) hasDeviceTrees() bool {
+	return slices.Contains([]string{"arm", "arm64", "riscv"}, lk.Triplet.GetKernelArch())
+}
+
+func (lk *LinuxKernel) getDeviceTreeDirectoryPath() string {
+	return path.Join(lk.OutputDirectoryPath, "boot", "dtbs", lk.kernelRelease)
+}
+
+// Get the image targets that are not built by "all" on every architecture
+func (lk *LinuxKernel) getImageTargets() []string {
+	switch lk.Triplet.GetKernelArch() {
+	case "arm64", "riscv":
+		return []string{"Image", "Image.gz"}
+	default:
+		return nil
+	}
+}
+
+// Install the kernel image to /boot. Most architectures support "make install". The behavior of
+// this on arm64 and riscv depends upon the kernel version, and only installs one image format,
+// so both the uncompressed (EFI bootable) and compressed images are copied directly instead.
+func (lk *LinuxKernel) installImage(buildDirectoryPath string, makeOptions []*runners.MakeOptions) error {
+	kernelArch := lk.Triplet.GetKernelArch()
+	if kernelArch != "arm64" && kernelArch != "riscv" {
+		err := lk.MakeBuild(buildDirectoryPath, makeOptions, "install")
+		if err != nil {
+			return trace.Wrap(err, "failed to install %s", lk.Name)
+		}
+
+		return nil
+	}
+
+	bootDirectoryPath := path.Join(lk.OutputDirectoryPath, "boot")
+	for sourcePath, destinationName := range map[string]string{
+		path.Join("arch", kernelArch, "boot", "Image"):    fmt.Sprintf("Image-%s", lk.kernelRelease),
+		path.Join("arch", kernelArch, "boot", "Image.gz"): fmt.Sprintf("Image.gz-%s", lk.kernelRelease),
+		"System.map": fmt.Sprintf("System.map-%s", lk.kernelRelease),
+	} {
+		err := copy.Copy(path.Join(buildDirectoryPath, sourcePath), path.Join(bootDirectoryPath, destinationName), copy.Options{
+			PermissionControl: copy.PerservePermission,
+		})
+		if err != nil {
+			return trace.Wrap(err, "failed to copy %q to %q", sourcePath, bootDirectoryPath)
+		}
+	}
+
+	return nil
+}
+
+// Copy the resolved config to /boot/config-<release>, where it can be inspected by tools on the target.
+// Options that refer to paths on the build host are cleared, as they are not meaningful on the
+// target, and would make the installed config depend on the build directory.
+func (lk *LinuxKernel) installConfig(buildDirectoryPath string) error {
+	configFileContents, err := os.ReadFile(path.Join(buildDirectoryPath, ".config"))
+	if err != nil {
+		return trace.Wrap(err, "failed to read the resolved kernel config")
+	}
+
+	configLines := strings.Split(string(configFileContents), "\n")
+	for i, configLine := range configLines {
+		for _, hostPathSymbol := range []string{"CONFIG_MODULE_SIG_KEY", "CONFIG_INITRAMFS_SOURCE"} {
+			if strings.HasPrefix(configLine, hostPathSymbol+"=") {
+				configLines[i] = fmt.Sprintf("%s=\"\"", hostPathSymbol)
+			}
+		}
+	}
+
+	installedConfigFilePath := lk.getInstalledConfigFilePath()
+	err = os.WriteFile(installedConfigFilePath, []byte(strings.Join(configLines, "\n")), 0644)
+	if err != nil {
+		return trace.Wrap(err, "failed to write kernel config to %q", installedConfigFilePath)
+	}
+
+	return nil
+}
+
+func (lk *LinuxKernel) getInstalledConfigFilePath() string {
+	return path.Join(lk.OutputDirectoryPath, "boot", fmt.Sprintf("config-%s", lk.kernelRelease))
+}
+
+func (lk *LinuxKernel) VerifyBuild(ctx context.Context) error {
+	err := lk.StandardBuilder.VerifyBuild(ctx)
+	if err != nil {
+		return trace.Wrap(err, "failed to verify built files")
+	}
+
+	err = lk.verifyBootFiles()
+	if err != nil {
+		return trace.Wrap(err, "failed to verify installed boot files")
+	}
+
+	requirements, err := getKernelRequirements(lk.RequirementsPath)
+	if err != nil {
+		return trace.Wrap(err, "failed to get kernel requirements")
+	}
+
+	config, err := readKconfig(lk.getInstalledConfigFilePath())
+	if err != nil {
+		return trace.Wrap(err, "failed to read the installed kernel config")
+	}
+
+	// The source is used to explain why requirements are not met, but is not strictly needed
+	kernelSourceDirectoryPath := path.Join(lk.OutputDirectoryPath, "usr", "src", "linux")
+	doesSourceExist, err := utils.DoesFilesystemPathExist(kernelSourceDirectoryPath)
+	if err != nil {
+		return trace.Wrap(err, "failed to check if the kernel source exists at %q", kernelSourceDirectoryPath)
+	}
+
+	if !doesSourceExist {
+		kernelSourceDirectoryPath = ""
+	}
+
+	err = checkKernelRequirements(config, requirements, kernelSourceDirectoryPath)
+	if err != nil {
+		return trace.Wrap(err, "kernel config does not meet the distro requirements")
+	}
+
+	err = lk.verifyModules()
+	if err != nil {
+		return trace.Wrap(err, "failed to verify installed kernel modules")
+	}
+
+	return nil
+}
+
+// Check that the kernel image and device trees (where built) were installed
+func (lk *LinuxKernel) verifyBootFiles() error {
+	bootDirectoryPath := path.Join(lk.OutputDirectoryPath, "boot")
+	imagePaths, err := filepath.Glob(path.Join(bootDirectoryPath, fmt.Sprintf("*-%s", lk.kernelRelease)))
+	if err != nil {
+		return trace.Wrap(err, "failed to search for kernel images in %q", bootDirectoryPath)
+	}
+
+	hasImage := slices.ContainsFunc(imagePaths, func(imagePath string) bool {
+		imageName := path.Base(imagePath)
+		return strings.HasPrefix(imageName, "vmlinuz-") || strings.HasPrefix(imageName, "Image-") || strings.HasPrefix(imageName, "vmlinux-")
+	})
+	if !hasImage {
+		return trace.Errorf("no kernel image for release %q was installed to %q", lk.kernelRelease, bootDirectoryPath)
+	}
+
+	// Device trees are only installed if any were built
+	deviceTreeDirectoryPath := lk.getDeviceTreeDirectoryPath()
+	doDeviceTreesExist, err := utils.DoesFilesystemPathExist(deviceTreeDirectoryPath)
+	if err != nil {
+		return trace.Wrap(err, "failed to check if %q exists", deviceTreeDirectoryPath)
+	}
+
+	if !doDeviceTreesExist {
+		return nil
+	}
+
+	deviceTreeCount, err := countDeviceTrees(deviceTreeDirectoryPath)
+	if err != nil {
+		return trace.Wrap(err, "failed to count installed device trees")
+	}
+
+	if deviceTreeCount == 0 {
+		return trace.Errorf("no device trees were installed to %q", deviceTreeDirectoryPath)
+	}
+
+	return nil
+}
+
+// Count the device trees under a directory, which may not exist if none were built
+func countDeviceTrees(directoryPath string) (int, error) {
+	exists, err := utils.DoesFilesystemPathExist(directoryPath)
+	if err != nil {
+		return 0, trace.Wrap(err, "failed to check if %q exists", directoryPath)
+	}
+
+	if !exists {
+		return 0, nil
+	}
+
+	deviceTreeCount := 0
+	err = filepath.WalkDir(directoryPath, func(fsPath string, fsEntry fs.DirEntry, err error) error {
+		if err != nil {
+			return trace.Wrap(err, "failed to walk dir %q", fsPath)
+		}
+
+		if path.Ext(fsPath) == ".dtb" {
+			deviceTreeCount++
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, trace.Wrap(err, "failed to search for device trees in %q", directoryPath)
+	}
+
+	return deviceTreeCount, nil
+}
+
+// Check that every installed module is compressed and signed, as configured
+func (lk *LinuxKernel) verifyModules() error {
+	if lk.ModuleSigningKeyPath == "" && !lk.ShouldCompressModules {
+		return nil
+	}
+
+	var certificate *x509.Certificate
+	if lk.ModuleSigningKeyPath != "" {
+		var err error
+		certificate, err = readModuleSigningCertificate(lk.ModuleSigningKeyPath)
+		if err != nil {
+			return trace.Wrap(err, "failed to read module signing certificate")
+		}
+	}
+
+	modulesDirectoryPath := path.Join(lk.OutputDirectoryPath, "usr", "lib", "modules", lk.kernelRelease)
+	moduleCount := 0
+	err := filepath.WalkDir(modulesDirectoryPath, func(fsPath string, fsEntry fs.DirEntry, err error) error {
+		if err != nil {
+			return trace.Wrap(err, "failed to walk dir %q", fsPath)
+		}
+
+		// Skip the links to the kernel source
+		if fsEntry.Type()&fs.ModeSymlink != 0 || fsEntry.IsDir() {
+			return nil
+		}
+
+		moduleExtension := getModuleExtension(fsPath)
+		if !strings.HasPrefix(moduleExtension, ".ko") {
+			return nil
+		}
+		moduleCount++
+
+		if lk.ShouldCompressModules && moduleExtension != ".ko.zst" {
+			return trace.Errorf("module %q is not compressed with zstd", fsPath)
+		}
+
+		if certificate == nil {
+			return nil
+		}
+
+		moduleContents, err := readModule(fsPath, moduleExtension)
+		if err != nil {
+			return trace.Wrap(err, "failed to read module %q", fsPath)
+		}
+
+		err = verifyModuleSignature(moduleContents, certificate)
+		if err != nil {
+			return trace.Wrap(err, "failed to verify signature of module %q", fsPath)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return trace.Wrap(err, "failed to verify modules in %q", modulesDirectoryPath)
+	}
+
+	slog.Info("Verified kernel modules", "module_count", moduleCount)
+	return nil
+}
+
+// Get the extension of a module file, including any compression extension, i.e. ".ko.zst"
+func getModuleExtension(modulePath string) string {
+	moduleExtension := path.Ext(modulePath)
+	if moduleExtension != ".ko" {
+		moduleExtension = path.Ext(strings.TrimSuffix(modulePath, moduleExtension)) + moduleExtension
+	}
+
+	return moduleExtension
+}
+
+// Read the uncompressed contents of a module
+func readModule(modulePath, moduleExtension string) (moduleContents []byte, err error) {
+	switch moduleExtension {
+	case ".ko":
+		moduleContents, err = os.ReadFile(modulePath)
+		if err != nil {
+			return nil, trace.Wrap(err, "failed to read %q", modulePath)
+		}
+	case ".ko.gz":
+		var moduleFile *os.File
+		moduleFile, err = os.Open(modulePath)
+		if err != nil {
+			return nil, trace.Wrap(err, "failed to open %q", modulePath)
+		}
+		defer utils.Close(moduleFile, &err)
+
+		var gzipReader *gzip.Reader
+		gzipReader, err = gzip.NewReader(moduleFile)
+		if err != nil {
+			return nil, trace.Wrap(err, "failed to create gzip reader for %q", modulePath)
+		}
+
+		moduleContents, err = io.ReadAll(gzipReader)
+		if err != nil {
+			return nil, trace.Wrap(err, "failed to decompress %q", modulePath)
+		}
+	case ".ko.zst":
+		// Decompress to a file, as command output is streamed to the console
+		var decompressedFile *os.File
+		decompressedFile, err = os.CreateTemp("", "module-*.ko")
+		if err != nil {
+			return nil, trace.Wrap(err, "failed to create temporary file for decompressed module")
+		}
+		decompressedFilePath := decompressedFile.Name()
+		defer utils.ErrDefer(func() error { return os.Remove(decompressedFilePath) }, &err)
+
+		err = decompressedFile.Close()
+		if err != nil {
+			return nil, trace.Wrap(err, "failed to close temporary file %q", decompressedFilePath)
+		}
+
+		// zstd replaces the file rather than writing to it, so it must be read by path
+		_, err = runners.Run(&runners.CommandRunner{
+			Command:   "zstd",
+			Arguments: []string{"-d", "-q", "-f", modulePath, "-o", decompressedFilePath},
+		})
+		if err != nil {
+			return nil, trace.Wrap(err, "failed to decompress %q", modulePath)
+		}
+
+		moduleContents, err = os.ReadFile(decompressedFilePath)
+		if err != nil {
+			return nil, trace.Wrap(err, "failed to read decompressed module %q", decompressedFilePath)
+		}
+	default:
+		return nil, trace.Errorf("unsupported module compression %q", moduleExtension)
+	}
+
+	return moduleContents, nil
+}
+
+func (lk *LinuxKernel) CheckHostRequirements() error {
+	err := lk.StandardBuilder.CheckHostRequirements()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	err = lk.validateInitramfsPath()
+	if err != nil {
+		return trace.Wrap(err, "failed to validate the initramfs to embed")
+	}
+
+	requiredCommands := make([]string, 0)
+	if lk.InitramfsPath != "" && lk.InitramfsCompression != InitramfsCompressionNone {
+		// Needed by the kernel build to compress the embedded initramfs
+		requiredCommands = append(requiredCommands, lk.InitramfsCompression)
+	}
+
+	if lk.ModuleSigningKeyPath != "" {
+		// Needed by the kernel build to sign modules
+		requiredCommands = append(requiredCommands, "openssl")
+	}
+
+	if lk.ShouldCompressModules {
+		requiredCommands = append(requiredCommands, "zstd")
+	}
+
+	err = runners.CheckRequiredCommandsExist(requiredCommands)
+	if err != nil {
+		return trace.Wrap(err, "failed to verify that all required commands exist")
+	}
+
+	return nil
+}
+
 func (lk *LinuxKernel) getMakeOptions() ([]*runners.MakeOptions, error) {
+	return getKernelMakeOptions(&lk.ToolchainRequiredBuilder, lk.OutputDirectoryPath)
+}
+
+// Get the make options for building against the kernel source tree with the cross toolchain,
+// installing into the output directory. These are shared by the kernel and external modules.
+func getKernelMakeOptions(toolchain *ToolchainRequiredBuilder, outputDirectoryPath string) ([]*runners.MakeOptions, error) {
 	clangPath, clangxxPath, pkgConfigPath, err := getUtilityPaths()
 	if err != nil {
 		return nil, trace.Wrap(err, "failed to get clang C and C++ compiler paths")
@@ -97,30 +724,30 @@ func (lk *LinuxKernel) getMakeOptions() ([]*runners.MakeOptions, error) {
 	return []*runners.MakeOptions{
 		{
 			Variables: map[string]args.IValue{
-				"CC":               args.StringValue("ccache " + lk.GetPathForTool("clang")),
-				"CXX":              args.StringValue("ccache " + lk.GetPathForTool("clang++")),
-				"NM":               args.StringValue(lk.GetPathForTool("llvm-nm")),
-				"AR":               args.StringValue(lk.GetPathForTool("llvm-ar")),
-				"LD":               args.StringValue(lk.GetPathForTool("ld.lld")),
-				"OBJCOPY":          args.StringValue(lk.GetPathForTool("llvm-objcopy")),
-				"OBJDUMP":          args.StringValue(lk.GetPathForTool("llvm-objdump")),
-				"READELF":          args.StringValue(lk.GetPathForTool("llvm-readelf")),
-				"STRIP":            args.StringValue(lk.GetPathForTool("llvm-strip")),
+				"CC":               args.StringValue("ccache " + toolchain.GetPathForTool("clang")),
+				"CXX":              args.StringValue("ccache " + toolchain.GetPathForTool("clang++")),
+				"NM":               args.StringValue(toolchain.GetPathForTool("llvm-nm")),
+				"AR":               args.StringValue(toolchain.GetPathForTool("llvm-ar")),
+				"LD":               args.StringValue(toolchain.GetPathForTool("ld.lld")),
+				"OBJCOPY":          args.StringValue(toolchain.GetPathForTool("llvm-objcopy")),
+				"OBJDUMP":          args.StringValue(toolchain.GetPathForTool("llvm-objdump")),
+				"READELF":          args.StringValue(toolchain.GetPathForTool("llvm-readelf")),
+				"STRIP":            args.StringValue(toolchain.GetPathForTool("llvm-strip")),
 				"HOSTCC":           args.StringValue("ccache " + clangPath),
 				"HOSTCXX":          args.StringValue("ccache " + clangxxPath),
 				"PKG_CONFIG":       args.StringValue(pkgConfigPath),
 				"LLVM":             args.StringValue("1"),
-				"CROSS_COMPILE":    args.StringValue(fmt.Sprintf("%s-", lk.Triplet.String())),
-				"ARCH":             args.StringValue(lk.Triplet.Machine),
-				"INSTALL_PATH":     args.StringValue(path.Join(lk.OutputDirectoryPath, "boot")),
-				"INSTALL_MOD_PATH": args.StringValue(path.Join(lk.OutputDirectoryPath, "usr")),
-				"INSTALL_HDR_PATH": args.StringValue(path.Join(lk.OutputDirectoryPath, "usr")),
+				"CROSS_COMPILE":    args.StringValue(fmt.Sprintf("%s-", toolchain.Triplet.String())),
+				"ARCH":             args.StringValue(toolchain.Triplet.GetKernelArch()),
+				"INSTALL_PATH":     args.StringValue(path.Join(outputDirectoryPath, "boot")),
+				"INSTALL_MOD_PATH": args.StringValue(path.Join(outputDirectoryPath, "usr")),
+				"INSTALL_HDR_PATH": args.StringValue(path.Join(outputDirectoryPath, "usr")),
 			},
 		},
 	}, nil
 }
 
-func (lk *LinuxKernel) copySource(makeOptions []*runners.MakeOptions) error {
+func (lk *LinuxKernel) copySource(buildDirectoryPath string, makeOptions []*runners.MakeOptions) error {
 	kernelVersionOutput, err := runners.Run(&runners.Make{
 		GenericRunner: lk.getGenericRunner(lk.SourceDirectoryPath),
 		Path:          ".",
@@ -174,6 +801,14 @@ func (lk *LinuxKernel) copySource(makeOptions []*runners.MakeOptions) error {
 		return nil
 	})
 
+	// External modules need the exported symbol versions to link against the kernel. This does
+	// not count towards the source tree being "unclean" for out-of-tree (O=) builds.
+	moduleSymversFilePath := path.Join(absolutekernelSourceDirectoryPath, "Module.symvers")
+	err = copy.Copy(path.Join(buildDirectoryPath, "Module.symvers"), moduleSymversFilePath, copy.Options{PermissionControl: copy.PerservePermission})
+	if err != nil {
+		return trace.Wrap(err, "failed to copy Module.symvers to %q", moduleSymversFilePath)
+	}
+
 	err = os.Symlink(soureDirectoryPath, path.Join(lk.OutputDirectoryPath, "usr", "src", "linux"))
 	if err != nil {
 		return trace.Wrap(err, "failed to symlink the generic linux source directory to the specific linux source directory %q ", soureDirectoryPath)
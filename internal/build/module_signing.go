@@ -0,0 +1,300 @@
+package build
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	_ "crypto/sha256" // Registers SHA-224 and SHA-256 for signature verification
+	_ "crypto/sha512" // Registers SHA-384 and SHA-512 for signature verification
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path"
+	"time"
+
+	"github.com/gravitational/trace"
+	"github.com/solidDoWant/distrobuilder/internal/utils"
+)
+
+const (
+	moduleSignatureMagic = "~Module signature appended~\n"
+	// Size of struct module_signature, from include/linux/module_signature.h
+	moduleSignatureInfoSize = 12
+	// The only signature ID type supported by current kernels
+	moduleSignatureIDTypePKCS7 = 2
+
+	moduleSigningKeySize     = 4096
+	moduleSigningKeyValidity = 100 * 365 * 24 * time.Hour
+)
+
+var (
+	oidExtKeyUsageCodeSigning = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 3}
+	oidPKCS7SignedData        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidPKCS9MessageDigest     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	pkcs7DigestAlgorithms     = map[string]crypto.Hash{
+		"1.3.14.3.2.26":          crypto.SHA1,
+		"2.16.840.1.101.3.4.2.1": crypto.SHA256,
+		"2.16.840.1.101.3.4.2.2": crypto.SHA384,
+		"2.16.840.1.101.3.4.2.3": crypto.SHA512,
+		"2.16.840.1.101.3.4.2.4": crypto.SHA224,
+	}
+)
+
+// Generate a self-signed module signing key pair, written as a single PEM file containing
+// the private key and certificate. This is the format expected by CONFIG_MODULE_SIG_KEY.
+func generateModuleSigningKey(keyFilePath, commonName string) error {
+	privateKey, err := rsa.GenerateKey(rand.Reader, moduleSigningKeySize)
+	if err != nil {
+		return trace.Wrap(err, "failed to generate RSA key")
+	}
+
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return trace.Wrap(err, "failed to generate certificate serial number")
+	}
+
+	publicKeyDER, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	if err != nil {
+		return trace.Wrap(err, "failed to marshal public key")
+	}
+	subjectKeyID := sha1.Sum(publicKeyDER)
+
+	// These extensions match the kernel's certs/default_x509.genkey
+	notBefore := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			CommonName: commonName,
+		},
+		NotBefore:             notBefore,
+		NotAfter:              notBefore.Add(moduleSigningKeyValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		UnknownExtKeyUsage:    []asn1.ObjectIdentifier{oidExtKeyUsageCodeSigning},
+		BasicConstraintsValid: true,
+		IsCA:                  false,
+		SubjectKeyId:          subjectKeyID[:],
+	}
+
+	certificateDER, err := x509.CreateCertificate(rand.Reader, template, template, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		return trace.Wrap(err, "failed to create certificate")
+	}
+
+	privateKeyDER, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return trace.Wrap(err, "failed to marshal private key")
+	}
+
+	keyFileContents := &bytes.Buffer{}
+	for _, block := range []*pem.Block{
+		{Type: "PRIVATE KEY", Bytes: privateKeyDER},
+		{Type: "CERTIFICATE", Bytes: certificateDER},
+	} {
+		err = pem.Encode(keyFileContents, block)
+		if err != nil {
+			return trace.Wrap(err, "failed to PEM encode %s", block.Type)
+		}
+	}
+
+	_, err = utils.EnsureDirectoryExists(path.Dir(keyFilePath))
+	if err != nil {
+		return trace.Wrap(err, "failed to ensure key directory exists")
+	}
+
+	err = os.WriteFile(keyFilePath, keyFileContents.Bytes(), 0600)
+	if err != nil {
+		return trace.Wrap(err, "failed to write module signing key to %q", keyFilePath)
+	}
+
+	return nil
+}
+
+// Read the certificate from a module signing key file
+func readModuleSigningCertificate(keyFilePath string) (*x509.Certificate, error) {
+	keyFileContents, err := os.ReadFile(keyFilePath)
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to read module signing key file %q", keyFilePath)
+	}
+
+	for {
+		var block *pem.Block
+		block, keyFileContents = pem.Decode(keyFileContents)
+		if block == nil {
+			return nil, trace.Errorf("module signing key file %q does not contain a certificate", keyFilePath)
+		}
+
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, trace.Wrap(err, "failed to parse certificate in %q", keyFilePath)
+		}
+
+		return certificate, nil
+	}
+}
+
+// ASN.1 structures from RFC 2315, limited to the fields needed for verification
+type pkcs7ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,tag:0"`
+}
+
+type pkcs7SignedData struct {
+	Version          int
+	DigestAlgorithms asn1.RawValue
+	ContentInfo      asn1.RawValue
+	Certificates     asn1.RawValue     `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue     `asn1:"optional,tag:1"`
+	SignerInfos      []pkcs7SignerInfo `asn1:"set"`
+}
+
+type pkcs7SignerInfo struct {
+	Version                   int
+	SignerIdentifier          asn1.RawValue
+	DigestAlgorithm           pkix.AlgorithmIdentifier
+	AuthenticatedAttributes   asn1.RawValue `asn1:"optional,tag:0"`
+	DigestEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedDigest           []byte
+}
+
+type pkcs7Attribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue
+}
+
+// Verify that the (uncompressed) module contents end with a valid signature from the certificate
+func verifyModuleSignature(moduleContents []byte, certificate *x509.Certificate) error {
+	signedContents, signature, err := splitModuleSignature(moduleContents)
+	if err != nil {
+		return trace.Wrap(err, "failed to read module signature")
+	}
+
+	contentInfo := &pkcs7ContentInfo{}
+	_, err = asn1.Unmarshal(signature, contentInfo)
+	if err != nil {
+		return trace.Wrap(err, "failed to parse PKCS#7 message")
+	}
+
+	if !contentInfo.ContentType.Equal(oidPKCS7SignedData) {
+		return trace.Errorf("PKCS#7 message has unexpected content type %s", contentInfo.ContentType)
+	}
+
+	signedData := &pkcs7SignedData{}
+	_, err = asn1.Unmarshal(contentInfo.Content.Bytes, signedData)
+	if err != nil {
+		return trace.Wrap(err, "failed to parse PKCS#7 signed data")
+	}
+
+	if len(signedData.SignerInfos) != 1 {
+		return trace.Errorf("expected exactly one signer, found %d", len(signedData.SignerInfos))
+	}
+	signerInfo := signedData.SignerInfos[0]
+
+	hashAlgorithm, ok := pkcs7DigestAlgorithms[signerInfo.DigestAlgorithm.Algorithm.String()]
+	if !ok {
+		return trace.Errorf("unsupported digest algorithm %s", signerInfo.DigestAlgorithm.Algorithm)
+	}
+
+	hasher := hashAlgorithm.New()
+	hasher.Write(signedContents)
+	digest := hasher.Sum(nil)
+
+	// When authenticated attributes are present, the signature covers the attributes (which
+	// include the content digest) instead of the content
+	if len(signerInfo.AuthenticatedAttributes.Bytes) > 0 {
+		err = verifyMessageDigestAttribute(signerInfo.AuthenticatedAttributes.Bytes, digest)
+		if err != nil {
+			return trace.Wrap(err, "failed to verify authenticated attributes")
+		}
+
+		// The attributes are signed with a SET tag, rather than the implicit tag used in the message
+		attributes := append([]byte{}, signerInfo.AuthenticatedAttributes.FullBytes...)
+		attributes[0] = 0x31
+
+		hasher = hashAlgorithm.New()
+		hasher.Write(attributes)
+		digest = hasher.Sum(nil)
+	}
+
+	switch publicKey := certificate.PublicKey.(type) {
+	case *rsa.PublicKey:
+		err = rsa.VerifyPKCS1v15(publicKey, hashAlgorithm, digest, signerInfo.EncryptedDigest)
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(publicKey, digest, signerInfo.EncryptedDigest) {
+			err = trace.Errorf("ECDSA signature does not match")
+		}
+	default:
+		return trace.Errorf("unsupported public key type %T", certificate.PublicKey)
+	}
+
+	if err != nil {
+		return trace.Wrap(err, "signature was not created by the key for %q", certificate.Subject.CommonName)
+	}
+
+	return nil
+}
+
+// Split the module into the signed contents and the PKCS#7 signature
+func splitModuleSignature(moduleContents []byte) ([]byte, []byte, error) {
+	unmarkedContents, found := bytes.CutSuffix(moduleContents, []byte(moduleSignatureMagic))
+	if !found {
+		return nil, nil, trace.Errorf("module is not signed")
+	}
+
+	if len(unmarkedContents) < moduleSignatureInfoSize {
+		return nil, nil, trace.Errorf("module signature information is truncated")
+	}
+
+	signatureInfo := unmarkedContents[len(unmarkedContents)-moduleSignatureInfoSize:]
+	if signatureIDType := signatureInfo[2]; signatureIDType != moduleSignatureIDTypePKCS7 {
+		return nil, nil, trace.Errorf("unsupported module signature type %d", signatureIDType)
+	}
+
+	signatureLength := int(binary.BigEndian.Uint32(signatureInfo[8:12]))
+	signatureEnd := len(unmarkedContents) - moduleSignatureInfoSize
+	if signatureLength > signatureEnd {
+		return nil, nil, trace.Errorf("module signature length %d exceeds the module size", signatureLength)
+	}
+
+	signatureStart := signatureEnd - signatureLength
+	return unmarkedContents[:signatureStart], unmarkedContents[signatureStart:signatureEnd], nil
+}
+
+func verifyMessageDigestAttribute(attributesDER, digest []byte) error {
+	for len(attributesDER) > 0 {
+		attribute := &pkcs7Attribute{}
+		var err error
+		attributesDER, err = asn1.Unmarshal(attributesDER, attribute)
+		if err != nil {
+			return trace.Wrap(err, "failed to parse attribute")
+		}
+
+		if !attribute.Type.Equal(oidPKCS9MessageDigest) {
+			continue
+		}
+
+		var messageDigest []byte
+		_, err = asn1.Unmarshal(attribute.Values.Bytes, &messageDigest)
+		if err != nil {
+			return trace.Wrap(err, "failed to parse message digest attribute")
+		}
+
+		if !bytes.Equal(messageDigest, digest) {
+			return trace.Errorf("message digest attribute does not match the module contents")
+		}
+
+		return nil
+	}
+
+	return trace.Errorf("authenticated attributes do not contain a message digest")
+}
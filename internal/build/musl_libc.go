@@ -26,8 +26,8 @@ func NewMuslLibc() *MuslLibc {
 		StandardBuilder: StandardBuilder{
 			Name: "musl-libc",
 			BinariesToCheck: []string{
-				path.Join("usr", "bin", "lz4"),
-				path.Join("usr", "lib", "liblz4.so"),
+				path.Join("usr", "lib", "libc.so"),
+				path.Join("usr", "lib", "crt1.o"),
 			},
 		},
 	}
@@ -73,6 +73,11 @@ func (ml *MuslLibc) getMakeOptions() []*runners.MakeOptions {
 }
 
 func (ml *MuslLibc) VerifyBuild(ctx context.Context) error {
+	err := ml.StandardBuilder.VerifyBuild(ctx)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
 	libcPath := path.Join(ml.OutputDirectoryPath, "usr", "lib", "libc.so")
 	isValid, version, err := (&runners.VersionChecker{
 		CommandRunner: runners.CommandRunner{
@@ -94,10 +99,5 @@ func (ml *MuslLibc) VerifyBuild(ctx context.Context) error {
 		return trace.Errorf("built musl libc version %q does not match build version %q", version, ml.sourceVersion)
 	}
 
-	err = ml.VerifyTargetElfFile(libcPath)
-	if err != nil {
-		return trace.Wrap(err, "libc file %q did not match the expected ELF values", libcPath)
-	}
-
 	return nil
 }
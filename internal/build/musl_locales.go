@@ -0,0 +1,107 @@
+package build
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/gravitational/trace"
+	"github.com/solidDoWant/distrobuilder/internal/runners"
+	"github.com/solidDoWant/distrobuilder/internal/runners/args"
+	"github.com/solidDoWant/distrobuilder/internal/source"
+	git_source "github.com/solidDoWant/distrobuilder/internal/source/git"
+)
+
+// Directory that musl loads locale catalogs from, via the MUSL_LOCPATH environment variable
+var muslLocalesDirectoryPath = path.Join("usr", "share", "i18n", "locales", "musl")
+
+// Sourced by the root filesystem's /etc/profile. Upstream's version of this file contains the
+// install prefix, which is the output directory rather than the final path.
+var muslLocalesProfile = fmt.Sprintf(`# Generated by distrobuilder
+export MUSL_LOCPATH="/%s"
+export CHARSET="${CHARSET:-UTF-8}"
+export LANG="${LANG:-C.UTF-8}"
+export LC_COLLATE="${LC_COLLATE:-C}"
+`, muslLocalesDirectoryPath)
+
+// musl's locale support reads translations of its own messages from catalogs, rather than the
+// glibc locale format
+type MuslLocales struct {
+	StandardBuilder
+}
+
+func NewMuslLocales() *MuslLocales {
+	instance := &MuslLocales{
+		StandardBuilder: StandardBuilder{
+			Name: "musl-locales",
+			BinariesToCheck: []string{
+				path.Join("usr", "bin", "locale"),
+			},
+		},
+	}
+
+	instance.IStandardBuilder = instance
+	return instance
+}
+
+func (ml *MuslLocales) CheckHostRequirements() error {
+	err := ml.StandardBuilder.CheckHostRequirements()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	// Catalogs are compiled on the host
+	err = runners.CheckRequiredCommandsExist([]string{"msgfmt"})
+	if err != nil {
+		return trace.Wrap(err, "failed to find required host commands")
+	}
+
+	return nil
+}
+
+func (ml *MuslLocales) GetGitRepo(repoDirectoryPath string, ref string) *source.GitRepo {
+	return git_source.NewMuslLocalesGitRepo(repoDirectoryPath, ref)
+}
+
+func (ml *MuslLocales) DoConfiguration(buildDirectoryPath string) error {
+	cmakeOptions := &runners.CMakeOptions{
+		Defines: map[string]args.IValue{
+			"LOCALE_PROFILE": args.OffValue(),
+		},
+	}
+	return ml.CMakeConfigure(buildDirectoryPath, cmakeOptions)
+}
+
+func (ml *MuslLocales) DoBuild(buildDirectoryPath string) error {
+	err := ml.NinjaBuild(buildDirectoryPath)
+	if err != nil {
+		return trace.Wrap(err, "failed to build and install %s", ml.Name)
+	}
+
+	err = ml.WriteOutputFile(path.Join("etc", "profile.d", "00locale.sh"), muslLocalesProfile, 0644)
+	if err != nil {
+		return trace.Wrap(err, "failed to write locale profile")
+	}
+
+	return nil
+}
+
+func (ml *MuslLocales) VerifyBuild(ctx context.Context) error {
+	err := ml.StandardBuilder.VerifyBuild(ctx)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	catalogDirectoryPath := path.Join(ml.OutputDirectoryPath, muslLocalesDirectoryPath)
+	catalogEntries, err := os.ReadDir(catalogDirectoryPath)
+	if err != nil {
+		return trace.Wrap(err, "failed to read locale catalog directory %q", catalogDirectoryPath)
+	}
+
+	if len(catalogEntries) == 0 {
+		return trace.Errorf("no locale catalogs were installed to %q", catalogDirectoryPath)
+	}
+
+	return nil
+}
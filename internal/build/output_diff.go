@@ -0,0 +1,685 @@
+package build
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"debug/elf"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gravitational/trace"
+	"github.com/sergi/go-diff/diffmatchpatch"
+	"github.com/solidDoWant/distrobuilder/internal/runners"
+	"github.com/solidDoWant/distrobuilder/internal/utils"
+	"golang.org/x/exp/maps"
+	"golang.org/x/sys/unix"
+)
+
+// Maximum number of detail lines reported for a single file
+const maxOutputDifferenceDetails = 50
+
+const (
+	arMagic        = "!<arch>\n"
+	arHeaderLength = 60
+	gzipMagic      = "\x1f\x8b"
+	zstdMagic      = "\x28\xb5\x2f\xfd"
+	xzMagic        = "\xfd7zXZ\x00"
+	zipMagic       = "PK\x03\x04"
+	tarMagicOffset = 257
+	tarMagic       = "ustar"
+)
+
+// Difference between the same path in two build outputs
+type OutputDifference struct {
+	Path    string // Relative to the output directories
+	Summary string
+	Details []string // Lines describing the difference, such as a text diff
+}
+
+func (od *OutputDifference) String() string {
+	builder := &strings.Builder{}
+	fmt.Fprintf(builder, "%s: %s\n", od.Path, od.Summary)
+	for _, detail := range od.getTruncatedDetails() {
+		fmt.Fprintf(builder, "    %s\n", detail)
+	}
+
+	return builder.String()
+}
+
+// Allows differences to be logged as structured attributes
+func (od *OutputDifference) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("path", od.Path),
+		slog.String("summary", od.Summary),
+		slog.Any("details", od.getTruncatedDetails()),
+	)
+}
+
+func (od *OutputDifference) getTruncatedDetails() []string {
+	if len(od.Details) <= maxOutputDifferenceDetails {
+		return od.Details
+	}
+
+	details := slices.Clone(od.Details[:maxOutputDifferenceDetails])
+	return append(details, fmt.Sprintf("... %d more lines", len(od.Details)-maxOutputDifferenceDetails))
+}
+
+// Compare two build outputs file by file
+func CompareOutputDirectories(firstDirectoryPath, secondDirectoryPath string) ([]*OutputDifference, error) {
+	firstEntries, err := getOutputEntries(firstDirectoryPath)
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to read first output directory %q", firstDirectoryPath)
+	}
+
+	secondEntries, err := getOutputEntries(secondDirectoryPath)
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to read second output directory %q", secondDirectoryPath)
+	}
+
+	relativePaths := maps.Keys(firstEntries)
+	for relativePath := range secondEntries {
+		if _, ok := firstEntries[relativePath]; !ok {
+			relativePaths = append(relativePaths, relativePath)
+		}
+	}
+	slices.Sort(relativePaths)
+
+	var differences []*OutputDifference
+	for _, relativePath := range relativePaths {
+		firstInfo, isInFirst := firstEntries[relativePath]
+		secondInfo, isInSecond := secondEntries[relativePath]
+
+		if !isInFirst || !isInSecond {
+			buildNumber := "first"
+			if isInSecond {
+				buildNumber = "second"
+			}
+
+			differences = append(differences, &OutputDifference{Path: relativePath, Summary: fmt.Sprintf("only in the %s build", buildNumber)})
+			continue
+		}
+
+		difference, err := compareOutputEntries(
+			relativePath,
+			filepath.Join(firstDirectoryPath, relativePath), firstInfo,
+			filepath.Join(secondDirectoryPath, relativePath), secondInfo,
+		)
+		if err != nil {
+			return nil, trace.Wrap(err, "failed to compare %q", relativePath)
+		}
+
+		if difference != nil {
+			differences = append(differences, difference)
+		}
+	}
+
+	return differences, nil
+}
+
+func getOutputEntries(directoryPath string) (map[string]fs.FileInfo, error) {
+	entries := map[string]fs.FileInfo{}
+	err := filepath.WalkDir(directoryPath, func(entryPath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return trace.Wrap(err, "failed to walk %q", entryPath)
+		}
+
+		if entryPath == directoryPath {
+			return nil
+		}
+
+		relativePath, err := filepath.Rel(directoryPath, entryPath)
+		if err != nil {
+			return trace.Wrap(err, "failed to get path of %q relative to %q", entryPath, directoryPath)
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return trace.Wrap(err, "failed to get file info for %q", entryPath)
+		}
+
+		entries[relativePath] = info
+		return nil
+	})
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to walk %q", directoryPath)
+	}
+
+	return entries, nil
+}
+
+func compareOutputEntries(relativePath, firstPath string, firstInfo fs.FileInfo, secondPath string, secondInfo fs.FileInfo) (*OutputDifference, error) {
+	if firstInfo.Mode().Type() != secondInfo.Mode().Type() {
+		return &OutputDifference{
+			Path:    relativePath,
+			Summary: fmt.Sprintf("file type differs: %s vs %s", firstInfo.Mode().Type(), secondInfo.Mode().Type()),
+		}, nil
+	}
+
+	var details []string
+	if firstInfo.Mode().Perm() != secondInfo.Mode().Perm() {
+		details = append(details, fmt.Sprintf("permissions differ: %04o vs %04o", firstInfo.Mode().Perm(), secondInfo.Mode().Perm()))
+	}
+
+	firstOwner, err := getOwner(firstPath)
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to get owner of %q", firstPath)
+	}
+
+	secondOwner, err := getOwner(secondPath)
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to get owner of %q", secondPath)
+	}
+
+	if firstOwner != secondOwner {
+		details = append(details, fmt.Sprintf("owner differs: %s vs %s", firstOwner, secondOwner))
+	}
+
+	switch firstInfo.Mode().Type() {
+	case fs.ModeSymlink:
+		firstTarget, err := os.Readlink(firstPath)
+		if err != nil {
+			return nil, trace.Wrap(err, "failed to read symlink %q", firstPath)
+		}
+
+		secondTarget, err := os.Readlink(secondPath)
+		if err != nil {
+			return nil, trace.Wrap(err, "failed to read symlink %q", secondPath)
+		}
+
+		if firstTarget != secondTarget {
+			details = append(details, fmt.Sprintf("symlink target differs: %q vs %q", firstTarget, secondTarget))
+		}
+	case 0:
+		firstContents, err := os.ReadFile(firstPath)
+		if err != nil {
+			return nil, trace.Wrap(err, "failed to read %q", firstPath)
+		}
+
+		secondContents, err := os.ReadFile(secondPath)
+		if err != nil {
+			return nil, trace.Wrap(err, "failed to read %q", secondPath)
+		}
+
+		if !bytes.Equal(firstContents, secondContents) {
+			summary, contentDetails := compareContents(firstContents, secondContents)
+			return &OutputDifference{
+				Path:    relativePath,
+				Summary: summary,
+				Details: append(details, contentDetails...),
+			}, nil
+		}
+	}
+
+	if len(details) == 0 {
+		return nil, nil
+	}
+
+	return &OutputDifference{Path: relativePath, Summary: "metadata differs", Details: details}, nil
+}
+
+// Get the owner of a file as "uid:gid", without following links
+func getOwner(filePath string) (string, error) {
+	stat := &unix.Stat_t{}
+	err := unix.Lstat(filePath, stat)
+	if err != nil {
+		return "", trace.Wrap(err, "failed to stat %q", filePath)
+	}
+
+	return fmt.Sprintf("%d:%d", stat.Uid, stat.Gid), nil
+}
+
+// Describe the difference between the contents of two files, based on the file type
+func compareContents(first, second []byte) (string, []string) {
+	switch {
+	case hasMagic(first, second, 0, elf.ELFMAG):
+		return "ELF file differs", compareElfContents(first, second)
+	case hasMagic(first, second, 0, arMagic):
+		return "ar archive differs", compareArContents(first, second)
+	case hasMagic(first, second, tarMagicOffset, tarMagic):
+		return "tar archive differs", compareTarContents(first, second)
+	case hasMagic(first, second, 0, gzipMagic):
+		return "gzip file differs", compareCompressedContents(first, second, readGzip)
+	case hasMagic(first, second, 0, zstdMagic):
+		return "zstd file differs", compareCompressedContents(first, second, readZstd)
+	case hasMagic(first, second, 0, xzMagic):
+		return "xz file differs", compareCompressedContents(first, second, readXz)
+	case hasMagic(first, second, 0, zipMagic):
+		return "zip archive differs", compareZipContents(first, second)
+	case isText(first) && isText(second):
+		return "text differs", compareTextContents(string(first), string(second))
+	default:
+		return "binary contents differ", compareBinaryContents(first, second)
+	}
+}
+
+func hasMagic(first, second []byte, offset int, magic string) bool {
+	for _, contents := range [][]byte{first, second} {
+		if len(contents) < offset+len(magic) || string(contents[offset:offset+len(magic)]) != magic {
+			return false
+		}
+	}
+
+	return true
+}
+
+func isText(contents []byte) bool {
+	return utf8.Valid(contents) && !bytes.Contains(contents, []byte{0})
+}
+
+func compareTextContents(first, second string) []string {
+	differ := diffmatchpatch.New()
+	firstLines, secondLines, lines := differ.DiffLinesToChars(first, second)
+	diffs := differ.DiffCharsToLines(differ.DiffMain(firstLines, secondLines, false), lines)
+
+	var details []string
+	for _, diff := range diffs {
+		prefix := ""
+		switch diff.Type {
+		case diffmatchpatch.DiffDelete:
+			prefix = "-"
+		case diffmatchpatch.DiffInsert:
+			prefix = "+"
+		default:
+			continue
+		}
+
+		for _, line := range strings.Split(strings.TrimSuffix(diff.Text, "\n"), "\n") {
+			details = append(details, prefix+line)
+		}
+	}
+
+	return details
+}
+
+func compareBinaryContents(first, second []byte) []string {
+	var details []string
+	if len(first) != len(second) {
+		details = append(details, fmt.Sprintf("size differs: %d vs %d bytes", len(first), len(second)))
+	}
+
+	differingByteCount := 0
+	firstDifferingOffset := -1
+	for i := 0; i < min(len(first), len(second)); i++ {
+		if first[i] == second[i] {
+			continue
+		}
+
+		if firstDifferingOffset == -1 {
+			firstDifferingOffset = i
+		}
+		differingByteCount++
+	}
+
+	if firstDifferingOffset != -1 {
+		details = append(details, fmt.Sprintf("%d bytes differ, starting at offset %#x", differingByteCount, firstDifferingOffset))
+	}
+
+	return details
+}
+
+// Member of an archive, or a section of an ELF file
+type outputMember struct {
+	Name     string
+	Header   string // Metadata that should be reproducible, such as modification times
+	Contents []byte
+}
+
+// Compare the members of two archives (or sections of two ELF files) by name
+func compareMembers(memberType string, firstMembers, secondMembers []*outputMember) []string {
+	secondMembersByName := make(map[string]*outputMember, len(secondMembers))
+	for _, member := range secondMembers {
+		secondMembersByName[member.Name] = member
+	}
+
+	var details []string
+	firstMemberNames := make(map[string]struct{}, len(firstMembers))
+	for _, firstMember := range firstMembers {
+		firstMemberNames[firstMember.Name] = struct{}{}
+
+		secondMember, ok := secondMembersByName[firstMember.Name]
+		if !ok {
+			details = append(details, fmt.Sprintf("%s %q only in the first build", memberType, firstMember.Name))
+			continue
+		}
+
+		if firstMember.Header != secondMember.Header {
+			details = append(details, fmt.Sprintf("%s %q header differs: %s vs %s", memberType, firstMember.Name, firstMember.Header, secondMember.Header))
+		}
+
+		if !bytes.Equal(firstMember.Contents, secondMember.Contents) {
+			summary, _ := compareContents(firstMember.Contents, secondMember.Contents)
+			details = append(details, fmt.Sprintf("%s %q contents differ (%s, %d vs %d bytes)", memberType, firstMember.Name, summary, len(firstMember.Contents), len(secondMember.Contents)))
+		}
+	}
+
+	for _, secondMember := range secondMembers {
+		if _, ok := firstMemberNames[secondMember.Name]; !ok {
+			details = append(details, fmt.Sprintf("%s %q only in the second build", memberType, secondMember.Name))
+		}
+	}
+
+	return details
+}
+
+func compareElfContents(first, second []byte) []string {
+	firstSections, err := getElfSections(first)
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	secondSections, err := getElfSections(second)
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	details := compareMembers("section", firstSections, secondSections)
+	if len(details) == 0 {
+		details = append(details, "sections are identical, headers or padding differ")
+		details = append(details, compareBinaryContents(first, second)...)
+	}
+
+	return details
+}
+
+func getElfSections(contents []byte) ([]*outputMember, error) {
+	elfFile, err := elf.NewFile(bytes.NewReader(contents))
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to parse ELF file")
+	}
+
+	sections := make([]*outputMember, 0, len(elfFile.Sections))
+	seenNames := map[string]int{}
+	for _, section := range elfFile.Sections {
+		// Relocatable objects can have multiple sections with the same name
+		name := section.Name
+		if seenCount := seenNames[section.Name]; seenCount > 0 {
+			name = fmt.Sprintf("%s#%d", section.Name, seenCount)
+		}
+		seenNames[section.Name]++
+
+		var sectionContents []byte
+		if section.Type != elf.SHT_NOBITS {
+			sectionContents, err = io.ReadAll(section.Open())
+			if err != nil {
+				return nil, trace.Wrap(err, "failed to read section %q", section.Name)
+			}
+		}
+
+		sections = append(sections, &outputMember{
+			Name:     name,
+			Header:   fmt.Sprintf("type=%s flags=%s size=%d", section.Type, section.Flags, section.Size),
+			Contents: sectionContents,
+		})
+	}
+
+	return sections, nil
+}
+
+func compareArContents(first, second []byte) []string {
+	firstMembers, err := getArMembers(first)
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	secondMembers, err := getArMembers(second)
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	return compareMembers("member", firstMembers, secondMembers)
+}
+
+// Read the members of a System V/GNU ar archive, which are used for static libraries
+func getArMembers(contents []byte) ([]*outputMember, error) {
+	var members []*outputMember
+	var longNames []byte
+	offset := len(arMagic)
+	for offset+arHeaderLength <= len(contents) {
+		header := contents[offset : offset+arHeaderLength]
+		name := strings.TrimSpace(string(header[0:16]))
+		size, err := strconv.Atoi(strings.TrimSpace(string(header[48:58])))
+		if err != nil {
+			return nil, trace.Wrap(err, "failed to parse size of ar member at offset %d", offset)
+		}
+
+		dataStart := offset + arHeaderLength
+		dataEnd := dataStart + size
+		if dataEnd > len(contents) {
+			return nil, trace.Errorf("ar member %q at offset %d is truncated", name, offset)
+		}
+		data := contents[dataStart:dataEnd]
+
+		switch {
+		case name == "//":
+			// GNU long name table
+			longNames = data
+		case name == "/" || name == "/SYM64/":
+			// Symbol table, which is typically only affected by other members
+			members = append(members, &outputMember{Name: "<symbol table>", Header: getArMemberHeader(header), Contents: data})
+		case strings.HasPrefix(name, "/") && len(name) > 1 && name[1] >= '0' && name[1] <= '9':
+			nameOffset, err := strconv.Atoi(name[1:])
+			if err != nil || nameOffset >= len(longNames) {
+				return nil, trace.Errorf("invalid ar long name reference %q", name)
+			}
+
+			name, _, _ = strings.Cut(string(longNames[nameOffset:]), "/\n")
+			fallthrough
+		default:
+			members = append(members, &outputMember{
+				Name:     strings.TrimSuffix(name, "/"),
+				Header:   getArMemberHeader(header),
+				Contents: data,
+			})
+		}
+
+		// Members are aligned to two bytes
+		offset = dataEnd + dataEnd%2
+	}
+
+	return members, nil
+}
+
+func getArMemberHeader(header []byte) string {
+	return fmt.Sprintf(
+		"mtime=%s uid=%s gid=%s mode=%s",
+		strings.TrimSpace(string(header[16:28])),
+		strings.TrimSpace(string(header[28:34])),
+		strings.TrimSpace(string(header[34:40])),
+		strings.TrimSpace(string(header[40:48])),
+	)
+}
+
+func compareTarContents(first, second []byte) []string {
+	firstMembers, err := getTarMembers(first)
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	secondMembers, err := getTarMembers(second)
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	return compareMembers("member", firstMembers, secondMembers)
+}
+
+func getTarMembers(contents []byte) ([]*outputMember, error) {
+	var members []*outputMember
+	reader := tar.NewReader(bytes.NewReader(contents))
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, trace.Wrap(err, "failed to read tar header")
+		}
+
+		memberContents, err := io.ReadAll(reader)
+		if err != nil {
+			return nil, trace.Wrap(err, "failed to read tar member %q", header.Name)
+		}
+
+		members = append(members, &outputMember{
+			Name: header.Name,
+			Header: fmt.Sprintf(
+				"mtime=%d uid=%d gid=%d user=%q group=%q mode=%04o link=%q",
+				header.ModTime.Unix(), header.Uid, header.Gid, header.Uname, header.Gname, header.Mode, header.Linkname,
+			),
+			Contents: memberContents,
+		})
+	}
+
+	return members, nil
+}
+
+// Compare the headers and decompressed contents of two compressed files. The decompress function
+// returns a description of the header, if the format has one, and the decompressed contents.
+func compareCompressedContents(first, second []byte, decompress func([]byte) (string, []byte, error)) []string {
+	firstHeader, firstContents, err := decompress(first)
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	secondHeader, secondContents, err := decompress(second)
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	var details []string
+	if firstHeader != secondHeader {
+		details = append(details, fmt.Sprintf("header differs: %s vs %s", firstHeader, secondHeader))
+	}
+
+	if bytes.Equal(firstContents, secondContents) {
+		if len(details) == 0 {
+			details = append(details, "decompressed contents are identical, compression differs")
+		}
+
+		return details
+	}
+
+	summary, contentDetails := compareContents(firstContents, secondContents)
+	details = append(details, fmt.Sprintf("decompressed contents differ: %s", summary))
+	return append(details, contentDetails...)
+}
+
+func readGzip(contents []byte) (string, []byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(contents))
+	if err != nil {
+		return "", nil, trace.Wrap(err, "failed to read gzip header")
+	}
+
+	decompressedContents, err := io.ReadAll(reader)
+	if err != nil {
+		return "", nil, trace.Wrap(err, "failed to decompress gzip file")
+	}
+
+	header := fmt.Sprintf("mtime=%d name=%q os=%d", reader.ModTime.Unix(), reader.Name, reader.OS)
+	return header, decompressedContents, nil
+}
+
+func readZstd(contents []byte) (string, []byte, error) {
+	decompressedContents, err := decompressWithCommand(contents, "zstd", ".zst")
+	if err != nil {
+		return "", nil, trace.Wrap(err, "failed to decompress zstd file")
+	}
+
+	return "", decompressedContents, nil
+}
+
+func readXz(contents []byte) (string, []byte, error) {
+	decompressedContents, err := decompressWithCommand(contents, "xz", ".xz")
+	if err != nil {
+		return "", nil, trace.Wrap(err, "failed to decompress xz file")
+	}
+
+	return "", decompressedContents, nil
+}
+
+// Decompress contents with a command that supports "-d" and replaces the file with the given
+// extension by the decompressed file, such as zstd and xz
+func decompressWithCommand(contents []byte, command, extension string) (decompressedContents []byte, err error) {
+	// Decompress to a file, as command output is streamed to the console
+	directoryPath, err := os.MkdirTemp("", "output-diff-*")
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to create temporary directory")
+	}
+	defer utils.ErrDefer(func() error { return os.RemoveAll(directoryPath) }, &err)
+
+	decompressedFilePath := filepath.Join(directoryPath, "contents")
+	compressedFilePath := decompressedFilePath + extension
+	err = os.WriteFile(compressedFilePath, contents, 0600)
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to write %q", compressedFilePath)
+	}
+
+	_, err = runners.Run(&runners.CommandRunner{
+		Command:   command,
+		Arguments: []string{"-d", "-q", compressedFilePath},
+	})
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to decompress %q with %s", compressedFilePath, command)
+	}
+
+	decompressedContents, err = os.ReadFile(decompressedFilePath)
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to read decompressed file %q", decompressedFilePath)
+	}
+
+	return decompressedContents, nil
+}
+
+func compareZipContents(first, second []byte) []string {
+	firstMembers, err := getZipMembers(first)
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	secondMembers, err := getZipMembers(second)
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	return compareMembers("member", firstMembers, secondMembers)
+}
+
+func getZipMembers(contents []byte) ([]*outputMember, error) {
+	reader, err := zip.NewReader(bytes.NewReader(contents), int64(len(contents)))
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to read zip archive")
+	}
+
+	members := make([]*outputMember, 0, len(reader.File))
+	for _, file := range reader.File {
+		memberReader, err := file.Open()
+		if err != nil {
+			return nil, trace.Wrap(err, "failed to open zip member %q", file.Name)
+		}
+
+		memberContents, err := io.ReadAll(memberReader)
+		memberReader.Close()
+		if err != nil {
+			return nil, trace.Wrap(err, "failed to read zip member %q", file.Name)
+		}
+
+		members = append(members, &outputMember{
+			Name:     file.Name,
+			Header:   fmt.Sprintf("mtime=%d mode=%s", file.Modified.Unix(), file.Mode()),
+			Contents: memberContents,
+		})
+	}
+
+	return members, nil
+}
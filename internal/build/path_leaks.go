@@ -0,0 +1,266 @@
+package build
+
+import (
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/gravitational/trace"
+	"github.com/solidDoWant/distrobuilder/internal/utils"
+)
+
+type IPathLeakFixer interface {
+	SetShouldFixPathLeaks(bool)
+}
+
+// Maximum number of offsets listed per file when reporting leaks
+const maxReportedLeakOffsets = 5
+
+// Reference to a build host path in an output file
+type pathLeak struct {
+	FilePath   string // Relative to the output directory
+	LeakedPath string
+	Offsets    []int
+}
+
+func (pl *pathLeak) String() string {
+	offsets := pl.Offsets
+	suffix := ""
+	if len(offsets) > maxReportedLeakOffsets {
+		offsets = offsets[:maxReportedLeakOffsets]
+		suffix = fmt.Sprintf(" and %d more", len(pl.Offsets)-maxReportedLeakOffsets)
+	}
+
+	return fmt.Sprintf("%q references build host path %q at offsets %v%s", pl.FilePath, pl.LeakedPath, offsets, suffix)
+}
+
+// Get a pattern matching every build host path that output files should not reference. Build
+// directories (and output directories when not specified) are temporary directories named with
+// a UUID, see utils.GetTempDirectoryPath.
+func (sb *StandardBuilder) getPathLeakPattern() *regexp.Regexp {
+	uuidPattern := `[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}`
+	alternatives := []string{regexp.QuoteMeta(filepath.Clean(os.TempDir())) + "/" + uuidPattern}
+	for _, hostPath := range []string{sb.OutputDirectoryPath, sb.SourceDirectoryPath, sb.ToolchainPath, sb.RootFSDirectoryPath} {
+		if hostPath == "" || filepath.Clean(hostPath) == "/" {
+			continue
+		}
+
+		alternatives = append(alternatives, regexp.QuoteMeta(filepath.Clean(hostPath)))
+	}
+
+	// Paths must end at a path component boundary, so that "/a/b" does not match "/a/bc"
+	return regexp.MustCompile(`(` + strings.Join(alternatives, "|") + `)(?:[^A-Za-z0-9._-]|$)`)
+}
+
+// Search every file in the output directory for references to build host paths. These are
+// typically baked in by build systems that use the install prefix at runtime.
+func (sb *StandardBuilder) VerifyNoPathLeaks() error {
+	leaks, err := findPathLeaks(sb.OutputDirectoryPath, sb.getPathLeakPattern())
+	if err != nil {
+		return trace.Wrap(err, "failed to search output for build host paths")
+	}
+
+	if len(leaks) == 0 {
+		return nil
+	}
+
+	errs := make([]error, 0, len(leaks))
+	for _, leak := range leaks {
+		errs = append(errs, trace.Errorf("%s", leak.String()))
+	}
+
+	return trace.Wrap(trace.NewAggregate(errs...), "output contains build host paths, rebuild with path leak fixes enabled or fix the %s build", sb.Name)
+}
+
+func findPathLeaks(outputDirectoryPath string, leakPattern *regexp.Regexp) ([]*pathLeak, error) {
+	var leaks []*pathLeak
+	err := filepath.WalkDir(outputDirectoryPath, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return trace.Wrap(err, "failed to walk %q", filePath)
+		}
+
+		// Symlink targets are intentionally not checked, as these are typically created by
+		// builders rather than build systems and are checked by package installation
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+
+		fileBytes, err := os.ReadFile(filePath)
+		if err != nil {
+			return trace.Wrap(err, "failed to read %q", filePath)
+		}
+
+		relativeFilePath, err := filepath.Rel(outputDirectoryPath, filePath)
+		if err != nil {
+			return trace.Wrap(err, "failed to get path of %q relative to %q", filePath, outputDirectoryPath)
+		}
+
+		fileLeaks := map[string]*pathLeak{}
+		for _, searchRange := range getLeakSearchRanges(fileBytes) {
+			for _, match := range leakPattern.FindAllSubmatchIndex(fileBytes[searchRange[0]:searchRange[1]], -1) {
+				leakedPath := string(fileBytes[searchRange[0]+match[2] : searchRange[0]+match[3]])
+				leak, ok := fileLeaks[leakedPath]
+				if !ok {
+					leak = &pathLeak{FilePath: relativeFilePath, LeakedPath: leakedPath}
+					fileLeaks[leakedPath] = leak
+					leaks = append(leaks, leak)
+				}
+
+				leak.Offsets = append(leak.Offsets, searchRange[0]+match[2])
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to search %q for path leaks", outputDirectoryPath)
+	}
+
+	return leaks, nil
+}
+
+// Get the file offset ranges that should be searched. For ELF files, debug sections are skipped,
+// as these always contain the build directory.
+func getLeakSearchRanges(fileBytes []byte) [][2]int {
+	elfFile, err := elf.NewFile(bytes.NewReader(fileBytes))
+	if err != nil {
+		return [][2]int{{0, len(fileBytes)}}
+	}
+
+	var searchRanges [][2]int
+	for _, section := range elfFile.Sections {
+		if section.Type == elf.SHT_NOBITS || strings.HasPrefix(section.Name, ".debug") || strings.HasPrefix(section.Name, ".zdebug") {
+			continue
+		}
+
+		sectionEnd := section.Offset + section.FileSize
+		if sectionEnd > uint64(len(fileBytes)) {
+			continue
+		}
+
+		searchRanges = append(searchRanges, [2]int{int(section.Offset), int(sectionEnd)})
+	}
+
+	return searchRanges
+}
+
+func (sb *StandardBuilder) SetShouldFixPathLeaks(shouldFixPathLeaks bool) {
+	sb.ShouldFixPathLeaks = shouldFixPathLeaks
+}
+
+// Rewrite null terminated strings in every output file that reference the output directory, so
+// that they reference the final install location instead. This cannot fix text files, or
+// references to other build host paths, which are left to be reported by VerifyNoPathLeaks.
+func (sb *StandardBuilder) FixPathLeaks() error {
+	err := filepath.WalkDir(sb.OutputDirectoryPath, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return trace.Wrap(err, "failed to walk %q", filePath)
+		}
+
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+
+		err = patchNullTerminatedPathPrefix(filePath, sb.OutputDirectoryPath)
+		if err != nil {
+			return trace.Wrap(err, "failed to patch %q", filePath)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return trace.Wrap(err, "failed to fix path leaks in %q", sb.OutputDirectoryPath)
+	}
+
+	return nil
+}
+
+// Replace the search prefix in every null terminated string containing it with "/". The string
+// is shortened in place, with the remainder left after the new null termination character.
+func patchNullTerminatedPathPrefix(filePath, searchPrefix string) error {
+	fileBytes, err := os.ReadFile(filePath)
+	if err != nil {
+		return trace.Wrap(err, "failed to read file %q into memory", filePath)
+	}
+
+	// Skip the write for the vast majority of files that do not need to be patched
+	if !bytes.Contains(fileBytes, []byte(searchPrefix)) {
+		return nil
+	}
+
+	// TODO look in data sections only?
+
+	isPatched := false
+	fileStrings := findNullTerminatedStrings(fileBytes, len(searchPrefix))
+	for fileString, positions := range fileStrings {
+		startOffset := strings.Index(fileString, searchPrefix)
+
+		// Skip the string if the search prefix is not found in it
+		if startOffset == -1 {
+			continue
+		}
+
+		// Skip the string if the search prefix is only part of a path component, i.e. "/a/bc" for "/a/b"
+		prefixEnd := startOffset + len(searchPrefix)
+		if prefixEnd < len(fileString) && fileString[prefixEnd] != '/' {
+			continue
+		}
+
+		// Remove the search prefix from the portion of the file string that contains it
+		correctPath, err := filepath.Rel(searchPrefix, fileString[startOffset:])
+		if err != nil {
+			return trace.Wrap(err, "failed to get path of %q relative to %q", fileString, searchPrefix)
+		}
+
+		// Make the path absolute, and add a null termination character
+		replacementValue := []byte(path.Join("/", correctPath) + string(rune(0)))
+
+		// Copy the replacement value
+		for _, position := range positions {
+			utils.UpdateSubset(&fileBytes, startOffset+position, &replacementValue)
+		}
+		isPatched = true
+	}
+
+	if !isPatched {
+		return nil
+	}
+
+	err = os.WriteFile(filePath, fileBytes, 0)
+	if err != nil {
+		return trace.Wrap(err, "failed to write patched binary to %q", filePath)
+	}
+
+	return nil
+}
+
+func findNullTerminatedStrings(bytes []byte, minLength int) map[string][]int {
+	results := make(map[string][]int)
+	minLength++ // Increase by 1 to account for the null termination character
+
+	previousNullTerminationCharacterPosition := 0
+	for i, b := range bytes {
+		// Find null termination characters
+		if rune(b) != rune(0) {
+			continue
+		}
+
+		// Found a string of approprate length
+		if i-previousNullTerminationCharacterPosition >= minLength {
+			// Skip the last null termination character, and the current one
+			startPosition := previousNullTerminationCharacterPosition + 1
+			foundString := string(bytes[startPosition:i])
+			results[foundString] = append(results[foundString], startPosition)
+		}
+
+		previousNullTerminationCharacterPosition = i
+	}
+
+	return results
+}
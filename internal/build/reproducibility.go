@@ -0,0 +1,195 @@
+package build
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gravitational/trace"
+	"github.com/solidDoWant/distrobuilder/internal/runners"
+	"github.com/solidDoWant/distrobuilder/internal/runners/args"
+	"golang.org/x/sys/unix"
+)
+
+// Default shift of the clock seen by build commands. This is over a year, so that dates, days of
+// the week and years all differ.
+const DefaultReproducibilityClockOffset = (397*24 + 7) * time.Hour
+
+// Locations that distributions install libfaketime to
+var faketimeLibraryPathPatterns = []string{
+	"/usr/lib/*/faketime/libfaketime.so.1",
+	"/usr/lib/faketime/libfaketime.so.1",
+	"/usr/lib64/faketime/libfaketime.so.1",
+	"/usr/local/lib/faketime/libfaketime.so.1",
+}
+
+// Build environment changes that should not affect the build output
+type ReproducibilityVariation struct {
+	TemporaryDirectoryPath string // Parent of the build directory, via TMPDIR
+	Umask                  int
+	ParallelJobCount       int
+	Timezone               string        // Via TZ
+	ClockOffset            time.Duration // Shift of the clock seen by build commands, via libfaketime. Zero to disable.
+	FaketimeLibraryPath    string        // Optional, searched for if not set
+}
+
+// Get a variation that differs from the current build environment
+func NewReproducibilityVariation() *ReproducibilityVariation {
+	// Reading the umask requires setting it
+	currentUmask := unix.Umask(0022)
+	unix.Umask(currentUmask)
+
+	variedUmask := 0022
+	if currentUmask == variedUmask {
+		variedUmask = 0002
+	}
+
+	variedParallelJobCount := 1
+	if runners.ParallelJobCount == variedParallelJobCount {
+		variedParallelJobCount = 2
+	}
+
+	return &ReproducibilityVariation{
+		// A different length catches paths that are padded or truncated to fit fixed size fields
+		TemporaryDirectoryPath: path.Join(os.TempDir(), "reproducibility-variation", "with-a-longer-build-directory-path"),
+		Umask:                  variedUmask,
+		ParallelJobCount:       variedParallelJobCount,
+		Timezone:               "Pacific/Kiritimati", // UTC+14, so that local dates usually differ from UTC
+		ClockOffset:            DefaultReproducibilityClockOffset,
+	}
+}
+
+// Check that the variation can be applied, so that this fails before the first build
+func (rv *ReproducibilityVariation) CheckHostRequirements() error {
+	if rv.ClockOffset == 0 {
+		return nil
+	}
+
+	_, err := rv.getFaketimeLibraryPath()
+	if err != nil {
+		return trace.Wrap(err, "libfaketime is required to vary the clock, install it or disable the clock offset")
+	}
+
+	return nil
+}
+
+func (rv *ReproducibilityVariation) getFaketimeLibraryPath() (string, error) {
+	if rv.FaketimeLibraryPath != "" {
+		_, err := os.Stat(rv.FaketimeLibraryPath)
+		if err != nil {
+			return "", trace.Wrap(err, "failed to find libfaketime at %q", rv.FaketimeLibraryPath)
+		}
+
+		return rv.FaketimeLibraryPath, nil
+	}
+
+	for _, pattern := range faketimeLibraryPathPatterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return "", trace.Wrap(err, "failed to search for %q", pattern)
+		}
+
+		if len(matches) > 0 {
+			return matches[0], nil
+		}
+	}
+
+	return "", trace.Errorf("failed to find libfaketime in any of %v", faketimeLibraryPathPatterns)
+}
+
+// Get the environment variables that shift the clock of dynamically linked commands run by
+// builders. The clock of this process, statically linked commands and Go programs is not shifted.
+// SOURCE_DATE_EPOCH is intentionally left unchanged, as tools that honour it should produce the
+// same output at any clock time.
+func (rv *ReproducibilityVariation) getClockEnvironmentVariables() (map[string]args.IValue, error) {
+	if rv.ClockOffset == 0 {
+		return nil, nil
+	}
+
+	faketimeLibraryPath, err := rv.getFaketimeLibraryPath()
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to get libfaketime path")
+	}
+
+	preloadedLibraries := faketimeLibraryPath
+	if existingPreloadedLibraries := os.Getenv("LD_PRELOAD"); existingPreloadedLibraries != "" {
+		preloadedLibraries = strings.Join([]string{existingPreloadedLibraries, faketimeLibraryPath}, " ")
+	}
+
+	return map[string]args.IValue{
+		"LD_PRELOAD": args.StringValue(preloadedLibraries),
+		"FAKETIME":   args.StringValue(fmt.Sprintf("%+d", int64(rv.ClockOffset.Seconds()))), // Offset in seconds
+		// Shifting monotonic clocks can break timeouts in build tools
+		"FAKETIME_DONT_FAKE_MONOTONIC": args.StringValue("1"),
+	}, nil
+}
+
+// Apply the variation to this process, and any commands that it runs. The clock is only shifted
+// for commands run by builders. The returned function restores the previous environment. If the
+// variation cannot be fully applied, any changes that were made are reverted.
+func (rv *ReproducibilityVariation) Apply() (_ func() error, err error) {
+	clockEnvironmentVariables, err := rv.getClockEnvironmentVariables()
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to get clock variation environment variables")
+	}
+
+	var restoreFuncs []func() error
+	restore := func() error {
+		var errs []error
+		for i := len(restoreFuncs) - 1; i >= 0; i-- {
+			errs = append(errs, restoreFuncs[i]())
+		}
+
+		return trace.NewAggregate(errs...)
+	}
+	defer func() {
+		if err != nil {
+			err = trace.NewAggregate(err, trace.Wrap(restore(), "failed to revert partially applied variation"))
+		}
+	}()
+
+	err = os.MkdirAll(rv.TemporaryDirectoryPath, 0755)
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to create temporary directory %q", rv.TemporaryDirectoryPath)
+	}
+	restoreFuncs = append(restoreFuncs, func() error {
+		return trace.Wrap(os.RemoveAll(rv.TemporaryDirectoryPath), "failed to remove temporary directory %q", rv.TemporaryDirectoryPath)
+	})
+
+	for name, value := range map[string]string{"TMPDIR": rv.TemporaryDirectoryPath, "TZ": rv.Timezone} {
+		name := name
+		previousValue, isSet := os.LookupEnv(name)
+		err = os.Setenv(name, value)
+		if err != nil {
+			return nil, trace.Wrap(err, "failed to set %s", name)
+		}
+
+		restoreFuncs = append(restoreFuncs, func() error {
+			if !isSet {
+				return trace.Wrap(os.Unsetenv(name), "failed to unset %s", name)
+			}
+
+			return trace.Wrap(os.Setenv(name, previousValue), "failed to restore %s", name)
+		})
+	}
+
+	previousBuildEnvironmentVariables := runners.BuildEnvironmentVariables
+	previousParallelJobCount := runners.ParallelJobCount
+	previousUmask := unix.Umask(rv.Umask)
+	runners.BuildEnvironmentVariables = clockEnvironmentVariables
+	runners.ParallelJobCount = rv.ParallelJobCount
+	restoreFuncs = append(restoreFuncs, func() error {
+		unix.Umask(previousUmask)
+		runners.ParallelJobCount = previousParallelJobCount
+		runners.BuildEnvironmentVariables = previousBuildEnvironmentVariables
+		return nil
+	})
+
+	slog.Info("Applied reproducibility variation", "temporary_directory", rv.TemporaryDirectoryPath, "umask", rv.Umask, "parallel_jobs", rv.ParallelJobCount, "timezone", rv.Timezone, "clock_offset", rv.ClockOffset)
+
+	return restore, nil
+}
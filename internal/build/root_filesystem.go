@@ -1,7 +1,6 @@
 package build
 
 import (
-	"cmp"
 	"context"
 	"fmt"
 	"io/fs"
@@ -9,17 +8,30 @@ import (
 	"os"
 	"path"
 	"path/filepath"
-	"slices"
-	"strings"
 
 	"github.com/gravitational/trace"
 )
 
 type RootFilesystem struct {
 	FilesystemOutputBuilder
+
+	ShellPath       string // Optional login shell for users that do not set one, defaults to /bin/sh
+	UsersConfigPath string // Optional YAML file declaring users and groups, defaults to root and nobody
+	// Optional YAML or JSON file declaring the directory tree, defaults to the tree from getFilesystemStructure
+	FilesystemLayoutPath string
+	IdentityConfigPath   string // Optional YAML file declaring the distro name, version, and hostname
+	BuildID              string // Optional identifier of the build pipeline run, written to os-release
+	// Create the default static device nodes under /dev, for booting without devtmpfs or chrooting
+	ShouldCreateDeviceNodes bool
+	DeviceTablePath         string // Optional YAML file declaring static device nodes, overrides the default nodes
 }
 
 func (rfs *RootFilesystem) CheckHostRequirements() error {
+	// Files, home directories and device nodes are owned by users other than the current user
+	if os.Geteuid() != 0 {
+		return trace.Errorf("building the root filesystem requires root, to set the ownership of files")
+	}
+
 	return nil
 }
 
@@ -30,173 +42,56 @@ func (rfs *RootFilesystem) Build(ctx context.Context) error {
 	}
 	rfs.OutputDirectoryPath = outputDirectory.Path
 
-	rootFSTree := rfs.getFilesystemStructure()
-	err = rootFSTree.Create(rfs.OutputDirectoryPath, "")
+	rootFSTree, err := rfs.getFilesystemLayout()
 	if err != nil {
-		return trace.Wrap(err, "failed to create rootfs tree at %q", rfs.OutputDirectoryPath)
+		return trace.Wrap(err, "failed to get filesystem layout")
 	}
 
-	users, groups := rfs.getUsersAndGroups()
-
-	err = users.WritePasswdFile(rfs.OutputDirectoryPath)
+	err = validateFilesystemLayout(rootFSTree)
 	if err != nil {
-		return trace.Wrap(err, "failed to write user passwd file to rootfs at %q", rfs.OutputDirectoryPath)
+		return trace.Wrap(err, "failed to validate filesystem layout")
 	}
 
-	err = groups.WriteGroupFile(rfs.OutputDirectoryPath)
+	err = rootFSTree.Create(rfs.OutputDirectoryPath, "")
 	if err != nil {
-		return trace.Wrap(err, "failed to write group file to rootfs at %q", rfs.OutputDirectoryPath)
+		return trace.Wrap(err, "failed to create rootfs tree at %q", rfs.OutputDirectoryPath)
 	}
 
-	return nil
-}
-
-func (rfs *RootFilesystem) VerifyBuild(context.Context) error {
-	// TODO verify what, if any, checks need to be performed here
-	return nil
-}
-
-func (rfs *RootFilesystem) createGroups(rootFSPath string) error {
-	filePath := path.Join(rootFSPath, "etc", "group")
-
-	fileContents := ""
-
-	err := os.WriteFile(path.Join(rootFSPath, "etc", "group"), []byte(fileContents), 0644)
+	err = rfs.installDeviceNodes()
 	if err != nil {
-		return trace.Wrap(err, "failed to create group file at %q", filePath)
+		return trace.Wrap(err, "failed to install static device nodes")
 	}
 
-	return nil
-}
-
-type systemGroup struct {
-	Name  string
-	ID    uint32
-	Users []string
-}
-
-func (sg *systemGroup) GetGroupFileEntry() string {
-	return fmt.Sprintf("%s:x:%d:%s", sg.Name, sg.ID, strings.Join(sg.Users, ","))
-}
-
-type systemGroups []*systemGroup
-
-func (sg systemGroups) GetGroupFile() string {
-	fileContents := ""
-
-	slices.SortFunc(sg, func(a, b *systemGroup) int { return cmp.Compare(a.ID, b.ID) })
-
-	for _, group := range sg {
-		if group == nil {
-			continue
-		}
-
-		fileContents += group.GetGroupFileEntry()
-		fileContents += "\n"
-	}
-
-	return fileContents
-}
-
-func (sg systemGroups) WriteGroupFile(rootFSPath string) error {
-	filePath := path.Join(rootFSPath, "etc", "group")
-	slog.Info("Writing group file", "path", filePath)
-
-	fileContents := sg.GetGroupFile()
-
-	err := os.WriteFile(filePath, []byte(fileContents), 0644)
+	err = rfs.installUsersAndGroups()
 	if err != nil {
-		return trace.Wrap(err, "failed to create group file at %q", filePath)
+		return trace.Wrap(err, "failed to install users and groups")
 	}
 
-	return nil
-}
-
-type systemUser struct {
-	Name              string
-	ID                uint32
-	PrimaryGroupID    uint32
-	Info              string
-	HomeDirectoryPath string
-	ShellPath         string
-}
-
-func (su *systemUser) GetPasswdFileEntry() string {
-	return fmt.Sprintf("%s:x:%d:%d:%s:%s:%s", su.Name, su.ID, su.PrimaryGroupID, su.Info, su.HomeDirectoryPath, su.ShellPath)
-}
-
-type systemUsers []*systemUser
-
-func (su systemUsers) GetPasswdFile() string {
-	fileContents := ""
-
-	slices.SortFunc(su, func(a, b *systemUser) int { return cmp.Compare(a.ID, b.ID) })
-
-	for _, user := range su {
-		if user == nil {
-			continue
-		}
-
-		fileContents += user.GetPasswdFileEntry()
-		fileContents += "\n"
-	}
-
-	return fileContents
-}
-
-func (su systemUsers) WritePasswdFile(rootFSPath string) error {
-	filePath := path.Join(rootFSPath, "etc", "passwd")
-	slog.Info("Creating passwd file", "path", filePath)
-
-	fileContents := su.GetPasswdFile()
-
-	err := os.WriteFile(filePath, []byte(fileContents), 0644)
+	err = rfs.installBaseConfiguration()
 	if err != nil {
-		return trace.Wrap(err, "failed to create passwd file at %q", filePath)
+		return trace.Wrap(err, "failed to install base configuration files")
 	}
 
 	return nil
 }
 
-func (rfs *RootFilesystem) getUsersAndGroups() (systemUsers, systemGroups) {
-	return []*systemUser{
-			{
-				Name:              "root",
-				ID:                0,
-				PrimaryGroupID:    0,
-				Info:              "root",
-				HomeDirectoryPath: "/root",
-				ShellPath:         "/bin/bash",
-			},
-			{
-				Name:              "nobody",
-				ID:                65534,
-				PrimaryGroupID:    65534,
-				Info:              "nobody",
-				HomeDirectoryPath: "/nonexistent",
-				ShellPath:         "/usr/sbin/nologin",
-			},
-		}, []*systemGroup{
-			{
-				Name: "root",
-				ID:   0,
-			},
-			{
-				Name: "nogroup",
-				ID:   65534,
-			},
-		}
+func (rfs *RootFilesystem) VerifyBuild(context.Context) error {
+	// TODO verify what, if any, checks need to be performed here
+	return nil
 }
 
 type rootFSObject struct {
-	Name          string
-	Permissions   uint16
-	ChildObjects  []*rootFSObject
-	SymlinkTarget string // If set them the object will be symlinked to the specified path
-	SetStickyBit  bool   // If set the object will be marked as sticky bit, invalid on symlinks
-	SetGroupId    bool   // If set the object will have the setgid bit enabled, invalid on symlinks
-	GroupID       int
-	UserID        int
+	Name          string            `yaml:"name"`
+	Permissions   rootFSPermissions `yaml:"permissions"`
+	ChildObjects  []*rootFSObject   `yaml:"children"`
+	SymlinkTarget string            `yaml:"symlink_target"` // If set them the object will be symlinked to the specified path
+	SetStickyBit  bool              `yaml:"sticky"`         // If set the object will be marked as sticky bit, invalid on symlinks
+	SetGroupId    bool              `yaml:"setgid"`         // If set the object will have the setgid bit enabled, invalid on symlinks
+	GroupID       int               `yaml:"gid"`
+	UserID        int               `yaml:"uid"`
+	// If set the directory contents are created at runtime, typically by mounting a virtual
+	// filesystem. Symlinks to paths under the directory are not checked during validation.
+	IsRuntimePopulated bool `yaml:"runtime_populated"`
 }
 
 func (rfso *rootFSObject) GetFileMode() fs.FileMode {
@@ -338,8 +233,9 @@ func (rfs *RootFilesystem) getFilesystemStructure() *rootFSObject {
 			},
 			// Device files; interfaces to devices and their drivers.
 			{
-				Name:        "dev",
-				Permissions: 0755,
+				Name:               "dev",
+				IsRuntimePopulated: true,
+				Permissions:        0755,
 				ChildObjects: []*rootFSObject{
 					// Shared memory directory, expected to be backed by a tempfs.
 					{
@@ -401,8 +297,9 @@ func (rfs *RootFilesystem) getFilesystemStructure() *rootFSObject {
 			},
 			// Process information virtual filesystem.
 			{
-				Name:        "proc",
-				Permissions: 0555,
+				Name:               "proc",
+				IsRuntimePopulated: true,
+				Permissions:        0555,
 			},
 			// Home directory for root user.
 			{
@@ -450,8 +347,9 @@ func (rfs *RootFilesystem) getFilesystemStructure() *rootFSObject {
 			},
 			// System information virtual filesystem.
 			{
-				Name:        "sys",
-				Permissions: 0555,
+				Name:               "sys",
+				IsRuntimePopulated: true,
+				Permissions:        0555,
 			},
 			// Temporary scratch space for users and programs.
 			{
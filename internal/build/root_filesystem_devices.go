@@ -0,0 +1,213 @@
+package build
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+
+	"github.com/gravitational/trace"
+	"github.com/solidDoWant/distrobuilder/internal/utils"
+	"golang.org/x/sys/unix"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	deviceTypeCharacter = "char"
+	deviceTypeBlock     = "block"
+	deviceTypeSymlink   = "symlink"
+)
+
+type deviceTableConfig struct {
+	Devices []*deviceTableEntry `yaml:"devices"`
+}
+
+// Static device node, or symlink, created under /dev for systems booted without devtmpfs, or
+// for use in a chroot
+type deviceTableEntry struct {
+	Path          string            `yaml:"path"` // Absolute path within the root filesystem
+	Type          string            `yaml:"type"` // One of "char", "block", or "symlink"
+	Major         uint32            `yaml:"major"`
+	Minor         uint32            `yaml:"minor"`
+	Permissions   rootFSPermissions `yaml:"permissions"`
+	UserID        int               `yaml:"uid"`
+	GroupID       int               `yaml:"gid"`
+	SymlinkTarget string            `yaml:"symlink_target"`
+}
+
+// Minimum set of nodes needed by common programs, see the kernel's admin-guide/devices.txt
+func getDefaultDeviceTable() *deviceTableConfig {
+	return &deviceTableConfig{
+		Devices: []*deviceTableEntry{
+			{Path: "/dev/null", Type: deviceTypeCharacter, Major: 1, Minor: 3, Permissions: 0666},
+			{Path: "/dev/zero", Type: deviceTypeCharacter, Major: 1, Minor: 5, Permissions: 0666},
+			{Path: "/dev/full", Type: deviceTypeCharacter, Major: 1, Minor: 7, Permissions: 0666},
+			{Path: "/dev/random", Type: deviceTypeCharacter, Major: 1, Minor: 8, Permissions: 0666},
+			{Path: "/dev/urandom", Type: deviceTypeCharacter, Major: 1, Minor: 9, Permissions: 0666},
+			{Path: "/dev/kmsg", Type: deviceTypeCharacter, Major: 1, Minor: 11, Permissions: 0644},
+			{Path: "/dev/tty", Type: deviceTypeCharacter, Major: 5, Minor: 0, Permissions: 0666},
+			{Path: "/dev/console", Type: deviceTypeCharacter, Major: 5, Minor: 1, Permissions: 0600},
+			{Path: "/dev/ptmx", Type: deviceTypeCharacter, Major: 5, Minor: 2, Permissions: 0666},
+			{Path: "/dev/fd", Type: deviceTypeSymlink, SymlinkTarget: "/proc/self/fd"},
+			{Path: "/dev/stdin", Type: deviceTypeSymlink, SymlinkTarget: "/proc/self/fd/0"},
+			{Path: "/dev/stdout", Type: deviceTypeSymlink, SymlinkTarget: "/proc/self/fd/1"},
+			{Path: "/dev/stderr", Type: deviceTypeSymlink, SymlinkTarget: "/proc/self/fd/2"},
+		},
+	}
+}
+
+func readDeviceTableConfig(tableFilePath string) (config *deviceTableConfig, err error) {
+	tableFile, err := os.Open(tableFilePath)
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to open device table file %q", tableFilePath)
+	}
+	defer utils.Close(tableFile, &err)
+
+	config = &deviceTableConfig{}
+	decoder := yaml.NewDecoder(tableFile)
+	decoder.KnownFields(true)
+	err = decoder.Decode(config)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, trace.Wrap(err, "failed to parse device table file %q", tableFilePath)
+	}
+
+	return config, nil
+}
+
+func (dtc *deviceTableConfig) validate() error {
+	seenPaths := make(map[string]struct{}, len(dtc.Devices))
+	for _, entry := range dtc.Devices {
+		if entry == nil {
+			return trace.Errorf("device table has an empty entry")
+		}
+
+		if !path.IsAbs(entry.Path) || path.Clean(entry.Path) == "/" {
+			return trace.Errorf("device path %q must be an absolute path below /", entry.Path)
+		}
+
+		if _, ok := seenPaths[path.Clean(entry.Path)]; ok {
+			return trace.Errorf("device %q is declared more than once", entry.Path)
+		}
+		seenPaths[path.Clean(entry.Path)] = struct{}{}
+
+		if entry.UserID < 0 || entry.GroupID < 0 {
+			return trace.Errorf("device %q has a negative owner %d:%d", entry.Path, entry.UserID, entry.GroupID)
+		}
+
+		switch entry.Type {
+		case deviceTypeCharacter, deviceTypeBlock:
+			if entry.SymlinkTarget != "" {
+				return trace.Errorf("device %q cannot have a symlink target", entry.Path)
+			}
+		case deviceTypeSymlink:
+			if entry.SymlinkTarget == "" {
+				return trace.Errorf("symlink %q must have a target", entry.Path)
+			}
+
+			if entry.Major != 0 || entry.Minor != 0 || entry.Permissions != 0 {
+				return trace.Errorf("symlink %q cannot have a device number or permissions", entry.Path)
+			}
+		default:
+			return trace.Errorf("device %q has unsupported type %q, must be one of %q, %q, or %q", entry.Path, entry.Type, deviceTypeCharacter, deviceTypeBlock, deviceTypeSymlink)
+		}
+	}
+
+	return nil
+}
+
+// Get the static device table, if one should be created
+func (rfs *RootFilesystem) getDeviceTable() (*deviceTableConfig, error) {
+	if rfs.DeviceTablePath != "" {
+		config, err := readDeviceTableConfig(rfs.DeviceTablePath)
+		if err != nil {
+			return nil, trace.Wrap(err, "failed to read device table")
+		}
+
+		return config, nil
+	}
+
+	if rfs.ShouldCreateDeviceNodes {
+		return getDefaultDeviceTable(), nil
+	}
+
+	return nil, nil
+}
+
+// Create the static device nodes. This requires CAP_MKNOD, as the nodes are copied verbatim into
+// packages and filesystem images.
+func (rfs *RootFilesystem) installDeviceNodes() (err error) {
+	config, err := rfs.getDeviceTable()
+	if err != nil {
+		return trace.Wrap(err, "failed to get device table")
+	}
+
+	if config == nil {
+		return nil
+	}
+
+	err = config.validate()
+	if err != nil {
+		return trace.Wrap(err, "device table is invalid")
+	}
+
+	root, err := utils.OpenRootedDirectory(rfs.OutputDirectoryPath)
+	if err != nil {
+		return trace.Wrap(err, "failed to open output directory %q", rfs.OutputDirectoryPath)
+	}
+	defer utils.Close(root, &err)
+
+	for _, entry := range config.Devices {
+		err := root.MkdirAll(path.Dir(entry.Path), 0755)
+		if err != nil {
+			return trace.Wrap(err, "failed to create parent directory of %q", entry.Path)
+		}
+
+		if entry.Type == deviceTypeSymlink {
+			err = root.Symlink(entry.SymlinkTarget, entry.Path)
+			if err != nil {
+				return trace.Wrap(err, "failed to create device symlink %q", entry.Path)
+			}
+
+			continue
+		}
+
+		err = createDeviceNode(root, &utils.DeviceNode{
+			Path:          entry.Path,
+			IsBlockDevice: entry.Type == deviceTypeBlock,
+			Permissions:   os.FileMode(entry.Permissions),
+			UserID:        entry.UserID,
+			GroupID:       entry.GroupID,
+			Major:         entry.Major,
+			Minor:         entry.Minor,
+		})
+		if err != nil {
+			return trace.Wrap(err, "failed to create device node %q", entry.Path)
+		}
+	}
+
+	return nil
+}
+
+func createDeviceNode(root *utils.RootedDirectory, node *utils.DeviceNode) error {
+	err := root.CreateDeviceNode(node)
+	if err != nil {
+		if errors.Is(err, unix.EPERM) {
+			return trace.Wrap(err, "creating device nodes requires root (CAP_MKNOD)")
+		}
+
+		return trace.Wrap(err, "failed to create device node")
+	}
+
+	// The mode passed to mknod is affected by the umask
+	err = root.Chmod(node.Path, node.Permissions)
+	if err != nil {
+		return trace.Wrap(err, "failed to set device node permissions")
+	}
+
+	err = root.Lchown(node.Path, node.UserID, node.GroupID)
+	if err != nil {
+		return trace.Wrap(err, "failed to set device node ownership")
+	}
+
+	return nil
+}
@@ -0,0 +1,266 @@
+package build
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/gravitational/trace"
+	"github.com/solidDoWant/distrobuilder/internal/utils"
+	"gopkg.in/yaml.v3"
+)
+
+const rootFSProfile = `# Generated from the distro identity config
+export PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin
+umask 022
+
+for script in /etc/profile.d/*.sh; do
+	[ -r "$script" ] && . "$script"
+done
+unset script
+`
+
+const rootFSFstab = `# Generated from the distro identity config. The root filesystem is mounted by the
+# initramfs, and virtual filesystems are mounted by init.
+# <file system> <mount point> <type> <options> <dump> <pass>
+`
+
+// musl does not use this, but other software reads it to determine lookup order
+const rootFSNsswitchConfig = `# Generated from the distro identity config
+passwd:    files
+group:     files
+shadow:    files
+gshadow:   files
+hosts:     files dns
+networks:  files
+protocols: files
+services:  files
+ethers:    files
+rpc:       files
+`
+
+// Characters allowed in os-release ID fields, see os-release(5)
+var osReleaseIDPattern = regexp.MustCompile(`^[a-z0-9._-]+$`)
+
+// IANA time zone names, i.e. "America/New_York" or "Etc/GMT+5"
+var timezoneNamePattern = regexp.MustCompile(`^[A-Za-z0-9_+-]+(/[A-Za-z0-9_+-]+)*$`)
+
+// RFC 1123 hostname label
+var hostnameLabelPattern = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+
+// Identifies the distro in /etc/os-release and related files
+type distroIdentity struct {
+	Name            string   `yaml:"name"`
+	ID              string   `yaml:"id"`
+	IDLike          []string `yaml:"id_like"`
+	PrettyName      string   `yaml:"pretty_name"` // Defaults to "<name> <version>"
+	Version         string   `yaml:"version"`
+	VersionID       string   `yaml:"version_id"`
+	VersionCodename string   `yaml:"version_codename"`
+	HomeURL         string   `yaml:"home_url"`
+	SupportURL      string   `yaml:"support_url"`
+	BugReportURL    string   `yaml:"bug_report_url"`
+	Hostname        string   `yaml:"hostname"` // Defaults to the ID, with "." and "_" replaced by "-"
+	// Optional IANA time zone name, linked to from /etc/localtime. The zone file is provided by
+	// the tzdata package. musl uses UTC when this is not set.
+	Timezone string `yaml:"timezone"`
+}
+
+func readDistroIdentity(identityFilePath string) (identity *distroIdentity, err error) {
+	identityFile, err := os.Open(identityFilePath)
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to open distro identity file %q", identityFilePath)
+	}
+	defer utils.Close(identityFile, &err)
+
+	identity = &distroIdentity{}
+	decoder := yaml.NewDecoder(identityFile)
+	decoder.KnownFields(true)
+	err = decoder.Decode(identity)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, trace.Wrap(err, "failed to parse distro identity file %q", identityFilePath)
+	}
+
+	return identity, nil
+}
+
+// Fill in defaults, matching those specified by os-release(5)
+func (di *distroIdentity) setDefaults() {
+	if di.Name == "" {
+		di.Name = "Linux"
+	}
+
+	if di.ID == "" {
+		di.ID = "linux"
+	}
+
+	if di.PrettyName == "" {
+		di.PrettyName = strings.TrimSpace(di.Name + " " + di.Version)
+	}
+
+	if di.Hostname == "" {
+		di.Hostname = getDefaultHostname(di.ID)
+	}
+}
+
+// Derive a hostname from the os-release ID, which may contain characters that are not allowed in
+// hostnames. "localhost" is used if the ID cannot be converted.
+func getDefaultHostname(id string) string {
+	hostname := strings.Map(func(r rune) rune {
+		if r == '.' || r == '_' {
+			return '-'
+		}
+
+		return r
+	}, id)
+	hostname = strings.Trim(hostname, "-")
+
+	if !hostnameLabelPattern.MatchString(hostname) {
+		return "localhost"
+	}
+
+	return hostname
+}
+
+func (di *distroIdentity) validate() error {
+	idFields := [][2]string{
+		{"ID", di.ID},
+		{"VERSION_ID", di.VersionID},
+		{"VERSION_CODENAME", di.VersionCodename},
+	}
+	for _, idLike := range di.IDLike {
+		idFields = append(idFields, [2]string{"ID_LIKE", idLike})
+	}
+
+	for _, idField := range idFields {
+		if idField[1] != "" && !osReleaseIDPattern.MatchString(idField[1]) {
+			return trace.Errorf("%s value %q may only contain lowercase letters, digits, \".\", \"_\", and \"-\"", idField[0], idField[1])
+		}
+	}
+
+	if len(di.Hostname) > 253 {
+		return trace.Errorf("hostname %q is longer than 253 characters", di.Hostname)
+	}
+
+	for _, label := range strings.Split(di.Hostname, ".") {
+		if !hostnameLabelPattern.MatchString(label) {
+			return trace.Errorf("hostname %q is not valid", di.Hostname)
+		}
+	}
+
+	if di.Timezone != "" && !timezoneNamePattern.MatchString(di.Timezone) {
+		return trace.Errorf("timezone %q is not a valid time zone name", di.Timezone)
+	}
+
+	return nil
+}
+
+func (di *distroIdentity) GetOSReleaseFile(buildID string) string {
+	fileContents := &strings.Builder{}
+	for _, field := range []struct {
+		Name  string
+		Value string
+	}{
+		{"NAME", di.Name},
+		{"ID", di.ID},
+		{"ID_LIKE", strings.Join(di.IDLike, " ")},
+		{"PRETTY_NAME", di.PrettyName},
+		{"VERSION", di.Version},
+		{"VERSION_ID", di.VersionID},
+		{"VERSION_CODENAME", di.VersionCodename},
+		{"BUILD_ID", buildID},
+		{"HOME_URL", di.HomeURL},
+		{"SUPPORT_URL", di.SupportURL},
+		{"BUG_REPORT_URL", di.BugReportURL},
+	} {
+		if field.Value == "" {
+			continue
+		}
+
+		fmt.Fprintf(fileContents, "%s=%s\n", field.Name, quoteOSReleaseValue(field.Value))
+	}
+
+	return fileContents.String()
+}
+
+// Quote a value using shell double quote rules, as required by os-release(5)
+func quoteOSReleaseValue(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "`", "\\`").Replace(value) + `"`
+}
+
+func (di *distroIdentity) GetHostsFile() string {
+	return fmt.Sprintf(`# Generated from the distro identity config
+127.0.0.1 localhost
+::1       localhost ip6-localhost ip6-loopback
+127.0.1.1 %s
+`, di.Hostname)
+}
+
+func (rfs *RootFilesystem) installBaseConfiguration() error {
+	identity := &distroIdentity{}
+	if rfs.IdentityConfigPath != "" {
+		var err error
+		identity, err = readDistroIdentity(rfs.IdentityConfigPath)
+		if err != nil {
+			return trace.Wrap(err, "failed to read distro identity")
+		}
+	}
+	identity.setDefaults()
+
+	err := identity.validate()
+	if err != nil {
+		return trace.Wrap(err, "distro identity is invalid")
+	}
+
+	// The canonical os-release location is under /usr so that it is updated with the rest of
+	// the OS, see os-release(5)
+	for relativeFilePath, fileContents := range map[string]string{
+		path.Join("usr", "lib", "os-release"): identity.GetOSReleaseFile(rfs.BuildID),
+		path.Join("etc", "hostname"):          identity.Hostname + "\n",
+		path.Join("etc", "hosts"):             identity.GetHostsFile(),
+		path.Join("etc", "fstab"):             rootFSFstab,
+		path.Join("etc", "nsswitch.conf"):     rootFSNsswitchConfig,
+		path.Join("etc", "shells"):            rfs.getShellsFile(),
+		path.Join("etc", "profile"):           rootFSProfile,
+	} {
+		err = rfs.WriteOutputFile(relativeFilePath, fileContents, 0644)
+		if err != nil {
+			return trace.Wrap(err, "failed to write %q", relativeFilePath)
+		}
+	}
+
+	links := map[string]string{
+		path.Join("etc", "os-release"): path.Join("..", "usr", "lib", "os-release"),
+		// Written at runtime by the network configuration, i.e. udhcpc
+		path.Join("etc", "resolv.conf"): path.Join("..", "run", "resolv.conf"),
+	}
+
+	if identity.Timezone != "" {
+		links[path.Join("etc", "localtime")] = path.Join("..", "usr", "share", "zoneinfo", identity.Timezone)
+
+		// Read by some tools instead of resolving the localtime link
+		err = rfs.WriteOutputFile(path.Join("etc", "timezone"), identity.Timezone+"\n", 0644)
+		if err != nil {
+			return trace.Wrap(err, "failed to write timezone file")
+		}
+	}
+
+	for linkPath, linkTarget := range links {
+		err = os.Symlink(linkTarget, path.Join(rfs.OutputDirectoryPath, linkPath))
+		if err != nil {
+			return trace.Wrap(err, "failed to link %q to %q", linkPath, linkTarget)
+		}
+	}
+
+	return nil
+}
+
+// List the default login shell. Other shells are not listed, as the root filesystem is built
+// before any shell is installed, so they may never exist.
+func (rfs *RootFilesystem) getShellsFile() string {
+	return "# Generated from the distro identity config\n" + rfs.getDefaultShellPath() + "\n"
+}
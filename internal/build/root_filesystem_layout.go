@@ -0,0 +1,215 @@
+package build
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gravitational/trace"
+	"github.com/solidDoWant/distrobuilder/internal/utils"
+	"golang.org/x/exp/maps"
+	"gopkg.in/yaml.v3"
+)
+
+// Maximum number of symlinks followed when resolving a single symlink target, matching Linux
+const maxLayoutSymlinkFollows = 40
+
+// Permission bits, written in octal in layout files (i.e. "0755", 0755, or 0o755). Values are
+// always read as octal so that they can be written as plain numbers in JSON.
+type rootFSPermissions uint16
+
+func (rfsp *rootFSPermissions) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind != yaml.ScalarNode {
+		return trace.Errorf("permissions must be a scalar value, line %d", node.Line)
+	}
+
+	octalValue := strings.TrimPrefix(strings.TrimPrefix(node.Value, "0o"), "0O")
+	permissions, err := strconv.ParseUint(octalValue, 8, 16)
+	if err != nil {
+		return trace.Wrap(err, "permissions %q on line %d are not a valid octal value", node.Value, node.Line)
+	}
+
+	if permissions > 0777 {
+		return trace.Errorf("permissions %q on line %d must only contain permission bits", node.Value, node.Line)
+	}
+
+	*rfsp = rootFSPermissions(permissions)
+	return nil
+}
+
+// Get the filesystem layout, either from the layout file or the built in default
+func (rfs *RootFilesystem) getFilesystemLayout() (*rootFSObject, error) {
+	if rfs.FilesystemLayoutPath == "" {
+		return rfs.getFilesystemStructure(), nil
+	}
+
+	layout, err := readFilesystemLayout(rfs.FilesystemLayoutPath)
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to read filesystem layout")
+	}
+
+	return layout, nil
+}
+
+// Read a layout file. JSON is a subset of YAML, so either format is accepted.
+func readFilesystemLayout(layoutFilePath string) (layout *rootFSObject, err error) {
+	layoutFile, err := os.Open(layoutFilePath)
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to open filesystem layout file %q", layoutFilePath)
+	}
+	defer utils.Close(layoutFile, &err)
+
+	layout = &rootFSObject{}
+	decoder := yaml.NewDecoder(layoutFile)
+	decoder.KnownFields(true)
+	err = decoder.Decode(layout)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, trace.Errorf("filesystem layout file %q is empty", layoutFilePath)
+		}
+
+		return nil, trace.Wrap(err, "failed to parse filesystem layout file %q", layoutFilePath)
+	}
+
+	return layout, nil
+}
+
+// Check that the layout can be created, and that every symlink resolves to an object in the
+// layout. Symlinks into runtime populated directories are assumed to be valid.
+func validateFilesystemLayout(root *rootFSObject) error {
+	if root.Name != "/" {
+		return trace.Errorf("the top level object must be named \"/\", found %q", root.Name)
+	}
+
+	if root.SymlinkTarget != "" {
+		return trace.Errorf("the top level object cannot be a symlink")
+	}
+
+	objects := map[string]*rootFSObject{}
+	err := indexFilesystemLayout(root, "/", objects)
+	if err != nil {
+		return trace.Wrap(err, "filesystem layout is invalid")
+	}
+
+	// Sorted for consistent error output
+	objectPaths := maps.Keys(objects)
+	slices.Sort(objectPaths)
+
+	errs := make([]error, 0)
+	for _, objectPath := range objectPaths {
+		object := objects[objectPath]
+		if object.SymlinkTarget == "" {
+			continue
+		}
+
+		_, _, err := resolveLayoutPath(objects, getLayoutSymlinkTarget(objectPath, object), 0)
+		if err != nil {
+			errs = append(errs, trace.Wrap(err, "symlink %q to %q is dangling", objectPath, object.SymlinkTarget))
+		}
+	}
+
+	if len(errs) > 0 {
+		return trace.NewAggregate(errs...)
+	}
+
+	return nil
+}
+
+// Build a map of absolute path to object, checking each object along the way
+func indexFilesystemLayout(object *rootFSObject, objectPath string, objects map[string]*rootFSObject) error {
+	objects[objectPath] = object
+
+	if object.UserID < 0 || object.GroupID < 0 {
+		return trace.Errorf("%q has a negative owner %d:%d", objectPath, object.UserID, object.GroupID)
+	}
+
+	if object.SymlinkTarget != "" {
+		switch {
+		case len(object.ChildObjects) > 0:
+			return trace.Errorf("symlink %q cannot have children", objectPath)
+		case object.SetStickyBit || object.SetGroupId:
+			return trace.Errorf("symlink %q cannot have the sticky or setgid bits set", objectPath)
+		case object.IsRuntimePopulated:
+			return trace.Errorf("symlink %q cannot be runtime populated", objectPath)
+		}
+	}
+
+	for _, childObject := range object.ChildObjects {
+		if childObject == nil {
+			return trace.Errorf("%q has an empty child entry", objectPath)
+		}
+
+		if childObject.Name == "" || childObject.Name == "." || childObject.Name == ".." || strings.Contains(childObject.Name, "/") {
+			return trace.Errorf("%q has a child with invalid name %q", objectPath, childObject.Name)
+		}
+
+		childPath := path.Join(objectPath, childObject.Name)
+		if _, ok := objects[childPath]; ok {
+			return trace.Errorf("%q is declared more than once", childPath)
+		}
+
+		err := indexFilesystemLayout(childObject, childPath, objects)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+	}
+
+	return nil
+}
+
+// Get the absolute path that a symlink points to. Relative targets are resolved lexically.
+func getLayoutSymlinkTarget(symlinkPath string, object *rootFSObject) string {
+	if path.IsAbs(object.SymlinkTarget) {
+		return object.SymlinkTarget
+	}
+
+	return path.Join(path.Dir(symlinkPath), object.SymlinkTarget)
+}
+
+// Resolve each component of the path through the layout, following symlinks. True is returned
+// if the path is under a runtime populated directory, in which case it cannot be resolved.
+func resolveLayoutPath(objects map[string]*rootFSObject, targetPath string, followCount int) (string, bool, error) {
+	resolvedPath := "/"
+	for _, component := range strings.Split(path.Clean(targetPath), "/") {
+		if component == "" {
+			continue
+		}
+
+		if objects[resolvedPath].IsRuntimePopulated {
+			return "", true, nil
+		}
+
+		candidatePath := path.Join(resolvedPath, component)
+		object, ok := objects[candidatePath]
+		if !ok {
+			return "", false, trace.Errorf("%q does not exist in the layout", candidatePath)
+		}
+
+		if object.SymlinkTarget == "" {
+			resolvedPath = candidatePath
+			continue
+		}
+
+		if followCount >= maxLayoutSymlinkFollows {
+			return "", false, trace.Errorf("too many levels of symlinks")
+		}
+
+		var isRuntimePopulated bool
+		var err error
+		resolvedPath, isRuntimePopulated, err = resolveLayoutPath(objects, getLayoutSymlinkTarget(candidatePath, object), followCount+1)
+		if err != nil {
+			// Not wrapped with the symlink path, as this would repeat for every level of a loop
+			return "", false, trace.Wrap(err)
+		}
+
+		if isRuntimePopulated {
+			return "", true, nil
+		}
+	}
+
+	return resolvedPath, false, nil
+}
@@ -0,0 +1,717 @@
+package build
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/gravitational/trace"
+	"github.com/solidDoWant/distrobuilder/internal/utils"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// Login shell for users that do not set one, as it is the only shell path that POSIX requires
+	defaultShellPath = "/bin/sh"
+	// Marks an account's password as locked, while still allowing other login methods
+	lockedPasswordHash           = "!"
+	noLoginShellPath             = "/usr/sbin/nologin"
+	nonexistentHomeDirectoryPath = "/nonexistent"
+)
+
+// Defaults match those of shadow's login.defs
+var (
+	defaultSystemIDRange      = idRange{Min: 100, Max: 999}
+	defaultUserIDRange        = idRange{Min: 1000, Max: 59999}
+	defaultSubordinateIDRange = subordinateIDRange{Start: 100000, Count: 65536}
+)
+
+// Portable user and group names, with the "$" suffix allowed for machine accounts
+var accountNamePattern = regexp.MustCompile(`^[a-z_][a-z0-9_-]{0,30}\$?$`)
+
+type idRange struct {
+	Min uint32 `yaml:"min"`
+	Max uint32 `yaml:"max"`
+}
+
+type subordinateIDRange struct {
+	Start uint32 `yaml:"start"` // First ID allocated to any user
+	Count uint32 `yaml:"count"` // Number of IDs allocated to each user
+}
+
+// Declarative user and group configuration. IDs that are not set are allocated from the
+// system range for system accounts, and the user range otherwise.
+type usersConfig struct {
+	SystemIDRange      *idRange            `yaml:"system_id_range"`
+	UserIDRange        *idRange            `yaml:"user_id_range"`
+	SubordinateIDRange *subordinateIDRange `yaml:"subordinate_id_range"`
+	Groups             []*groupConfig      `yaml:"groups"`
+	Users              []*userConfig       `yaml:"users"`
+}
+
+type groupConfig struct {
+	Name    string   `yaml:"name"`
+	ID      *uint32  `yaml:"gid"`
+	System  bool     `yaml:"system"`
+	Members []string `yaml:"members"` // Supplementary members, in addition to users that list this group
+}
+
+type userConfig struct {
+	Name              string   `yaml:"name"`
+	ID                *uint32  `yaml:"uid"`
+	System            bool     `yaml:"system"`
+	PrimaryGroup      string   `yaml:"primary_group"` // Defaults to a group with the same name as the user, which is created if needed
+	Groups            []string `yaml:"groups"`        // Supplementary groups
+	Info              string   `yaml:"info"`
+	HomeDirectoryPath string   `yaml:"home"`        // Defaults to /home/<name>, or /nonexistent for system users
+	CreateHome        *bool    `yaml:"create_home"` // Defaults to true for non-system users
+	ShellPath         string   `yaml:"shell"`       // Defaults to the installed shell, or nologin for system users
+	// At most one of these may be set. If neither are set then the password is locked.
+	Password     string `yaml:"password"`      // Plain text password, hashed with SHA-512 crypt
+	PasswordHash string `yaml:"password_hash"` // Pre-hashed crypt(3) password, i.e. yescrypt or SHA-512 crypt
+	// Whether to allocate subordinate UIDs and GIDs for rootless containers. Defaults to true for
+	// non-system users.
+	SubordinateIDs *bool `yaml:"subordinate_ids"`
+}
+
+func getDefaultUsersConfig() *usersConfig {
+	rootID := uint32(0)
+	nobodyID := uint32(65534)
+	shouldCreateHome := false
+
+	return &usersConfig{
+		Groups: []*groupConfig{
+			{
+				Name:   "root",
+				ID:     &rootID,
+				System: true,
+			},
+			{
+				Name:   "nogroup",
+				ID:     &nobodyID,
+				System: true,
+			},
+		},
+		Users: []*userConfig{
+			{
+				Name:              "root",
+				ID:                &rootID,
+				System:            true,
+				PrimaryGroup:      "root",
+				Info:              "root",
+				HomeDirectoryPath: "/root",
+				CreateHome:        &shouldCreateHome, // Created as part of the filesystem structure
+			},
+			{
+				Name:              "nobody",
+				ID:                &nobodyID,
+				System:            true,
+				PrimaryGroup:      "nogroup",
+				Info:              "nobody",
+				HomeDirectoryPath: nonexistentHomeDirectoryPath,
+				ShellPath:         noLoginShellPath,
+			},
+		},
+	}
+}
+
+func readUsersConfig(configFilePath string) (config *usersConfig, err error) {
+	configFile, err := os.Open(configFilePath)
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to open users config file %q", configFilePath)
+	}
+	defer utils.Close(configFile, &err)
+
+	config = &usersConfig{}
+	decoder := yaml.NewDecoder(configFile)
+	decoder.KnownFields(true)
+	err = decoder.Decode(config)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, trace.Wrap(err, "failed to parse users config file %q", configFilePath)
+	}
+
+	return config, nil
+}
+
+type systemGroup struct {
+	Name  string
+	ID    uint32
+	Users []string
+}
+
+func (sg *systemGroup) GetGroupFileEntry() string {
+	return fmt.Sprintf("%s:x:%d:%s", sg.Name, sg.ID, strings.Join(sg.Users, ","))
+}
+
+func (sg *systemGroup) GetGshadowFileEntry() string {
+	return fmt.Sprintf("%s:%s::%s", sg.Name, lockedPasswordHash, strings.Join(sg.Users, ","))
+}
+
+type systemGroups []*systemGroup
+
+func (sg systemGroups) getFile(getEntry func(*systemGroup) string) string {
+	fileContents := ""
+
+	slices.SortFunc(sg, func(a, b *systemGroup) int { return cmp.Compare(a.ID, b.ID) })
+
+	for _, group := range sg {
+		if group == nil {
+			continue
+		}
+
+		fileContents += getEntry(group)
+		fileContents += "\n"
+	}
+
+	return fileContents
+}
+
+func (sg systemGroups) GetGroupFile() string {
+	return sg.getFile((*systemGroup).GetGroupFileEntry)
+}
+
+func (sg systemGroups) GetGshadowFile() string {
+	return sg.getFile((*systemGroup).GetGshadowFileEntry)
+}
+
+func (sg systemGroups) WriteGroupFiles(rootFSPath string) error {
+	filePath := path.Join(rootFSPath, "etc", "group")
+	slog.Info("Writing group file", "path", filePath)
+
+	err := os.WriteFile(filePath, []byte(sg.GetGroupFile()), 0644)
+	if err != nil {
+		return trace.Wrap(err, "failed to create group file at %q", filePath)
+	}
+
+	filePath = path.Join(rootFSPath, "etc", "gshadow")
+	slog.Info("Writing gshadow file", "path", filePath)
+
+	err = os.WriteFile(filePath, []byte(sg.GetGshadowFile()), 0600)
+	if err != nil {
+		return trace.Wrap(err, "failed to create gshadow file at %q", filePath)
+	}
+
+	return nil
+}
+
+type systemUser struct {
+	Name              string
+	ID                uint32
+	PrimaryGroupID    uint32
+	Info              string
+	HomeDirectoryPath string
+	ShellPath         string
+	PasswordHash      string
+
+	ShouldCreateHomeDirectory bool
+	SubordinateIDStart        uint32
+	SubordinateIDCount        uint32 // Zero if the user does not have subordinate IDs
+}
+
+func (su *systemUser) GetPasswdFileEntry() string {
+	return fmt.Sprintf("%s:x:%d:%d:%s:%s:%s", su.Name, su.ID, su.PrimaryGroupID, su.Info, su.HomeDirectoryPath, su.ShellPath)
+}
+
+// Password aging is disabled by leaving the last change date empty, which also keeps the
+// file reproducible
+func (su *systemUser) GetShadowFileEntry() string {
+	return fmt.Sprintf("%s:%s::0:99999:7:::", su.Name, su.PasswordHash)
+}
+
+// Get the entry used for both /etc/subuid and /etc/subgid
+func (su *systemUser) GetSubordinateIDFileEntry() string {
+	return fmt.Sprintf("%s:%d:%d", su.Name, su.SubordinateIDStart, su.SubordinateIDCount)
+}
+
+type systemUsers []*systemUser
+
+func (su systemUsers) getFile(getEntry func(*systemUser) string, filter func(*systemUser) bool) string {
+	fileContents := ""
+
+	slices.SortFunc(su, func(a, b *systemUser) int { return cmp.Compare(a.ID, b.ID) })
+
+	for _, user := range su {
+		if user == nil || !filter(user) {
+			continue
+		}
+
+		fileContents += getEntry(user)
+		fileContents += "\n"
+	}
+
+	return fileContents
+}
+
+func (su systemUsers) GetPasswdFile() string {
+	return su.getFile((*systemUser).GetPasswdFileEntry, func(*systemUser) bool { return true })
+}
+
+func (su systemUsers) GetShadowFile() string {
+	return su.getFile((*systemUser).GetShadowFileEntry, func(*systemUser) bool { return true })
+}
+
+func (su systemUsers) GetSubordinateIDFile() string {
+	return su.getFile((*systemUser).GetSubordinateIDFileEntry, func(user *systemUser) bool { return user.SubordinateIDCount > 0 })
+}
+
+func (su systemUsers) WritePasswdFiles(rootFSPath string) error {
+	for _, file := range []struct {
+		Name        string
+		Contents    string
+		Permissions os.FileMode
+	}{
+		{"passwd", su.GetPasswdFile(), 0644},
+		{"shadow", su.GetShadowFile(), 0600},
+		{"subuid", su.GetSubordinateIDFile(), 0644},
+		{"subgid", su.GetSubordinateIDFile(), 0644},
+	} {
+		filePath := path.Join(rootFSPath, "etc", file.Name)
+		slog.Info(fmt.Sprintf("Creating %s file", file.Name), "path", filePath)
+
+		err := os.WriteFile(filePath, []byte(file.Contents), file.Permissions)
+		if err != nil {
+			return trace.Wrap(err, "failed to create %s file at %q", file.Name, filePath)
+		}
+	}
+
+	return nil
+}
+
+// Create home directories that are owned by, and only accessible to, each user
+func (su systemUsers) CreateHomeDirectories(rootFSPath string) error {
+	for _, user := range su {
+		if !user.ShouldCreateHomeDirectory {
+			continue
+		}
+
+		homeDirectoryPath := path.Join(rootFSPath, user.HomeDirectoryPath)
+		err := os.MkdirAll(homeDirectoryPath, 0700)
+		if err != nil {
+			return trace.Wrap(err, "failed to create home directory %q for user %q", homeDirectoryPath, user.Name)
+		}
+
+		err = os.Chmod(homeDirectoryPath, 0700)
+		if err != nil {
+			return trace.Wrap(err, "failed to set permissions of home directory %q", homeDirectoryPath)
+		}
+
+		err = os.Chown(homeDirectoryPath, int(user.ID), int(user.PrimaryGroupID))
+		if err != nil {
+			return trace.Wrap(err, "failed to set ownership of %q to %d:%d", homeDirectoryPath, user.ID, user.PrimaryGroupID)
+		}
+	}
+
+	return nil
+}
+
+func (rfs *RootFilesystem) installUsersAndGroups() error {
+	users, groups, err := rfs.getUsersAndGroups()
+	if err != nil {
+		return trace.Wrap(err, "failed to get users and groups")
+	}
+
+	err = users.WritePasswdFiles(rfs.OutputDirectoryPath)
+	if err != nil {
+		return trace.Wrap(err, "failed to write user passwd files to rootfs at %q", rfs.OutputDirectoryPath)
+	}
+
+	err = groups.WriteGroupFiles(rfs.OutputDirectoryPath)
+	if err != nil {
+		return trace.Wrap(err, "failed to write group files to rootfs at %q", rfs.OutputDirectoryPath)
+	}
+
+	err = users.CreateHomeDirectories(rfs.OutputDirectoryPath)
+	if err != nil {
+		return trace.Wrap(err, "failed to create home directories in rootfs at %q", rfs.OutputDirectoryPath)
+	}
+
+	return nil
+}
+
+func (rfs *RootFilesystem) getUsersAndGroups() (systemUsers, systemGroups, error) {
+	config := getDefaultUsersConfig()
+	if rfs.UsersConfigPath != "" {
+		var err error
+		config, err = readUsersConfig(rfs.UsersConfigPath)
+		if err != nil {
+			return nil, nil, trace.Wrap(err, "failed to read users config")
+		}
+	}
+
+	resolver := newUsersConfigResolver(config, rfs.getDefaultShellPath())
+	users, groups, err := resolver.Resolve()
+	if err != nil {
+		return nil, nil, trace.Wrap(err, "failed to resolve users config")
+	}
+
+	return users, groups, nil
+}
+
+// Get the login shell for users that do not specify one. The root filesystem is built before
+// any shell is installed, so installed shells cannot be detected.
+func (rfs *RootFilesystem) getDefaultShellPath() string {
+	if rfs.ShellPath != "" {
+		return rfs.ShellPath
+	}
+
+	return defaultShellPath
+}
+
+// Converts the declarative config into concrete users and groups, allocating IDs as needed
+type usersConfigResolver struct {
+	config             *usersConfig
+	defaultShellPath   string
+	systemIDRange      idRange
+	userIDRange        idRange
+	subordinateIDRange subordinateIDRange
+
+	groups       map[string]*systemGroup
+	usedGroupIDs map[uint32]struct{}
+	users        map[string]*systemUser
+	usedUserIDs  map[uint32]struct{}
+}
+
+func newUsersConfigResolver(config *usersConfig, defaultShellPath string) *usersConfigResolver {
+	resolver := &usersConfigResolver{
+		config:             config,
+		defaultShellPath:   defaultShellPath,
+		systemIDRange:      defaultSystemIDRange,
+		userIDRange:        defaultUserIDRange,
+		subordinateIDRange: defaultSubordinateIDRange,
+		groups:             map[string]*systemGroup{},
+		usedGroupIDs:       map[uint32]struct{}{},
+		users:              map[string]*systemUser{},
+		usedUserIDs:        map[uint32]struct{}{},
+	}
+
+	if config.SystemIDRange != nil {
+		resolver.systemIDRange = *config.SystemIDRange
+	}
+
+	if config.UserIDRange != nil {
+		resolver.userIDRange = *config.UserIDRange
+	}
+
+	if config.SubordinateIDRange != nil {
+		resolver.subordinateIDRange = *config.SubordinateIDRange
+	}
+
+	return resolver
+}
+
+func (ucr *usersConfigResolver) Resolve() (systemUsers, systemGroups, error) {
+	err := ucr.validate()
+	if err != nil {
+		return nil, nil, trace.Wrap(err, "users config is invalid")
+	}
+
+	// Explicit IDs are reserved first so that allocated IDs never collide with them
+	for _, groupConfig := range ucr.config.Groups {
+		if groupConfig.ID == nil {
+			continue
+		}
+
+		err = ucr.addGroup(groupConfig.Name, *groupConfig.ID)
+		if err != nil {
+			return nil, nil, trace.Wrap(err, "failed to add group %q", groupConfig.Name)
+		}
+	}
+
+	for _, userConfig := range ucr.config.Users {
+		if userConfig.ID == nil {
+			continue
+		}
+
+		if _, ok := ucr.usedUserIDs[*userConfig.ID]; ok {
+			return nil, nil, trace.Errorf("UID %d of user %q is used by another user", *userConfig.ID, userConfig.Name)
+		}
+		ucr.usedUserIDs[*userConfig.ID] = struct{}{}
+	}
+
+	for _, groupConfig := range ucr.config.Groups {
+		if groupConfig.ID != nil {
+			continue
+		}
+
+		groupID, err := allocateID(ucr.getIDRange(groupConfig.System), groupConfig.System, ucr.usedGroupIDs)
+		if err != nil {
+			return nil, nil, trace.Wrap(err, "failed to allocate GID for group %q", groupConfig.Name)
+		}
+
+		err = ucr.addGroup(groupConfig.Name, groupID)
+		if err != nil {
+			return nil, nil, trace.Wrap(err, "failed to add group %q", groupConfig.Name)
+		}
+	}
+
+	users := make(systemUsers, 0, len(ucr.config.Users))
+	nextSubordinateID := ucr.subordinateIDRange.Start
+	for _, userConfig := range ucr.config.Users {
+		user, err := ucr.resolveUser(userConfig)
+		if err != nil {
+			return nil, nil, trace.Wrap(err, "failed to resolve user %q", userConfig.Name)
+		}
+
+		shouldAllocateSubordinateIDs := !userConfig.System
+		if userConfig.SubordinateIDs != nil {
+			shouldAllocateSubordinateIDs = *userConfig.SubordinateIDs
+		}
+
+		if shouldAllocateSubordinateIDs {
+			user.SubordinateIDStart = nextSubordinateID
+			user.SubordinateIDCount = ucr.subordinateIDRange.Count
+			nextSubordinateID += ucr.subordinateIDRange.Count
+		}
+
+		ucr.users[user.Name] = user
+		users = append(users, user)
+	}
+
+	// Supplementary group membership may be declared on either the user or the group
+	for _, userConfig := range ucr.config.Users {
+		for _, groupName := range userConfig.Groups {
+			err = ucr.addGroupMember(groupName, userConfig.Name)
+			if err != nil {
+				return nil, nil, trace.Wrap(err, "failed to add user %q to supplementary groups", userConfig.Name)
+			}
+		}
+	}
+
+	for _, groupConfig := range ucr.config.Groups {
+		for _, userName := range groupConfig.Members {
+			err = ucr.addGroupMember(groupConfig.Name, userName)
+			if err != nil {
+				return nil, nil, trace.Wrap(err, "failed to add members to group %q", groupConfig.Name)
+			}
+		}
+	}
+
+	groups := make(systemGroups, 0, len(ucr.groups))
+	for _, group := range ucr.groups {
+		groups = append(groups, group)
+	}
+
+	return users, groups, nil
+}
+
+func (ucr *usersConfigResolver) validate() error {
+	for _, r := range []idRange{ucr.systemIDRange, ucr.userIDRange} {
+		if r.Min > r.Max {
+			return trace.Errorf("ID range minimum %d is greater than the maximum %d", r.Min, r.Max)
+		}
+	}
+
+	if ucr.subordinateIDRange.Count == 0 {
+		return trace.Errorf("subordinate ID count must be greater than zero")
+	}
+
+	groupNames := map[string]struct{}{}
+	for _, groupConfig := range ucr.config.Groups {
+		if !accountNamePattern.MatchString(groupConfig.Name) {
+			return trace.Errorf("group name %q is not valid", groupConfig.Name)
+		}
+
+		if _, ok := groupNames[groupConfig.Name]; ok {
+			return trace.Errorf("group %q is declared more than once", groupConfig.Name)
+		}
+		groupNames[groupConfig.Name] = struct{}{}
+	}
+
+	hasRoot := false
+	userNames := map[string]struct{}{}
+	for _, userConfig := range ucr.config.Users {
+		if !accountNamePattern.MatchString(userConfig.Name) {
+			return trace.Errorf("user name %q is not valid", userConfig.Name)
+		}
+
+		if _, ok := userNames[userConfig.Name]; ok {
+			return trace.Errorf("user %q is declared more than once", userConfig.Name)
+		}
+		userNames[userConfig.Name] = struct{}{}
+
+		if userConfig.Password != "" && userConfig.PasswordHash != "" {
+			return trace.Errorf("user %q sets both a password and a password hash", userConfig.Name)
+		}
+
+		if strings.ContainsAny(userConfig.PasswordHash, ":\n") {
+			return trace.Errorf("password hash for user %q contains invalid characters", userConfig.Name)
+		}
+
+		for _, field := range []string{userConfig.Info, userConfig.HomeDirectoryPath, userConfig.ShellPath} {
+			if strings.ContainsAny(field, ":\n") {
+				return trace.Errorf("passwd field %q for user %q contains invalid characters", field, userConfig.Name)
+			}
+		}
+
+		if userConfig.HomeDirectoryPath != "" && !path.IsAbs(userConfig.HomeDirectoryPath) {
+			return trace.Errorf("home directory %q for user %q is not absolute", userConfig.HomeDirectoryPath, userConfig.Name)
+		}
+
+		if userConfig.Name == "root" {
+			if userConfig.ID == nil || *userConfig.ID != 0 {
+				return trace.Errorf("user root must have UID 0")
+			}
+			hasRoot = true
+		}
+	}
+
+	if !hasRoot {
+		return trace.Errorf("the root user must be declared")
+	}
+
+	return nil
+}
+
+func (ucr *usersConfigResolver) resolveUser(userConfig *userConfig) (*systemUser, error) {
+	var userID uint32
+	if userConfig.ID != nil {
+		userID = *userConfig.ID
+	} else {
+		var err error
+		userID, err = allocateID(ucr.getIDRange(userConfig.System), userConfig.System, ucr.usedUserIDs)
+		if err != nil {
+			return nil, trace.Wrap(err, "failed to allocate UID")
+		}
+		ucr.usedUserIDs[userID] = struct{}{}
+	}
+
+	primaryGroupName := userConfig.PrimaryGroup
+	if primaryGroupName == "" {
+		primaryGroupName = userConfig.Name
+	}
+
+	primaryGroup, ok := ucr.groups[primaryGroupName]
+	if !ok {
+		if userConfig.PrimaryGroup != "" {
+			return nil, trace.Errorf("primary group %q is not declared", primaryGroupName)
+		}
+
+		// Create a user private group, matching the UID when possible
+		groupID := userID
+		if _, ok := ucr.usedGroupIDs[groupID]; ok {
+			var err error
+			groupID, err = allocateID(ucr.getIDRange(userConfig.System), userConfig.System, ucr.usedGroupIDs)
+			if err != nil {
+				return nil, trace.Wrap(err, "failed to allocate GID for user private group")
+			}
+		}
+
+		err := ucr.addGroup(primaryGroupName, groupID)
+		if err != nil {
+			return nil, trace.Wrap(err, "failed to add user private group")
+		}
+		primaryGroup = ucr.groups[primaryGroupName]
+	}
+
+	homeDirectoryPath := userConfig.HomeDirectoryPath
+	if homeDirectoryPath == "" {
+		homeDirectoryPath = path.Join("/home", userConfig.Name)
+		if userConfig.System {
+			homeDirectoryPath = nonexistentHomeDirectoryPath
+		}
+	}
+
+	shouldCreateHomeDirectory := !userConfig.System
+	if userConfig.CreateHome != nil {
+		shouldCreateHomeDirectory = *userConfig.CreateHome
+	}
+
+	if homeDirectoryPath == nonexistentHomeDirectoryPath {
+		shouldCreateHomeDirectory = false
+	}
+
+	shellPath := userConfig.ShellPath
+	if shellPath == "" {
+		shellPath = ucr.defaultShellPath
+		// Root is a system user, but it should still be able to log in
+		if userConfig.System && userID != 0 {
+			shellPath = noLoginShellPath
+		}
+	}
+
+	passwordHash := userConfig.PasswordHash
+	switch {
+	case userConfig.Password != "":
+		var err error
+		passwordHash, err = sha512Crypt(userConfig.Password)
+		if err != nil {
+			return nil, trace.Wrap(err, "failed to hash password")
+		}
+	case passwordHash == "":
+		passwordHash = lockedPasswordHash
+	}
+
+	return &systemUser{
+		Name:                      userConfig.Name,
+		ID:                        userID,
+		PrimaryGroupID:            primaryGroup.ID,
+		Info:                      userConfig.Info,
+		HomeDirectoryPath:         homeDirectoryPath,
+		ShellPath:                 shellPath,
+		PasswordHash:              passwordHash,
+		ShouldCreateHomeDirectory: shouldCreateHomeDirectory,
+	}, nil
+}
+
+func (ucr *usersConfigResolver) addGroup(name string, id uint32) error {
+	if _, ok := ucr.usedGroupIDs[id]; ok {
+		return trace.Errorf("GID %d is used by another group", id)
+	}
+
+	ucr.usedGroupIDs[id] = struct{}{}
+	ucr.groups[name] = &systemGroup{
+		Name: name,
+		ID:   id,
+	}
+
+	return nil
+}
+
+func (ucr *usersConfigResolver) addGroupMember(groupName, userName string) error {
+	group, ok := ucr.groups[groupName]
+	if !ok {
+		return trace.Errorf("group %q is not declared", groupName)
+	}
+
+	if _, ok := ucr.users[userName]; !ok {
+		return trace.Errorf("user %q is not declared", userName)
+	}
+
+	if !slices.Contains(group.Users, userName) {
+		group.Users = append(group.Users, userName)
+	}
+
+	return nil
+}
+
+func (ucr *usersConfigResolver) getIDRange(isSystem bool) idRange {
+	if isSystem {
+		return ucr.systemIDRange
+	}
+
+	return ucr.userIDRange
+}
+
+// Find the lowest free ID in the range, or the highest for system accounts. This matches the
+// behavior of useradd and groupadd. The caller is responsible for marking the ID as used.
+func allocateID(r idRange, fromTop bool, usedIDs map[uint32]struct{}) (uint32, error) {
+	for offset := uint64(0); offset <= uint64(r.Max-r.Min); offset++ {
+		id := r.Min + uint32(offset)
+		if fromTop {
+			id = r.Max - uint32(offset)
+		}
+
+		if _, ok := usedIDs[id]; !ok {
+			return id, nil
+		}
+	}
+
+	return 0, trace.Errorf("no free IDs in range %d-%d", r.Min, r.Max)
+}
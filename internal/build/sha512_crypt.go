@@ -0,0 +1,139 @@
+package build
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/gravitational/trace"
+)
+
+// SHA-512 based crypt(3), as specified at https://www.akkadia.org/drepper/SHA-crypt.txt. This is
+// the strongest scheme supported by musl's crypt, which is used by BusyBox's login and passwd.
+const (
+	sha512CryptPrefix        = "$6$"
+	sha512CryptDefaultRounds = 5000
+	sha512CryptMaxSaltLength = 16
+	sha512CryptAlphabet      = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+)
+
+// Order that the final digest bytes are encoded in, in groups of three
+var sha512CryptEncodingOrder = [][3]int{
+	{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4}, {47, 5, 26}, {6, 27, 48},
+	{28, 49, 7}, {50, 8, 29}, {9, 30, 51}, {31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13},
+	{56, 14, 35}, {15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19}, {62, 20, 41},
+}
+
+// Hash the password with a random salt
+func sha512Crypt(password string) (string, error) {
+	salt := make([]byte, sha512CryptMaxSaltLength)
+	alphabetLength := big.NewInt(int64(len(sha512CryptAlphabet)))
+	for i := range salt {
+		index, err := rand.Int(rand.Reader, alphabetLength)
+		if err != nil {
+			return "", trace.Wrap(err, "failed to generate salt")
+		}
+
+		salt[i] = sha512CryptAlphabet[index.Int64()]
+	}
+
+	return sha512CryptWithSalt(password, string(salt), sha512CryptDefaultRounds), nil
+}
+
+func sha512CryptWithSalt(password, salt string, rounds int) string {
+	if len(salt) > sha512CryptMaxSaltLength {
+		salt = salt[:sha512CryptMaxSaltLength]
+	}
+	passwordBytes, saltBytes := []byte(password), []byte(salt)
+
+	alternateHash := sha512.New()
+	alternateHash.Write(passwordBytes)
+	alternateHash.Write(saltBytes)
+	alternateHash.Write(passwordBytes)
+	alternateDigest := alternateHash.Sum(nil)
+
+	hash := sha512.New()
+	hash.Write(passwordBytes)
+	hash.Write(saltBytes)
+	hash.Write(repeatDigest(alternateDigest, len(passwordBytes)))
+	for length := len(passwordBytes); length > 0; length >>= 1 {
+		if length&1 != 0 {
+			hash.Write(alternateDigest)
+		} else {
+			hash.Write(passwordBytes)
+		}
+	}
+	digest := hash.Sum(nil)
+
+	passwordHash := sha512.New()
+	for range passwordBytes {
+		passwordHash.Write(passwordBytes)
+	}
+	passwordSequence := repeatDigest(passwordHash.Sum(nil), len(passwordBytes))
+
+	saltHash := sha512.New()
+	for i := 0; i < 16+int(digest[0]); i++ {
+		saltHash.Write(saltBytes)
+	}
+	saltSequence := repeatDigest(saltHash.Sum(nil), len(saltBytes))
+
+	for round := 0; round < rounds; round++ {
+		roundHash := sha512.New()
+		if round%2 != 0 {
+			roundHash.Write(passwordSequence)
+		} else {
+			roundHash.Write(digest)
+		}
+
+		if round%3 != 0 {
+			roundHash.Write(saltSequence)
+		}
+
+		if round%7 != 0 {
+			roundHash.Write(passwordSequence)
+		}
+
+		if round%2 != 0 {
+			roundHash.Write(digest)
+		} else {
+			roundHash.Write(passwordSequence)
+		}
+
+		digest = roundHash.Sum(nil)
+	}
+
+	result := &strings.Builder{}
+	result.WriteString(sha512CryptPrefix)
+	if rounds != sha512CryptDefaultRounds {
+		fmt.Fprintf(result, "rounds=%d$", rounds)
+	}
+	result.WriteString(salt)
+	result.WriteString("$")
+
+	for _, indices := range sha512CryptEncodingOrder {
+		writeCryptBase64(result, uint(digest[indices[0]])<<16|uint(digest[indices[1]])<<8|uint(digest[indices[2]]), 4)
+	}
+	writeCryptBase64(result, uint(digest[63]), 2)
+
+	return result.String()
+}
+
+// Repeat the digest to fill the given length
+func repeatDigest(digest []byte, length int) []byte {
+	sequence := make([]byte, 0, length)
+	for len(sequence) < length {
+		sequence = append(sequence, digest[:min(len(digest), length-len(sequence))]...)
+	}
+
+	return sequence
+}
+
+// Write the value as characters of the crypt alphabet, least significant six bits first
+func writeCryptBase64(builder *strings.Builder, value uint, characterCount int) {
+	for i := 0; i < characterCount; i++ {
+		builder.WriteByte(sha512CryptAlphabet[value&0x3f])
+		value >>= 6
+	}
+}
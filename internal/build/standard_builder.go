@@ -2,7 +2,10 @@ package build
 
 import (
 	"context"
+	"debug/elf"
+	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"log/slog"
 	"os"
@@ -40,8 +43,15 @@ type StandardBuilder struct {
 	// Variables for building
 	Name string
 
+	// Variables for testing
+	ShouldRunTests     bool
+	TestExeWrapperPath string // If empty, target executables are run directly via binfmt_misc
+	testSuite          *upstreamTestSuite
+
 	// Variables for build verification
-	BinariesToCheck []string
+	BinariesToCheck        []string // Files that must exist in the output. All ELF files are checked regardless.
+	AllowNonPIEExecutables bool
+	ShouldFixPathLeaks     bool
 }
 
 func (sb *StandardBuilder) CheckHostRequirements() error {
@@ -50,6 +60,11 @@ func (sb *StandardBuilder) CheckHostRequirements() error {
 		return trace.Wrap(err, "failed to verify that all required toolchain tools exist")
 	}
 
+	err = sb.checkTestHostRequirements()
+	if err != nil {
+		return trace.Wrap(err, "failed to verify that target executables can be run for tests")
+	}
+
 	return nil
 }
 
@@ -70,6 +85,20 @@ func (sb *StandardBuilder) Build(ctx context.Context) error {
 		return trace.Wrap(err, "failed to build %s", sb.Name)
 	}
 
+	if sb.ShouldRunTests {
+		err = sb.RunTests()
+		if err != nil {
+			return trace.Wrap(err, "failed to test %s", sb.Name)
+		}
+	}
+
+	if sb.ShouldFixPathLeaks {
+		err = sb.FixPathLeaks()
+		if err != nil {
+			return trace.Wrap(err, "failed to fix build host path references in %s output", sb.Name)
+		}
+	}
+
 	return nil
 }
 
@@ -88,16 +117,111 @@ func (sb *StandardBuilder) Setup(ctx context.Context) (*utils.Directory, error)
 }
 
 func (sb *StandardBuilder) VerifyBuild(ctx context.Context) error {
+	err := sb.VerifyRequiredFilesExist()
+	if err != nil {
+		return trace.Wrap(err, "failed to verify that required files were built")
+	}
+
+	err = sb.VerifyElfFiles()
+	if err != nil {
+		return trace.Wrap(err, "failed to verify built ELF files")
+	}
+
+	err = sb.VerifyElfDependencies()
+	if err != nil {
+		return trace.Wrap(err, "failed to verify ELF dynamic dependencies")
+	}
+
+	err = sb.VerifyNoPathLeaks()
+	if err != nil {
+		return trace.Wrap(err, "failed to verify that the output does not reference build host paths")
+	}
+
+	return nil
+}
+
+func (sb *StandardBuilder) VerifyRequiredFilesExist() error {
 	for _, binaryPath := range sb.BinariesToCheck {
-		err := sb.VerifyTargetElfFile(path.Join(sb.OutputDirectoryPath, binaryPath))
+		exists, err := utils.DoesFilesystemPathExist(path.Join(sb.OutputDirectoryPath, binaryPath))
 		if err != nil {
-			return trace.Wrap(err, "built file %q did not match the expected ELF values", binaryPath)
+			return trace.Wrap(err, "failed to check if built file %q exists", binaryPath)
+		}
+
+		if !exists {
+			return trace.Errorf("expected built file %q does not exist", binaryPath)
 		}
 	}
 
 	return nil
 }
 
+// Check every ELF file in the output directory against the target
+func (sb *StandardBuilder) VerifyElfFiles() error {
+	var errs []error
+	err := filepath.WalkDir(sb.OutputDirectoryPath, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return trace.Wrap(err, "failed to walk %q", filePath)
+		}
+
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+
+		isElfFile, err := isElfFile(filePath)
+		if err != nil {
+			return trace.Wrap(err, "failed to check if %q is an ELF file", filePath)
+		}
+
+		if !isElfFile {
+			return nil
+		}
+
+		relativeFilePath, err := filepath.Rel(sb.OutputDirectoryPath, filePath)
+		if err != nil {
+			return trace.Wrap(err, "failed to get path of %q relative to %q", filePath, sb.OutputDirectoryPath)
+		}
+
+		properties, err := sb.VerifyTargetElfFile(filePath)
+		if err != nil {
+			errs = append(errs, trace.Wrap(err, "built file %q did not match the expected ELF values", relativeFilePath))
+			return nil
+		}
+
+		slog.Debug("Verified ELF file", "path", relativeFilePath, "type", properties.Type.String(), "pie", properties.IsPIE, "static", properties.IsStaticallyLinked)
+
+		if properties.IsExecutable && !properties.IsPIE && !sb.AllowNonPIEExecutables {
+			errs = append(errs, trace.Errorf("built executable %q is not position independent", relativeFilePath))
+		}
+
+		return nil
+	})
+	if err != nil {
+		return trace.Wrap(err, "failed to search %q for ELF files", sb.OutputDirectoryPath)
+	}
+
+	return trace.NewAggregate(errs...)
+}
+
+func isElfFile(filePath string) (isElf bool, err error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return false, trace.Wrap(err, "failed to open %q", filePath)
+	}
+	defer utils.Close(file, &err)
+
+	magic := make([]byte, len(elf.ELFMAG))
+	_, err = io.ReadFull(file, magic)
+	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return false, nil
+		}
+
+		return false, trace.Wrap(err, "failed to read %q", filePath)
+	}
+
+	return string(magic) == elf.ELFMAG, nil
+}
+
 func (sb *StandardBuilder) getGenericRunner(workingDirectory string) runners.GenericRunner {
 	return runners.GenericRunner{
 		WorkingDirectory: workingDirectory,
@@ -113,7 +237,12 @@ func (sb *StandardBuilder) CMakeConfigure(buildDirectoryPath string, options ...
 }
 
 func (sb *StandardBuilder) CMakeConfigureWithPath(buildDirectoryPath, cmakePath string, options ...*runners.CMakeOptions) error {
-	_, err := runners.Run(&runners.CMake{
+	testOptions, err := sb.getTestCMakeOptions()
+	if err != nil {
+		return trace.Wrap(err, "failed to get CMake test options")
+	}
+
+	_, err = runners.Run(&runners.CMake{
 		GenericRunner: sb.getGenericRunner(buildDirectoryPath),
 		Generator:     "Ninja",
 		Path:          cmakePath,
@@ -122,6 +251,7 @@ func (sb *StandardBuilder) CMakeConfigureWithPath(buildDirectoryPath, cmakePath
 				sb.FilesystemOutputBuilder.GetCMakeOptions("usr"),
 				sb.ToolchainRequiredBuilder.GetCMakeOptions(),
 				sb.RootFSBuilder.GetCMakeOptions(),
+				testOptions,
 			},
 			options...,
 		),
@@ -131,6 +261,7 @@ func (sb *StandardBuilder) CMakeConfigureWithPath(buildDirectoryPath, cmakePath
 		return trace.Wrap(err, "failed to create generator file for %s", sb.Name)
 	}
 
+	sb.setTestSuite(buildSystemCMake, buildDirectoryPath)
 	return nil
 }
 
@@ -200,6 +331,7 @@ func (sb *StandardBuilder) GNUConfigureWithSrc(buildDirectoryPath, sourceDirecto
 		return trace.Wrap(err, "failed to run configure script for %s", sb.Name)
 	}
 
+	sb.setTestSuite(buildSystemAutotools, buildDirectoryPath)
 	return nil
 }
 
@@ -286,7 +418,13 @@ func updatePkgconfigPrefix(pkgconfigFilePath string) error {
 }
 
 func (sb *StandardBuilder) MesonSetup(buildDirectoryPath string, options ...*runners.MesonOptions) error {
-	_, err := runners.Run(&runners.Meson{
+	toolchainOptions := sb.ToolchainRequiredBuilder.GetMesonOptions()
+	err := sb.updateTestMesonOptions(toolchainOptions)
+	if err != nil {
+		return trace.Wrap(err, "failed to add Meson test options")
+	}
+
+	_, err = runners.Run(&runners.Meson{
 		GenericRunner:       sb.getGenericRunner(buildDirectoryPath), // This does not nescessarily need to be set to the build directory,
 		Backend:             "Ninja",
 		SourceDirectoryPath: sb.SourceDirectoryPath,
@@ -294,7 +432,7 @@ func (sb *StandardBuilder) MesonSetup(buildDirectoryPath string, options ...*run
 		Options: append(
 			[]*runners.MesonOptions{
 				sb.FilesystemOutputBuilder.GetMesonOptions(),
-				sb.ToolchainRequiredBuilder.GetMesonOptions(),
+				toolchainOptions,
 				sb.RootFSBuilder.GetMesonOptions(),
 			},
 			options...,
@@ -305,6 +443,7 @@ func (sb *StandardBuilder) MesonSetup(buildDirectoryPath string, options ...*run
 		return trace.Wrap(err, "failed to create perform setup with meson for %s", sb.Name)
 	}
 
+	sb.setTestSuite(buildSystemMeson, buildDirectoryPath)
 	return nil
 }
 
@@ -331,7 +470,7 @@ func (sb *StandardBuilder) genericNinjaBuild(baseRunner runners.GenericRunner, b
 
 	_, err := runners.Run(runners.CommandRunner{
 		Command:       "ninja",
-		Arguments:     buildTargets,
+		Arguments:     append([]string{fmt.Sprintf("-j%d", runners.ParallelJobCount)}, buildTargets...),
 		GenericRunner: baseRunner,
 	})
 	if err != nil {
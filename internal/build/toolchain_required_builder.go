@@ -13,6 +13,7 @@ import (
 	"github.com/gravitational/trace"
 	"github.com/solidDoWant/distrobuilder/internal/runners"
 	"github.com/solidDoWant/distrobuilder/internal/runners/args"
+	"github.com/solidDoWant/distrobuilder/internal/utils"
 	"golang.org/x/exp/slices"
 )
 
@@ -149,40 +150,121 @@ func (trb *ToolchainRequiredBuilder) CheckToolsExist() error {
 	return nil
 }
 
-func (trb *ToolchainRequiredBuilder) VerifyTargetElfFile(targetExecutablePath string) error {
-	file, err := elf.Open(targetExecutablePath)
+// Properties of a built ELF file that are not specific to the target
+type targetElfProperties struct {
+	Type               elf.Type
+	IsExecutable       bool // False for shared libraries and relocatable objects
+	IsPIE              bool
+	IsStaticallyLinked bool
+	InterpreterPath    string // Empty if the file is not dynamically linked
+}
+
+// Check that an ELF file was built for the target machine and C library, and get its properties
+func (trb *ToolchainRequiredBuilder) VerifyTargetElfFile(targetElfFilePath string) (properties *targetElfProperties, err error) {
+	file, err := elf.Open(targetElfFilePath)
 	if err != nil {
-		return trace.Wrap(err, "failed to open executable for validation")
+		return nil, trace.Wrap(err, "failed to open ELF file for validation")
 	}
+	defer utils.Close(file, &err)
 
 	executableMachine := strings.ToLower(strings.TrimPrefix(file.Machine.String(), "EM_"))
 	targetMachine := strings.ToLower(trb.Triplet.Machine)
 	if executableMachine != targetMachine {
-		return trace.Errorf("the executable machine type %q does not match desired target machine type %q", executableMachine, targetMachine)
+		return nil, trace.Errorf("the ELF machine type %q does not match desired target machine type %q", executableMachine, targetMachine)
+	}
+
+	properties, err = getTargetElfProperties(file)
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to get ELF file properties")
+	}
+
+	// Relocatable objects (i.e. crt1.o, kernel modules) are not linked yet
+	if properties.Type == elf.ET_REL {
+		return properties, nil
 	}
 
-	// TODO check if binary is position independent
+	err = trb.verifyElfLibC(file, properties)
+	if err != nil {
+		return nil, trace.Wrap(err, "ELF file was not linked against the target C library")
+	}
+
+	// The .dynamic section is checked against the root filesystem by VerifyElfDependencies
+
+	return properties, nil
+}
+
+func getTargetElfProperties(file *elf.File) (*targetElfProperties, error) {
+	properties := &targetElfProperties{
+		Type: file.Type,
+	}
 
 	interpreterSection := pie.Of(file.Progs).Filter(func(programSection *elf.Prog) bool { return programSection.Type == elf.PT_INTERP }).First()
-	if interpreterSection == nil {
-		// Assume that the binary is statically linked
-		// TODO verify that this is a valid test
+	if interpreterSection != nil {
+		buffer := make([]byte, interpreterSection.Filesz-1) // The last character is a null termination character, don't read it
+		_, err := interpreterSection.ReadAt(buffer, 0)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, trace.Wrap(err, "failed to read entire interpreter section from the ELF file")
+		}
+
+		properties.InterpreterPath = string(buffer)
+	}
+
+	switch file.Type {
+	case elf.ET_EXEC:
+		properties.IsExecutable = true
+		properties.IsStaticallyLinked = properties.InterpreterPath == ""
+	case elf.ET_DYN:
+		// Position independent executables are shared objects with either an interpreter, or the
+		// PIE flag set for static PIE executables, which load themselves
+		var flags uint64
+		if file.Section(".dynamic") != nil {
+			flagValues, err := file.DynValue(elf.DT_FLAGS_1)
+			if err != nil {
+				return nil, trace.Wrap(err, "failed to read dynamic section flags")
+			}
+
+			for _, flagValue := range flagValues {
+				flags |= flagValue
+			}
+		}
+
+		properties.IsExecutable = properties.InterpreterPath != "" || flags&uint64(elf.DF_1_PIE) != 0
+		properties.IsPIE = properties.IsExecutable
+		properties.IsStaticallyLinked = properties.IsExecutable && properties.InterpreterPath == ""
+	}
+
+	return properties, nil
+}
+
+func (trb *ToolchainRequiredBuilder) verifyElfLibC(file *elf.File, properties *targetElfProperties) error {
+	if properties.InterpreterPath != "" {
+		desiredInterpreterPaths := []string{path.Join("/lib", trb.Triplet.GetDynamicLoaderName()), path.Join("/usr", "/lib", trb.Triplet.GetDynamicLoaderName())}
+		if !slices.Contains(desiredInterpreterPaths, properties.InterpreterPath) {
+			return trace.Errorf("the executable interpreter %q does not match one of expected value %v", properties.InterpreterPath, desiredInterpreterPaths)
+		}
+	}
+
+	libCSoname := trb.Triplet.GetLibCSoname()
+	if libCSoname == "" {
 		return nil
 	}
 
-	buffer := make([]byte, interpreterSection.Filesz-1) // The last character is a null termination character, don't read it
-	_, err = interpreterSection.ReadAt(buffer, 0)
-	if err != nil && !errors.Is(err, io.EOF) {
-		return trace.Wrap(err, "failed to read entire interpreter section from the executable")
+	neededLibraries, err := file.ImportedLibraries()
+	if err != nil {
+		return trace.Wrap(err, "failed to read needed libraries")
 	}
 
-	interpreterPath := string(buffer)
-	desiredInterpreterPaths := []string{path.Join("/lib", trb.Triplet.GetDynamicLoaderName()), path.Join("/usr", "/lib", trb.Triplet.GetDynamicLoaderName())}
-	if !slices.Contains(desiredInterpreterPaths, interpreterPath) {
-		return trace.Errorf("the executable interpreter %q does not match one of expected value %v", interpreterPath, desiredInterpreterPaths)
+	for _, neededLibrary := range neededLibraries {
+		if (neededLibrary == "libc.so" || strings.HasPrefix(neededLibrary, "libc.so.")) && neededLibrary != libCSoname {
+			return trace.Errorf("the ELF file needs C library %q instead of %q", neededLibrary, libCSoname)
+		}
 	}
 
-	// TODO check .dynamic section for possible host libs
+	// glibc's startup files add an ABI tag note, which is the only reliable marker in statically
+	// linked files
+	if libCSoname != "libc.so.6" && file.Section(".note.ABI-tag") != nil {
+		return trace.Errorf("the ELF file contains a glibc ABI tag note, but the target C library is %q", trb.Triplet.LibC)
+	}
 
 	return nil
 }
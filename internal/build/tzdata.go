@@ -0,0 +1,144 @@
+package build
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path"
+
+	"github.com/gravitational/trace"
+	"github.com/solidDoWant/distrobuilder/internal/runners"
+	"github.com/solidDoWant/distrobuilder/internal/runners/args"
+	"github.com/solidDoWant/distrobuilder/internal/source"
+	git_source "github.com/solidDoWant/distrobuilder/internal/source/git"
+	"github.com/solidDoWant/distrobuilder/internal/utils"
+)
+
+// TZif files start with this, see RFC 8536
+const tzifMagic = "TZif"
+
+// Tables installed alongside the compiled zones, used by tools like tzselect
+var tzdataTableFiles = []string{
+	"iso3166.tab",
+	"zone.tab",
+	"zone1970.tab",
+	"zonenow.tab", // Only present in 2023d and later
+	"leapseconds",
+	"tzdata.zi",
+}
+
+// Compiles the IANA time zone database. The data is architecture independent, so zic is built for
+// and run on the host.
+type TZData struct {
+	StandardBuilder
+}
+
+func NewTZData() *TZData {
+	instance := &TZData{
+		StandardBuilder: StandardBuilder{
+			Name: "tzdata",
+		},
+	}
+
+	instance.IStandardBuilder = instance
+	return instance
+}
+
+// The toolchain is not used, as nothing is built for the target
+func (tzd *TZData) CheckHostRequirements() error {
+	err := runners.CheckRequiredCommandsExist([]string{"clang", "make", "awk"})
+	if err != nil {
+		return trace.Wrap(err, "failed to find required host commands")
+	}
+
+	return nil
+}
+
+func (tzd *TZData) GetGitRepo(repoDirectoryPath string, ref string) *source.GitRepo {
+	return git_source.NewTZDataGitRepo(repoDirectoryPath, ref)
+}
+
+func (tzd *TZData) DoConfiguration(buildDirectoryPath string) error {
+	err := tzd.CopyToBuildDirectory(buildDirectoryPath)
+	if err != nil {
+		return trace.Wrap(err, "failed to copy sources to build directory")
+	}
+
+	return nil
+}
+
+func (tzd *TZData) DoBuild(buildDirectoryPath string) error {
+	clangPath, err := utils.SearchPath("clang")
+	if err != nil {
+		return trace.Wrap(err, "failed to find host clang executable path")
+	}
+
+	// tzdata.zi is a single file containing all zones, generated from the individual region files
+	err = tzd.MakeBuild(buildDirectoryPath, []*runners.MakeOptions{
+		{
+			Variables: map[string]args.IValue{
+				"CC": args.StringValue(clangPath),
+			},
+		},
+	}, "zic", "tzdata.zi")
+	if err != nil {
+		return trace.Wrap(err, "failed to build host zic and tzdata.zi")
+	}
+
+	zoneinfoDirectoryPath := path.Join(tzd.OutputDirectoryPath, "usr", "share", "zoneinfo")
+	_, err = runners.Run(runners.CommandRunner{
+		GenericRunner: runners.GenericRunner{
+			WorkingDirectory: buildDirectoryPath,
+		},
+		Command:   path.Join(buildDirectoryPath, "zic"),
+		Arguments: []string{"-d", zoneinfoDirectoryPath, "tzdata.zi"},
+	})
+	if err != nil {
+		return trace.Wrap(err, "failed to compile time zones")
+	}
+
+	for _, tableFileName := range tzdataTableFiles {
+		tableFilePath := path.Join(buildDirectoryPath, tableFileName)
+		exists, err := utils.DoesFilesystemPathExist(tableFilePath)
+		if err != nil {
+			return trace.Wrap(err, "failed to check if %q exists", tableFilePath)
+		}
+
+		if !exists {
+			continue
+		}
+
+		tableFileContents, err := os.ReadFile(tableFilePath)
+		if err != nil {
+			return trace.Wrap(err, "failed to read %q", tableFilePath)
+		}
+
+		err = tzd.WriteOutputFile(path.Join("usr", "share", "zoneinfo", tableFileName), string(tableFileContents), 0644)
+		if err != nil {
+			return trace.Wrap(err, "failed to install %q", tableFileName)
+		}
+	}
+
+	return nil
+}
+
+func (tzd *TZData) VerifyBuild(ctx context.Context) error {
+	err := tzd.StandardBuilder.VerifyBuild(ctx)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	for _, zoneName := range []string{"UTC", path.Join("America", "New_York"), path.Join("Europe", "London")} {
+		zoneFilePath := path.Join(tzd.OutputDirectoryPath, "usr", "share", "zoneinfo", zoneName)
+		zoneFileContents, err := os.ReadFile(zoneFilePath)
+		if err != nil {
+			return trace.Wrap(err, "failed to read zone file %q", zoneFilePath)
+		}
+
+		if !bytes.HasPrefix(zoneFileContents, []byte(tzifMagic)) {
+			return trace.Errorf("zone file %q is not a TZif file", zoneFilePath)
+		}
+	}
+
+	return nil
+}
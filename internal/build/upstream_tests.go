@@ -0,0 +1,218 @@
+package build
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/gravitational/trace"
+	"github.com/solidDoWant/distrobuilder/internal/runners"
+	"github.com/solidDoWant/distrobuilder/internal/runners/args"
+	"github.com/solidDoWant/distrobuilder/internal/utils"
+)
+
+// Directory that the kernel exposes registered binfmt_misc handlers in
+const binfmtMiscDirectoryPath = "/proc/sys/fs/binfmt_misc"
+
+type ITestRunner interface {
+	SetShouldRunTests(bool)
+	SetTestExeWrapperPath(string)
+}
+
+type buildSystem string
+
+const (
+	buildSystemAutotools buildSystem = "autotools"
+	buildSystemCMake     buildSystem = "cmake"
+	buildSystemMeson     buildSystem = "meson"
+)
+
+// The upstream test suite of a configured build
+type upstreamTestSuite struct {
+	BuildSystem        buildSystem
+	BuildDirectoryPath string // Directory that the build system was configured in
+}
+
+func (sb *StandardBuilder) SetShouldRunTests(shouldRunTests bool) {
+	sb.ShouldRunTests = shouldRunTests
+}
+
+func (sb *StandardBuilder) SetTestExeWrapperPath(testExeWrapperPath string) {
+	sb.TestExeWrapperPath = testExeWrapperPath
+}
+
+// Record the build system used to configure the build, so that its test suite can be run later
+func (sb *StandardBuilder) setTestSuite(buildSystem buildSystem, buildDirectoryPath string) {
+	sb.testSuite = &upstreamTestSuite{
+		BuildSystem:        buildSystem,
+		BuildDirectoryPath: buildDirectoryPath,
+	}
+}
+
+// Check that target executables can be run on the host, either via the exe wrapper or a binfmt_misc
+// handler (typically installed by qemu-user-static)
+func (sb *StandardBuilder) checkTestHostRequirements() error {
+	if !sb.ShouldRunTests {
+		return nil
+	}
+
+	if sb.TestExeWrapperPath != "" {
+		_, err := utils.SearchPath(sb.TestExeWrapperPath)
+		if err != nil {
+			return trace.Wrap(err, "failed to find test exe wrapper %q", sb.TestExeWrapperPath)
+		}
+
+		return nil
+	}
+
+	isRegistered, err := isBinfmtHandlerRegistered(sb.Triplet.GetQemuUserArch())
+	if err != nil {
+		return trace.Wrap(err, "failed to check for a binfmt_misc handler for %q", sb.Triplet.Machine)
+	}
+
+	if !isRegistered {
+		return trace.Errorf("no qemu-user binfmt_misc handler is registered for %q, install one or set a test exe wrapper (i.e. qemu-%s)", sb.Triplet.Machine, sb.Triplet.GetQemuUserArch())
+	}
+
+	return nil
+}
+
+func isBinfmtHandlerRegistered(qemuArch string) (bool, error) {
+	handlerFilePath := path.Join(binfmtMiscDirectoryPath, fmt.Sprintf("qemu-%s", qemuArch))
+	handlerFileContents, err := os.ReadFile(handlerFilePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+
+		return false, trace.Wrap(err, "failed to read binfmt_misc handler file %q", handlerFilePath)
+	}
+
+	return strings.HasPrefix(string(handlerFileContents), "enabled"), nil
+}
+
+// Get the absolute path to the test exe wrapper, or an empty string if target executables should
+// be run directly via binfmt_misc
+func (sb *StandardBuilder) getTestExeWrapperPath() (string, error) {
+	if sb.TestExeWrapperPath == "" {
+		return "", nil
+	}
+
+	exeWrapperPath, err := utils.SearchPath(sb.TestExeWrapperPath)
+	if err != nil {
+		return "", trace.Wrap(err, "failed to find test exe wrapper %q", sb.TestExeWrapperPath)
+	}
+
+	return exeWrapperPath, nil
+}
+
+// Runner for test suites. qemu-user loads the dynamic loader and libraries from the root
+// filesystem, falling back to host paths for libraries in the build directory.
+func (sb *StandardBuilder) getTestRunner(workingDirectory string) runners.GenericRunner {
+	runner := sb.getGenericRunner(workingDirectory)
+	runner.ExcludeBuildEnvironment = true
+	runner.Options = append(runner.Options, &runners.GenericRunnerOptions{
+		EnvironmentVariables: map[string]args.IValue{
+			"QEMU_LD_PREFIX": args.StringValue(sb.RootFSDirectoryPath),
+		},
+	})
+
+	return runner
+}
+
+func (sb *StandardBuilder) getTestCMakeOptions() (*runners.CMakeOptions, error) {
+	if !sb.ShouldRunTests {
+		return nil, nil
+	}
+
+	exeWrapperPath, err := sb.getTestExeWrapperPath()
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to get test exe wrapper path")
+	}
+
+	if exeWrapperPath == "" {
+		return nil, nil
+	}
+
+	return &runners.CMakeOptions{
+		Defines: map[string]args.IValue{
+			"CMAKE_CROSSCOMPILING_EMULATOR": args.StringValue(exeWrapperPath),
+		},
+	}, nil
+}
+
+// Provide the exe wrapper that the toolchain cross file requires for running target executables
+func (sb *StandardBuilder) updateTestMesonOptions(options *runners.MesonOptions) error {
+	if !sb.ShouldRunTests {
+		return nil
+	}
+
+	exeWrapperPath, err := sb.getTestExeWrapperPath()
+	if err != nil {
+		return trace.Wrap(err, "failed to get test exe wrapper path")
+	}
+
+	if exeWrapperPath == "" {
+		// Target executables can be run directly via binfmt_misc
+		options.CrossFile["properties"]["needs_exe_wrapper"] = args.FalseValue()
+		return nil
+	}
+
+	options.CrossFile["binaries"]["exe_wrapper"] = args.StringValue(exeWrapperPath)
+	return nil
+}
+
+// Run the upstream test suite of the configured build system
+func (sb *StandardBuilder) RunTests() error {
+	if sb.testSuite == nil {
+		slog.Warn(fmt.Sprintf("No known test suite for %s, skipping tests", sb.Name))
+		return nil
+	}
+
+	slog.Info(fmt.Sprintf("Running %s test suite", sb.Name), "build_system", sb.testSuite.BuildSystem)
+	testRunner := sb.getTestRunner(sb.testSuite.BuildDirectoryPath)
+
+	var err error
+	switch sb.testSuite.BuildSystem {
+	case buildSystemAutotools:
+		// Automake test harnesses run target executables (or libtool wrapper scripts) directly
+		if sb.TestExeWrapperPath != "" {
+			isRegistered, err := isBinfmtHandlerRegistered(sb.Triplet.GetQemuUserArch())
+			if err != nil {
+				return trace.Wrap(err, "failed to check for a binfmt_misc handler for %q", sb.Triplet.Machine)
+			}
+
+			if !isRegistered {
+				return trace.Errorf("%s tests are run with make, which requires a qemu-user binfmt_misc handler for %q", sb.Name, sb.Triplet.Machine)
+			}
+		}
+
+		_, err = runners.Run(&runners.Make{
+			GenericRunner: testRunner,
+			Path:          ".",
+			Targets:       []string{"check"},
+		})
+	case buildSystemCMake:
+		_, err = runners.Run(runners.CommandRunner{
+			GenericRunner: testRunner,
+			Command:       "ctest",
+			Arguments:     []string{"--output-on-failure", fmt.Sprintf("-j%d", runners.ParallelJobCount)},
+		})
+	case buildSystemMeson:
+		_, err = runners.Run(runners.CommandRunner{
+			GenericRunner: testRunner,
+			Command:       "meson",
+			Arguments:     []string{"test", "-C", sb.testSuite.BuildDirectoryPath, "--print-errorlogs"},
+		})
+	default:
+		return trace.Errorf("unsupported build system %q", sb.testSuite.BuildSystem)
+	}
+
+	if err != nil {
+		return trace.Wrap(err, "%s test suite failed", sb.Name)
+	}
+
+	return nil
+}
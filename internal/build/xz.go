@@ -51,6 +51,10 @@ func (xz *XZ) DoBuild(buildDirectoryPath string) error {
 // XZ has a relatively complicated build process that requires a two stage build
 func (xz *XZ) Build(ctx context.Context) error {
 	slog.Info(fmt.Sprintf("Starting %s build", xz.Name))
+	if xz.ShouldRunTests {
+		slog.Warn(fmt.Sprintf("Tests are not supported for the two stage %s build, skipping tests", xz.Name))
+	}
+
 	repo := xz.GetGitRepo(xz.SourceDirectoryPath, xz.GitRef)
 	sourcePath := repo.FullDownloadPath()
 
@@ -84,6 +88,13 @@ func (xz *XZ) Build(ctx context.Context) error {
 		return trace.Wrap(err, "failed to copy extras from %q to output directory at %q", extraSourcePath, extraDestinationPath)
 	}
 
+	if xz.ShouldFixPathLeaks {
+		err = xz.FixPathLeaks()
+		if err != nil {
+			return trace.Wrap(err, "failed to fix build host path references in %s output", xz.Name)
+		}
+	}
+
 	return nil
 }
 
@@ -0,0 +1,151 @@
+package command_artifacts
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/gravitational/trace"
+	"github.com/solidDoWant/distrobuilder/internal/artifacts"
+	"github.com/solidDoWant/distrobuilder/internal/command/flags"
+	"github.com/solidDoWant/distrobuilder/internal/utils"
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	packageVersionFlagName      = "package-version"
+	packageArchitectureFlagName = "architecture"
+	packageDescriptionFlagName  = "description"
+	packageURLFlagName          = "url"
+	packageLicenseFlagName      = "license"
+	packageMaintainerFlagName   = "maintainer"
+	packageDependsFlagName      = "depends"
+	signingKeyPathFlagName      = "signing-key-path"
+	signingKeyNameFlagName      = "signing-key-name"
+)
+
+type ApkCommand struct {
+	OutputFilePath string
+}
+
+func (ac *ApkCommand) GetPackageCommand() *cli.Command {
+	commandFlags := append(getPackageMetadataFlags(), getSigningFlags()...)
+	commandFlags = append(commandFlags, &cli.BoolFlag{
+		Name:    clearOwnerFlagName,
+		Usage:   "Clear owner and group of packaged files",
+		Aliases: []string{"c"},
+		Value:   false,
+	})
+
+	return &cli.Command{
+		Name:  "apk",
+		Usage: "Packages a build into a signed Alpine-compatible apk package",
+		Flags: commandFlags,
+		Action: func(cliCtx *cli.Context) error {
+			startTime := time.Now()
+			packager, err := ac.GetArtifactHandler(cliCtx)
+			if err != nil {
+				return trace.Wrap(err, "failed to create apk packager")
+			}
+
+			ctx := context.Background() // TODO verify that this is the proper context for this use case
+			_, err = packager.Package(ctx)
+			if err != nil {
+				return trace.Wrap(err, "failed to create apk package")
+			}
+
+			slog.Info(fmt.Sprintf("Created package in %v", time.Since(startTime)))
+			return nil
+		},
+	}
+}
+
+func (ac *ApkCommand) GetArtifactHandler(cliCtx *cli.Context) (*artifacts.APK, error) {
+	apkPackager := &artifacts.APK{
+		SourcePath:       cliCtx.Path(buildOutputPathFlagName),
+		ShouldResetOwner: cliCtx.Bool(clearOwnerFlagName),
+		Metadata:         getPackageMetadata(cliCtx),
+		SigningKeyPath:   cliCtx.Path(signingKeyPathFlagName),
+		SigningKeyName:   cliCtx.String(signingKeyNameFlagName),
+	}
+	apkPackager.SetOutputFilePath(ac.OutputFilePath)
+
+	return apkPackager, nil
+}
+
+func (ac *ApkCommand) SetOutputFilePath(outputFilePath string) {
+	ac.OutputFilePath = outputFilePath
+}
+
+func getPackageMetadataFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:     packageNameFlagName,
+			Usage:    "name of the package",
+			Aliases:  []string{"n"},
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:     packageVersionFlagName,
+			Usage:    "version of the package, including any release suffix (i.e. 1.2.3-r0)",
+			Aliases:  []string{"V"},
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:    packageArchitectureFlagName,
+			Usage:   "architecture of the packaged files",
+			Aliases: []string{"a"},
+			Value:   utils.GetTripletMachineValue(),
+		},
+		&cli.StringFlag{
+			Name:  packageDescriptionFlagName,
+			Usage: "short description of the package",
+		},
+		&cli.StringFlag{
+			Name:  packageURLFlagName,
+			Usage: "upstream project URL",
+		},
+		&cli.StringFlag{
+			Name:  packageLicenseFlagName,
+			Usage: "license of the packaged files",
+		},
+		&cli.StringFlag{
+			Name:  packageMaintainerFlagName,
+			Usage: "package maintainer, i.e. 'Name <email>'",
+		},
+		&cli.StringSliceFlag{
+			Name:  packageDependsFlagName,
+			Usage: "package dependency, can be specified multiple times",
+		},
+	}
+}
+
+func getPackageMetadata(cliCtx *cli.Context) *artifacts.PackageMetadata {
+	return &artifacts.PackageMetadata{
+		Name:         cliCtx.String(packageNameFlagName),
+		Version:      cliCtx.String(packageVersionFlagName),
+		Architecture: cliCtx.String(packageArchitectureFlagName),
+		Description:  cliCtx.String(packageDescriptionFlagName),
+		URL:          cliCtx.String(packageURLFlagName),
+		License:      cliCtx.String(packageLicenseFlagName),
+		Maintainer:   cliCtx.String(packageMaintainerFlagName),
+		Depends:      cliCtx.StringSlice(packageDependsFlagName),
+	}
+}
+
+func getSigningFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.PathFlag{
+			Name:     signingKeyPathFlagName,
+			Usage:    "path to the PEM encoded RSA private key used for signing",
+			Aliases:  []string{"k"},
+			Required: true,
+			Action:   flags.ExistingFileValidator,
+		},
+		&cli.StringFlag{
+			Name:  signingKeyNameFlagName,
+			Usage: "file name of the public key that will be used for verification, defaults to the private key file name with a .pub suffix",
+		},
+	}
+}
@@ -0,0 +1,89 @@
+package command_artifacts
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/gravitational/trace"
+	"github.com/solidDoWant/distrobuilder/internal/artifacts"
+	"github.com/urfave/cli/v2"
+)
+
+type DebCommand struct {
+	OutputFilePath string
+}
+
+func (dc *DebCommand) GetPackageCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "deb",
+		Usage: "Packages a build into a Debian binary package",
+		Flags: append(getPackageMetadataFlags(), dc.getCommonFlags()...),
+		Action: func(cliCtx *cli.Context) error {
+			startTime := time.Now()
+			packager, err := dc.GetArtifactHandler(cliCtx)
+			if err != nil {
+				return trace.Wrap(err, "failed to create deb packager")
+			}
+			packager.Metadata = getPackageMetadata(cliCtx)
+
+			ctx := context.Background() // TODO verify that this is the proper context for this use case
+			_, err = packager.Package(ctx)
+			if err != nil {
+				return trace.Wrap(err, "failed to create deb package")
+			}
+
+			slog.Info(fmt.Sprintf("Created package in %v", time.Since(startTime)))
+			return nil
+		},
+	}
+}
+
+func (dc DebCommand) GetInstallCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "deb",
+		Usage: "Installs the files from a Debian binary package, without running maintainer scripts",
+		Flags: dc.getCommonFlags(),
+		Action: func(cliCtx *cli.Context) error {
+			startTime := time.Now()
+			installer, err := dc.GetArtifactHandler(cliCtx)
+			if err != nil {
+				return trace.Wrap(err, "failed to create deb installer")
+			}
+
+			ctx := context.Background() // TODO verify that this is the proper context for this use case
+			err = installer.Install(ctx, getArtifactInstallOptions(cliCtx))
+			if err != nil {
+				return trace.Wrap(err, "failed to install deb package")
+			}
+
+			slog.Info(fmt.Sprintf("Installed package in %v", time.Since(startTime)))
+			return nil
+		},
+	}
+}
+
+func (dc *DebCommand) getCommonFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.BoolFlag{
+			Name:    clearOwnerFlagName,
+			Usage:   "Clear owner and group of packaged or installed files",
+			Aliases: []string{"c"},
+			Value:   false,
+		},
+	}
+}
+
+func (dc *DebCommand) GetArtifactHandler(cliCtx *cli.Context) (*artifacts.Deb, error) {
+	debPackager := &artifacts.Deb{}
+	debPackager.ShouldResetOwner = cliCtx.Bool(clearOwnerFlagName)
+	debPackager.SourcePath = cliCtx.Path(buildOutputPathFlagName)
+	debPackager.SetOutputFilePath(dc.OutputFilePath)
+
+	return debPackager, nil
+}
+
+func (dc *DebCommand) SetOutputFilePath(outputFilePath string) {
+	dc.OutputFilePath = outputFilePath
+}
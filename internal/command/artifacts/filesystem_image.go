@@ -0,0 +1,95 @@
+package command_artifacts
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/gravitational/trace"
+	"github.com/solidDoWant/distrobuilder/internal/artifacts"
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	filesystemTypeFlagName = "filesystem-type"
+	compressionFlagName    = "compression"
+	verifyFlagName         = "verify"
+)
+
+type FilesystemImageCommand struct {
+	OutputFilePath string
+}
+
+func (fic *FilesystemImageCommand) GetPackageCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "filesystem-image",
+		Usage: "Packages a root filesystem into a read-only SquashFS or EROFS image",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    filesystemTypeFlagName,
+				Usage:   fmt.Sprintf("type of filesystem to create, one of %v", artifacts.FilesystemImageTypes),
+				Aliases: []string{"f"},
+				Value:   artifacts.FilesystemImageTypeSquashfs,
+				Action: func(cliCtx *cli.Context, filesystemType string) error {
+					if !slices.Contains(artifacts.FilesystemImageTypes, filesystemType) {
+						return trace.Errorf("unsupported filesystem type %q, must be one of %v", filesystemType, artifacts.FilesystemImageTypes)
+					}
+
+					return nil
+				},
+			},
+			&cli.StringFlag{
+				Name:    compressionFlagName,
+				Usage:   fmt.Sprintf("compression algorithm, one of %v", artifacts.FilesystemImageCompressions),
+				Aliases: []string{"z"},
+				Value:   artifacts.FilesystemImageCompressionZstd,
+				Action: func(cliCtx *cli.Context, compression string) error {
+					if !slices.Contains(artifacts.FilesystemImageCompressions, compression) {
+						return trace.Errorf("unsupported compression %q, must be one of %v", compression, artifacts.FilesystemImageCompressions)
+					}
+
+					return nil
+				},
+			},
+			&cli.BoolFlag{
+				Name:  verifyFlagName,
+				Usage: "extract the image after creation and compare the contents to the root filesystem",
+				Value: true,
+			},
+		},
+		Action: func(cliCtx *cli.Context) error {
+			startTime := time.Now()
+			packager, err := fic.GetArtifactHandler(cliCtx)
+			if err != nil {
+				return trace.Wrap(err, "failed to create filesystem image packager")
+			}
+
+			ctx := context.Background() // TODO verify that this is the proper context for this use case
+			_, err = packager.Package(ctx)
+			if err != nil {
+				return trace.Wrap(err, "failed to create filesystem image")
+			}
+
+			slog.Info(fmt.Sprintf("Created image in %v", time.Since(startTime)))
+			return nil
+		},
+	}
+}
+
+func (fic *FilesystemImageCommand) GetArtifactHandler(cliCtx *cli.Context) (*artifacts.FilesystemImage, error) {
+	imagePackager := &artifacts.FilesystemImage{
+		SourcePath:     cliCtx.Path(buildOutputPathFlagName),
+		FilesystemType: cliCtx.String(filesystemTypeFlagName),
+		Compression:    cliCtx.String(compressionFlagName),
+		ShouldVerify:   cliCtx.Bool(verifyFlagName),
+	}
+	imagePackager.SetOutputFilePath(fic.OutputFilePath)
+
+	return imagePackager, nil
+}
+
+func (fic *FilesystemImageCommand) SetOutputFilePath(outputFilePath string) {
+	fic.OutputFilePath = outputFilePath
+}
@@ -0,0 +1,74 @@
+package command_artifacts
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/gravitational/trace"
+	"github.com/solidDoWant/distrobuilder/internal/artifacts"
+	"github.com/solidDoWant/distrobuilder/internal/command/flags"
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	packageDirectoryPathFlagName  = "package-directory-path"
+	repositoryDescriptionFlagName = "description"
+)
+
+func IndexCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "index",
+		Usage: "Generates repository indexes for directories of packages",
+		Subcommands: []*cli.Command{
+			getApkIndexCommand(),
+		},
+	}
+}
+
+func getApkIndexCommand() *cli.Command {
+	commandFlags := append(getSigningFlags(),
+		&cli.PathFlag{
+			Name:     packageDirectoryPathFlagName,
+			Usage:    "path to the directory containing the apk packages",
+			Aliases:  []string{"s"},
+			Required: true,
+			Action:   flags.ExistingDirValidator,
+		},
+		&cli.PathFlag{
+			Name:    outputFilePathFlagName,
+			Usage:   "path to the index output file, defaults to " + artifacts.APKIndexFileName + " in the package directory",
+			Aliases: []string{"O"},
+		},
+		&cli.StringFlag{
+			Name:  repositoryDescriptionFlagName,
+			Usage: "description of the repository",
+		},
+	)
+
+	return &cli.Command{
+		Name:  "apk",
+		Usage: "Generates a signed " + artifacts.APKIndexFileName + " for a directory of apk packages",
+		Flags: commandFlags,
+		Action: func(cliCtx *cli.Context) error {
+			startTime := time.Now()
+			index := &artifacts.APKIndex{
+				PackageDirectoryPath: cliCtx.Path(packageDirectoryPathFlagName),
+				OutputPath:           cliCtx.Path(outputFilePathFlagName),
+				Description:          cliCtx.String(repositoryDescriptionFlagName),
+				SigningKeyPath:       cliCtx.Path(signingKeyPathFlagName),
+				SigningKeyName:       cliCtx.String(signingKeyNameFlagName),
+			}
+
+			ctx := context.Background() // TODO verify that this is the proper context for this use case
+			_, err := index.Generate(ctx)
+			if err != nil {
+				return trace.Wrap(err, "failed to generate apk index")
+			}
+
+			slog.Info(fmt.Sprintf("Generated index in %v", time.Since(startTime)))
+			return nil
+		},
+	}
+}
@@ -7,13 +7,16 @@ import (
 )
 
 const (
-	sourcePathFlagName  = "source-path"
-	installPathFlagName = "install-path"
+	sourcePathFlagName     = "source-path"
+	installPathFlagName    = "install-path"
+	packageNameFlagName    = "package-name"
+	allowOverwriteFlagName = "allow-overwrite"
 )
 
 func InstallCommand() *cli.Command {
 	subcommands := []*cli.Command{
 		TarballCommand{}.GetInstallCommand(),
+		DebCommand{}.GetInstallCommand(),
 	}
 
 	for _, subcommand := range subcommands {
@@ -44,12 +47,24 @@ func processInstallCommand(command *cli.Command) {
 		Required: true,
 	}
 
-	command.Flags = append(command.Flags, sourcePathFlag, installPathFlag)
+	packageNameFlag := &cli.StringFlag{
+		Name:  packageNameFlagName,
+		Usage: "name to record the installed files under, defaults to the package file name without extensions",
+	}
+
+	allowOverwriteFlag := &cli.StringSliceFlag{
+		Name:  allowOverwriteFlagName,
+		Usage: "glob pattern of paths that may be overwritten even if they are owned by another installed package, can be specified multiple times",
+	}
+
+	command.Flags = append(command.Flags, sourcePathFlag, installPathFlag, packageNameFlag, allowOverwriteFlag)
 }
 
 func getArtifactInstallOptions(cliCtx *cli.Context) *artifacts.InstallOptions {
 	return &artifacts.InstallOptions{
-		SourcePath:  cliCtx.Path(sourcePathFlagName),
-		InstallPath: cliCtx.Path(installPathFlagName),
+		SourcePath:        cliCtx.Path(sourcePathFlagName),
+		InstallPath:       cliCtx.Path(installPathFlagName),
+		PackageName:       cliCtx.String(packageNameFlagName),
+		AllowedOverwrites: cliCtx.StringSlice(allowOverwriteFlagName),
 	}
 }
@@ -0,0 +1,152 @@
+package command_artifacts
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/gravitational/trace"
+	"github.com/solidDoWant/distrobuilder/internal/artifacts"
+	"github.com/solidDoWant/distrobuilder/internal/command/flags"
+	"github.com/solidDoWant/distrobuilder/internal/utils"
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	layerTarballPathFlagName = "layer-tarball-path"
+	imageFormatFlagName      = "format"
+	imageTagFlagName         = "tag"
+	imageEntrypointFlagName  = "entrypoint"
+	imageCmdFlagName         = "cmd"
+	imageEnvFlagName         = "env"
+	imageUserFlagName        = "user"
+	imageWorkingDirFlagName  = "working-dir"
+)
+
+type OCICommand struct {
+	OutputFilePath string
+}
+
+func (oc *OCICommand) GetPackageCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "oci",
+		Usage: "Packages a root filesystem directory, or a set of component tarballs, into a container image",
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:    clearOwnerFlagName,
+				Usage:   "Clear owner and group of image files",
+				Aliases: []string{"c"},
+				Value:   false,
+			},
+			&cli.StringSliceFlag{
+				Name:    layerTarballPathFlagName,
+				Usage:   "path to a component tarball to add as an image layer, can be specified multiple times. Layers are applied in the order provided. Cannot be used with a build output path.",
+				Aliases: []string{"l"},
+				Action: func(cliCtx *cli.Context, layerTarballPaths []string) error {
+					for _, layerTarballPath := range layerTarballPaths {
+						err := flags.ExistingFileValidator(cliCtx, layerTarballPath)
+						if err != nil {
+							return trace.Wrap(err, "layer tarball validation failed")
+						}
+					}
+
+					return nil
+				},
+			},
+			&cli.StringFlag{
+				Name:  imageFormatFlagName,
+				Usage: fmt.Sprintf("output format, one of %v", artifacts.OCIImageFormats),
+				Value: artifacts.OCIImageFormatLayout,
+				Action: func(cliCtx *cli.Context, format string) error {
+					if !slices.Contains(artifacts.OCIImageFormats, format) {
+						return trace.Errorf("unsupported image format %q, must be one of %v", format, artifacts.OCIImageFormats)
+					}
+
+					return nil
+				},
+			},
+			&cli.StringFlag{
+				Name:    imageTagFlagName,
+				Usage:   "image reference to tag the image with",
+				Aliases: []string{"t"},
+				Value:   "distrobuilder:latest",
+			},
+			&cli.StringFlag{
+				Name:    packageArchitectureFlagName,
+				Usage:   "architecture of the image files",
+				Aliases: []string{"a"},
+				Value:   utils.GetTripletMachineValue(),
+			},
+			&cli.StringSliceFlag{
+				Name:  imageEntrypointFlagName,
+				Usage: "entrypoint argument, can be specified multiple times",
+			},
+			&cli.StringSliceFlag{
+				Name:  imageCmdFlagName,
+				Usage: "default command argument, can be specified multiple times",
+			},
+			&cli.StringSliceFlag{
+				Name:    imageEnvFlagName,
+				Usage:   "environment variable in KEY=VALUE form, can be specified multiple times",
+				Aliases: []string{"e"},
+				Value:   cli.NewStringSlice("PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"),
+			},
+			&cli.StringFlag{
+				Name:    imageUserFlagName,
+				Usage:   "user (and optionally group) that the container process runs as",
+				Aliases: []string{"u"},
+			},
+			&cli.StringFlag{
+				Name:  imageWorkingDirFlagName,
+				Usage: "working directory of the container process",
+			},
+		},
+		Action: func(cliCtx *cli.Context) error {
+			startTime := time.Now()
+			packager, err := oc.GetArtifactHandler(cliCtx)
+			if err != nil {
+				return trace.Wrap(err, "failed to create container image packager")
+			}
+
+			ctx := context.Background() // TODO verify that this is the proper context for this use case
+			_, err = packager.Package(ctx)
+			if err != nil {
+				return trace.Wrap(err, "failed to create container image")
+			}
+
+			slog.Info(fmt.Sprintf("Created image in %v", time.Since(startTime)))
+			return nil
+		},
+	}
+}
+
+func (oc *OCICommand) GetArtifactHandler(cliCtx *cli.Context) (*artifacts.OCIImage, error) {
+	imagePackager := &artifacts.OCIImage{
+		SourcePath:        cliCtx.Path(buildOutputPathFlagName),
+		LayerTarballPaths: cliCtx.StringSlice(layerTarballPathFlagName),
+		Format:            cliCtx.String(imageFormatFlagName),
+		ShouldResetOwner:  cliCtx.Bool(clearOwnerFlagName),
+		Architecture:      cliCtx.String(packageArchitectureFlagName),
+		Tag:               cliCtx.String(imageTagFlagName),
+		Config: artifacts.OCIImageConfig{
+			User:       cliCtx.String(imageUserFlagName),
+			Env:        cliCtx.StringSlice(imageEnvFlagName),
+			Entrypoint: cliCtx.StringSlice(imageEntrypointFlagName),
+			Cmd:        cliCtx.StringSlice(imageCmdFlagName),
+			WorkingDir: cliCtx.String(imageWorkingDirFlagName),
+		},
+	}
+	imagePackager.SetOutputFilePath(oc.OutputFilePath)
+
+	return imagePackager, nil
+}
+
+func (oc *OCICommand) SetOutputFilePath(outputFilePath string) {
+	oc.OutputFilePath = outputFilePath
+}
+
+func (oc *OCICommand) IsBuildOutputOptional() bool {
+	return true
+}
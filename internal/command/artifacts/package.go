@@ -18,6 +18,11 @@ type FilesystemOutputPackager interface {
 	SetOutputFilePath(string)
 }
 
+// Packagers that can produce a package from inputs other than a build output directory
+type OptionalBuildOutputPackager interface {
+	IsBuildOutputOptional() bool
+}
+
 func PackageCommand() *cli.Command {
 	return &cli.Command{
 		Name:        "package",
@@ -30,6 +35,10 @@ func PackageCommand() *cli.Command {
 func getCommands() []*cli.Command {
 	packagers := []Packager{
 		&TarballCommand{},
+		&ApkCommand{},
+		&DebCommand{},
+		&OCICommand{},
+		&FilesystemImageCommand{},
 	}
 
 	commands := make([]*cli.Command, 0, len(packagers))
@@ -58,6 +67,10 @@ func setCommandFlaags(command *cli.Command, packager Packager) {
 		Action:   flags.ExistingDirValidator,
 	}
 
+	if optionalBuildOutputPackager, ok := packager.(OptionalBuildOutputPackager); ok {
+		buildOutputPathFlag.Required = !optionalBuildOutputPackager.IsBuildOutputOptional()
+	}
+
 	command.Flags = append(command.Flags, buildOutputPathFlag)
 
 	if _, ok := packager.(FilesystemOutputPackager); ok {
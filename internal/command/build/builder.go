@@ -32,7 +32,18 @@ func BuildCommand() *cli.Command {
 }
 
 func getCommands() []*cli.Command {
-	builders := []Builder{
+	builders := getBuilders()
+	commands := make([]*cli.Command, 0, len(builders))
+	for _, builder := range builders {
+		commands = append(commands, getCommand(builder))
+	}
+
+	return commands
+}
+
+// Some builder commands hold a builder instance, so this must be called for each build
+func getBuilders() []Builder {
+	return []Builder{
 		&CrossLLVMCommand{},
 		&RootFilesystemCommand{},
 		&LinuxHeadersCommand{},
@@ -44,6 +55,8 @@ func getCommands() []*cli.Command {
 		NewBusyBoxCommand(),
 		NewLibreSSLCommand(),
 		NewLinuxKernelCommand(),
+		&InitramfsCommand{},
+		NewKernelModuleCommand(),
 		NewFreeTypeCommand(),
 		NewDejaVuFontsCommand(),
 		NewLibFUSECommand(),
@@ -53,14 +66,9 @@ func getCommands() []*cli.Command {
 		NewLibtoolCommand(),
 		NewGDBMCommand(),
 		NewLibiconvCommand(),
+		&TZDataCommand{},
+		NewMuslLocalesCommand(),
 	}
-
-	commands := make([]*cli.Command, 0, len(builders))
-	for _, builder := range builders {
-		commands = append(commands, getCommand(builder))
-	}
-
-	return commands
 }
 
 func getCommand(builder Builder) *cli.Command {
@@ -103,9 +111,9 @@ func builderAction(builder Builder) cli.ActionFunc {
 
 		setValuesForInterfaceFlags(builder, cliCtx)
 
-		err = builder.CheckHostRequirements()
+		err = runBuilder(cliCtx, builder)
 		if err != nil {
-			return trace.Wrap(err, "failed to verify host requirements for builder")
+			return trace.Wrap(err, "failed to run builder")
 		}
 
 		if cliCtx.Bool(checkHostRequirementsFlagName) {
@@ -113,19 +121,6 @@ func builderAction(builder Builder) cli.ActionFunc {
 			return nil
 		}
 
-		ctx := context.Background() // TODO verify that this is the proper context for this use case
-		err = builder.Build(ctx)
-		if err != nil {
-			return trace.Wrap(err, "build failed")
-		}
-
-		if !cliCtx.Bool(skipVerificationFlagName) {
-			err = builder.VerifyBuild(ctx)
-			if err != nil {
-				return trace.Wrap(err, "failed to verify completed build")
-			}
-		}
-
 		args := make([]any, 0, 2) // slog.Info requires "any" as the type
 		if outputBuilder, ok := builder.(build.IFilesystemOutputBuilder); ok {
 			args = append(args, "output_directory", outputBuilder.GetOutputDirectoryPath())
@@ -139,6 +134,33 @@ func builderAction(builder Builder) cli.ActionFunc {
 	return action
 }
 
+// Checks host requirements, then builds and verifies the build, as configured by the CLI flags
+func runBuilder(cliCtx *cli.Context, builder build.IBuilder) error {
+	err := builder.CheckHostRequirements()
+	if err != nil {
+		return trace.Wrap(err, "failed to verify host requirements for builder")
+	}
+
+	if cliCtx.Bool(checkHostRequirementsFlagName) {
+		return nil
+	}
+
+	ctx := context.Background() // TODO verify that this is the proper context for this use case
+	err = builder.Build(ctx)
+	if err != nil {
+		return trace.Wrap(err, "build failed")
+	}
+
+	if !cliCtx.Bool(skipVerificationFlagName) {
+		err = builder.VerifyBuild(ctx)
+		if err != nil {
+			return trace.Wrap(err, "failed to verify completed build")
+		}
+	}
+
+	return nil
+}
+
 // Transfers flags for optional interfaces from the command to the builder
 // This function should be called during a command's action
 func setValuesForInterfaceFlags(builder build.IBuilder, cliCtx *cli.Context) {
@@ -168,7 +190,17 @@ func setValuesForInterfaceFlags(builder build.IBuilder, cliCtx *cli.Context) {
 		rootFSBuilder.SetRootFSDirectoryPath(cliCtx.Path(rootFSDirectoryPathFlag.Name))
 	}
 
+	if pathLeakFixer, ok := builder.(build.IPathLeakFixer); ok {
+		pathLeakFixer.SetShouldFixPathLeaks(cliCtx.Bool(fixPathLeaksFlag.Name))
+	}
+
+	if testRunner, ok := builder.(build.ITestRunner); ok {
+		testRunner.SetShouldRunTests(cliCtx.Bool(runTestsFlag.Name))
+		testRunner.SetTestExeWrapperPath(cliCtx.String(testExeWrapperPathFlag.Name))
+	}
+
 	if kconfigBuilder, ok := builder.(build.IKconfigBuilder); ok {
 		kconfigBuilder.SetConfigFilePath(cliCtx.Path(configPathFlag.Name))
+		kconfigBuilder.SetConfigFragmentPaths(cliCtx.StringSlice(configFragmentPathFlag.Name))
 	}
 }
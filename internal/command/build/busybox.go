@@ -20,6 +20,6 @@ func NewBusyBoxCommand() *BusyBoxBuilder {
 
 func (bb *BusyBoxBuilder) GetCommand() *cli.Command {
 	standardCommand := bb.StandardBuilder.GetCommand()
-	standardCommand.Flags = append(standardCommand.Flags, configPathFlag)
+	standardCommand.Flags = append(standardCommand.Flags, configPathFlag, configFragmentPathFlag)
 	return standardCommand
 }
@@ -3,6 +3,7 @@ package command_build
 import (
 	"fmt"
 
+	"github.com/gravitational/trace"
 	"github.com/solidDoWant/distrobuilder/internal/command/flags"
 	"github.com/solidDoWant/distrobuilder/internal/utils"
 	"github.com/urfave/cli/v2"
@@ -52,6 +53,24 @@ var rootFSDirectoryPathFlag = &cli.PathFlag{
 	Action:   flags.ExistingDirValidator,
 }
 
+var fixPathLeaksFlag = &cli.BoolFlag{
+	Name:  "fix-path-leaks",
+	Usage: "rewrite null terminated strings in the build output that reference the output directory, so that they reference the install location instead",
+	Value: false,
+}
+
+var runTestsFlag = &cli.BoolFlag{
+	Name:  "run-tests",
+	Usage: "run the upstream test suite after building. Target executables are run via the test exe wrapper, or a qemu-user binfmt_misc handler.",
+	Value: false,
+}
+
+var testExeWrapperPathFlag = &cli.StringFlag{
+	Name:  "test-exe-wrapper-path",
+	Usage: "command used to run target executables for tests, i.e. qemu-aarch64. If unset, target executables are run directly.",
+	Value: "",
+}
+
 var configPathFlag = &cli.PathFlag{
 	Name:     "config-file-path",
 	Usage:    "path to .config Kconfig file",
@@ -59,3 +78,18 @@ var configPathFlag = &cli.PathFlag{
 	Required: true,
 	Action:   flags.ExistingFileValidator,
 }
+
+var configFragmentPathFlag = &cli.StringSliceFlag{
+	Name:  "config-fragment-path",
+	Usage: "path to a Kconfig fragment to merge on top of the config file. May be specified multiple times, later fragments take precedence.",
+	Action: func(cliCtx *cli.Context, configFragmentPaths []string) error {
+		for _, configFragmentPath := range configFragmentPaths {
+			err := flags.ExistingFileValidator(cliCtx, configFragmentPath)
+			if err != nil {
+				return trace.Wrap(err, "invalid config fragment path")
+			}
+		}
+
+		return nil
+	},
+}
@@ -0,0 +1,71 @@
+package command_build
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/gravitational/trace"
+	"github.com/solidDoWant/distrobuilder/internal/build"
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	kernelVersionFlagName        string = "kernel-version"
+	initramfsFileFlagName        string = "file"
+	initramfsModuleFlagName      string = "module"
+	initramfsCompressionFlagName string = "compression"
+	embeddableArchiveFlagName    string = "embeddable-archive"
+)
+
+type InitramfsCommand struct{}
+
+func (ic *InitramfsCommand) GetCommand() *cli.Command {
+	return &cli.Command{
+		Name: "initramfs",
+		Flags: []cli.Flag{
+			outputDirectoryPathFlag,
+			rootFSDirectoryPathFlag,
+			&cli.StringFlag{
+				Name:  kernelVersionFlagName,
+				Usage: "kernel version to include modules for, defaults to the only version installed in the root filesystem",
+			},
+			&cli.StringSliceFlag{
+				Name:  initramfsFileFlagName,
+				Usage: "root filesystem path of a file to include, along with its shared library dependencies. May be specified multiple times.",
+			},
+			&cli.StringSliceFlag{
+				Name:  initramfsModuleFlagName,
+				Usage: "name of a kernel module to include and load at boot, along with its dependencies. May be specified multiple times.",
+			},
+			&cli.StringFlag{
+				Name:   initramfsCompressionFlagName,
+				Usage:  fmt.Sprintf("compression to use for the image, one of %v", build.InitramfsCompressions),
+				Value:  build.InitramfsCompressionZstd,
+				Action: initramfsCompressionValidator,
+			},
+			&cli.BoolFlag{
+				Name:  embeddableArchiveFlagName,
+				Usage: "also write an uncompressed cpio archive, for embedding in the kernel image with the linux-kernel initramfs path flag",
+			},
+		},
+	}
+}
+
+func (ic *InitramfsCommand) GetBuilder(cliCtx *cli.Context) (build.IBuilder, error) {
+	return &build.Initramfs{
+		KernelVersion: cliCtx.String(kernelVersionFlagName),
+		Files:         cliCtx.StringSlice(initramfsFileFlagName),
+		Modules:       cliCtx.StringSlice(initramfsModuleFlagName),
+		Compression:   cliCtx.String(initramfsCompressionFlagName),
+
+		ShouldWriteEmbeddableArchive: cliCtx.Bool(embeddableArchiveFlagName),
+	}, nil
+}
+
+func initramfsCompressionValidator(cliCtx *cli.Context, value string) error {
+	if !slices.Contains(build.InitramfsCompressions, value) {
+		return trace.Errorf("unsupported compression %q, must be one of %v", value, build.InitramfsCompressions)
+	}
+
+	return nil
+}
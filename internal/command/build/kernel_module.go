@@ -0,0 +1,59 @@
+package command_build
+
+import (
+	"github.com/solidDoWant/distrobuilder/internal/build"
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	moduleNameFlagName               string = "module-name"
+	moduleRepoURLFlagName            string = "repo-url"
+	moduleSourceSubdirectoryFlagName string = "source-subdirectory"
+)
+
+type KernelModuleBuilder struct {
+	*StandardBuilder
+}
+
+func NewKernelModuleCommand() *KernelModuleBuilder {
+	return &KernelModuleBuilder{
+		StandardBuilder: &StandardBuilder{
+			Name:    "kernel-module",
+			Builder: build.NewKernelModule(),
+		},
+	}
+}
+
+func (km *KernelModuleBuilder) GetCommand() *cli.Command {
+	standardCommand := km.StandardBuilder.GetCommand()
+	standardCommand.Flags = append(standardCommand.Flags,
+		&cli.StringFlag{
+			Name:     moduleNameFlagName,
+			Usage:    "name of the module source, used for storing the downloaded source",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:     moduleRepoURLFlagName,
+			Usage:    "URL of the Git repo containing the module source",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:  kernelVersionFlagName,
+			Usage: "release of the kernel to build against, defaults to the only version installed in the root filesystem",
+		},
+		&cli.StringFlag{
+			Name:  moduleSourceSubdirectoryFlagName,
+			Usage: "path to the directory containing the module's Kbuild file, relative to the repo root",
+		},
+	)
+	return standardCommand
+}
+
+func (km *KernelModuleBuilder) GetBuilder(cliCtx *cli.Context) (build.IBuilder, error) {
+	builder := km.Builder.(*build.KernelModule)
+	builder.ModuleName = cliCtx.String(moduleNameFlagName)
+	builder.RepoURL = cliCtx.String(moduleRepoURLFlagName)
+	builder.KernelRelease = cliCtx.String(kernelVersionFlagName)
+	builder.SourceSubdirectoryPath = cliCtx.String(moduleSourceSubdirectoryFlagName)
+	return builder, nil
+}
@@ -1,10 +1,21 @@
 package command_build
 
 import (
+	"fmt"
+
 	"github.com/solidDoWant/distrobuilder/internal/build"
+	"github.com/solidDoWant/distrobuilder/internal/command/flags"
 	"github.com/urfave/cli/v2"
 )
 
+const (
+	initramfsPathFlagName              string = "initramfs-path"
+	kernelInitramfsCompressionFlagName string = "initramfs-compression"
+	kernelRequirementsPathFlagName     string = "kernel-requirements-path"
+	moduleSigningKeyPathFlagName       string = "module-signing-key-path"
+	compressModulesFlagName            string = "compress-modules"
+)
+
 type LinuxKernelBuilder struct {
 	*StandardBuilder
 }
@@ -20,6 +31,42 @@ func NewLinuxKernelCommand() *LinuxKernelBuilder {
 
 func (lk *LinuxKernelBuilder) GetCommand() *cli.Command {
 	standardCommand := lk.StandardBuilder.GetCommand()
-	standardCommand.Flags = append(standardCommand.Flags, configPathFlag)
+	standardCommand.Flags = append(standardCommand.Flags,
+		configPathFlag,
+		configFragmentPathFlag,
+		&cli.PathFlag{
+			Name:  initramfsPathFlagName,
+			Usage: "optional path to an uncompressed initramfs cpio archive (see the initramfs embeddable archive flag) or a directory, to embed in the kernel image via CONFIG_INITRAMFS_SOURCE",
+		},
+		&cli.StringFlag{
+			Name:   kernelInitramfsCompressionFlagName,
+			Usage:  fmt.Sprintf("compression applied to the embedded initramfs by the kernel build, one of %v", build.InitramfsCompressions),
+			Value:  build.InitramfsCompressionZstd,
+			Action: initramfsCompressionValidator,
+		},
+		&cli.PathFlag{
+			Name:   kernelRequirementsPathFlagName,
+			Usage:  "optional path to a Kconfig fragment of options that the built kernel must have, in addition to the distro defaults. Values may be separated with \"|\" to allow any of them, i.e. CONFIG_X=y|m.",
+			Action: flags.ExistingFileValidator,
+		},
+		&cli.PathFlag{
+			Name:  moduleSigningKeyPathFlagName,
+			Usage: "optional path to a PEM file with the module signing private key and certificate. A new key pair is generated at this path if it does not exist.",
+		},
+		&cli.BoolFlag{
+			Name:  compressModulesFlagName,
+			Usage: "compress installed kernel modules with zstd",
+		},
+	)
 	return standardCommand
 }
+
+func (lk *LinuxKernelBuilder) GetBuilder(cliCtx *cli.Context) (build.IBuilder, error) {
+	builder := lk.Builder.(*build.LinuxKernel)
+	builder.InitramfsPath = cliCtx.Path(initramfsPathFlagName)
+	builder.InitramfsCompression = cliCtx.String(kernelInitramfsCompressionFlagName)
+	builder.RequirementsPath = cliCtx.Path(kernelRequirementsPathFlagName)
+	builder.ModuleSigningKeyPath = cliCtx.Path(moduleSigningKeyPathFlagName)
+	builder.ShouldCompressModules = cliCtx.Bool(compressModulesFlagName)
+	return builder, nil
+}
@@ -0,0 +1,12 @@
+package command_build
+
+import (
+	"github.com/solidDoWant/distrobuilder/internal/build"
+)
+
+func NewMuslLocalesCommand() *StandardBuilder {
+	return &StandardBuilder{
+		Name:    "musl-locales",
+		Builder: build.NewMuslLocales(),
+	}
+}
@@ -0,0 +1,125 @@
+package command_build
+
+import (
+	"fmt"
+	"log/slog"
+	"path"
+	"time"
+
+	"github.com/gravitational/trace"
+	"github.com/solidDoWant/distrobuilder/internal/build"
+	"github.com/solidDoWant/distrobuilder/internal/utils"
+	"github.com/urfave/cli/v2"
+)
+
+var clockOffsetFlag = &cli.DurationFlag{
+	Name:  "clock-offset",
+	Usage: "shift of the clock seen by commands run during the second build, via libfaketime. Set to 0 to only vary the timezone.",
+	Value: build.DefaultReproducibilityClockOffset,
+}
+
+var faketimeLibraryPathFlag = &cli.PathFlag{
+	Name:  "faketime-library-path",
+	Usage: "path to libfaketime.so.1, searched for in common install locations if not set",
+}
+
+// Commands that build a component twice, varying the build environment, and compare the outputs
+func ReproducibleCommands() []*cli.Command {
+	builders := getBuilders()
+	commands := make([]*cli.Command, 0, len(builders))
+	for builderIndex, builder := range builders {
+		command := builder.GetCommand()
+		command.Usage = fmt.Sprintf("builds %s twice and compares the outputs. The output directory path is used as the parent of both outputs.", command.Name)
+
+		setCommandFlags(command, builder)
+		command.Flags = append(command.Flags, clockOffsetFlag, faketimeLibraryPathFlag)
+		command.Action = reproducibleBuilderAction(builderIndex)
+
+		commands = append(commands, command)
+	}
+
+	return commands
+}
+
+func reproducibleBuilderAction(builderIndex int) cli.ActionFunc {
+	action := func(cliCtx *cli.Context) error {
+		startTime := time.Now()
+
+		outputDirectoryPath := cliCtx.Path(outputDirectoryPathFlag.Name)
+		if outputDirectoryPath == "" {
+			outputDirectoryPath = utils.GetTempDirectoryPath()
+		}
+
+		firstOutputDirectoryPath := path.Join(outputDirectoryPath, "first")
+		secondOutputDirectoryPath := path.Join(outputDirectoryPath, "second")
+
+		variation := build.NewReproducibilityVariation()
+		variation.ClockOffset = cliCtx.Duration(clockOffsetFlag.Name)
+		variation.FaketimeLibraryPath = cliCtx.Path(faketimeLibraryPathFlag.Name)
+		err := variation.CheckHostRequirements()
+		if err != nil {
+			return trace.Wrap(err, "failed to verify host requirements for the reproducibility variation")
+		}
+
+		slog.Info("Starting first build", "output_directory", firstOutputDirectoryPath)
+		err = reproducibleBuild(cliCtx, getBuilders()[builderIndex], firstOutputDirectoryPath)
+		if err != nil {
+			return trace.Wrap(err, "first build failed")
+		}
+
+		if cliCtx.Bool(checkHostRequirementsFlagName) {
+			slog.Info(fmt.Sprintf("Completed host checks in %v", time.Since(startTime)))
+			return nil
+		}
+
+		// Varying the environment requires global process state, so builders must be created after
+		// the variation is applied
+		restore, err := variation.Apply()
+		if err != nil {
+			return trace.Wrap(err, "failed to apply reproducibility variation")
+		}
+
+		slog.Info("Starting second build", "output_directory", secondOutputDirectoryPath)
+		err = reproducibleBuild(cliCtx, getBuilders()[builderIndex], secondOutputDirectoryPath)
+		err = trace.NewAggregate(err, trace.Wrap(restore(), "failed to restore build environment"))
+		if err != nil {
+			return trace.Wrap(err, "second build failed")
+		}
+
+		differences, err := build.CompareOutputDirectories(firstOutputDirectoryPath, secondOutputDirectoryPath)
+		if err != nil {
+			return trace.Wrap(err, "failed to compare build outputs")
+		}
+
+		slog.Info(fmt.Sprintf("Completed reproducibility check in %v", time.Since(startTime)), "output_directory", outputDirectoryPath)
+		if len(differences) == 0 {
+			slog.Info("Build outputs are identical")
+			return nil
+		}
+
+		for _, difference := range differences {
+			slog.Warn("Build outputs differ", "difference", difference)
+		}
+
+		return trace.Errorf("%d files differ between builds", len(differences))
+	}
+
+	return action
+}
+
+func reproducibleBuild(cliCtx *cli.Context, commandBuilder Builder, outputDirectoryPath string) error {
+	builder, err := commandBuilder.GetBuilder(cliCtx)
+	if err != nil {
+		return trace.Wrap(err, "failed to create builder")
+	}
+
+	setValuesForInterfaceFlags(builder, cliCtx)
+
+	outputBuilder, ok := builder.(build.IFilesystemOutputBuilder)
+	if !ok {
+		return trace.Errorf("builder does not produce filesystem output, so outputs cannot be compared")
+	}
+	outputBuilder.SetOutputDirectoryPath(outputDirectoryPath)
+
+	return runBuilder(cliCtx, builder)
+}
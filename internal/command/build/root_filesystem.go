@@ -2,9 +2,20 @@ package command_build
 
 import (
 	"github.com/solidDoWant/distrobuilder/internal/build"
+	"github.com/solidDoWant/distrobuilder/internal/command/flags"
 	"github.com/urfave/cli/v2"
 )
 
+const (
+	shellPathFlagName       string = "shell-path"
+	usersConfigPathFlagName string = "users-config-path"
+	layoutPathFlagName      string = "filesystem-layout-path"
+	identityConfigFlagName  string = "identity-config-path"
+	buildIDFlagName         string = "build-id"
+	deviceNodesFlagName     string = "static-device-nodes"
+	deviceTablePathFlagName string = "device-table-path"
+)
+
 type RootFilesystemCommand struct{}
 
 func (rfc *RootFilesystemCommand) GetCommand() *cli.Command {
@@ -12,10 +23,51 @@ func (rfc *RootFilesystemCommand) GetCommand() *cli.Command {
 		Name: "root-filesystem",
 		Flags: []cli.Flag{
 			outputDirectoryPathFlag,
+			&cli.StringFlag{
+				Name:  shellPathFlagName,
+				Usage: "root filesystem path of the login shell for users that do not set one, defaults to the first installed shell of /bin/bash, /bin/ash, and /bin/sh",
+			},
+			&cli.PathFlag{
+				Name:   usersConfigPathFlagName,
+				Usage:  "optional path to a YAML file declaring the users and groups to create. Defaults to root and nobody.",
+				Action: flags.ExistingFileValidator,
+			},
+			&cli.PathFlag{
+				Name:   layoutPathFlagName,
+				Usage:  "optional path to a YAML or JSON file declaring the directory tree to create. Defaults to an FHS compliant tree with /bin, /sbin, and /lib linked to /usr.",
+				Action: flags.ExistingFileValidator,
+			},
+			&cli.PathFlag{
+				Name:   identityConfigFlagName,
+				Usage:  "optional path to a YAML file declaring the distro identity (name, ID, version, hostname, etc.) used to generate os-release and other /etc files",
+				Action: flags.ExistingFileValidator,
+			},
+			&cli.StringFlag{
+				Name:    buildIDFlagName,
+				Usage:   "optional identifier of this build, written to os-release as BUILD_ID. Defaults to the CI pipeline ID when available.",
+				EnvVars: []string{"BUILD_ID", "GITHUB_RUN_ID", "CI_PIPELINE_ID"},
+			},
+			&cli.BoolFlag{
+				Name:  deviceNodesFlagName,
+				Usage: "create static device nodes (/dev/null, /dev/console, etc.) and standard /dev symlinks, for booting without devtmpfs or chrooting. Requires running as root.",
+			},
+			&cli.PathFlag{
+				Name:   deviceTablePathFlagName,
+				Usage:  "optional path to a YAML file declaring the static device nodes to create, instead of the defaults. Implies --" + deviceNodesFlagName + ".",
+				Action: flags.ExistingFileValidator,
+			},
 		},
 	}
 }
 
 func (rfc *RootFilesystemCommand) GetBuilder(cliCtx *cli.Context) (build.IBuilder, error) {
-	return &build.RootFilesystem{}, nil
+	return &build.RootFilesystem{
+		ShellPath:               cliCtx.String(shellPathFlagName),
+		UsersConfigPath:         cliCtx.Path(usersConfigPathFlagName),
+		FilesystemLayoutPath:    cliCtx.Path(layoutPathFlagName),
+		IdentityConfigPath:      cliCtx.Path(identityConfigFlagName),
+		BuildID:                 cliCtx.String(buildIDFlagName),
+		ShouldCreateDeviceNodes: cliCtx.Bool(deviceNodesFlagName),
+		DeviceTablePath:         cliCtx.Path(deviceTablePathFlagName),
+	}, nil
 }
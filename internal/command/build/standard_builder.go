@@ -20,6 +20,9 @@ func (sb *StandardBuilder) GetCommand() *cli.Command {
 			toolchainDirectoryPathFlag,
 			targetTripletFlag,
 			rootFSDirectoryPathFlag,
+			fixPathLeaksFlag,
+			runTestsFlag,
+			testExeWrapperPathFlag,
 		},
 	}
 }
@@ -0,0 +1,24 @@
+package command_build
+
+import (
+	"github.com/solidDoWant/distrobuilder/internal/build"
+	"github.com/urfave/cli/v2"
+)
+
+// The time zone database is architecture independent, so no toolchain or root filesystem is needed
+type TZDataCommand struct{}
+
+func (tzdc *TZDataCommand) GetCommand() *cli.Command {
+	return &cli.Command{
+		Name: "tzdata",
+		Flags: []cli.Flag{
+			gitRefFlag,
+			outputDirectoryPathFlag,
+			sourceDirectoryPathFlag,
+		},
+	}
+}
+
+func (tzdc *TZDataCommand) GetBuilder(cliCtx *cli.Context) (build.IBuilder, error) {
+	return build.NewTZData(), nil
+}
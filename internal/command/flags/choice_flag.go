@@ -0,0 +1,19 @@
+package flags
+
+import (
+	"slices"
+
+	"github.com/gravitational/trace"
+	"github.com/urfave/cli/v2"
+)
+
+// Get a validator for string flags that only accept one of the given values
+func ChoiceValidator(choices []string) func(*cli.Context, string) error {
+	return func(cliCtx *cli.Context, value string) error {
+		if !slices.Contains(choices, value) {
+			return trace.Errorf("unsupported value %q, must be one of %v", value, choices)
+		}
+
+		return nil
+	}
+}
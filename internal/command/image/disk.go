@@ -0,0 +1,119 @@
+package command_image
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/gravitational/trace"
+	"github.com/solidDoWant/distrobuilder/internal/command/flags"
+	"github.com/solidDoWant/distrobuilder/internal/image"
+	"github.com/solidDoWant/distrobuilder/internal/utils"
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	rootFSDirectoryPathFlagName = "root-fs-directory-path"
+	outputFilePathFlagName      = "output-file-path"
+	formatFlagName              = "format"
+	rootFilesystemTypeFlagName  = "root-filesystem-type"
+	rootPartitionSizeFlagName   = "root-partition-size"
+	espSizeFlagName             = "esp-size"
+	kernelVersionFlagName       = "kernel-version"
+	kernelCommandLineFlagName   = "kernel-command-line"
+	bootloaderEFIPathFlagName   = "bootloader-efi-path"
+	architectureFlagName        = "architecture"
+	titleFlagName               = "title"
+)
+
+func DiskCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "disk",
+		Usage: "Creates a GPT partitioned disk image with an EFI system partition and a root partition",
+		Flags: []cli.Flag{
+			&cli.PathFlag{
+				Name:     rootFSDirectoryPathFlagName,
+				Usage:    "path to the populated root filesystem directory, including the kernel in /boot",
+				Aliases:  []string{"R"},
+				Required: true,
+				Action:   flags.ExistingDirValidator,
+			},
+			&cli.PathFlag{
+				Name:     outputFilePathFlagName,
+				Usage:    "path to the disk image output file",
+				Aliases:  []string{"O"},
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:   formatFlagName,
+				Usage:  fmt.Sprintf("disk image format, one of %v", image.DiskFormats),
+				Value:  image.DiskFormatRaw,
+				Action: flags.ChoiceValidator(image.DiskFormats),
+			},
+			&cli.StringFlag{
+				Name:   rootFilesystemTypeFlagName,
+				Usage:  fmt.Sprintf("root partition filesystem, one of %v", image.RootFilesystemTypes),
+				Value:  image.RootFilesystemTypeExt4,
+				Action: flags.ChoiceValidator(image.RootFilesystemTypes),
+			},
+			&cli.Int64Flag{
+				Name:  rootPartitionSizeFlagName,
+				Usage: "size of the root partition in MiB, calculated from the root filesystem contents if not set",
+			},
+			&cli.Int64Flag{
+				Name:  espSizeFlagName,
+				Usage: "size of the EFI system partition in MiB",
+				Value: image.DefaultESPSize / 1024 / 1024,
+			},
+			&cli.StringFlag{
+				Name:  kernelVersionFlagName,
+				Usage: "version of the kernel in /boot to boot, only required if multiple kernels are installed",
+			},
+			&cli.StringFlag{
+				Name:  kernelCommandLineFlagName,
+				Usage: "additional kernel command line arguments",
+			},
+			&cli.PathFlag{
+				Name:   bootloaderEFIPathFlagName,
+				Usage:  "path to an EFI bootloader binary (i.e. systemd-bootx64.efi) to install as the default boot file",
+				Action: flags.ExistingFileValidator,
+			},
+			&cli.StringFlag{
+				Name:  architectureFlagName,
+				Usage: "architecture of the root filesystem",
+				Value: utils.GetTripletMachineValue(),
+			},
+			&cli.StringFlag{
+				Name:  titleFlagName,
+				Usage: "boot menu entry title",
+				Value: "distrobuilder",
+			},
+		},
+		Action: func(cliCtx *cli.Context) error {
+			startTime := time.Now()
+			disk := &image.Disk{
+				RootFilesystemPath: cliCtx.Path(rootFSDirectoryPathFlagName),
+				OutputPath:         cliCtx.Path(outputFilePathFlagName),
+				Format:             cliCtx.String(formatFlagName),
+				RootFilesystemType: cliCtx.String(rootFilesystemTypeFlagName),
+				RootPartitionSize:  cliCtx.Int64(rootPartitionSizeFlagName) * 1024 * 1024,
+				ESPSize:            cliCtx.Int64(espSizeFlagName) * 1024 * 1024,
+				KernelVersion:      cliCtx.String(kernelVersionFlagName),
+				KernelCommandLine:  cliCtx.String(kernelCommandLineFlagName),
+				BootloaderEFIPath:  cliCtx.Path(bootloaderEFIPathFlagName),
+				Architecture:       cliCtx.String(architectureFlagName),
+				Title:              cliCtx.String(titleFlagName),
+			}
+
+			ctx := context.Background() // TODO verify that this is the proper context for this use case
+			_, err := disk.Build(ctx)
+			if err != nil {
+				return trace.Wrap(err, "failed to build disk image")
+			}
+
+			slog.Info(fmt.Sprintf("Created disk image in %v", time.Since(startTime)))
+			return nil
+		},
+	}
+}
@@ -0,0 +1,15 @@
+package command_image
+
+import (
+	"github.com/urfave/cli/v2"
+)
+
+func ImageCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "image",
+		Usage: "Produces bootable images from a populated root filesystem",
+		Subcommands: []*cli.Command{
+			DiskCommand(),
+		},
+	}
+}
@@ -0,0 +1,116 @@
+package command_testing
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/gravitational/trace"
+	"github.com/solidDoWant/distrobuilder/internal/command/flags"
+	"github.com/solidDoWant/distrobuilder/internal/image"
+	"github.com/solidDoWant/distrobuilder/internal/utils"
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	kernelDirectoryPathFlagName = "kernel-directory-path"
+	rootFSDirectoryPathFlagName = "root-fs-directory-path"
+	rootFilesystemTypeFlagName  = "root-filesystem-type"
+	kernelVersionFlagName       = "kernel-version"
+	kernelCommandLineFlagName   = "kernel-command-line"
+	architectureFlagName        = "architecture"
+	successMarkerFlagName       = "success-marker"
+	timeoutFlagName             = "timeout"
+	memorySizeFlagName          = "memory-size"
+	consoleLogPathFlagName      = "console-log-path"
+)
+
+func BootCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "boot",
+		Usage: "Boots a kernel and an image of a root filesystem in QEMU, and waits for a marker on the serial console",
+		Flags: []cli.Flag{
+			&cli.PathFlag{
+				Name:    kernelDirectoryPathFlagName,
+				Usage:   "path to the directory containing the kernel in /boot, typically the linux-kernel build output. Defaults to the root filesystem.",
+				Aliases: []string{"K"},
+				Action:  flags.ExistingDirValidator,
+			},
+			&cli.PathFlag{
+				Name:     rootFSDirectoryPathFlagName,
+				Usage:    "path to the populated root filesystem directory",
+				Aliases:  []string{"R"},
+				Required: true,
+				Action:   flags.ExistingDirValidator,
+			},
+			&cli.StringFlag{
+				Name:   rootFilesystemTypeFlagName,
+				Usage:  fmt.Sprintf("root filesystem image type, one of %v", image.RootFilesystemTypes),
+				Value:  image.RootFilesystemTypeExt4,
+				Action: flags.ChoiceValidator(image.RootFilesystemTypes),
+			},
+			&cli.StringFlag{
+				Name:  kernelVersionFlagName,
+				Usage: "version of the kernel in /boot to boot, only required if multiple kernels are installed",
+			},
+			&cli.StringFlag{
+				Name:  kernelCommandLineFlagName,
+				Usage: "additional kernel command line arguments",
+			},
+			&cli.StringFlag{
+				Name:  architectureFlagName,
+				Usage: "architecture of the kernel and root filesystem",
+				Value: utils.GetTripletMachineValue(),
+			},
+			&cli.StringFlag{
+				Name:  successMarkerFlagName,
+				Usage: "console output that indicates a successful boot, such as a login prompt or a message printed by a test init",
+				Value: image.DefaultBootSuccessMarker,
+			},
+			&cli.DurationFlag{
+				Name:  timeoutFlagName,
+				Usage: "maximum time to wait for the success marker",
+				Value: image.DefaultBootTimeout,
+			},
+			&cli.Int64Flag{
+				Name:  memorySizeFlagName,
+				Usage: "memory size of the virtual machine in MiB",
+				Value: image.DefaultBootMemorySize,
+			},
+			&cli.PathFlag{
+				Name:  consoleLogPathFlagName,
+				Usage: "path to write the console log to",
+			},
+		},
+		Action: func(cliCtx *cli.Context) error {
+			startTime := time.Now()
+			kernelDirectoryPath := cliCtx.Path(kernelDirectoryPathFlagName)
+			if kernelDirectoryPath == "" {
+				kernelDirectoryPath = cliCtx.Path(rootFSDirectoryPathFlagName)
+			}
+
+			bootCheck := &image.BootCheck{
+				KernelDirectoryPath: kernelDirectoryPath,
+				RootFilesystemPath:  cliCtx.Path(rootFSDirectoryPathFlagName),
+				RootFilesystemType:  cliCtx.String(rootFilesystemTypeFlagName),
+				KernelVersion:       cliCtx.String(kernelVersionFlagName),
+				KernelCommandLine:   cliCtx.String(kernelCommandLineFlagName),
+				Architecture:        cliCtx.String(architectureFlagName),
+				SuccessMarker:       cliCtx.String(successMarkerFlagName),
+				Timeout:             cliCtx.Duration(timeoutFlagName),
+				MemorySize:          cliCtx.Int64(memorySizeFlagName),
+				ConsoleLogPath:      cliCtx.Path(consoleLogPathFlagName),
+			}
+
+			ctx := context.Background() // TODO verify that this is the proper context for this use case
+			err := bootCheck.Run(ctx)
+			if err != nil {
+				return trace.Wrap(err, "failed to boot the kernel and root filesystem")
+			}
+
+			slog.Info(fmt.Sprintf("Boot check passed in %v", time.Since(startTime)))
+			return nil
+		},
+	}
+}
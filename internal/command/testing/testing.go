@@ -0,0 +1,15 @@
+package command_testing
+
+import (
+	"github.com/urfave/cli/v2"
+)
+
+func TestCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "test",
+		Usage: "Tests built artifacts by running them",
+		Subcommands: []*cli.Command{
+			BootCommand(),
+		},
+	}
+}
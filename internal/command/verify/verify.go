@@ -0,0 +1,20 @@
+package command_verify
+
+import (
+	command_build "github.com/solidDoWant/distrobuilder/internal/command/build"
+	"github.com/urfave/cli/v2"
+)
+
+func VerifyCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "verify",
+		Usage: "Verifies properties of builds",
+		Subcommands: []*cli.Command{
+			{
+				Name:        "reproducible",
+				Usage:       "Builds a component twice with a varied build environment, and reports differences between the outputs",
+				Subcommands: command_build.ReproducibleCommands(),
+			},
+		},
+	}
+}
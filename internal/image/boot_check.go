@@ -0,0 +1,306 @@
+package image
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gravitational/trace"
+	"github.com/solidDoWant/distrobuilder/internal/runners"
+	"github.com/solidDoWant/distrobuilder/internal/utils"
+)
+
+const (
+	DefaultBootSuccessMarker = "login:"
+	DefaultBootTimeout       = 5 * time.Minute
+	DefaultBootMemorySize    = 512 // MiB
+)
+
+// Console output that indicates that the boot has failed, and will not recover
+var bootFailureMarkers = []string{
+	"Kernel panic - not syncing",
+	"Attempted to kill init",
+}
+
+// Emulated machine used to boot a kernel for an architecture
+type qemuSystemMachine struct {
+	Command   string
+	Arguments []string
+	Console   string // Kernel console device of the machine's first serial port
+}
+
+var qemuSystemMachines = map[string]*qemuSystemMachine{
+	"x86_64":  {Command: "qemu-system-x86_64", Console: "ttyS0"},
+	"i686":    {Command: "qemu-system-i386", Console: "ttyS0"},
+	"aarch64": {Command: "qemu-system-aarch64", Arguments: []string{"-machine", "virt", "-cpu", "max"}, Console: "ttyAMA0"},
+	"riscv64": {Command: "qemu-system-riscv64", Arguments: []string{"-machine", "virt"}, Console: "ttyS0"},
+}
+
+// Boots a kernel with an image of a root filesystem in QEMU, and waits for a marker on the serial
+// console. Emulation is used rather than KVM, so this works on any host and in containers.
+type BootCheck struct {
+	KernelDirectoryPath string // Directory containing the kernel in /boot, typically the kernel build output
+	RootFilesystemPath  string
+	RootFilesystemType  string
+	KernelVersion       string // Version of the kernel in /boot to boot. Only required if there are multiple kernels.
+	KernelCommandLine   string // Additional kernel arguments
+	Architecture        string // GNU machine name, i.e. "x86_64"
+	SuccessMarker       string // Console output that indicates a successful boot
+	Timeout             time.Duration
+	MemorySize          int64  // MiB
+	ConsoleLogPath      string // Optional path to write the console output to
+}
+
+// Thread safe buffer for the console output, which is written to by the QEMU output readers
+type consoleLog struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (cl *consoleLog) Write(p []byte) (int, error) {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	return cl.buffer.Write(p)
+}
+
+func (cl *consoleLog) String() string {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	return cl.buffer.String()
+}
+
+func (bc *BootCheck) Run(ctx context.Context) (err error) {
+	err = bc.validate()
+	if err != nil {
+		return trace.Wrap(err, "failed to validate boot check options")
+	}
+
+	machine := qemuSystemMachines[bc.Architecture]
+	err = runners.CheckRequiredCommandsExist(bc.getRequiredCommands(machine))
+	if err != nil {
+		return trace.Wrap(err, "failed to find required commands for the boot check")
+	}
+
+	kernel, err := findBootFiles(bc.KernelDirectoryPath, bc.KernelVersion)
+	if err != nil {
+		return trace.Wrap(err, "failed to find kernel in %q", bc.KernelDirectoryPath)
+	}
+
+	workingDirectory, err := os.MkdirTemp("", "boot-check-*")
+	if err != nil {
+		return trace.Wrap(err, "failed to create temporary working directory")
+	}
+	defer utils.ErrDefer(func() error { return os.RemoveAll(workingDirectory) }, &err)
+
+	rootImagePath := path.Join(workingDirectory, "root.img")
+	err = buildRootFilesystem(bc.RootFilesystemPath, bc.RootFilesystemType, 0, rootImagePath)
+	if err != nil {
+		return trace.Wrap(err, "failed to build root filesystem image")
+	}
+
+	console := &consoleLog{}
+	bootErr := bc.boot(ctx, machine, kernel, rootImagePath, console)
+
+	if bc.ConsoleLogPath != "" {
+		err = os.WriteFile(bc.ConsoleLogPath, []byte(console.String()), 0644)
+		if err != nil {
+			return trace.NewAggregate(bootErr, trace.Wrap(err, "failed to write console log to %q", bc.ConsoleLogPath))
+		}
+	}
+
+	if bootErr != nil {
+		return trace.Wrap(bootErr, "boot check failed, console log:\n%s", console.String())
+	}
+
+	return nil
+}
+
+func (bc *BootCheck) validate() error {
+	if bc.KernelDirectoryPath == "" {
+		return trace.Errorf("a kernel directory path is required")
+	}
+
+	if bc.RootFilesystemPath == "" {
+		return trace.Errorf("a root filesystem path is required")
+	}
+
+	if _, ok := qemuSystemMachines[bc.Architecture]; !ok {
+		return trace.Errorf("unsupported boot check architecture %q", bc.Architecture)
+	}
+
+	if bc.SuccessMarker == "" {
+		return trace.Errorf("a success marker is required")
+	}
+
+	if bc.Timeout <= 0 {
+		return trace.Errorf("the timeout must be positive")
+	}
+
+	if bc.MemorySize <= 0 {
+		return trace.Errorf("the memory size must be positive")
+	}
+
+	return nil
+}
+
+func (bc *BootCheck) getRequiredCommands(machine *qemuSystemMachine) []string {
+	requiredCommands := []string{machine.Command}
+
+	switch bc.RootFilesystemType {
+	case RootFilesystemTypeExt4:
+		requiredCommands = append(requiredCommands, "mkfs.ext4")
+	case RootFilesystemTypeErofs:
+		requiredCommands = append(requiredCommands, "mkfs.erofs")
+	}
+
+	return requiredCommands
+}
+
+func (bc *BootCheck) getKernelCommandLine(machine *qemuSystemMachine) string {
+	// Panics should exit QEMU immediately (with -no-reboot) rather than waiting for the timeout
+	arguments := []string{fmt.Sprintf("console=%s", machine.Console), "root=/dev/vda", "rootwait", "panic=-1"}
+	if bc.RootFilesystemType == RootFilesystemTypeErofs {
+		arguments = append(arguments, "ro", "rootfstype=erofs")
+	} else {
+		arguments = append(arguments, "rw")
+	}
+
+	if bc.KernelCommandLine != "" {
+		arguments = append(arguments, bc.KernelCommandLine)
+	}
+
+	return strings.Join(arguments, " ")
+}
+
+func (bc *BootCheck) getQemuArguments(machine *qemuSystemMachine, kernel *bootFiles, rootImagePath string) []string {
+	driveOptions := fmt.Sprintf("file=%s,format=raw,if=virtio", rootImagePath)
+	if bc.RootFilesystemType == RootFilesystemTypeErofs {
+		driveOptions += ",readonly=on"
+	}
+
+	arguments := append([]string{}, machine.Arguments...)
+	arguments = append(arguments,
+		"-accel", "tcg",
+		"-m", fmt.Sprintf("%dM", bc.MemorySize),
+		"-display", "none",
+		"-monitor", "none",
+		"-serial", "stdio",
+		"-no-reboot",
+		"-kernel", kernel.KernelPath,
+		"-append", bc.getKernelCommandLine(machine),
+		"-drive", driveOptions,
+	)
+
+	if kernel.InitramfsPath != "" {
+		arguments = append(arguments, "-initrd", kernel.InitramfsPath)
+	}
+
+	return arguments
+}
+
+// Boot the machine and wait for the success marker, a failure marker, QEMU exiting, or the timeout
+func (bc *BootCheck) boot(ctx context.Context, machine *qemuSystemMachine, kernel *bootFiles, rootImagePath string, console *consoleLog) error {
+	ctx, cancel := context.WithTimeout(ctx, bc.Timeout)
+	defer cancel()
+
+	arguments := bc.getQemuArguments(machine, kernel, rootImagePath)
+	slog.Info("Booting kernel", "command", machine.Command, "arguments", arguments)
+
+	qemu := exec.CommandContext(ctx, machine.Command, arguments...)
+	qemu.Stdin = nil // Nothing should be typed into the console
+	outputReader, outputWriter := io.Pipe()
+	qemu.Stdout = outputWriter
+	qemu.Stderr = outputWriter
+	qemu.WaitDelay = 5 * time.Second // Don't wait on output from leftover child processes after QEMU is killed
+
+	err := qemu.Start()
+	if err != nil {
+		return trace.Wrap(err, "failed to start %q", machine.Command)
+	}
+
+	exitResult := make(chan error, 1)
+	go func() {
+		exitResult <- qemu.Wait()
+		outputWriter.Close()
+	}()
+
+	markerResult := make(chan error, 1)
+	go func() {
+		markerResult <- bc.watchConsole(outputReader, console)
+	}()
+
+	select {
+	case err = <-markerResult:
+		// The deadline may have passed while the marker was being found, in which case the result
+		// is not trusted. This also covers QEMU being killed at the deadline, closing the console.
+		timeoutErr := ctx.Err()
+
+		// The machine is not shut down cleanly, as the root filesystem image is discarded. Output
+		// must still be drained, otherwise QEMU cannot exit.
+		cancel()
+		go func() { _, _ = io.Copy(io.Discard, outputReader) }()
+		<-exitResult
+
+		if errors.Is(timeoutErr, context.DeadlineExceeded) {
+			return trace.Errorf("timed out after %v waiting for %q on the console", bc.Timeout, bc.SuccessMarker)
+		}
+
+		return trace.Wrap(err)
+	case err = <-exitResult:
+		// Drain the remaining output, which may include the marker
+		markerErr := <-markerResult
+		if markerErr == nil {
+			return nil
+		}
+
+		if err != nil {
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return trace.Errorf("timed out after %v waiting for %q on the console", bc.Timeout, bc.SuccessMarker)
+			}
+
+			return trace.Wrap(err, "%q exited before the boot completed", machine.Command)
+		}
+
+		return trace.Wrap(markerErr, "%q exited before the boot completed", machine.Command)
+	}
+}
+
+// Copy console output to the log until the success marker is found (nil) or the boot fails
+func (bc *BootCheck) watchConsole(output io.Reader, console *consoleLog) error {
+	buffer := make([]byte, 4096)
+	for {
+		readCount, err := output.Read(buffer)
+		if readCount > 0 {
+			_, _ = console.Write(buffer[:readCount])
+			consoleOutput := console.String()
+
+			for _, failureMarker := range bootFailureMarkers {
+				if strings.Contains(consoleOutput, failureMarker) {
+					return trace.Errorf("found boot failure %q on the console", failureMarker)
+				}
+			}
+
+			if strings.Contains(consoleOutput, bc.SuccessMarker) {
+				slog.Info("Found boot success marker on the console", "marker", bc.SuccessMarker)
+				return nil
+			}
+		}
+
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return trace.Errorf("console closed without printing %q", bc.SuccessMarker)
+			}
+
+			return trace.Wrap(err, "failed to read console output")
+		}
+	}
+}
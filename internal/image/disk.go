@@ -0,0 +1,541 @@
+package image
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/gravitational/trace"
+	"github.com/solidDoWant/distrobuilder/internal/runners"
+	"github.com/solidDoWant/distrobuilder/internal/utils"
+)
+
+const (
+	DiskFormatRaw   = "raw"
+	DiskFormatQcow2 = "qcow2"
+
+	RootFilesystemTypeExt4  = "ext4"
+	RootFilesystemTypeErofs = "erofs"
+
+	DefaultESPSize = 256 * 1024 * 1024
+
+	loaderEntryName = "distrobuilder.conf"
+)
+
+var (
+	DiskFormats         = []string{DiskFormatRaw, DiskFormatQcow2}
+	RootFilesystemTypes = []string{RootFilesystemTypeExt4, RootFilesystemTypeErofs}
+
+	// File name prefixes used by the kernel's `make install` target on various architectures
+	kernelImagePrefixes = []string{"vmlinuz-", "Image-", "vmlinux-"}
+
+	// Removable media boot paths from the UEFI specification
+	efiBootFileNames = map[string]string{
+		"x86_64":  "BOOTX64.EFI",
+		"aarch64": "BOOTAA64.EFI",
+		"i686":    "BOOTIA32.EFI",
+		"riscv64": "BOOTRISCV64.EFI",
+	}
+)
+
+// Produces a bootable GPT partitioned disk image from a populated root filesystem. The disk contains
+// an EFI system partition with the kernel, any initramfs, and a systemd-boot compatible loader
+// configuration, followed by a root partition. Partition tables are written directly, so no loop
+// devices or elevated privileges are required.
+type Disk struct {
+	RootFilesystemPath string
+	OutputPath         string
+	Format             string
+	RootFilesystemType string
+	RootPartitionSize  int64  // Size of the root partition in bytes. Calculated from the root filesystem contents if not set.
+	ESPSize            int64  // Size of the EFI system partition in bytes
+	KernelVersion      string // Version of the kernel in /boot to boot. Only required if there are multiple kernels.
+	KernelCommandLine  string // Additional kernel arguments
+	BootloaderEFIPath  string // Path to an EFI bootloader binary (i.e. systemd-bootx64.efi) to install as the default boot file
+	Architecture       string // GNU machine name, i.e. "x86_64"
+	Title              string // Boot menu entry title
+}
+
+type bootFiles struct {
+	KernelPath    string
+	InitramfsPath string
+	Version       string
+}
+
+func (d *Disk) Build(ctx context.Context) (string, error) {
+	err := d.validate()
+	if err != nil {
+		return "", trace.Wrap(err, "failed to validate disk image options")
+	}
+
+	err = runners.CheckRequiredCommandsExist(d.getRequiredCommands())
+	if err != nil {
+		return "", trace.Wrap(err, "failed to find required commands for building the disk image")
+	}
+
+	kernel, err := findBootFiles(d.RootFilesystemPath, d.KernelVersion)
+	if err != nil {
+		return "", trace.Wrap(err, "failed to find kernel in root filesystem %q", d.RootFilesystemPath)
+	}
+
+	workingDirectory, err := os.MkdirTemp("", "disk-image-*")
+	if err != nil {
+		return "", trace.Wrap(err, "failed to create temporary working directory")
+	}
+	defer utils.ErrDefer(func() error { return os.RemoveAll(workingDirectory) }, &err)
+
+	rootPartitionGUID := uuid.New()
+	rootImagePath := path.Join(workingDirectory, "root.img")
+	err = buildRootFilesystem(d.RootFilesystemPath, d.RootFilesystemType, d.RootPartitionSize, rootImagePath)
+	if err != nil {
+		return "", trace.Wrap(err, "failed to build root filesystem image")
+	}
+
+	espImagePath := path.Join(workingDirectory, "esp.img")
+	err = d.buildESP(espImagePath, kernel, rootPartitionGUID)
+	if err != nil {
+		return "", trace.Wrap(err, "failed to build EFI system partition image")
+	}
+
+	rawImagePath := d.OutputPath
+	if d.Format != DiskFormatRaw {
+		rawImagePath = path.Join(workingDirectory, "disk.raw")
+	}
+
+	err = d.writeDisk(rawImagePath, espImagePath, rootImagePath, rootPartitionGUID)
+	if err != nil {
+		return "", trace.Wrap(err, "failed to write disk image")
+	}
+
+	if d.Format == DiskFormatQcow2 {
+		_, err = utils.EnsureDirectoryExists(path.Dir(d.OutputPath))
+		if err != nil {
+			return "", trace.Wrap(err, "failed to ensure disk image output directory exists")
+		}
+
+		_, err = runners.Run(&runners.CommandRunner{
+			Command:   "qemu-img",
+			Arguments: []string{"convert", "-f", "raw", "-O", "qcow2", rawImagePath, d.OutputPath},
+		})
+		if err != nil {
+			return "", trace.Wrap(err, "failed to convert disk image to qcow2")
+		}
+	}
+
+	slog.Info("Disk image complete!", "output_file", d.OutputPath, "kernel_version", kernel.Version, "root_partuuid", rootPartitionGUID.String())
+	return d.OutputPath, nil
+}
+
+func (d *Disk) validate() error {
+	if d.RootFilesystemPath == "" {
+		return trace.Errorf("a root filesystem path is required")
+	}
+
+	if d.OutputPath == "" {
+		return trace.Errorf("an output path is required")
+	}
+
+	if d.Format == "" {
+		d.Format = DiskFormatRaw
+	}
+
+	if !slices.Contains(DiskFormats, d.Format) {
+		return trace.Errorf("unsupported disk format %q, must be one of %v", d.Format, DiskFormats)
+	}
+
+	if d.RootFilesystemType == "" {
+		d.RootFilesystemType = RootFilesystemTypeExt4
+	}
+
+	if !slices.Contains(RootFilesystemTypes, d.RootFilesystemType) {
+		return trace.Errorf("unsupported root filesystem type %q, must be one of %v", d.RootFilesystemType, RootFilesystemTypes)
+	}
+
+	if d.ESPSize == 0 {
+		d.ESPSize = DefaultESPSize
+	}
+
+	if d.Architecture == "" {
+		d.Architecture = utils.GetTripletMachineValue()
+	}
+
+	if d.Title == "" {
+		d.Title = "distrobuilder"
+	}
+
+	return nil
+}
+
+func (d *Disk) getRequiredCommands() []string {
+	requiredCommands := []string{"mkfs.vfat", "mmd", "mcopy"}
+
+	switch d.RootFilesystemType {
+	case RootFilesystemTypeExt4:
+		requiredCommands = append(requiredCommands, "mkfs.ext4")
+	case RootFilesystemTypeErofs:
+		requiredCommands = append(requiredCommands, "mkfs.erofs")
+	}
+
+	if d.Format == DiskFormatQcow2 {
+		requiredCommands = append(requiredCommands, "qemu-img")
+	}
+
+	return requiredCommands
+}
+
+// Find the kernel (and initramfs, if any) installed by the kernel builder under the root
+// filesystem's /boot. The kernel version is only required if there are multiple kernels.
+func findBootFiles(rootFilesystemPath, kernelVersion string) (*bootFiles, error) {
+	bootDirectoryPath := path.Join(rootFilesystemPath, "boot")
+
+	var kernels []*bootFiles
+	for _, prefix := range kernelImagePrefixes {
+		matches, err := filepath.Glob(path.Join(bootDirectoryPath, prefix+"*"))
+		if err != nil {
+			return nil, trace.Wrap(err, "failed to search for kernels in %q", bootDirectoryPath)
+		}
+
+		for _, match := range matches {
+			version := strings.TrimPrefix(path.Base(match), prefix)
+			if kernelVersion != "" && version != kernelVersion {
+				continue
+			}
+
+			kernels = append(kernels, &bootFiles{
+				KernelPath: match,
+				Version:    version,
+			})
+		}
+
+		// Prefer compressed images when multiple formats are installed
+		if len(kernels) > 0 {
+			break
+		}
+	}
+
+	if len(kernels) == 0 {
+		return nil, trace.Errorf("no kernel found in %q", bootDirectoryPath)
+	}
+
+	if len(kernels) > 1 {
+		versions := make([]string, 0, len(kernels))
+		for _, kernel := range kernels {
+			versions = append(versions, kernel.Version)
+		}
+
+		return nil, trace.Errorf("found multiple kernels %v, a kernel version must be specified", versions)
+	}
+
+	kernel := kernels[0]
+	initramfsPath := path.Join(bootDirectoryPath, GetInitramfsFileName(kernel.Version))
+	doesInitramfsExist, err := utils.DoesFilesystemPathExist(initramfsPath)
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to check if initramfs %q exists", initramfsPath)
+	}
+
+	if doesInitramfsExist {
+		kernel.InitramfsPath = initramfsPath
+	}
+
+	slog.Info("Found kernel", "kernel_path", kernel.KernelPath, "initramfs_path", kernel.InitramfsPath)
+	return kernel, nil
+}
+
+// Name of the initramfs for a kernel version, relative to /boot
+func GetInitramfsFileName(kernelVersion string) string {
+	return fmt.Sprintf("initramfs-%s.img", kernelVersion)
+}
+
+// Build a filesystem image of the root filesystem directory. The partition size is calculated from
+// the root filesystem contents if it is zero.
+func buildRootFilesystem(rootFilesystemPath, rootFilesystemType string, partitionSize int64, imagePath string) error {
+	slog.Info("Building root filesystem image", "type", rootFilesystemType)
+
+	switch rootFilesystemType {
+	case RootFilesystemTypeExt4:
+		if partitionSize == 0 {
+			contentsSize, err := getDirectorySize(rootFilesystemPath)
+			if err != nil {
+				return trace.Wrap(err, "failed to calculate root filesystem size")
+			}
+
+			// Leave room for filesystem metadata and some free space
+			partitionSize = contentsSize + contentsSize/4 + 64*1024*1024
+		}
+		partitionSize = alignUp(partitionSize, PartitionAlignment)
+
+		err := os.WriteFile(imagePath, nil, 0644)
+		if err != nil {
+			return trace.Wrap(err, "failed to create root filesystem image %q", imagePath)
+		}
+
+		err = os.Truncate(imagePath, partitionSize)
+		if err != nil {
+			return trace.Wrap(err, "failed to resize root filesystem image %q to %d bytes", imagePath, partitionSize)
+		}
+
+		_, err = runners.Run(&runners.CommandRunner{
+			Command:   "mkfs.ext4",
+			Arguments: []string{"-q", "-F", "-L", "root", "-E", "root_owner=0:0", "-d", rootFilesystemPath, imagePath},
+		})
+		if err != nil {
+			return trace.Wrap(err, "failed to create ext4 filesystem")
+		}
+	case RootFilesystemTypeErofs:
+		_, err := runners.Run(&runners.CommandRunner{
+			Command:   "mkfs.erofs",
+			Arguments: []string{"-L", "root", imagePath, rootFilesystemPath},
+		})
+		if err != nil {
+			return trace.Wrap(err, "failed to create erofs filesystem")
+		}
+
+		if partitionSize != 0 {
+			err = os.Truncate(imagePath, alignUp(partitionSize, PartitionAlignment))
+			if err != nil {
+				return trace.Wrap(err, "failed to resize root filesystem image %q", imagePath)
+			}
+		}
+	}
+
+	return nil
+}
+
+func getDirectorySize(directoryPath string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(directoryPath, func(fsPath string, fsEntry fs.DirEntry, err error) error {
+		if err != nil {
+			return trace.Wrap(err, "failed to walk dir %q", fsPath)
+		}
+
+		fileInfo, err := fsEntry.Info()
+		if err != nil {
+			return trace.Wrap(err, "failed to get file info for %q", fsPath)
+		}
+
+		// Round up to the filesystem block size
+		size += alignUp(fileInfo.Size(), 4096)
+		return nil
+	})
+	if err != nil {
+		return 0, trace.Wrap(err, "failed to walk over %q", directoryPath)
+	}
+
+	return size, nil
+}
+
+func (d *Disk) buildESP(imagePath string, kernel *bootFiles, rootPartitionGUID uuid.UUID) error {
+	slog.Info("Building EFI system partition image")
+
+	err := os.WriteFile(imagePath, nil, 0644)
+	if err != nil {
+		return trace.Wrap(err, "failed to create EFI system partition image %q", imagePath)
+	}
+
+	err = os.Truncate(imagePath, alignUp(d.ESPSize, PartitionAlignment))
+	if err != nil {
+		return trace.Wrap(err, "failed to resize EFI system partition image %q", imagePath)
+	}
+
+	_, err = runners.Run(&runners.CommandRunner{
+		Command:   "mkfs.vfat",
+		Arguments: []string{"-F", "32", "-n", "ESP", imagePath},
+	})
+	if err != nil {
+		return trace.Wrap(err, "failed to create FAT filesystem")
+	}
+
+	err = runMtools("mmd", imagePath, "::/EFI", "::/EFI/BOOT", "::/loader", "::/loader/entries")
+	if err != nil {
+		return trace.Wrap(err, "failed to create EFI system partition directories")
+	}
+
+	files := map[string]string{
+		kernel.KernelPath: path.Base(kernel.KernelPath),
+	}
+
+	if kernel.InitramfsPath != "" {
+		files[kernel.InitramfsPath] = path.Base(kernel.InitramfsPath)
+	}
+
+	if d.BootloaderEFIPath != "" {
+		efiBootFileName, ok := efiBootFileNames[d.Architecture]
+		if !ok {
+			return trace.Errorf("no default EFI boot file name for architecture %q", d.Architecture)
+		}
+
+		files[d.BootloaderEFIPath] = path.Join("EFI", "BOOT", efiBootFileName)
+	} else {
+		slog.Warn("No bootloader provided, the disk will only contain the loader configuration")
+	}
+
+	loaderDirectoryPath := path.Dir(imagePath)
+	loaderConfigPath := path.Join(loaderDirectoryPath, "loader.conf")
+	err = os.WriteFile(loaderConfigPath, []byte(fmt.Sprintf("default %s\ntimeout 3\n", loaderEntryName)), 0644)
+	if err != nil {
+		return trace.Wrap(err, "failed to write loader configuration")
+	}
+	files[loaderConfigPath] = path.Join("loader", "loader.conf")
+
+	loaderEntryPath := path.Join(loaderDirectoryPath, loaderEntryName)
+	err = os.WriteFile(loaderEntryPath, []byte(d.getLoaderEntry(kernel, rootPartitionGUID)), 0644)
+	if err != nil {
+		return trace.Wrap(err, "failed to write loader entry")
+	}
+	files[loaderEntryPath] = path.Join("loader", "entries", loaderEntryName)
+
+	for sourcePath, destinationPath := range files {
+		err = runMtools("mcopy", imagePath, sourcePath, "::/"+destinationPath)
+		if err != nil {
+			return trace.Wrap(err, "failed to copy %q to the EFI system partition", sourcePath)
+		}
+	}
+
+	return nil
+}
+
+func (d *Disk) getLoaderEntry(kernel *bootFiles, rootPartitionGUID uuid.UUID) string {
+	rootMode := "rw"
+	if d.RootFilesystemType == RootFilesystemTypeErofs {
+		rootMode = "ro"
+	}
+
+	options := []string{
+		fmt.Sprintf("root=PARTUUID=%s", rootPartitionGUID.String()),
+		fmt.Sprintf("rootfstype=%s", d.RootFilesystemType),
+		rootMode,
+	}
+	if d.KernelCommandLine != "" {
+		options = append(options, d.KernelCommandLine)
+	}
+
+	lines := []string{
+		fmt.Sprintf("title %s", d.Title),
+		fmt.Sprintf("version %s", kernel.Version),
+		fmt.Sprintf("linux /%s", path.Base(kernel.KernelPath)),
+	}
+
+	if kernel.InitramfsPath != "" {
+		lines = append(lines, fmt.Sprintf("initrd /%s", path.Base(kernel.InitramfsPath)))
+	}
+
+	lines = append(lines, fmt.Sprintf("options %s", strings.Join(options, " ")))
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func runMtools(command, imagePath string, arguments ...string) error {
+	_, err := runners.Run(&runners.CommandRunner{
+		Command:   command,
+		Arguments: append([]string{"-i", imagePath}, arguments...),
+	})
+	if err != nil {
+		return trace.Wrap(err, "%s failed", command)
+	}
+
+	return nil
+}
+
+// Assemble the partition table and partition images into a raw disk image
+func (d *Disk) writeDisk(diskImagePath, espImagePath, rootImagePath string, rootPartitionGUID uuid.UUID) error {
+	slog.Info("Writing disk image", "output_file", diskImagePath)
+
+	partitionImages := []struct {
+		Name      string
+		Type      uuid.UUID
+		GUID      uuid.UUID
+		ImagePath string
+		Size      int64
+	}{
+		{Name: "ESP", Type: EFISystemPartitionType, GUID: uuid.New(), ImagePath: espImagePath},
+		{Name: "root", Type: GetRootPartitionType(d.Architecture), GUID: rootPartitionGUID, ImagePath: rootImagePath},
+	}
+
+	// Reserve space for the primary and backup partition tables
+	diskSize := int64(2 * PartitionAlignment)
+	for i, partitionImage := range partitionImages {
+		imageInfo, err := os.Stat(partitionImage.ImagePath)
+		if err != nil {
+			return trace.Wrap(err, "failed to get size of partition image %q", partitionImage.ImagePath)
+		}
+
+		partitionImages[i].Size = alignUp(imageInfo.Size(), PartitionAlignment)
+		diskSize += partitionImages[i].Size
+	}
+
+	_, err := utils.EnsureDirectoryExists(path.Dir(diskImagePath))
+	if err != nil {
+		return trace.Wrap(err, "failed to ensure disk image output directory exists")
+	}
+
+	diskFile, err := os.OpenFile(diskImagePath, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	defer utils.Close(diskFile, &err)
+	if err != nil {
+		return trace.Wrap(err, "failed to create disk image %q", diskImagePath)
+	}
+
+	err = diskFile.Truncate(diskSize)
+	if err != nil {
+		return trace.Wrap(err, "failed to resize disk image to %d bytes", diskSize)
+	}
+
+	partitionTable := NewGPT(diskSize)
+	for _, partitionImage := range partitionImages {
+		partition, err := partitionTable.AddPartition(partitionImage.Name, partitionImage.Type, partitionImage.Size)
+		if err != nil {
+			return trace.Wrap(err, "failed to add partition %q", partitionImage.Name)
+		}
+		partition.GUID = partitionImage.GUID
+
+		err = copyPartitionImage(diskFile, partition.GetOffset(), partitionImage.ImagePath)
+		if err != nil {
+			return trace.Wrap(err, "failed to write partition %q", partitionImage.Name)
+		}
+	}
+
+	err = partitionTable.Write(diskFile)
+	if err != nil {
+		return trace.Wrap(err, "failed to write partition table")
+	}
+
+	return nil
+}
+
+// Copy the image into the disk at the given offset. Blocks of zeros are skipped so that the disk
+// image remains sparse.
+func copyPartitionImage(disk io.WriterAt, offset int64, imagePath string) error {
+	imageFile, err := os.Open(imagePath)
+	defer utils.Close(imageFile, &err)
+	if err != nil {
+		return trace.Wrap(err, "failed to open partition image %q", imagePath)
+	}
+
+	buffer := make([]byte, 1024*1024)
+	zeroBlock := make([]byte, len(buffer))
+	for {
+		readByteCount, err := io.ReadFull(imageFile, buffer)
+		if readByteCount > 0 && !bytes.Equal(buffer[:readByteCount], zeroBlock[:readByteCount]) {
+			_, writeErr := disk.WriteAt(buffer[:readByteCount], offset)
+			if writeErr != nil {
+				return trace.Wrap(writeErr, "failed to write to disk at offset %d", offset)
+			}
+		}
+		offset += int64(readByteCount)
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+
+		if err != nil {
+			return trace.Wrap(err, "failed to read partition image %q", imagePath)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"unicode/utf16"
+
+	"github.com/google/uuid"
+	"github.com/gravitational/trace"
+)
+
+const (
+	SectorSize = 512
+
+	gptSignature          = "EFI PART"
+	gptRevision           = 0x00010000
+	gptHeaderSize         = 92
+	gptPartitionEntrySize = 128
+	gptPartitionCount     = 128
+	// Number of sectors used by the partition entry array
+	gptPartitionEntrySectors = gptPartitionEntrySize * gptPartitionCount / SectorSize
+	// Partitions are aligned to 1 MiB boundaries, matching common partitioning tools
+	PartitionAlignment = 1024 * 1024
+)
+
+// Well-known partition type GUIDs, from the UEFI specification and the Discoverable Partitions Specification
+var (
+	EFISystemPartitionType = uuid.MustParse("C12A7328-F81F-11D2-BA4B-00A0C93EC93B")
+	LinuxFilesystemType    = uuid.MustParse("0FC63DAF-8483-4772-8E79-3D69D8477DE4")
+	rootPartitionTypes     = map[string]uuid.UUID{
+		"x86_64":  uuid.MustParse("4F68BCE3-E8CD-4DB1-96E7-FBCAF984B709"),
+		"aarch64": uuid.MustParse("B921B045-1DF0-41C3-AF44-4C6F280D3FAE"),
+		"i686":    uuid.MustParse("44479540-F297-41B2-9AF7-D131D5F0458A"),
+		"riscv64": uuid.MustParse("72EC70A6-CF74-40E6-BD49-4BDA08E8F224"),
+	}
+)
+
+// Get the discoverable root partition type for the architecture, falling back to the generic
+// Linux filesystem type
+func GetRootPartitionType(architecture string) uuid.UUID {
+	if partitionType, ok := rootPartitionTypes[architecture]; ok {
+		return partitionType
+	}
+
+	return LinuxFilesystemType
+}
+
+type GPTPartition struct {
+	Type       uuid.UUID
+	GUID       uuid.UUID
+	Name       string
+	FirstLBA   uint64
+	LastLBA    uint64 // Inclusive
+	Attributes uint64
+}
+
+func (gp *GPTPartition) GetOffset() int64 {
+	return int64(gp.FirstLBA) * SectorSize
+}
+
+func (gp *GPTPartition) GetSize() int64 {
+	return int64(gp.LastLBA-gp.FirstLBA+1) * SectorSize
+}
+
+// GUID partition table for a disk with 512 byte sectors
+type GPT struct {
+	DiskGUID    uuid.UUID
+	SectorCount uint64
+	Partitions  []*GPTPartition
+}
+
+func NewGPT(diskSize int64) *GPT {
+	return &GPT{
+		DiskGUID:    uuid.New(),
+		SectorCount: uint64(diskSize / SectorSize),
+	}
+}
+
+// First sector that may be used by a partition
+func (g *GPT) GetFirstUsableLBA() uint64 {
+	return 2 + gptPartitionEntrySectors
+}
+
+// Last sector that may be used by a partition
+func (g *GPT) GetLastUsableLBA() uint64 {
+	return g.SectorCount - 2 - gptPartitionEntrySectors
+}
+
+// Add a partition of at least the given size, starting at the next aligned offset
+func (g *GPT) AddPartition(name string, partitionType uuid.UUID, size int64) (*GPTPartition, error) {
+	if len(g.Partitions) == gptPartitionCount {
+		return nil, trace.Errorf("the partition table is full")
+	}
+
+	startOffset := int64(g.GetFirstUsableLBA()) * SectorSize
+	if len(g.Partitions) > 0 {
+		startOffset = int64(g.Partitions[len(g.Partitions)-1].LastLBA+1) * SectorSize
+	}
+	startOffset = alignUp(startOffset, PartitionAlignment)
+
+	partition := &GPTPartition{
+		Type:     partitionType,
+		GUID:     uuid.New(),
+		Name:     name,
+		FirstLBA: uint64(startOffset / SectorSize),
+		LastLBA:  uint64((startOffset+alignUp(size, SectorSize))/SectorSize) - 1,
+	}
+
+	if partition.LastLBA > g.GetLastUsableLBA() {
+		return nil, trace.Errorf("partition %q of size %d does not fit on the disk", name, size)
+	}
+
+	g.Partitions = append(g.Partitions, partition)
+	return partition, nil
+}
+
+// Write the protective MBR, along with the primary and backup partition tables
+func (g *GPT) Write(disk io.WriterAt) error {
+	partitionEntries, err := g.getPartitionEntries()
+	if err != nil {
+		return trace.Wrap(err, "failed to build partition entries")
+	}
+	partitionEntriesCRC := crc32.ChecksumIEEE(partitionEntries)
+
+	_, err = disk.WriteAt(g.getProtectiveMBR(), 0)
+	if err != nil {
+		return trace.Wrap(err, "failed to write protective MBR")
+	}
+
+	backupHeaderLBA := g.SectorCount - 1
+	backupEntriesLBA := backupHeaderLBA - gptPartitionEntrySectors
+	for _, table := range []struct {
+		Name       string
+		HeaderLBA  uint64
+		BackupLBA  uint64
+		EntriesLBA uint64
+	}{
+		{"primary", 1, backupHeaderLBA, 2},
+		{"backup", backupHeaderLBA, 1, backupEntriesLBA},
+	} {
+		_, err = disk.WriteAt(partitionEntries, int64(table.EntriesLBA)*SectorSize)
+		if err != nil {
+			return trace.Wrap(err, "failed to write %s partition entries", table.Name)
+		}
+
+		header := g.getHeader(table.HeaderLBA, table.BackupLBA, table.EntriesLBA, partitionEntriesCRC)
+		_, err = disk.WriteAt(header, int64(table.HeaderLBA)*SectorSize)
+		if err != nil {
+			return trace.Wrap(err, "failed to write %s partition table header", table.Name)
+		}
+	}
+
+	return nil
+}
+
+// The protective MBR marks the entire disk as in use, so that tools that do not understand GPT
+// do not treat the disk as empty
+func (g *GPT) getProtectiveMBR() []byte {
+	mbr := make([]byte, SectorSize)
+
+	sectorCount := g.SectorCount - 1
+	if sectorCount > 0xFFFFFFFF {
+		sectorCount = 0xFFFFFFFF
+	}
+
+	partitionEntry := mbr[446:462]
+	partitionEntry[1] = 0x00 // Starting CHS
+	partitionEntry[2] = 0x02
+	partitionEntry[3] = 0x00
+	partitionEntry[4] = 0xEE // GPT protective partition type
+	partitionEntry[5] = 0xFF // Ending CHS
+	partitionEntry[6] = 0xFF
+	partitionEntry[7] = 0xFF
+	binary.LittleEndian.PutUint32(partitionEntry[8:12], 1)
+	binary.LittleEndian.PutUint32(partitionEntry[12:16], uint32(sectorCount))
+
+	mbr[510] = 0x55
+	mbr[511] = 0xAA
+	return mbr
+}
+
+func (g *GPT) getHeader(currentLBA, backupLBA, entriesLBA uint64, partitionEntriesCRC uint32) []byte {
+	header := make([]byte, SectorSize)
+	copy(header[0:8], gptSignature)
+	binary.LittleEndian.PutUint32(header[8:12], gptRevision)
+	binary.LittleEndian.PutUint32(header[12:16], gptHeaderSize)
+	// The header CRC (bytes 16-20) is calculated with the field zeroed
+	binary.LittleEndian.PutUint64(header[24:32], currentLBA)
+	binary.LittleEndian.PutUint64(header[32:40], backupLBA)
+	binary.LittleEndian.PutUint64(header[40:48], g.GetFirstUsableLBA())
+	binary.LittleEndian.PutUint64(header[48:56], g.GetLastUsableLBA())
+	copy(header[56:72], encodeGUID(g.DiskGUID))
+	binary.LittleEndian.PutUint64(header[72:80], entriesLBA)
+	binary.LittleEndian.PutUint32(header[80:84], gptPartitionCount)
+	binary.LittleEndian.PutUint32(header[84:88], gptPartitionEntrySize)
+	binary.LittleEndian.PutUint32(header[88:92], partitionEntriesCRC)
+
+	binary.LittleEndian.PutUint32(header[16:20], crc32.ChecksumIEEE(header[:gptHeaderSize]))
+	return header
+}
+
+func (g *GPT) getPartitionEntries() ([]byte, error) {
+	entries := make([]byte, gptPartitionEntrySize*gptPartitionCount)
+	for i, partition := range g.Partitions {
+		entry := entries[i*gptPartitionEntrySize : (i+1)*gptPartitionEntrySize]
+		copy(entry[0:16], encodeGUID(partition.Type))
+		copy(entry[16:32], encodeGUID(partition.GUID))
+		binary.LittleEndian.PutUint64(entry[32:40], partition.FirstLBA)
+		binary.LittleEndian.PutUint64(entry[40:48], partition.LastLBA)
+		binary.LittleEndian.PutUint64(entry[48:56], partition.Attributes)
+
+		encodedName := utf16.Encode([]rune(partition.Name))
+		if len(encodedName) > 36 {
+			return nil, trace.Errorf("partition name %q is longer than 36 UTF-16 code units", partition.Name)
+		}
+
+		nameBuffer := &bytes.Buffer{}
+		err := binary.Write(nameBuffer, binary.LittleEndian, encodedName)
+		if err != nil {
+			return nil, trace.Wrap(err, "failed to encode partition name %q", partition.Name)
+		}
+		copy(entry[56:128], nameBuffer.Bytes())
+	}
+
+	return entries, nil
+}
+
+// GUIDs are stored with the first three fields in little endian order
+func encodeGUID(guid uuid.UUID) []byte {
+	encoded := make([]byte, 16)
+	copy(encoded, guid[:])
+
+	encoded[0], encoded[1], encoded[2], encoded[3] = guid[3], guid[2], guid[1], guid[0]
+	encoded[4], encoded[5] = guid[5], guid[4]
+	encoded[6], encoded[7] = guid[7], guid[6]
+
+	return encoded
+}
+
+func alignUp(value, alignment int64) int64 {
+	return (value + alignment - 1) / alignment * alignment
+}
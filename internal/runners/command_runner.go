@@ -1,6 +1,7 @@
 package runners
 
 import (
+	"io"
 	"strings"
 
 	execute "github.com/alexellis/go-execute/pkg/v1"
@@ -9,9 +10,10 @@ import (
 
 type CommandRunner struct {
 	GenericRunner
-	Command   string // Can be fully qualified path, relative path, or binary name. If binary name then it will be searched for via the $PATH environment variable.
-	Arguments []string
-	Stdin     string
+	Command     string // Can be fully qualified path, relative path, or binary name. If binary name then it will be searched for via the $PATH environment variable.
+	Arguments   []string
+	Stdin       string
+	StdinReader io.Reader // Takes precedence over Stdin when set, for large or streamed input
 }
 
 func (cr CommandRunner) BuildTask() (*execute.ExecTask, error) {
@@ -35,7 +37,9 @@ func (cr CommandRunner) BuildTask() (*execute.ExecTask, error) {
 	}
 	task.Args = args
 
-	if cr.Stdin != "" {
+	if cr.StdinReader != nil {
+		task.Stdin = cr.StdinReader
+	} else if cr.Stdin != "" {
 		task.Stdin = strings.NewReader(cr.Stdin)
 	}
 
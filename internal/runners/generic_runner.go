@@ -22,6 +22,10 @@ func MergeGenericRunnerOptions(options ...*GenericRunnerOptions) (*GenericRunner
 	}, nil
 }
 
+// Environment variables set for commands run by builders, in addition to the environment of this
+// process. This allows for varying the build environment without affecting this process.
+var BuildEnvironmentVariables map[string]args.IValue
+
 type GenericRunnerOptions struct {
 	EnvironmentVariables map[string]args.IValue
 }
@@ -29,10 +33,18 @@ type GenericRunnerOptions struct {
 type GenericRunner struct {
 	WorkingDirectory string
 	Options          []*GenericRunnerOptions
+	// Set for commands that run target executables, such as tests run with qemu-user, which may
+	// not be able to load libraries preloaded by the build environment
+	ExcludeBuildEnvironment bool
 }
 
 func (gr GenericRunner) BuildTask() (*execute.ExecTask, error) {
-	mergedOptions, err := MergeGenericRunnerOptions(gr.Options...)
+	options := gr.Options
+	if !gr.ExcludeBuildEnvironment {
+		options = append([]*GenericRunnerOptions{{EnvironmentVariables: BuildEnvironmentVariables}}, options...)
+	}
+
+	mergedOptions, err := MergeGenericRunnerOptions(options...)
 	if err != nil {
 		return nil, trace.Wrap(err, "failed to merge generic runner options")
 	}
@@ -2,7 +2,7 @@ package runners
 
 import (
 	"fmt"
-	"runtime"
+	"io"
 
 	execute "github.com/alexellis/go-execute/pkg/v1"
 	pie "github.com/elliotchance/pie/v2"
@@ -29,9 +29,10 @@ func MergeMakeOptions(options ...*MakeOptions) (*MakeOptions, error) {
 
 type Make struct {
 	GenericRunner
-	Path    string // Path to the directory containing the makefile, relative to the working directory
-	Targets []string
-	Options []*MakeOptions
+	Path        string // Path to the directory containing the makefile, relative to the working directory
+	Targets     []string
+	Options     []*MakeOptions
+	StdinReader io.Reader // Optional, used to answer interactive prompts
 }
 
 func (m *Make) BuildTask() (*execute.ExecTask, error) {
@@ -47,11 +48,15 @@ func (m *Make) BuildTask() (*execute.ExecTask, error) {
 	args = append(
 		args,
 		"--no-print-directory",                // This makes outputs hard to parse when not set
-		fmt.Sprintf("-j%d", runtime.NumCPU()), // Use all CPU cores
+		fmt.Sprintf("-j%d", ParallelJobCount), // Use all CPU cores by default
 	)
 	task.Args = append(task.Args, args...)
 	task.Command = "make"
 
+	if m.StdinReader != nil {
+		task.Stdin = m.StdinReader
+	}
+
 	return task, nil
 }
 
@@ -3,12 +3,16 @@ package runners
 import (
 	"fmt"
 	"log/slog"
+	"runtime"
 
 	execute "github.com/alexellis/go-execute/pkg/v1"
 	"github.com/gravitational/trace"
 	"github.com/solidDoWant/distrobuilder/internal/utils"
 )
 
+// Number of jobs that build tools should run in parallel
+var ParallelJobCount = runtime.NumCPU()
+
 type CommandError struct {
 	error
 }
@@ -0,0 +1,18 @@
+package git_source
+
+import (
+	"github.com/solidDoWant/distrobuilder/internal/source"
+)
+
+const (
+	DefaultMuslLocalesRef string = "refs/heads/master"
+	MuslLocalesRepoUrl    string = "https://gitlab.com/rilian-la-te/musl-locales.git"
+)
+
+func NewMuslLocalesGitRepo(repoDirectoryPath, ref string) *source.GitRepo {
+	if ref == "" {
+		ref = DefaultMuslLocalesRef
+	}
+
+	return source.NewGitRepo("musl-locales", MuslLocalesRepoUrl, ref)
+}
@@ -0,0 +1,18 @@
+package git_source
+
+import (
+	"github.com/solidDoWant/distrobuilder/internal/source"
+)
+
+const (
+	DefaultTZDataRef string = "refs/tags/2024a"
+	TZDataRepoUrl    string = "https://github.com/eggert/tz.git"
+)
+
+func NewTZDataGitRepo(repoDirectoryPath, ref string) *source.GitRepo {
+	if ref == "" {
+		ref = DefaultTZDataRef
+	}
+
+	return source.NewGitRepo("tzdata", TZDataRepoUrl, ref)
+}
@@ -0,0 +1,44 @@
+package utils
+
+import (
+	"io/fs"
+
+	"github.com/gravitational/trace"
+	"golang.org/x/sys/unix"
+)
+
+// Character or block device node
+type DeviceNode struct {
+	Path          string
+	IsBlockDevice bool
+	Permissions   fs.FileMode
+	UserID        int
+	GroupID       int
+	Major         uint32
+	Minor         uint32
+}
+
+// Get the file type and permission bits used by syscalls
+func (dn *DeviceNode) GetSyscallMode() uint32 {
+	fileType := uint32(unix.S_IFCHR)
+	if dn.IsBlockDevice {
+		fileType = unix.S_IFBLK
+	}
+
+	return fileType | GetSyscallMode(dn.Permissions)
+}
+
+// Create the device node, replacing any existing non-directory at the path. Ownership is not set.
+func (rd *RootedDirectory) CreateDeviceNode(node *DeviceNode) error {
+	err := rd.RemoveNonDirectory(node.Path)
+	if err != nil {
+		return trace.Wrap(err, "failed to remove pre-existing file at %q", node.Path)
+	}
+
+	err = rd.Mknod(node.Path, node.GetSyscallMode(), node.Major, node.Minor)
+	if err != nil {
+		return trace.Wrap(err, "failed to create device node at %q", node.Path)
+	}
+
+	return nil
+}
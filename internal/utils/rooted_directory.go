@@ -0,0 +1,276 @@
+package utils
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/gravitational/trace"
+	"golang.org/x/sys/unix"
+)
+
+// Performs filesystem operations that are confined to a root directory. All paths are
+// resolved as if the root directory was "/", including ".." components and symlink targets,
+// so that no operation can modify anything outside of the root directory. This requires
+// openat2 (Linux 5.6+).
+type RootedDirectory struct {
+	Path string
+	fd   int
+}
+
+func OpenRootedDirectory(rootPath string) (*RootedDirectory, error) {
+	fd, err := unix.Open(rootPath, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to open root directory %q", rootPath)
+	}
+
+	return &RootedDirectory{
+		Path: rootPath,
+		fd:   fd,
+	}, nil
+}
+
+func (rd *RootedDirectory) Close() error {
+	err := unix.Close(rd.fd)
+	if err != nil {
+		return trace.Wrap(err, "failed to close root directory %q", rd.Path)
+	}
+
+	return nil
+}
+
+// Returns true if the path, when interpreted relative to a root directory, would
+// lexically resolve to a path outside of the root directory. Absolute paths are
+// always considered to be escaping as they are not relative to the root.
+func IsEscapingPath(name string) bool {
+	if path.IsAbs(name) {
+		return true
+	}
+
+	cleanedPath := path.Clean(name)
+	return cleanedPath == ".." || strings.HasPrefix(cleanedPath, "../")
+}
+
+// Convert the name to a path relative to the root directory
+func toRootRelativePath(name string) string {
+	relativePath := strings.TrimPrefix(path.Clean("/"+name), "/")
+	if relativePath == "" {
+		return "."
+	}
+
+	return relativePath
+}
+
+func (rd *RootedDirectory) resolve(name string, flags uint64, mode uint32) (int, error) {
+	fd, err := unix.Openat2(rd.fd, name, &unix.OpenHow{
+		Flags:   flags | unix.O_CLOEXEC,
+		Mode:    uint64(mode),
+		Resolve: unix.RESOLVE_IN_ROOT | unix.RESOLVE_NO_MAGICLINKS,
+	})
+	if err != nil {
+		return -1, trace.Wrap(err, "failed to resolve %q in root directory %q", name, rd.Path)
+	}
+
+	return fd, nil
+}
+
+// Open the parent directory of the named path. The returned file descriptor must be closed
+// by the caller.
+func (rd *RootedDirectory) openParent(name string) (int, string, error) {
+	cleanedName := path.Clean("/" + name)
+	if cleanedName == "/" {
+		return -1, "", trace.Errorf("the root directory does not have a parent")
+	}
+
+	parentPath, baseName := path.Split(cleanedName)
+	parentFd, err := rd.resolve(toRootRelativePath(parentPath), unix.O_PATH|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return -1, "", trace.Wrap(err, "failed to open parent directory of %q", name)
+	}
+
+	return parentFd, baseName, nil
+}
+
+// Run an operation against the parent directory of the named path. Operations on the root
+// directory itself are ran against the root directory with a base name of ".".
+func (rd *RootedDirectory) withParent(name string, operation func(parentFd int, baseName string) error) error {
+	if toRootRelativePath(name) == "." {
+		return operation(rd.fd, ".")
+	}
+
+	parentFd, baseName, err := rd.openParent(name)
+	if err != nil {
+		return trace.Wrap(err, "failed to open parent directory")
+	}
+	defer unix.Close(parentFd)
+
+	return operation(parentFd, baseName)
+}
+
+func (rd *RootedDirectory) OpenFile(name string, flag int, perm fs.FileMode) (*os.File, error) {
+	fd, err := rd.resolve(toRootRelativePath(name), uint64(flag), uint32(perm.Perm()))
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to open %q", name)
+	}
+
+	return os.NewFile(uintptr(fd), path.Join(rd.Path, name)), nil
+}
+
+// Stat the named path without following a symlink in the final path component
+func (rd *RootedDirectory) Lstat(name string) (*unix.Stat_t, error) {
+	stat := &unix.Stat_t{}
+	err := rd.withParent(name, func(parentFd int, baseName string) error {
+		return unix.Fstatat(parentFd, baseName, stat, unix.AT_SYMLINK_NOFOLLOW)
+	})
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to stat %q", name)
+	}
+
+	return stat, nil
+}
+
+// Create the named directory, along with any missing parents
+func (rd *RootedDirectory) MkdirAll(name string, perm fs.FileMode) error {
+	cleanedName := toRootRelativePath(name)
+	if cleanedName == "." {
+		return nil
+	}
+
+	currentPath := ""
+	for _, pathComponent := range strings.Split(cleanedName, "/") {
+		currentPath = path.Join(currentPath, pathComponent)
+		err := rd.withParent(currentPath, func(parentFd int, baseName string) error {
+			err := unix.Mkdirat(parentFd, baseName, uint32(perm.Perm()))
+			if errors.Is(err, unix.EEXIST) {
+				return nil
+			}
+
+			return err
+		})
+		if err != nil {
+			return trace.Wrap(err, "failed to create directory %q", currentPath)
+		}
+	}
+
+	return nil
+}
+
+func (rd *RootedDirectory) Symlink(target, name string) error {
+	err := rd.withParent(name, func(parentFd int, baseName string) error {
+		return unix.Symlinkat(target, parentFd, baseName)
+	})
+	if err != nil {
+		return trace.Wrap(err, "failed to create symlink %q to %q", name, target)
+	}
+
+	return nil
+}
+
+// Create a hard link at the named path to the target path. Both paths are resolved within the root.
+func (rd *RootedDirectory) Link(target, name string) error {
+	targetParentFd, targetBaseName, err := rd.openParent(target)
+	if err != nil {
+		return trace.Wrap(err, "failed to open parent directory of link target %q", target)
+	}
+	defer unix.Close(targetParentFd)
+
+	err = rd.withParent(name, func(parentFd int, baseName string) error {
+		return unix.Linkat(targetParentFd, targetBaseName, parentFd, baseName, 0)
+	})
+	if err != nil {
+		return trace.Wrap(err, "failed to create hard link %q to %q", name, target)
+	}
+
+	return nil
+}
+
+// Create a device node. The file type must be included in the mode (i.e. unix.S_IFCHR).
+func (rd *RootedDirectory) Mknod(name string, mode uint32, major, minor uint32) error {
+	err := rd.withParent(name, func(parentFd int, baseName string) error {
+		return unix.Mknodat(parentFd, baseName, mode, int(unix.Mkdev(major, minor)))
+	})
+	if err != nil {
+		return trace.Wrap(err, "failed to create device node %q for device number %d:%d", name, major, minor)
+	}
+
+	return nil
+}
+
+// Remove the named path if it exists and is not a directory. Symlinks are removed, not followed.
+func (rd *RootedDirectory) RemoveNonDirectory(name string) error {
+	err := rd.withParent(name, func(parentFd int, baseName string) error {
+		stat := &unix.Stat_t{}
+		err := unix.Fstatat(parentFd, baseName, stat, unix.AT_SYMLINK_NOFOLLOW)
+		if err != nil {
+			if errors.Is(err, unix.ENOENT) {
+				return nil
+			}
+
+			return err
+		}
+
+		if stat.Mode&unix.S_IFMT == unix.S_IFDIR {
+			return nil
+		}
+
+		return unix.Unlinkat(parentFd, baseName, 0)
+	})
+	if err != nil {
+		return trace.Wrap(err, "failed to remove %q", name)
+	}
+
+	return nil
+}
+
+// Set the file mode of the named path. Symlinks in the final path component are skipped as
+// they do not have a meaningful mode on Linux.
+func (rd *RootedDirectory) Chmod(name string, mode fs.FileMode) error {
+	err := rd.withParent(name, func(parentFd int, baseName string) error {
+		stat := &unix.Stat_t{}
+		err := unix.Fstatat(parentFd, baseName, stat, unix.AT_SYMLINK_NOFOLLOW)
+		if err != nil {
+			return err
+		}
+
+		if stat.Mode&unix.S_IFMT == unix.S_IFLNK {
+			return nil
+		}
+
+		return unix.Fchmodat(parentFd, baseName, GetSyscallMode(mode), 0)
+	})
+	if err != nil {
+		return trace.Wrap(err, "failed to set mode of %q to %o", name, mode)
+	}
+
+	return nil
+}
+
+// Set the owner of the named path, without following a symlink in the final path component
+func (rd *RootedDirectory) Lchown(name string, uid, gid int) error {
+	err := rd.withParent(name, func(parentFd int, baseName string) error {
+		return unix.Fchownat(parentFd, baseName, uid, gid, unix.AT_SYMLINK_NOFOLLOW)
+	})
+	if err != nil {
+		return trace.Wrap(err, "failed to set ownership of %q to %d:%d", name, uid, gid)
+	}
+
+	return nil
+}
+
+// Convert a Go file mode to the mode bits used by syscalls
+func GetSyscallMode(mode fs.FileMode) uint32 {
+	syscallMode := uint32(mode.Perm())
+	if mode&fs.ModeSetuid != 0 {
+		syscallMode |= unix.S_ISUID
+	}
+	if mode&fs.ModeSetgid != 0 {
+		syscallMode |= unix.S_ISGID
+	}
+	if mode&fs.ModeSticky != 0 {
+		syscallMode |= unix.S_ISVTX
+	}
+
+	return syscallMode
+}
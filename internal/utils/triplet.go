@@ -105,6 +105,68 @@ func (t *Triplet) GetDynamicLoaderName() string {
 	return fmt.Sprintf("ld-%s-%s.so.1", t.LibC, t.Machine)
 }
 
+// Get the name that dynamically linked files use to reference the C library, or an empty string
+// if the C library is not known
+func (t *Triplet) GetLibCSoname() string {
+	libc := strings.ToLower(t.LibC)
+	switch {
+	case strings.HasPrefix(libc, "musl"):
+		return "libc.so"
+	case strings.HasPrefix(libc, "gnu"):
+		return "libc.so.6"
+	default:
+		return ""
+	}
+}
+
+// Get the architecture name that qemu-user uses for the machine, i.e. qemu-<arch>
+func (t *Triplet) GetQemuUserArch() string {
+	machine := strings.ToLower(t.Machine)
+	switch {
+	case len(machine) == 4 && machine[0] == 'i' && strings.HasSuffix(machine, "86"):
+		return "i386"
+	case machine == "arm64":
+		return "aarch64"
+	case strings.HasPrefix(machine, "arm") && strings.HasSuffix(machine, "eb"):
+		return "armeb"
+	case strings.HasPrefix(machine, "arm"):
+		return "arm"
+	case machine == "powerpc64le":
+		return "ppc64le"
+	case machine == "powerpc64":
+		return "ppc64"
+	case machine == "powerpc":
+		return "ppc"
+	default:
+		return machine
+	}
+}
+
+// Get the name that the Linux kernel build system uses for the machine (the ARCH variable)
+func (t *Triplet) GetKernelArch() string {
+	machine := strings.ToLower(t.Machine)
+	switch {
+	case machine == "x86" || machine == "x86_64" || (len(machine) == 4 && machine[0] == 'i' && strings.HasSuffix(machine, "86")):
+		return "x86"
+	case machine == "aarch64" || machine == "aarch64_be" || machine == "arm64":
+		return "arm64"
+	case strings.HasPrefix(machine, "arm"):
+		return "arm"
+	case strings.HasPrefix(machine, "riscv"):
+		return "riscv"
+	case strings.HasPrefix(machine, "powerpc") || strings.HasPrefix(machine, "ppc"):
+		return "powerpc"
+	case strings.HasPrefix(machine, "mips"):
+		return "mips"
+	case strings.HasPrefix(machine, "loongarch"):
+		return "loongarch"
+	case machine == "s390x":
+		return "s390"
+	default:
+		return machine
+	}
+}
+
 func GetTripletMachineValue() string {
 	switch runtime.GOARCH {
 	case "386":
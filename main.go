@@ -7,6 +7,9 @@ import (
 	"github.com/gravitational/trace"
 	command_artifacts "github.com/solidDoWant/distrobuilder/internal/command/artifacts"
 	command_build "github.com/solidDoWant/distrobuilder/internal/command/build"
+	command_image "github.com/solidDoWant/distrobuilder/internal/command/image"
+	command_testing "github.com/solidDoWant/distrobuilder/internal/command/testing"
+	command_verify "github.com/solidDoWant/distrobuilder/internal/command/verify"
 	"github.com/urfave/cli/v2"
 )
 
@@ -22,6 +25,10 @@ func main() {
 			command_build.BuildCommand(),
 			command_artifacts.PackageCommand(),
 			command_artifacts.InstallCommand(),
+			command_artifacts.IndexCommand(),
+			command_image.ImageCommand(),
+			command_testing.TestCommand(),
+			command_verify.VerifyCommand(),
 		},
 		// TODO allow for setting log level
 	}